@@ -8,6 +8,7 @@ import (
 	"github.com/ghetzel/mobius"
 	"github.com/op/go-logging"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -90,7 +91,7 @@ func main() {
 		}, {
 			Name:      `query`,
 			ArgsUsage: `PATH [SERIES ..]`,
-			Usage:     `Query the named dataset and output the results in a given format.`,
+			Usage:     `Query the named dataset and output the results in a given format.  Series may be followed by a time shift, e.g.: 'app.requests [-7d]'.`,
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  `format, f`,
@@ -111,9 +112,26 @@ func main() {
 					Name:  `graph-title, T`,
 					Usage: `The title of the graph.`,
 				},
+				cli.StringFlag{
+					Name:  `expr, x`,
+					Usage: `An expression to evaluate instead of a list of series (e.g.: 'sumSeries(app.*.requests)'.)`,
+				},
+				cli.StringFlag{
+					Name:  `transform, t`,
+					Usage: `A comma-separated list of transforms to apply to each series (e.g.: 'per-second'.)`,
+				},
+				cli.StringFlag{
+					Name:  `interval, i`,
+					Usage: `Consolidate each series into buckets of this duration.`,
+				},
+				cli.StringFlag{
+					Name:  `fn, F`,
+					Usage: `The reducer used to consolidate each bucket (e.g.: 'max', 'p99.9', or 'trimmed-mean(10)'.)`,
+					Value: mobius.DefaultMetricReducerFunc,
+				},
 			},
 			Action: func(c *cli.Context) {
-				if c.NArg() > 1 {
+				if c.NArg() > 1 || (c.NArg() > 0 && c.String(`expr`) != ``) {
 					start, err := mobius.ParseTimeString(c.String(`start-time`))
 					if err != nil {
 						log.Fatalf("Invalid start time: %v", err)
@@ -124,11 +142,48 @@ func main() {
 						log.Fatalf("Invalid end time: %v", err)
 					}
 
+					transforms, err := mobius.ParseTransforms(c.String(`transform`))
+					if err != nil {
+						log.Fatalf("Invalid transform: %v", err)
+					}
+
+					var interval time.Duration
+
+					if v := c.String(`interval`); v != `` {
+						if interval, err = time.ParseDuration(v); err != nil {
+							log.Fatalf("Invalid interval: %v", err)
+						}
+					}
+
+					reducer, ok := mobius.LookupReducer(c.String(`fn`))
+					if !ok {
+						log.Fatalf("Unknown reducer %q", c.String(`fn`))
+					}
+
 					if dataset, err := mobius.OpenDatasetReadOnly(c.Args().First()); err == nil {
 						defer dataset.Close()
-						patterns := c.Args()[1:]
 
-						if metrics, err := dataset.Range(start, end, patterns...); err == nil {
+						var metrics []*mobius.Metric
+
+						if expr := c.String(`expr`); expr != `` {
+							var expression *mobius.Expression
+
+							if expression, err = mobius.ParseExpression(expr); err == nil {
+								metrics, err = expression.Evaluate(dataset, start, end)
+							}
+						} else {
+							metrics, err = dataset.RangeShifted(start, end, c.Args()[1:]...)
+						}
+
+						if err == nil {
+							metrics = mobius.TransformMetrics(metrics, transforms...)
+
+							if interval > 0 {
+								for i, metric := range metrics {
+									metrics[i] = metric.Consolidate(interval, reducer)
+								}
+							}
+
 							format := c.String(`format`)
 
 							switch format {
@@ -162,6 +217,8 @@ func main() {
 									log.Fatalf("Unknown formatter %q", format)
 								}
 							}
+						} else if exprErr, ok := err.(mobius.ExpressionError); ok {
+							log.Fatalf("Invalid expression: %v\n%s", err, exprErr.Pointer())
 						} else {
 							log.Fatalf("Query failed: %v", err)
 						}
@@ -169,15 +226,169 @@ func main() {
 						log.Fatalf("Failed to open dataset: %v", err)
 					}
 				} else {
-					log.Fatalf("Must specify a dataset path and at least one series to retrieve.")
+					log.Fatalf("Must specify a dataset path and at least one series or an expression to retrieve.")
 				}
 			},
+		}, {
+			Name:      `tail`,
+			ArgsUsage: `PATH PATTERN`,
+			Usage:     `Output points written to series matching the given pattern as they arrive.  Only points newer than the last one seen in each series are shown.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  `format, f`,
+					Usage: `The output format to render the data into.`,
+					Value: DefaultRenderFormat,
+				},
+			},
+			Action: func(c *cli.Context) {
+				if c.NArg() > 1 {
+					format := c.String(`format`)
+					formatter, ok := mobius.GetFormatter(format)
+
+					if !ok && format != `json` {
+						log.Fatalf("Unknown formatter %q", format)
+					}
+
+					if dataset, err := mobius.OpenDatasetReadOnly(c.Args().First()); err == nil {
+						defer dataset.Close()
+
+						if subscription, err := dataset.SubscribeBlocking(c.Args().Get(1)); err == nil {
+							enc := json.NewEncoder(os.Stdout)
+
+							for metric := range subscription.C {
+								if formatter == nil {
+									if err := enc.Encode(metric); err != nil {
+										log.Fatal(err)
+									}
+								} else {
+									for _, point := range metric.Points() {
+										fmt.Println(formatter.Format(metric, point))
+									}
+								}
+							}
+						} else {
+							log.Fatalf("Failed to subscribe: %v", err)
+						}
+					} else {
+						log.Fatalf("Failed to open dataset: %v", err)
+					}
+				} else {
+					log.Fatalf("Must specify a dataset path and a series pattern to follow.")
+				}
+			},
+		}, {
+			Name:  `reducers`,
+			Usage: `List the reducers available to consolidate and summarize series.`,
+			Action: func(c *cli.Context) {
+				for _, reducer := range mobius.Reducers() {
+					name := reducer.Name
+
+					kind := ``
+
+					if reducer.Parameterized {
+						name += `(N)`
+					}
+
+					if reducer.TimeWeighted {
+						kind = `time-weighted`
+					}
+
+					fmt.Printf("%s\t%s\t%s\n", name, kind, strings.Join(reducer.Aliases, `, `))
+				}
+			},
+		}, {
+			Name:  `rules`,
+			Usage: `List and run the recording rules defined in a rules file.`,
+			Subcommands: []cli.Command{
+				{
+					Name:      `list`,
+					ArgsUsage: `RULES`,
+					Usage:     `List the recording rules defined in the given file.`,
+					Action: func(c *cli.Context) {
+						if rules, err := mobius.LoadRules(c.Args().First()); err == nil {
+							for _, rule := range rules {
+								fmt.Printf("%s\t%s\t%s\t%s\t%s\n", rule.Name, rule.Selector, rule.Reducer, rule.Interval, rule.GroupBy)
+							}
+						} else {
+							log.Fatalf("Failed to load rules: %v", err)
+						}
+					},
+				}, {
+					Name:      `run`,
+					ArgsUsage: `PATH RULES [RULE ..]`,
+					Usage:     `Evaluate recording rules once against the named dataset and store the results.  Rules that run continuously belong in the process that writes to the dataset.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  `start-time, s`,
+							Usage: `Recompute all intervals since the given time instead of each rule's lookback window.`,
+						},
+						cli.StringFlag{
+							Name:  `end-time, e`,
+							Usage: `The end time for recomputing intervals (used with --start-time.)`,
+						},
+					},
+					Action: func(c *cli.Context) {
+						if c.NArg() < 2 {
+							log.Fatalf("Must specify a dataset path and a rules file.")
+						}
+
+						rules, err := mobius.LoadRules(c.Args().Get(1))
+
+						if err != nil {
+							log.Fatalf("Failed to load rules: %v", err)
+						}
+
+						dataset, err := mobius.OpenDataset(c.Args().First())
+
+						if mobius.IsLockError(err) {
+							log.Fatalf("Failed to open dataset: %v (rules must be run by the process writing to it)", err)
+						} else if err != nil {
+							log.Fatalf("Failed to open dataset: %v", err)
+						}
+
+						defer dataset.Close()
+
+						engine := mobius.NewRuleEngine(dataset, rules)
+						names := c.Args()[2:]
+
+						if v := c.String(`start-time`); v != `` {
+							start, err := mobius.ParseTimeString(v)
+							if err != nil {
+								log.Fatalf("Invalid start time: %v", err)
+							}
+
+							end, err := mobius.ParseTimeString(c.String(`end-time`))
+							if err != nil {
+								log.Fatalf("Invalid end time: %v", err)
+							}
+
+							if len(names) == 0 {
+								for _, rule := range rules {
+									names = append(names, rule.Name)
+								}
+							}
+
+							for _, name := range names {
+								if rule, ok := engine.Get(name); ok {
+									if err := rule.Run(dataset, start, end); err != nil {
+										log.Fatalf("Rule %q failed: %v", name, err)
+									}
+								} else {
+									log.Fatalf("No such rule %q", name)
+								}
+							}
+						} else if err := engine.Trigger(names...); err != nil {
+							log.Fatal(err)
+						}
+					},
+				},
+			},
 		}, {
 			Name:      `ls`,
 			ArgsUsage: `PATH [METRICS ..]`,
 			Usage:     "List metric names from the dataset.",
 			Action: func(c *cli.Context) {
-				if dataset, err := mobius.OpenDataset(c.Args().First()); err == nil {
+				if dataset, err := mobius.OpenDatasetReadOnly(c.Args().First()); err == nil {
 					defer dataset.Close()
 					pattern := c.Args().Get(1)
 
@@ -285,7 +496,7 @@ func main() {
 			ArgsUsage: `PATH`,
 			Usage:     `Dump a restorable backup of the dataset to standard output.`,
 			Action: func(c *cli.Context) {
-				if dataset, err := mobius.OpenDataset(c.Args().First()); err == nil {
+				if dataset, err := mobius.OpenDatasetReadOnly(c.Args().First()); err == nil {
 					defer dataset.Close()
 
 					if err := dataset.Backup(os.Stdout); err != nil {
@@ -0,0 +1,292 @@
+package mobius
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The name of the file (relative to the dataset directory) that is locked by the process that
+// holds a dataset open for writing.
+var LockFileName = `mobius.lock`
+
+// Returned when a dataset cannot be opened for writing because another process already holds
+// the writer lock.
+type LockError struct {
+	Path string
+	PID  int
+}
+
+func (self LockError) Error() string {
+	if self.PID > 0 {
+		return fmt.Sprintf("dataset %s is locked for writing by another process (pid %d)", self.Path, self.PID)
+	} else {
+		return fmt.Sprintf("dataset %s is locked for writing by another process", self.Path)
+	}
+}
+
+// Returns whether the given error indicates that a dataset is locked by another writer.
+func IsLockError(err error) bool {
+	_, ok := err.(LockError)
+	return ok
+}
+
+type datasetLock struct {
+	file *os.File
+}
+
+// Acquires an exclusive, non-blocking lock on the given dataset directory and records the current
+// process ID in the lock file.
+func lockDataset(directory string) (*datasetLock, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	lockPath := filepath.Join(directory, LockFileName)
+
+	if file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644); err == nil {
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			defer file.Close()
+
+			if err == syscall.EWOULDBLOCK {
+				return nil, LockError{
+					Path: directory,
+					PID:  readLockPID(file),
+				}
+			} else {
+				return nil, err
+			}
+		}
+
+		if err := file.Truncate(0); err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		return &datasetLock{
+			file: file,
+		}, nil
+	} else {
+		return nil, err
+	}
+}
+
+func (self *datasetLock) Release() error {
+	if self.file != nil {
+		defer self.file.Close()
+		self.file.Truncate(0)
+		return syscall.Flock(int(self.file.Fd()), syscall.LOCK_UN)
+	}
+
+	return nil
+}
+
+func readLockPID(file *os.File) int {
+	if data, err := ioutil.ReadAll(file); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			return pid
+		}
+	}
+
+	return 0
+}
+
+// The number of times a snapshot is retried when the dataset changes while it is being taken.
+var SnapshotRetries = 10
+
+// Creates a point-in-time copy of the given dataset directory that can be opened independently of
+// any process currently writing to it.  The snapshot is created alongside the dataset where possible,
+// so that immutable table files can be hard linked rather than copied.
+//
+// The CURRENT file and the manifest it names are copied before anything else, then the tables and
+// logs are linked or copied.  Tables are only deleted after a new manifest record is written, so if
+// the manifest is unchanged once everything has been copied, the snapshot contains every table the
+// copied manifest refers to; otherwise, the snapshot is retried.
+func snapshotDataset(directory string) (string, error) {
+	if _, err := os.Stat(directory); err != nil {
+		return ``, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		snapshot, err := ioutil.TempDir(filepath.Dir(directory), `.`+filepath.Base(directory)+`.snapshot.`)
+
+		if err != nil {
+			if snapshot, err = ioutil.TempDir(``, `mobius_snapshot_`); err != nil {
+				return ``, err
+			}
+		}
+
+		stable, err := copySnapshot(directory, snapshot)
+
+		if err == nil && stable {
+			return snapshot, nil
+		}
+
+		os.RemoveAll(snapshot)
+
+		if err != nil {
+			return ``, err
+		} else if attempt >= SnapshotRetries {
+			return ``, fmt.Errorf("dataset %s changed too often to snapshot", directory)
+		}
+	}
+}
+
+// The manifest named by a database's CURRENT file, and its size when it was read.
+type manifestState struct {
+	name string
+	size int64
+}
+
+// Copies the dataset into the snapshot directory, returning whether its manifests were unchanged
+// throughout.
+func copySnapshot(directory string, snapshot string) (bool, error) {
+	manifests, err := readManifests(directory)
+
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// the manifests (and the CURRENT files naming them) go first
+	copied := make(map[string]bool)
+
+	for dir, manifest := range manifests {
+		for _, name := range []string{`CURRENT`, manifest.name} {
+			rel, err := filepath.Rel(directory, filepath.Join(dir, name))
+
+			if err != nil {
+				return false, err
+			}
+
+			target := filepath.Join(snapshot, rel)
+
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return false, err
+			} else if err := copyFile(filepath.Join(dir, name), target, 0644); os.IsNotExist(err) {
+				return false, nil
+			} else if err != nil {
+				return false, err
+			}
+
+			copied[rel] = true
+		}
+	}
+
+	err = filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(directory, path)
+
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(snapshot, rel)
+
+		switch {
+		case copied[rel]:
+			return nil
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode())
+		case rel == LockFileName, info.Name() == `LOCK`, strings.HasPrefix(info.Name(), `MANIFEST-`):
+			return nil
+		case strings.HasSuffix(path, `.ldb`), strings.HasSuffix(path, `.sst`):
+			if err := os.Link(path, target); err == nil {
+				return nil
+			}
+		}
+
+		return copyFile(path, target, info.Mode())
+	})
+
+	// files removed while walking mean the dataset changed underneath us
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if current, err := readManifests(directory); os.IsNotExist(err) {
+		return false, nil
+	} else if err == nil {
+		if len(current) != len(manifests) {
+			return false, nil
+		}
+
+		for dir, manifest := range manifests {
+			if current[dir] != manifest {
+				return false, nil
+			}
+		}
+
+		return true, nil
+	} else {
+		return false, err
+	}
+}
+
+// Finds every database under the given directory (i.e.: every directory with a CURRENT file), and
+// returns the state of its manifest.
+func readManifests(directory string) (map[string]manifestState, error) {
+	manifests := make(map[string]manifestState)
+
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() || info.Name() != `CURRENT` {
+			return nil
+		}
+
+		dir := filepath.Dir(path)
+
+		if data, err := ioutil.ReadFile(path); err == nil {
+			name := strings.TrimSpace(string(data))
+
+			if stat, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				manifests[dir] = manifestState{
+					name: name,
+					size: stat.Size(),
+				}
+			} else {
+				return err
+			}
+		} else {
+			return err
+		}
+
+		return nil
+	})
+
+	return manifests, err
+}
+
+func copyFile(source string, target string, mode os.FileMode) error {
+	if src, err := os.Open(source); err == nil {
+		defer src.Close()
+
+		if dest, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode); err == nil {
+			defer dest.Close()
+
+			_, err = io.Copy(dest, src)
+			return err
+		} else {
+			return err
+		}
+	} else {
+		return err
+	}
+}
@@ -0,0 +1,326 @@
+package mobius
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The number of metrics that may be queued for a subscriber before further metrics are dropped (or,
+// for blocking subscriptions, before writes to the dataset wait for the subscriber to catch up.)
+var SubscriptionBufferSize = 64
+
+// How often read-only datasets check the underlying dataset for newly-written points to deliver to
+// subscribers.  Each check that finds the dataset changed opens a fresh snapshot of it, so this
+// also limits how often snapshots are taken.
+var SubscriptionPollInterval = time.Second
+
+// A Subscription receives the points written to a dataset for all series matching a pattern.
+type Subscription struct {
+	Pattern  string
+	C        <-chan *Metric
+	dataset  *Dataset
+	selector *namePattern
+	channel  chan *Metric
+	blocking bool
+	derived  bool
+	dropped  uint64
+	newest   map[string]time.Time
+	done     chan bool
+	once     sync.Once
+	lock     sync.RWMutex
+	closed   bool
+}
+
+// Subscribes to all points written to series matching the given pattern (using the same name,
+// field, and tag syntax as Range.)  Each successful Write is delivered on the subscription's
+// channel as a metric holding the points that were written to a matching series.
+//
+// Once SubscriptionBufferSize metrics are waiting to be received, further metrics are dropped
+// rather than holding up writers; see Dropped.  Read-only datasets cannot be written to directly,
+// so they instead check the underlying dataset for changes every SubscriptionPollInterval and
+// deliver any points that are newer than the last point seen for each series.  Points written at or
+// before that time are not delivered to read-only subscribers: late or out-of-order points, points
+// that replace an existing one, and sketches or distinct-count sets merged into an existing point
+// are only seen by subscribers to the dataset they are written through.
+func (self *Dataset) Subscribe(pattern string) (*Subscription, error) {
+	return self.subscribe(pattern, false, true)
+}
+
+// Subscribes to the given pattern like Subscribe, but applies backpressure instead of dropping
+// metrics: once SubscriptionBufferSize metrics are waiting to be received, writes block until the
+// subscriber catches up or unsubscribes.
+func (self *Dataset) SubscribeBlocking(pattern string) (*Subscription, error) {
+	return self.subscribe(pattern, true, true)
+}
+
+// Creates a subscription, which receives the output of recording rules only if derived is set.
+func (self *Dataset) subscribe(pattern string, blocking bool, derived bool) (*Subscription, error) {
+	selector, err := parseNamePattern(pattern)
+
+	if err != nil {
+		return nil, err
+	}
+
+	channel := make(chan *Metric, SubscriptionBufferSize)
+
+	subscription := &Subscription{
+		Pattern:  pattern,
+		C:        channel,
+		dataset:  self,
+		selector: selector,
+		channel:  channel,
+		blocking: blocking,
+		derived:  derived,
+		newest:   make(map[string]time.Time),
+		done:     make(chan bool),
+	}
+
+	if self.readonly {
+		// start from the newest point already present in each series
+		if metrics, err := self.Newest(selector.series); err == nil {
+			for _, metric := range metrics {
+				if points := metric.Points(); len(points) > 0 {
+					subscription.newest[metric.GetUniqueName()] = points[len(points)-1].Timestamp
+				}
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	self.subLock.Lock()
+	self.subscriptions = append(self.subscriptions, subscription)
+
+	// all subscriptions to a read-only dataset share one poller
+	if self.readonly && self.pollDone == nil {
+		self.pollDone = make(chan bool)
+		go self.poll(self.pollDone)
+	}
+
+	self.subLock.Unlock()
+
+	return subscription, nil
+}
+
+// Returns the number of metrics that were dropped because the subscriber fell behind.
+func (self *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&self.dropped)
+}
+
+// Stops delivery to this subscription and closes its channel.
+func (self *Subscription) Unsubscribe() {
+	self.once.Do(func() {
+		close(self.done)
+
+		// wait for any in-progress deliveries to give up before closing the channel
+		self.lock.Lock()
+		self.closed = true
+		close(self.channel)
+		self.lock.Unlock()
+
+		self.dataset.removeSubscription(self)
+	})
+}
+
+// Delivers the given metric (or the requested fields of it) if it matches the subscription pattern.
+// Blocking subscriptions wait until it has been received or the subscription is closed; others drop
+// it if their buffer is full.
+func (self *Subscription) publish(metric *Metric) {
+	if metric.IsEmpty() || !self.selector.matchMetric(metric) {
+		return
+	}
+
+	metrics := []*Metric{metric}
+
+	if self.selector.field != `` {
+		metrics = nil
+
+		if metric.Type == FieldsType {
+			for _, field := range metric.FieldNames() {
+				if matchField(self.selector.field, field) {
+					metrics = append(metrics, metric.Field(field))
+				}
+			}
+		}
+	}
+
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+
+	if self.closed {
+		return
+	}
+
+	for _, m := range metrics {
+		if self.blocking {
+			select {
+			case self.channel <- m:
+			case <-self.done:
+				return
+			}
+		} else {
+			select {
+			case self.channel <- m:
+			default:
+				atomic.AddUint64(&self.dropped, 1)
+			}
+		}
+	}
+}
+
+// Periodically checks whether the underlying dataset has changed and, if so, opens a single fresh
+// snapshot of it from which all subscriptions receive the points written since the last check.
+func (self *Dataset) poll(done chan bool) {
+	ticker := time.NewTicker(SubscriptionPollInterval)
+	defer ticker.Stop()
+
+	var state string
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if current, err := datasetState(self.directory); err != nil {
+				log.Warningf("Failed to check %v for new points: %v", self.directory, err)
+			} else if current != state {
+				if err := self.pollOnce(); err == nil {
+					state = current
+				} else {
+					log.Warningf("Failed to read new points from %v: %v", self.directory, err)
+				}
+			}
+		}
+	}
+}
+
+func (self *Dataset) pollOnce() error {
+	self.subLock.Lock()
+	subscriptions := make([]*Subscription, len(self.subscriptions))
+	copy(subscriptions, self.subscriptions)
+	self.subLock.Unlock()
+
+	snapshot, err := OpenDatasetReadOnly(self.directory)
+
+	if err != nil {
+		return err
+	}
+
+	defer snapshot.Close()
+
+	for _, subscription := range subscriptions {
+		if err := subscription.pollSnapshot(snapshot); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delivers the points in the given snapshot that are newer than the last seen for each series.
+// Changes to older points aren't detected (see Subscribe.)
+func (self *Subscription) pollSnapshot(snapshot *Dataset) error {
+	// field selection is applied when publishing, so whole series are read here
+	names, err := snapshot.GetNames(self.selector.series)
+
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		var start time.Time
+
+		if last, ok := self.newest[name]; ok {
+			start = last.Add(time.Nanosecond)
+		}
+
+		if metrics, err := snapshot.Range(start, time.Time{}, name); err == nil {
+			for _, metric := range metrics {
+				// range patterns are prefix matches, so only take the series being polled
+				if metric.GetUniqueName() != name || metric.IsEmpty() {
+					continue
+				}
+
+				points := metric.Points()
+				self.newest[name] = points[len(points)-1].Timestamp
+
+				self.publish(metric)
+			}
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Describes the name, size, and modification time of every file in the given dataset directory, so
+// that changes can be detected without taking a snapshot.
+func datasetState(directory string) (string, error) {
+	files := make([]string, 0)
+
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if !info.IsDir() && info.Name() != LockFileName {
+			files = append(files, fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano()))
+		}
+
+		return nil
+	})
+
+	sort.Strings(files)
+
+	return strings.Join(files, "\n"), err
+}
+
+// Delivers a written metric to all subscriptions, skipping those that don't take the output of
+// recording rules if the metric is derived from one.
+func (self *Dataset) publish(metric *Metric, derived bool) {
+	self.subLock.Lock()
+	subscriptions := make([]*Subscription, len(self.subscriptions))
+	copy(subscriptions, self.subscriptions)
+	self.subLock.Unlock()
+
+	for _, subscription := range subscriptions {
+		if subscription.derived || !derived {
+			subscription.publish(metric)
+		}
+	}
+}
+
+func (self *Dataset) removeSubscription(subscription *Subscription) {
+	self.subLock.Lock()
+	defer self.subLock.Unlock()
+
+	for i, s := range self.subscriptions {
+		if s == subscription {
+			self.subscriptions = append(self.subscriptions[:i], self.subscriptions[i+1:]...)
+			break
+		}
+	}
+
+	if len(self.subscriptions) == 0 && self.pollDone != nil {
+		close(self.pollDone)
+		self.pollDone = nil
+	}
+}
+
+func (self *Dataset) unsubscribeAll() {
+	self.subLock.Lock()
+	subscriptions := make([]*Subscription, len(self.subscriptions))
+	copy(subscriptions, self.subscriptions)
+	self.subLock.Unlock()
+
+	for _, subscription := range subscriptions {
+		subscription.Unsubscribe()
+	}
+}
@@ -2,17 +2,23 @@ package mobius
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ghetzel/go-stockutil/maputil"
+	"github.com/ghetzel/go-stockutil/sliceutil"
 	"github.com/jbenet/go-base58"
 	"github.com/op/go-logging"
 	"github.com/siddontang/ledisdb/config"
 	"github.com/siddontang/ledisdb/ledis"
 	"io"
 	"math"
+	"os"
+	"path"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,9 +26,13 @@ var log = logging.MustGetLogger(`mobius/db`)
 
 var MetricValuePattern = "mobius:metrics:%s:values"
 var MetricRangePattern = "mobius:metrics:%s:range"
+var MetricTypePattern = "mobius:metrics:%s:type"
+var MetricFieldsPattern = "mobius:metrics:%s:fields"
 var TagSetPattern = "mobius:tags:%s:%s"
 var MetricNameSetKey = "mobius:metrics:names"
 
+var ErrReadOnly = errors.New(`dataset is open in read-only mode`)
+
 type trimDirection int
 
 const (
@@ -31,37 +41,70 @@ const (
 )
 
 type Dataset struct {
-	StoreZeroes bool
-	directory   string
-	conn        *ledis.Ledis
-	db          *ledis.DB
+	StoreZeroes   bool
+	directory     string
+	snapshot      string
+	readonly      bool
+	lock          *datasetLock
+	conn          *ledis.Ledis
+	db            *ledis.DB
+	writeLock     sync.Mutex
+	subscriptions []*Subscription
+	subLock       sync.Mutex
+	pollDone      chan bool
 }
 
+// Opens the dataset at the given directory for reading and writing.  Only one process may hold a
+// dataset open for writing at a time; if another process already does, a LockError is returned.
 func OpenDataset(directory string) (*Dataset, error) {
 	return openDataset(directory, false)
 }
 
+// Opens the dataset at the given directory for reading only.  The dataset is opened from a
+// point-in-time snapshot of the directory, so it may be read while another process holds it open
+// for writing.
 func OpenDatasetReadOnly(directory string) (*Dataset, error) {
 	return openDataset(directory, true)
 }
 
 func openDataset(directory string, readonly bool) (*Dataset, error) {
-	c := config.NewConfigDefault()
+	dataset := &Dataset{
+		directory: directory,
+		readonly:  readonly,
+	}
 
-	c.DataDir = directory
+	c := config.NewConfigDefault()
 	c.SetReadonly(readonly)
 
+	if readonly {
+		if snapshot, err := snapshotDataset(directory); err == nil {
+			dataset.snapshot = snapshot
+			c.DataDir = snapshot
+		} else {
+			return nil, err
+		}
+	} else {
+		if lock, err := lockDataset(directory); err == nil {
+			dataset.lock = lock
+			c.DataDir = directory
+		} else {
+			return nil, err
+		}
+	}
+
 	if conn, err := ledis.Open(c); err == nil {
 		if db, err := conn.Select(0); err == nil {
-			return &Dataset{
-				directory: directory,
-				conn:      conn,
-				db:        db,
-			}, nil
+			dataset.conn = conn
+			dataset.db = db
+
+			return dataset, nil
 		} else {
+			conn.Close()
+			dataset.Close()
 			return nil, err
 		}
 	} else {
+		dataset.Close()
 		return nil, err
 	}
 }
@@ -70,15 +113,43 @@ func (self *Dataset) GetPath() string {
 	return self.directory
 }
 
+// Returns whether this dataset was opened in read-only mode.
+func (self *Dataset) IsReadOnly() bool {
+	return self.readonly
+}
+
 func (self *Dataset) Close() error {
+	self.unsubscribeAll()
+
 	if self.conn != nil {
 		self.conn.Close()
+		self.conn = nil
+	}
+
+	if self.lock != nil {
+		if err := self.lock.Release(); err != nil {
+			log.Warningf("Failed to release lock on %v: %v", self.directory, err)
+		}
+
+		self.lock = nil
+	}
+
+	if self.snapshot != `` {
+		if err := os.RemoveAll(self.snapshot); err != nil {
+			log.Warningf("Failed to remove snapshot %v: %v", self.snapshot, err)
+		}
+
+		self.snapshot = ``
 	}
 
 	return nil
 }
 
 func (self *Dataset) Compact() error {
+	if self.readonly {
+		return ErrReadOnly
+	}
+
 	return self.conn.CompactStore()
 }
 
@@ -87,37 +158,25 @@ func (self *Dataset) Backup(w io.Writer) error {
 }
 
 func (self *Dataset) Restore(r io.Reader) error {
+	if self.readonly {
+		return ErrReadOnly
+	}
+
 	_, err := self.conn.LoadDump(r)
 	return err
 }
 
 func (self *Dataset) GetNames(pattern string) ([]string, error) {
-	parts := strings.SplitN(pattern, NameTagsDelimiter, 2)
-
-	pattern = parts[0]
-	pattern = `^` + strings.TrimPrefix(pattern, `^`)
-	pattern = strings.Replace(pattern, `.`, `\.`, -1)
-	pattern = strings.Replace(pattern, `*`, `[^\.]*`, -1)
-	pattern = strings.Replace(pattern, `**`, `.*`, -1)
-	pattern = strings.Replace(pattern, `?`, `.`, -1)
-	requiredTags := make(map[string][]string)
-
-	if len(parts) == 2 {
-		for k, v := range maputil.Split(parts[1], `=`, InlineTagSeparator) {
-			requiredTags[k] = strings.Split(fmt.Sprintf("%v", v), `|`)
-		}
-	}
-
-	if matcher, err := regexp.Compile(pattern); err == nil {
+	if selector, err := parseNamePattern(pattern); err == nil {
 		names := make([]string, 0)
 
 		if nameset, err := self.db.SMembers([]byte(MetricNameSetKey)); err == nil {
 		NameLoop:
 			for _, member := range nameset {
-				if name := string(member[:]); strings.HasPrefix(name, pattern+InlineTagSeparator) || matcher.MatchString(name) {
+				if name := string(member[:]); selector.matchName(name) {
 					// if tag filters were given, skip this iteration if the current metric name
 					// does not appear in all of the associated tagsets
-					for tag, values := range requiredTags {
+					for tag, values := range selector.requiredTags {
 						shouldSkip := true
 
 						for _, value := range values {
@@ -188,12 +247,30 @@ func (self *Dataset) rangeGeneric(start time.Time, end time.Time, maxPointsPerMe
 	}
 
 	for _, nameset := range names {
+		nameset, fieldset := SplitNameField(nameset)
+
 		if expandedNames, err := self.GetNames(nameset); err == nil {
 			for _, name := range expandedNames {
+				var fields []string
+
 				metric := NewMetric(name)
 				metricValueKey := []byte(fmt.Sprintf(MetricValuePattern, name))
 				metricRangeKey := []byte(fmt.Sprintf(MetricRangePattern, name))
 
+				if valueType, _, err := self.getValueType(name); err == nil {
+					metric.Type = valueType
+				} else {
+					return nil, err
+				}
+
+				if metric.Type == FieldsType {
+					if f, err := self.getFieldNames(name); err == nil {
+						fields = f
+					} else {
+						return nil, err
+					}
+				}
+
 				if results, err := self.db.ZRangeByScoreGeneric(metricRangeKey, startZScore, endZScore, 0, maxPointsPerMetric, reverse); err == nil {
 					// if we traversed the range in reverse order, we need to reverse the results so they are ordered as time-ascending
 					if reverse {
@@ -203,8 +280,12 @@ func (self *Dataset) rangeGeneric(start time.Time, end time.Time, maxPointsPerMe
 					}
 
 					for _, result := range results {
-						if value, err := self.db.HGet(metricValueKey, result.Member); err == nil {
-							metric.Push(time.Unix(0, result.Score), bytesToFloat(value))
+						if value, err := self.db.HGet(metricValueKey, result.Member); err == nil && len(value) > 0 {
+							if point, err := decodePoint(metric.Type, fields, time.Unix(0, result.Score), value); err == nil {
+								metric.PushPoint(point)
+							} else {
+								log.Warningf("Value at key %v[%v] is invalid: %v", string(metricValueKey[:]), result.Score, err)
+							}
 						} else {
 							log.Warningf("Value at key %v[%v] missing", string(metricValueKey[:]), result.Score)
 						}
@@ -213,6 +294,19 @@ func (self *Dataset) rangeGeneric(start time.Time, end time.Time, maxPointsPerMe
 					return nil, err
 				}
 
+				// if specific fields were requested, return each of them as their own metric
+				if fieldset != `` {
+					if metric.Type == FieldsType {
+						for _, field := range fields {
+							if matchField(fieldset, field) {
+								metrics = append(metrics, metric.Field(field))
+							}
+						}
+					}
+
+					continue
+				}
+
 				metrics = append(metrics, metric)
 			}
 		} else {
@@ -224,57 +318,163 @@ func (self *Dataset) rangeGeneric(start time.Time, end time.Time, maxPointsPerMe
 }
 
 func (self *Dataset) Write(metric *Metric) error {
+	return self.writeAndPublish(metric, false)
+}
+
+// Writes the output of a recording rule, which is not delivered to on-write rules so that rules
+// never trigger on their own (or each other's) output.
+func (self *Dataset) writeDerived(metric *Metric) error {
+	return self.writeAndPublish(metric, true)
+}
+
+func (self *Dataset) writeAndPublish(metric *Metric, derived bool) error {
+	if self.readonly {
+		return ErrReadOnly
+	}
+
 	if metric != nil {
-		metricName := metric.GetUniqueName()
-		metricValueKey := []byte(fmt.Sprintf(MetricValuePattern, metricName))
-		metricRangeKey := []byte(fmt.Sprintf(MetricRangePattern, metricName))
+		if written, err := self.write(metric); err == nil {
+			// subscribers are notified outside of the write lock so that they may write in turn
+			self.publish(written, derived)
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stores the points of the given metric and returns a metric holding the points as they were written.
+func (self *Dataset) write(metric *Metric) (*Metric, error) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+
+	metricName := metric.GetUniqueName()
+	metricValueKey := []byte(fmt.Sprintf(MetricValuePattern, metricName))
+	metricRangeKey := []byte(fmt.Sprintf(MetricRangePattern, metricName))
+
+	// write the metric name to a set to allow name pattern matching
+	if _, err := self.db.SAdd([]byte(MetricNameSetKey), []byte(metricName)); err != nil {
+		return nil, fmt.Errorf("name index failed: %v", err)
+	}
 
-		// write the metric name to a set to allow name pattern matching
-		if _, err := self.db.SAdd([]byte(MetricNameSetKey), []byte(metricName)); err != nil {
-			return fmt.Errorf("name index failed: %v", err)
+	// write the metric name to hashes for each tag value
+	for tag, value := range metric.GetTags() {
+		if _, err := self.db.SAdd([]byte(tagSetKey(tag, value)), []byte(metricName)); err != nil {
+			return nil, fmt.Errorf("tag index failed: %v", err)
 		}
+	}
 
-		// write the metric name to hashes for each tag value
-		for tag, value := range metric.GetTags() {
-			if _, err := self.db.SAdd([]byte(tagSetKey(tag, value)), []byte(metricName)); err != nil {
-				return fmt.Errorf("tag index failed: %v", err)
-			}
+	// the value type of a series is set by the first write to it
+	valueType, ok, err := self.getValueType(metricName)
+
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		// series written before value types were recorded already hold plain floats
+		if n, err := self.db.ZCard(metricRangeKey); err != nil {
+			return nil, err
+		} else if n > 0 {
+			valueType = FloatType
+		} else {
+			valueType = metric.Type
 		}
 
-		for _, point := range metric.Points() {
-			if self.StoreZeroes || point.Value != 0 {
-				epoch := point.Timestamp.UnixNano()
-				epochBytes := int64ToBytes(epoch)
+		if err := self.db.Set([]byte(fmt.Sprintf(MetricTypePattern, metricName)), []byte(valueType.String())); err != nil {
+			return nil, fmt.Errorf("type index failed: %v", err)
+		}
+	}
 
-				// write the value to hash at metric name, keyed on epoch nano
-				if _, err := self.db.HSet(
-					metricValueKey,
-					epochBytes,
-					floatToBytes(point.Value),
-				); err != nil {
-					return fmt.Errorf("write failed: %v", err)
-				}
+	// integer series are widened to floating point by the first value that isn't an integer, as
+	// integer metrics are in memory (see PushPoint)
+	if valueType == IntegerType && needsWidening(metric.Points()) {
+		if err := self.widenToFloat(metricName); err != nil {
+			return nil, fmt.Errorf("write failed: %v", err)
+		}
+
+		valueType = FloatType
+	}
+
+	var fields []string
+
+	written := NewMetric(metricName)
+	written.Type = valueType
 
-				// add the time to a sorted set for this metric for efficient ranging
-				if _, err := self.db.ZAdd(metricRangeKey, ledis.ScorePair{
-					Score:  epoch,
-					Member: epochBytes,
-				}); err != nil {
-					defer self.db.HDel(metricValueKey)
-					return fmt.Errorf("write failed: %v", err)
+	// multi-field series store their values packed in the order the fields were first seen
+	if valueType == FieldsType {
+		if f, err := self.addFieldNames(metricName, metric.FieldNames()); err == nil {
+			fields = f
+		} else {
+			return nil, fmt.Errorf("field index failed: %v", err)
+		}
+	}
+
+	for _, point := range metric.Points() {
+		if self.StoreZeroes || !point.isZero() {
+			epoch := point.Timestamp.UnixNano()
+			epochBytes := int64ToBytes(epoch)
+
+			if p, err := point.As(valueType); err == nil {
+				point = p
+			} else {
+				return nil, fmt.Errorf("write failed: %s is a %v series: %v", metricName, valueType, err)
+			}
+
+			written.push(point)
+
+			// sketches and sets written to the same time are merged with what is already stored there
+			if isMergeableType(valueType) {
+				if existing, err := self.db.HGet(metricValueKey, epochBytes); err == nil && len(existing) > 0 {
+					if stored, err := decodePoint(valueType, fields, point.Timestamp, existing); err == nil {
+						if merged, err := mergePoints(stored, point); err == nil {
+							point = merged
+						} else {
+							return nil, fmt.Errorf("write failed: %v", err)
+						}
+					} else {
+						return nil, fmt.Errorf("write failed: %v", err)
+					}
 				}
 			}
-		}
 
-		if err := self.TrimOldestToCount(metric.MaxSize, metricName); err != nil {
-			return err
+			value, err := encodePoint(point, fields)
+
+			if err != nil {
+				return nil, fmt.Errorf("write failed: %v", err)
+			}
+
+			// write the value to hash at metric name, keyed on epoch nano
+			if _, err := self.db.HSet(
+				metricValueKey,
+				epochBytes,
+				value,
+			); err != nil {
+				return nil, fmt.Errorf("write failed: %v", err)
+			}
+
+			// add the time to a sorted set for this metric for efficient ranging
+			if _, err := self.db.ZAdd(metricRangeKey, ledis.ScorePair{
+				Score:  epoch,
+				Member: epochBytes,
+			}); err != nil {
+				defer self.db.HDel(metricValueKey)
+				return nil, fmt.Errorf("write failed: %v", err)
+			}
 		}
 	}
 
-	return nil
+	if err := self.TrimOldestToCount(metric.MaxSize, metricName); err != nil {
+		return nil, err
+	}
+
+	return written, nil
 }
 
 func (self *Dataset) Remove(names ...string) (int64, error) {
+	if self.readonly {
+		return 0, ErrReadOnly
+	}
+
 	var totalRemoved int64
 	valueKeysToClear := make([][]byte, 0)
 	namesToClear := make([][]byte, 0)
@@ -291,6 +491,14 @@ func (self *Dataset) Remove(names ...string) (int64, error) {
 					[]byte(metric.GetUniqueName()),
 				)
 
+				// remove the value type and field names of the series
+				if _, err := self.db.Del(
+					[]byte(fmt.Sprintf(MetricTypePattern, metric.GetUniqueName())),
+					[]byte(fmt.Sprintf(MetricFieldsPattern, metric.GetUniqueName())),
+				); err != nil {
+					log.Errorf("Failed to remove metric type: %v", err)
+				}
+
 				// add this metric name to the list being removed from the Metric Value Hash
 				valueKeysToClear = append(
 					valueKeysToClear,
@@ -392,6 +600,10 @@ func (self *Dataset) TrimNewestToCount(size int, names ...string) error {
 }
 
 func (self *Dataset) trimCountGeneric(toSize int, reverse bool, names ...string) error {
+	if self.readonly {
+		return ErrReadOnly
+	}
+
 	if toSize > 0 {
 		for _, nameset := range names {
 			if expandedNames, err := self.GetNames(nameset); err == nil {
@@ -439,6 +651,10 @@ func (self *Dataset) trim(direction trimDirection, mark time.Time, names ...stri
 	var end int64
 	var totalRemoved int64
 
+	if self.readonly {
+		return 0, ErrReadOnly
+	}
+
 	switch direction {
 	case trimBeforeMark:
 		start = math.MinInt64
@@ -485,6 +701,279 @@ func (self *Dataset) trim(direction trimDirection, mark time.Time, names ...stri
 	return totalRemoved, nil
 }
 
+// Retrieves the value type of the named series, and whether the series has a type recorded.
+// Series written before value types were tracked are treated as floating point.
+func (self *Dataset) getValueType(name string) (ValueType, bool, error) {
+	if data, err := self.db.Get([]byte(fmt.Sprintf(MetricTypePattern, name))); err == nil {
+		if len(data) == 0 {
+			return FloatType, false, nil
+		}
+
+		valueType, err := ParseValueType(string(data))
+		return valueType, true, err
+	} else {
+		return FloatType, false, err
+	}
+}
+
+// Returns whether any of the given points can only be stored in an integer series by converting the
+// series to floating point.
+func needsWidening(points PointSet) bool {
+	for _, point := range points {
+		if _, err := point.As(IntegerType); err != nil {
+			if _, err := point.As(FloatType); err == nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Converts the stored values of the named integer series to floating point.
+func (self *Dataset) widenToFloat(name string) error {
+	metricValueKey := []byte(fmt.Sprintf(MetricValuePattern, name))
+
+	if pairs, err := self.db.HGetAll(metricValueKey); err == nil {
+		for _, pair := range pairs {
+			if len(pair.Value) != 8 {
+				continue
+			}
+
+			if _, err := self.db.HSet(metricValueKey, pair.Field, floatToBytes(float64(bytesToInt64(pair.Value)))); err != nil {
+				return err
+			}
+		}
+	} else {
+		return err
+	}
+
+	return self.db.Set([]byte(fmt.Sprintf(MetricTypePattern, name)), []byte(FloatType.String()))
+}
+
+// Retrieves the ordered list of field names stored for the named multi-field series.
+func (self *Dataset) getFieldNames(name string) ([]string, error) {
+	fields := make([]string, 0)
+
+	if data, err := self.db.Get([]byte(fmt.Sprintf(MetricFieldsPattern, name))); err == nil {
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &fields); err != nil {
+				return nil, err
+			}
+		}
+
+		return fields, nil
+	} else {
+		return nil, err
+	}
+}
+
+// Appends any field names not already known to the named series, returning the updated list.
+func (self *Dataset) addFieldNames(name string, names []string) ([]string, error) {
+	if fields, err := self.getFieldNames(name); err == nil {
+		changed := false
+
+		for _, field := range names {
+			if !sliceutil.ContainsString(fields, field) {
+				fields = append(fields, field)
+				changed = true
+			}
+		}
+
+		if changed {
+			if data, err := json.Marshal(fields); err == nil {
+				if err := self.db.Set([]byte(fmt.Sprintf(MetricFieldsPattern, name)), data); err != nil {
+					return nil, err
+				}
+			} else {
+				return nil, err
+			}
+		}
+
+		return fields, nil
+	} else {
+		return nil, err
+	}
+}
+
+// Encodes the value of the given point for storage.  Multi-field values are packed as one 8-byte
+// value per field in the given order, followed by a bitmap of the fields present in the point (padded
+// to a multiple of 8 bytes) and the 4-byte number of fields, so that values written before later
+// fields were added can still be decoded.
+func encodePoint(point Point, fields []string) ([]byte, error) {
+	switch point.Type {
+	case IntegerType:
+		return int64ToBytes(point.Integer), nil
+	case SketchType:
+		return point.Sketch.MarshalBinary()
+	case UniqueType:
+		return point.Unique.MarshalBinary()
+	case FieldsType:
+		out := make([]byte, 0, fieldsEncodedLen(len(fields)))
+		present := make([]byte, 8*((len(fields)+63)/64))
+
+		for i, field := range fields {
+			if v, ok := point.Fields[field]; ok {
+				out = append(out, floatToBytes(v)...)
+				present[i/8] |= 1 << uint(i%8)
+			} else {
+				out = append(out, floatToBytes(0)...)
+			}
+		}
+
+		count := make([]byte, 4)
+		binary.BigEndian.PutUint32(count, uint32(len(fields)))
+
+		out = append(out, present...)
+		return append(out, count...), nil
+	default:
+		return floatToBytes(point.Value), nil
+	}
+}
+
+// The length of an encoded multi-field value with the given number of fields.
+func fieldsEncodedLen(count int) int {
+	return 8*count + 8*((count+63)/64) + 4
+}
+
+func decodePoint(valueType ValueType, fields []string, timestamp time.Time, data []byte) (Point, error) {
+	switch valueType {
+	case IntegerType:
+		if len(data) != 8 {
+			return Point{}, fmt.Errorf("expected 8 bytes, got %d", len(data))
+		}
+
+		return IntegerPoint(timestamp, bytesToInt64(data)), nil
+	case FieldsType:
+		values := make(map[string]float64)
+
+		if len(data) < 4 {
+			return Point{}, fmt.Errorf("truncated multi-field value")
+		}
+
+		// points written before a field was added hold fewer fields than the current field list
+		count := int(binary.BigEndian.Uint32(data[len(data)-4:]))
+
+		if len(data) != fieldsEncodedLen(count) {
+			return Point{}, fmt.Errorf("expected %d bytes for %d fields, got %d", fieldsEncodedLen(count), count, len(data))
+		}
+
+		present := data[8*count:]
+
+		for i, field := range fields {
+			if i < count && present[i/8]&(1<<uint(i%8)) != 0 {
+				values[field] = bytesToFloat(data[i*8 : i*8+8])
+			}
+		}
+
+		return FieldsPoint(timestamp, values), nil
+	case SketchType:
+		sketch := NewSketch()
+
+		if err := sketch.UnmarshalBinary(data); err != nil {
+			return Point{}, err
+		}
+
+		return SketchPoint(timestamp, sketch), nil
+	case UniqueType:
+		set := NewHyperLogLog()
+
+		if err := set.UnmarshalBinary(data); err != nil {
+			return Point{}, err
+		}
+
+		return UniquePoint(timestamp, set), nil
+	default:
+		if len(data) != 8 {
+			return Point{}, fmt.Errorf("expected 8 bytes, got %d", len(data))
+		}
+
+		return Point{
+			Timestamp: timestamp,
+			Value:     bytesToFloat(data),
+		}, nil
+	}
+}
+
+// Returns whether the given field name matches a field selector, which may contain several
+// "|"-separated alternatives and "*" wildcards.
+func matchField(selector string, field string) bool {
+	for _, pattern := range strings.Split(selector, `|`) {
+		if ok, err := path.Match(pattern, field); err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+type namePattern struct {
+	series       string
+	pattern      string
+	matcher      *regexp.Regexp
+	requiredTags map[string][]string
+	field        string
+}
+
+// Parses a "name[#field][:tag=value,...]" selector as accepted by GetNames and Range.
+func parseNamePattern(pattern string) (*namePattern, error) {
+	pattern, field := SplitNameField(pattern)
+	series := pattern
+	parts := strings.SplitN(pattern, NameTagsDelimiter, 2)
+
+	pattern = parts[0]
+	pattern = `^` + strings.TrimPrefix(pattern, `^`)
+	pattern = strings.Replace(pattern, `.`, `\.`, -1)
+	pattern = strings.Replace(pattern, `*`, `[^\.]*`, -1)
+	pattern = strings.Replace(pattern, `**`, `.*`, -1)
+	pattern = strings.Replace(pattern, `?`, `.`, -1)
+	requiredTags := make(map[string][]string)
+
+	if len(parts) == 2 {
+		for k, v := range maputil.Split(parts[1], `=`, InlineTagSeparator) {
+			requiredTags[k] = strings.Split(fmt.Sprintf("%v", v), `|`)
+		}
+	}
+
+	if matcher, err := regexp.Compile(pattern); err == nil {
+		return &namePattern{
+			series:       series,
+			pattern:      pattern,
+			matcher:      matcher,
+			requiredTags: requiredTags,
+			field:        field,
+		}, nil
+	} else {
+		return nil, err
+	}
+}
+
+func (self *namePattern) matchName(name string) bool {
+	return strings.HasPrefix(name, self.pattern+InlineTagSeparator) || self.matcher.MatchString(name)
+}
+
+// Returns whether the given metric's name and tags satisfy this pattern.
+func (self *namePattern) matchMetric(metric *Metric) bool {
+	if !self.matchName(metric.GetUniqueName()) {
+		return false
+	}
+
+TagLoop:
+	for tag, values := range self.requiredTags {
+		if actual := metric.GetTag(tag); actual != nil {
+			for _, value := range values {
+				if fmt.Sprintf("%v", actual) == value {
+					continue TagLoop
+				}
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
 func tagSetKey(tag string, value interface{}) string {
 	valueBytes := []byte(fmt.Sprintf("%v", value))
 	return fmt.Sprintf(TagSetPattern, tag, base58.Encode(valueBytes))
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -190,3 +192,431 @@ func TestDatasetPointTrimToSize(t *testing.T) {
 	assert.True(time.Date(2006, 1, 2, 15, 4, 5+76, 0, mst).Equal(points[0].Timestamp))
 	assert.Equal(float64(77), points[0].Value)
 }
+
+func TestDatasetLocking(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+
+	writer, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	assert.NotNil(writer)
+	assert.False(writer.IsReadOnly())
+
+	metric := NewMetric(`mobius.test.locking`)
+	metric.Push(time.Date(2006, 1, 2, 15, 4, 5, 0, mst), 42)
+	assert.NoError(writer.Write(metric))
+
+	// a second writer must be refused while the first holds the lock
+	_, err = OpenDataset(tempPath)
+	assert.Error(err)
+	assert.True(IsLockError(err))
+	assert.Equal(os.Getpid(), err.(LockError).PID)
+
+	// readers can open the dataset alongside the writer
+	reader, err := OpenDatasetReadOnly(tempPath)
+	assert.NoError(err)
+	assert.True(reader.IsReadOnly())
+
+	metrics, err := reader.Range(time.Time{}, time.Now(), `mobius.test.locking`)
+	assert.NoError(err)
+	assert.Len(metrics, 1)
+	assert.Equal(float64(42), metrics[0].Points()[0].Value)
+
+	assert.Equal(ErrReadOnly, reader.Write(metric))
+	_, err = reader.Remove(`**`)
+	assert.Equal(ErrReadOnly, err)
+	assert.NoError(reader.Close())
+
+	// once the writer releases the lock, another writer may open the dataset
+	assert.NoError(writer.Close())
+
+	writer, err = OpenDataset(tempPath)
+	assert.NoError(err)
+	assert.NoError(writer.Close())
+}
+
+func TestDatasetSnapshot(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	// a database as laid out by leveldb, with a stale manifest that must not be copied
+	db := filepath.Join(tempPath, `db`)
+	assert.NoError(os.MkdirAll(db, 0755))
+
+	for name, data := range map[string]string{
+		`CURRENT`:         "MANIFEST-000004\n",
+		`MANIFEST-000002`: `old`,
+		`MANIFEST-000004`: `new`,
+		`000005.ldb`:      `table`,
+		`000006.log`:      `journal`,
+		`LOCK`:            ``,
+	} {
+		assert.NoError(ioutil.WriteFile(filepath.Join(db, name), []byte(data), 0644))
+	}
+
+	snapshot, err := snapshotDataset(tempPath)
+	assert.NoError(err)
+	defer os.RemoveAll(snapshot)
+
+	// snapshots are taken alongside the dataset so that tables can be linked
+	assert.Equal(filepath.Dir(tempPath), filepath.Dir(snapshot))
+
+	for name, expected := range map[string]string{
+		`CURRENT`:         "MANIFEST-000004\n",
+		`MANIFEST-000004`: `new`,
+		`000005.ldb`:      `table`,
+		`000006.log`:      `journal`,
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(snapshot, `db`, name))
+		assert.NoError(err, name)
+		assert.Equal(expected, string(data), name)
+	}
+
+	for _, name := range []string{`MANIFEST-000002`, `LOCK`} {
+		_, err := os.Stat(filepath.Join(snapshot, `db`, name))
+		assert.True(os.IsNotExist(err), name)
+	}
+
+	original, err := os.Stat(filepath.Join(db, `000005.ldb`))
+	assert.NoError(err)
+	linked, err := os.Stat(filepath.Join(snapshot, `db`, `000005.ldb`))
+	assert.NoError(err)
+	assert.True(os.SameFile(original, linked))
+}
+
+func TestDatasetIntegerSeries(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	large := int64(1)<<62 + 1
+
+	metric := NewMetric(`mobius.test.counter`)
+	metric.PushInt(time.Date(2006, 1, 2, 15, 4, 5, 0, mst), large)
+	metric.PushInt(time.Date(2006, 1, 2, 15, 4, 6, 0, mst), 7)
+	assert.NoError(database.Write(metric))
+
+	metrics, err := database.Range(time.Time{}, time.Now(), `mobius.test.counter`)
+	assert.NoError(err)
+	assert.Len(metrics, 1)
+	assert.Equal(IntegerType, metrics[0].Type)
+	assert.Equal([]int64{large, 7}, metrics[0].Points().Integers())
+
+	// integral floats may be written to integer series, and fractional ones widen them to floats
+	metric = NewMetric(`mobius.test.counter`)
+	metric.Push(time.Date(2006, 1, 2, 15, 4, 7, 0, mst), 8)
+	assert.NoError(database.Write(metric))
+
+	metrics, err = database.Range(time.Time{}, time.Now(), `mobius.test.counter`)
+	assert.NoError(err)
+	assert.Equal(IntegerType, metrics[0].Type)
+
+	metric = NewMetric(`mobius.test.counter`)
+	metric.Push(time.Date(2006, 1, 2, 15, 4, 8, 0, mst), 8.5)
+	assert.NoError(database.Write(metric))
+
+	metrics, err = database.Range(time.Time{}, time.Now(), `mobius.test.counter`)
+	assert.NoError(err)
+	assert.Equal(FloatType, metrics[0].Type)
+	assert.Equal([]float64{float64(large), 7, 8, 8.5}, metrics[0].Points().Values())
+
+	// parsed integer literals start integer series that later fractional values widen
+	parser := CarbonParser{}
+
+	for _, line := range []string{`mobius.test.cpu 12 1136239445`, `mobius.test.cpu 12.5 1136239446`} {
+		name, point, err := parser.Parse(line)
+		assert.NoError(err)
+		assert.NoError(database.Write(NewMetric(name).PushPoint(point)))
+	}
+
+	metrics, err = database.Range(time.Time{}, time.Now(), `mobius.test.cpu`)
+	assert.NoError(err)
+	assert.Len(metrics, 1)
+	assert.Equal(FloatType, metrics[0].Type)
+	assert.Equal([]float64{12, 12.5}, metrics[0].Points().Values())
+}
+
+func TestDatasetLegacySeries(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	dataset, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer dataset.Close()
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 5, 0, mst)
+
+	// series written before value types were recorded have no type key
+	for _, name := range []string{`mobius.test.legacy.counter`, `mobius.test.legacy.timer`} {
+		legacy := NewMetric(name)
+		legacy.Push(epoch, 2.5)
+		assert.NoError(dataset.Write(legacy))
+
+		_, err = dataset.db.Del([]byte(fmt.Sprintf(MetricTypePattern, name)))
+		assert.NoError(err)
+	}
+
+	counter := NewMetric(`mobius.test.legacy.counter`)
+	counter.PushInt(epoch.Add(time.Second), 3)
+	assert.NoError(dataset.Write(counter))
+
+	sketch := NewSketch()
+	sketch.Add(7)
+
+	timer := NewMetric(`mobius.test.legacy.timer`)
+	timer.PushSketch(epoch.Add(time.Second), sketch)
+	assert.NoError(dataset.Write(timer))
+
+	for _, name := range []string{`mobius.test.legacy.counter`, `mobius.test.legacy.timer`} {
+		valueType, ok, err := dataset.getValueType(name)
+		assert.NoError(err)
+		assert.True(ok)
+		assert.Equal(FloatType, valueType, name)
+	}
+
+	metrics, err := dataset.Range(epoch, epoch.Add(time.Minute), `mobius.test.legacy.*`)
+	assert.NoError(err)
+	assert.Len(metrics, 2)
+	assert.Equal([]float64{2.5, 3}, metrics[0].Points().Values())
+	assert.Equal([]float64{2.5, 7}, metrics[1].Points().Values())
+}
+
+func TestDatasetMultiFieldSeries(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	metric := NewMetric(`mobius.test.latency:host=web1`)
+	metric.PushFields(time.Date(2006, 1, 2, 15, 4, 5, 0, mst), map[string]float64{
+		`count`: 10,
+		`sum`:   2.5,
+	})
+
+	assert.NoError(database.Write(metric))
+
+	// add a new field to the series after the fact
+	metric = NewMetric(`mobius.test.latency:host=web1`)
+	metric.PushFields(time.Date(2006, 1, 2, 15, 4, 6, 0, mst), map[string]float64{
+		`count`: 4,
+		`max`:   0.9,
+	})
+
+	assert.NoError(database.Write(metric))
+
+	metrics, err := database.Range(time.Time{}, time.Now(), `mobius.test.latency`)
+	assert.NoError(err)
+	assert.Len(metrics, 1)
+	assert.Equal(FieldsType, metrics[0].Type)
+	assert.Equal([]string{`count`, `max`, `sum`}, metrics[0].FieldNames())
+
+	points := metrics[0].Points()
+	assert.Len(points, 2)
+	assert.Equal(map[string]float64{`count`: 10, `sum`: 2.5}, points[0].Fields)
+	assert.Equal(map[string]float64{`count`: 4, `max`: 0.9}, points[1].Fields)
+
+	// select individual fields
+	metrics, err = database.Range(time.Time{}, time.Now(), `mobius.test.latency#count|max:host=web1`)
+	assert.NoError(err)
+	assert.Len(metrics, 2)
+	assert.Equal(`mobius.test.latency#count:host=web1`, metrics[0].GetUniqueName())
+	assert.Equal([]float64{10, 4}, metrics[0].Points().Values())
+	assert.Equal(`mobius.test.latency#max:host=web1`, metrics[1].GetUniqueName())
+	assert.Equal([]float64{0.9}, metrics[1].Points().Values())
+
+	consolidated := metrics[0].Consolidate(time.Minute, Sum)
+	assert.Equal([]float64{14}, consolidated.Points().Values())
+
+	// genuine NaN values are kept apart from absent fields
+	metric = NewMetric(`mobius.test.latency:host=web1`)
+	metric.PushFields(time.Date(2006, 1, 2, 15, 4, 7, 0, mst), map[string]float64{
+		`max`: math.NaN(),
+	})
+
+	assert.NoError(database.Write(metric))
+
+	metrics, err = database.Range(time.Date(2006, 1, 2, 15, 4, 7, 0, mst), time.Now(), `mobius.test.latency`)
+	assert.NoError(err)
+	assert.Len(metrics[0].Points(), 1)
+
+	fields := metrics[0].Points()[0].Fields
+	assert.Len(fields, 1)
+	assert.True(math.IsNaN(fields[`max`]))
+}
+
+func TestDatasetSubscribe(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	bufferSize := SubscriptionBufferSize
+	SubscriptionBufferSize = 1
+	defer func() {
+		SubscriptionBufferSize = bufferSize
+	}()
+
+	subscription, err := database.SubscribeBlocking(`mobius.test.sub:host=a`)
+	assert.NoError(err)
+
+	for _, name := range []string{
+		`mobius.test.sub:host=a`,
+		`mobius.test.sub:host=b`,
+		`mobius.test.other:host=a`,
+	} {
+		metric := NewMetric(name)
+		metric.Push(time.Date(2006, 1, 2, 15, 4, 5, 0, mst), 1)
+		metric.Push(time.Date(2006, 1, 2, 15, 4, 6, 0, mst), 2)
+		assert.NoError(database.Write(metric))
+	}
+
+	received := <-subscription.C
+	assert.Equal(`mobius.test.sub:host=a`, received.GetUniqueName())
+	assert.Equal([]float64{1, 2}, received.Points().Values())
+
+	// with a full buffer, writes block until the subscriber receives
+	written := make(chan bool)
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			metric := NewMetric(`mobius.test.sub:host=a`)
+			metric.Push(time.Date(2006, 1, 2, 15, 5, i, 0, mst), 3)
+			database.Write(metric)
+		}
+
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		assert.Fail(`writes should block on a full subscription`)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.Len((<-subscription.C).Points(), 1)
+	<-written
+	assert.Len((<-subscription.C).Points(), 1)
+
+	// unsubscribing closes the channel and writes no longer block
+	subscription.Unsubscribe()
+	_, ok := <-subscription.C
+	assert.False(ok)
+
+	metric := NewMetric(`mobius.test.sub:host=a`)
+	metric.Push(time.Date(2006, 1, 2, 15, 6, 0, 0, mst), 4)
+	assert.NoError(database.Write(metric))
+
+	// non-blocking subscriptions drop what doesn't fit in their buffer instead
+	subscription, err = database.Subscribe(`mobius.test.sub:host=a`)
+	assert.NoError(err)
+	defer subscription.Unsubscribe()
+
+	for i := 0; i < 3; i++ {
+		metric := NewMetric(`mobius.test.sub:host=a`)
+		metric.Push(time.Date(2006, 1, 2, 15, 7, i, 0, mst), 5)
+		assert.NoError(database.Write(metric))
+	}
+
+	assert.Equal(uint64(2), subscription.Dropped())
+	assert.Equal(time.Date(2006, 1, 2, 15, 7, 0, 0, mst), (<-subscription.C).Points()[0].Timestamp)
+}
+
+func TestDatasetSubscribeReadOnly(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+
+	writer, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer writer.Close()
+
+	pollInterval := SubscriptionPollInterval
+	SubscriptionPollInterval = 10 * time.Millisecond
+	defer func() {
+		SubscriptionPollInterval = pollInterval
+	}()
+
+	metric := NewMetric(`mobius.test.sub`)
+	metric.Push(time.Date(2006, 1, 2, 15, 4, 5, 0, mst), 1)
+	assert.NoError(writer.Write(metric))
+
+	reader, err := OpenDatasetReadOnly(tempPath)
+	assert.NoError(err)
+	defer reader.Close()
+
+	subscription, err := reader.Subscribe(`mobius.test.*`)
+	assert.NoError(err)
+	defer subscription.Unsubscribe()
+
+	// only points written after subscribing are delivered
+	metric = NewMetric(`mobius.test.sub`)
+	metric.Push(time.Date(2006, 1, 2, 15, 4, 6, 0, mst), 2)
+	assert.NoError(writer.Write(metric))
+
+	select {
+	case received := <-subscription.C:
+		assert.Equal(`mobius.test.sub`, received.GetUniqueName())
+		assert.Equal([]float64{2}, received.Points().Values())
+	case <-time.After(5 * time.Second):
+		assert.Fail(`timed out waiting for new points`)
+	}
+
+	// subscriptions share the reader's poller, which only looks again once the dataset changes
+	other, err := reader.Subscribe(`mobius.test.sub`)
+	assert.NoError(err)
+	defer other.Unsubscribe()
+
+	state, err := datasetState(tempPath)
+	assert.NoError(err)
+
+	again, err := datasetState(tempPath)
+	assert.NoError(err)
+	assert.Equal(state, again)
+
+	metric = NewMetric(`mobius.test.sub`)
+	metric.Push(time.Date(2006, 1, 2, 15, 4, 7, 0, mst), 3)
+	assert.NoError(writer.Write(metric))
+
+	// (the new subscription starts from the reader's snapshot, so it sees the previous point too)
+	for _, s := range []*Subscription{subscription, other} {
+		select {
+		case received := <-s.C:
+			values := received.Points().Values()
+			assert.Equal(float64(3), values[len(values)-1])
+		case <-time.After(5 * time.Second):
+			assert.Fail(`timed out waiting for new points`)
+		}
+	}
+}
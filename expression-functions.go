@@ -0,0 +1,672 @@
+package mobius
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The resolution at which functions that combine several series align their points.
+var ExpressionResolution = time.Second
+
+type ExpressionArgType int
+
+const (
+	SeriesArg ExpressionArgType = iota
+	NumberArg
+	StringArg
+	DurationArg
+	ReducerArg
+
+	// A duration string or a number of points (see ParseWindow.)
+	WindowArg
+
+	// A reducer name, which unlike ReducerArg may also name a time-weighted reducer.
+	AnyReducerArg
+)
+
+// Describes a single argument accepted by an expression function.
+type ExpressionArg struct {
+	Name     string
+	Type     ExpressionArgType
+	Optional bool
+}
+
+// The state available to expression functions while an expression is being evaluated.
+type ExpressionContext struct {
+	Dataset *Dataset
+	Start   time.Time
+	End     time.Time
+}
+
+// Implements an expression function.  Arguments are passed as evaluated values according to their
+// declared types: []*Metric for series, float64 for numbers, and string for strings, durations, and
+// reducer names.  Windows are given as either a string or a float64 (see windowArg.)  Optional
+// arguments that were not given are omitted.
+type ExpressionFunc func(context *ExpressionContext, args ...interface{}) ([]*Metric, error)
+
+type ExpressionFunction struct {
+	Name        string
+	Description string
+	Args        []ExpressionArg
+
+	// If true, the last argument may be repeated any number of times.
+	Variadic bool
+	Fn       ExpressionFunc
+}
+
+var expressionFunctions = make(map[string]ExpressionFunction)
+
+// Adds a function to the registry of functions available to expressions, replacing any existing
+// function with the same name.
+func RegisterExpressionFunction(fn ExpressionFunction) {
+	expressionFunctions[fn.Name] = fn
+}
+
+func GetExpressionFunction(name string) (ExpressionFunction, bool) {
+	fn, ok := expressionFunctions[name]
+	return fn, ok
+}
+
+// Returns all registered expression functions, sorted by name.
+func ExpressionFunctions() []ExpressionFunction {
+	functions := make([]ExpressionFunction, 0, len(expressionFunctions))
+
+	for _, fn := range expressionFunctions {
+		functions = append(functions, fn)
+	}
+
+	sort.Slice(functions, func(i, j int) bool {
+		return functions[i].Name < functions[j].Name
+	})
+
+	return functions
+}
+
+func init() {
+	for name, reducer := range map[string]string{
+		`sumSeries`:     `sum`,
+		`averageSeries`: `mean`,
+		`minSeries`:     `minimum`,
+		`maxSeries`:     `max`,
+		`countSeries`:   `count`,
+	} {
+		reducer := reducer
+
+		RegisterExpressionFunction(ExpressionFunction{
+			Name:        name,
+			Description: fmt.Sprintf("Combines all given series into one using the %q reducer.", reducer),
+			Args: []ExpressionArg{
+				{Name: `series`, Type: SeriesArg},
+			},
+			Variadic: true,
+			Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+				return combineSeries(seriesArgs(args), ``, reducer)
+			},
+		})
+	}
+
+	for name, op := range map[string]BinaryOperator{
+		`add`:      Add,
+		`subtract`: Subtract,
+		`multiply`: Multiply,
+		`divide`:   Divide,
+	} {
+		op := op
+
+		RegisterExpressionFunction(ExpressionFunction{
+			Name: name,
+			Description: fmt.Sprintf(
+				"Applies %q to each pair of matching series, joined one-to-one (or many-to-one) on the given comma-separated tags or else all tags.",
+				op,
+			),
+			Args: []ExpressionArg{
+				{Name: `left`, Type: SeriesArg},
+				{Name: `right`, Type: SeriesArg},
+				{Name: `on`, Type: StringArg, Optional: true},
+				{Name: `join`, Type: StringArg, Optional: true},
+			},
+			Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+				return applySeries(op, args[0].([]*Metric), args[1].([]*Metric), stringArg(args, 2, ``), stringArg(args, 3, ``))
+			},
+		})
+	}
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `compare`,
+		Description: `Keeps the points of each series on the left for which the comparison with its matching series on the right holds.`,
+		Args: []ExpressionArg{
+			{Name: `left`, Type: SeriesArg},
+			{Name: `operator`, Type: StringArg},
+			{Name: `right`, Type: SeriesArg},
+			{Name: `on`, Type: StringArg, Optional: true},
+			{Name: `join`, Type: StringArg, Optional: true},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			if op, err := ParseBinaryOperator(args[1].(string)); err == nil && op.IsComparison() {
+				return applySeries(op, args[0].([]*Metric), args[2].([]*Metric), stringArg(args, 3, ``), stringArg(args, 4, ``))
+			} else {
+				return nil, fmt.Errorf("invalid comparison operator %q", args[1])
+			}
+		},
+	})
+
+	for name, transform := range map[string]string{
+		`delta`:         `delta`,
+		`derivative`:    `derivative`,
+		`integral`:      `integral`,
+		`perSecond`:     `per-second`,
+		`cumulativeSum`: `cumulative-sum`,
+	} {
+		transform, _ := GetTransform(transform)
+
+		RegisterExpressionFunction(ExpressionFunction{
+			Name:        name,
+			Description: `Transforms each series; rates and integrals are per second.`,
+			Args: []ExpressionArg{
+				{Name: `series`, Type: SeriesArg},
+			},
+			Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+				return TransformMetrics(args[0].([]*Metric), transform), nil
+			},
+		})
+	}
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `nonNegativeDerivative`,
+		Description: `Replaces each point with the per-second increase of a counter, detecting resets and (if a maximum value is given) wrapping.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `maxValue`, Type: NumberArg, Optional: true},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			var maxValue float64
+
+			if len(args) > 1 {
+				maxValue = args[1].(float64)
+			}
+
+			return TransformMetrics(args[0].([]*Metric), func(metric *Metric) *Metric {
+				return metric.NonNegativeDerivative(time.Second, maxValue)
+			}), nil
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `topk`,
+		Description: `Selects the given number of series with the greatest values summarized with the named reducer (default: mean).`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `n`, Type: NumberArg},
+			{Name: `reducer`, Type: AnyReducerArg, Optional: true},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			reducer, _ := LookupReducer(stringArg(args, 2, DefaultSelectionReducer))
+			selected, _ := TopK(expandFields(args[0].([]*Metric)), int(args[1].(float64)), reducer)
+			return selected, nil
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `bottomk`,
+		Description: `Selects the given number of series with the least values summarized with the named reducer (default: mean).`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `n`, Type: NumberArg},
+			{Name: `reducer`, Type: AnyReducerArg, Optional: true},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			reducer, _ := LookupReducer(stringArg(args, 2, DefaultSelectionReducer))
+			selected, _ := BottomK(expandFields(args[0].([]*Metric)), int(args[1].(float64)), reducer)
+			return selected, nil
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `above`,
+		Description: `Selects the series whose values summarized with the named reducer (default: mean) are greater than a threshold.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `threshold`, Type: NumberArg},
+			{Name: `reducer`, Type: AnyReducerArg, Optional: true},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			reducer, _ := LookupReducer(stringArg(args, 2, DefaultSelectionReducer))
+			selected, _ := Above(expandFields(args[0].([]*Metric)), args[1].(float64), reducer)
+			return selected, nil
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `below`,
+		Description: `Selects the series whose values summarized with the named reducer (default: mean) are less than a threshold.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `threshold`, Type: NumberArg},
+			{Name: `reducer`, Type: AnyReducerArg, Optional: true},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			reducer, _ := LookupReducer(stringArg(args, 2, DefaultSelectionReducer))
+			selected, _ := Below(expandFields(args[0].([]*Metric)), args[1].(float64), reducer)
+			return selected, nil
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `mostDeviant`,
+		Description: `Selects the given number of series with the greatest standard deviation.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `n`, Type: NumberArg},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			selected, _ := MostDeviant(expandFields(args[0].([]*Metric)), int(args[1].(float64)))
+			return selected, nil
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `aggregate`,
+		Description: `Combines all given series into one using the named reducer.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `reducer`, Type: ReducerArg},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			return combineSeries(args[0].([]*Metric), ``, args[1].(string))
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `groupByTag`,
+		Description: `Combines the given series into one series per value of a tag using the named reducer.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `tag`, Type: StringArg},
+			{Name: `reducer`, Type: ReducerArg, Optional: true},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			return combineSeries(args[0].([]*Metric), args[1].(string), stringArg(args, 2, DefaultMetricReducerFunc))
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `summarize`,
+		Description: `Consolidates each series into intervals of the given width using the named reducer, filling empty intervals according to the fill policy.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `interval`, Type: DurationArg},
+			{Name: `reducer`, Type: AnyReducerArg, Optional: true},
+			{Name: `fill`, Type: StringArg, Optional: true},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			reducer, _ := LookupReducer(stringArg(args, 2, DefaultMetricReducerFunc))
+			fill, err := ParseFillPolicy(stringArg(args, 3, ``))
+
+			if err != nil {
+				return nil, err
+			}
+
+			bucketing := TimeBucketing{
+				Size: durationArg(args, 1),
+			}
+
+			metrics := args[0].([]*Metric)
+			output := make([]*Metric, len(metrics))
+
+			for i, metric := range metrics {
+				output[i] = metric.ConsolidateBuckets(bucketing, reducer).FillBuckets(bucketing, fill, context.Start, context.End)
+			}
+
+			return output, nil
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `scale`,
+		Description: `Multiplies every value of each series by a factor.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `factor`, Type: NumberArg},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			factor := args[1].(float64)
+
+			return mapSeriesValues(args[0].([]*Metric), func(v float64) float64 {
+				return v * factor
+			}), nil
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `offset`,
+		Description: `Adds a constant to every value of each series.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `amount`, Type: NumberArg},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			amount := args[1].(float64)
+
+			return mapSeriesValues(args[0].([]*Metric), func(v float64) float64 {
+				return v + amount
+			}), nil
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `absolute`,
+		Description: `Replaces every value of each series with its absolute value.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			return mapSeriesValues(args[0].([]*Metric), math.Abs), nil
+		},
+	})
+
+	for name, reducer := range map[string]string{
+		`movingAverage`: `mean`,
+		`movingMedian`:  `median`,
+		`movingMin`:     `minimum`,
+		`movingMax`:     `maximum`,
+		`movingSum`:     `sum`,
+	} {
+		reducer, _ := LookupReducer(reducer)
+
+		RegisterExpressionFunction(ExpressionFunction{
+			Name:        name,
+			Description: `Replaces each point with the result of a reducer applied to the trailing window (a duration or number of points) ending at it.`,
+			Args: []ExpressionArg{
+				{Name: `series`, Type: SeriesArg},
+				{Name: `window`, Type: WindowArg},
+			},
+			Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+				return movingSeries(args[0].([]*Metric), windowArg(args, 1), reducer), nil
+			},
+		})
+	}
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `movingPercentile`,
+		Description: `Replaces each point with the given percentile (0-100) of the trailing window ending at it.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `window`, Type: WindowArg},
+			{Name: `percentile`, Type: NumberArg},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			if percentile := args[2].(float64); percentile > 0 && percentile <= 100 {
+				return movingSeries(args[0].([]*Metric), windowArg(args, 1), percentileFn(percentile)), nil
+			} else {
+				return nil, fmt.Errorf("percentile must be between 0 and 100")
+			}
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `movingWindow`,
+		Description: `Replaces each point with the result of the named reducer applied to the trailing window ending at it.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `window`, Type: WindowArg},
+			{Name: `reducer`, Type: AnyReducerArg},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			reducer, _ := LookupReducer(args[2].(string))
+			return movingSeries(args[0].([]*Metric), windowArg(args, 1), reducer), nil
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `ewma`,
+		Description: `Replaces each point with the exponentially-weighted moving average, giving the newest point a weight of alpha (0-1).`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `alpha`, Type: NumberArg},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			alpha := args[1].(float64)
+
+			if alpha <= 0 || alpha > 1 {
+				return nil, fmt.Errorf("alpha must be between 0 and 1")
+			}
+
+			return TransformMetrics(args[0].([]*Metric), func(metric *Metric) *Metric {
+				return metric.EWMA(alpha)
+			}), nil
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `holtWintersForecast`,
+		Description: `Projects each series the given number of intervals ahead using Holt-Winters smoothing with the given season length, along with upper and lower confidence bands.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `season`, Type: WindowArg},
+			{Name: `ahead`, Type: NumberArg},
+			{Name: `alpha`, Type: NumberArg, Optional: true},
+			{Name: `beta`, Type: NumberArg, Optional: true},
+			{Name: `gamma`, Type: NumberArg, Optional: true},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			options := ForecastOptions{
+				Season: windowArg(args, 1),
+				Ahead:  int(args[2].(float64)),
+			}
+
+			for i, factor := range []*float64{&options.Alpha, &options.Beta, &options.Gamma} {
+				if len(args) > 3+i {
+					*factor = args[3+i].(float64)
+				}
+			}
+
+			output := make([]*Metric, 0)
+
+			for _, metric := range expandFields(args[0].([]*Metric)) {
+				if forecast, err := metric.HoltWinters(options); err == nil {
+					output = append(output, forecast.Metrics()...)
+				} else {
+					return nil, fmt.Errorf("%s: %v", metric.GetName(), err)
+				}
+			}
+
+			return output, nil
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `anomalyScores`,
+		Description: `Scores how unusual each point of each series is using the named detector (zscore, mad, or seasonal), compared against a trailing window (or season length.)`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `detector`, Type: StringArg, Optional: true},
+			{Name: `window`, Type: WindowArg, Optional: true},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			return anomalySeries(args, func(anomalies *Anomalies) *Metric {
+				return anomalies.Scores
+			})
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `anomalies`,
+		Description: `Returns 1 for each point of each series whose anomaly score (see anomalyScores) reaches the threshold, and 0 otherwise.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `detector`, Type: StringArg, Optional: true},
+			{Name: `window`, Type: WindowArg, Optional: true},
+			{Name: `threshold`, Type: NumberArg, Optional: true},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			return anomalySeries(args, func(anomalies *Anomalies) *Metric {
+				return anomalies.Anomalous
+			})
+		},
+	})
+
+	RegisterExpressionFunction(ExpressionFunction{
+		Name:        `alias`,
+		Description: `Renames each series, keeping its tags.`,
+		Args: []ExpressionArg{
+			{Name: `series`, Type: SeriesArg},
+			{Name: `name`, Type: StringArg},
+		},
+		Fn: func(context *ExpressionContext, args ...interface{}) ([]*Metric, error) {
+			metrics := args[0].([]*Metric)
+
+			for _, metric := range metrics {
+				metric.SetName(args[1].(string))
+			}
+
+			return metrics, nil
+		},
+	})
+}
+
+func movingSeries(metrics []*Metric, window Window, reducer Reducer) []*Metric {
+	return TransformMetrics(metrics, func(metric *Metric) *Metric {
+		return metric.Moving(window, reducer)
+	})
+}
+
+// Combines each group of the given metrics into a single series by reducing their values within
+// each ExpressionResolution-wide bucket with the named reducer (see AggregateMetrics.)
+func combineSeries(metrics []*Metric, groupBy string, reducerName string) ([]*Metric, error) {
+	if reducer, ok := LookupReducer(reducerName); ok {
+		return AggregateMetrics(metrics, groupBy, ExpressionResolution, reducer), nil
+	} else {
+		return nil, fmt.Errorf("reducer %q cannot combine series", reducerName)
+	}
+}
+
+// Applies a binary operator between two sets of series, matching them on the given comma-separated
+// tags with a "one-to-one" (the default) or "many-to-one" join.
+func applySeries(op BinaryOperator, left []*Metric, right []*Metric, on string, join string) ([]*Metric, error) {
+	options := JoinOptions{
+		Step: ExpressionResolution,
+	}
+
+	if on != `` {
+		options.On = strings.Split(on, `,`)
+	}
+
+	switch join {
+	case ``, `one-to-one`:
+		options.Type = OneToOne
+	case `many-to-one`:
+		options.Type = ManyToOne
+	default:
+		return nil, fmt.Errorf("invalid join %q, expected one-to-one or many-to-one", join)
+	}
+
+	return ApplyMetrics(op, left, right, options)
+}
+
+// Applies a function to the value of every point in the given metrics.
+func mapSeriesValues(metrics []*Metric, fn func(float64) float64) []*Metric {
+	output := make([]*Metric, 0, len(metrics))
+
+	for _, input := range expandFields(metrics) {
+		metric := NewMetric(input.GetName())
+		metric.SetTags(input.GetTags())
+
+		for _, point := range input.Points() {
+			metric.Push(point.Timestamp, fn(point.Value))
+		}
+
+		output = append(output, metric)
+	}
+
+	return output
+}
+
+// Splits any multi-field metrics into one metric per field.
+func expandFields(metrics []*Metric) []*Metric {
+	output := make([]*Metric, 0, len(metrics))
+
+	for _, metric := range metrics {
+		output = append(output, metric.SplitFields()...)
+	}
+
+	return output
+}
+
+// Concatenates all series arguments of a variadic function.
+func seriesArgs(args []interface{}) []*Metric {
+	metrics := make([]*Metric, 0)
+
+	for _, arg := range args {
+		if m, ok := arg.([]*Metric); ok {
+			metrics = append(metrics, m...)
+		}
+	}
+
+	return metrics
+}
+
+func stringArg(args []interface{}, i int, fallback string) string {
+	if i < len(args) {
+		if v, ok := args[i].(string); ok {
+			return v
+		}
+	}
+
+	return fallback
+}
+
+// Returns the duration argument at the given index, which will already have been validated.
+func durationArg(args []interface{}, i int) time.Duration {
+	d, _ := time.ParseDuration(stringArg(args, i, ``))
+	return d
+}
+
+// Detects anomalies in each series given by the arguments of anomalyScores or anomalies, returning
+// the chosen part of each result.
+func anomalySeries(args []interface{}, part func(anomalies *Anomalies) *Metric) ([]*Metric, error) {
+	detector, err := ParseAnomalyDetector(stringArg(args, 1, ``))
+
+	if err != nil {
+		return nil, err
+	}
+
+	options := AnomalyOptions{
+		Detector: detector,
+	}
+
+	if len(args) > 2 {
+		options.Window = windowArg(args, 2)
+	}
+
+	if len(args) > 3 {
+		options.Threshold = args[3].(float64)
+	}
+
+	output := make([]*Metric, 0)
+
+	for _, metric := range expandFields(args[0].([]*Metric)) {
+		if anomalies, err := metric.DetectAnomalies(options); err == nil {
+			output = append(output, part(anomalies))
+		} else {
+			return nil, err
+		}
+	}
+
+	return output, nil
+}
+
+// Returns the window argument at the given index, which will already have been validated.
+func windowArg(args []interface{}, i int) Window {
+	switch v := args[i].(type) {
+	case float64:
+		return Window{
+			Points: int(v),
+		}
+	default:
+		window, _ := ParseWindow(stringArg(args, i, ``))
+		return window
+	}
+}
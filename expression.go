@@ -0,0 +1,454 @@
+package mobius
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// An ExpressionError describes a problem with an expression at a specific (zero-based) byte offset.
+type ExpressionError struct {
+	Expression string `json:"expression"`
+	Position   int    `json:"position"`
+	Message    string `json:"message"`
+}
+
+func (self ExpressionError) Error() string {
+	return fmt.Sprintf("%s at position %d", self.Message, self.Position)
+}
+
+// Returns the expression followed by a line with a caret pointing at the error position.
+func (self ExpressionError) Pointer() string {
+	return self.Expression + "\n" + strings.Repeat(` `, self.Position) + `^`
+}
+
+// Returns whether the given error is an ExpressionError.
+func IsExpressionError(err error) bool {
+	_, ok := err.(ExpressionError)
+	return ok
+}
+
+type exprNodeType int
+
+const (
+	seriesNode exprNodeType = iota
+	numberNode
+	stringNode
+	callNode
+)
+
+func (self exprNodeType) String() string {
+	switch self {
+	case numberNode:
+		return `number`
+	case stringNode:
+		return `string`
+	case callNode:
+		return `function call`
+	default:
+		return `series`
+	}
+}
+
+type exprNode struct {
+	Type     exprNodeType
+	Position int
+	Text     string
+	Number   float64
+	Args     []*exprNode
+}
+
+// An Expression is a parsed query that selects series from a dataset and transforms them with the
+// functions in the expression function registry, e.g.: `sumSeries(scale(app.*.latency, 1000))`.
+//
+// Series are selected using the same name, field, and tag syntax accepted by Dataset.Range.
+// Strings may be enclosed in single or double quotes, and numbers are written as usual.
+type Expression struct {
+	Source string
+	root   *exprNode
+}
+
+// Parses the given expression, returning an ExpressionError identifying the position of any
+// syntax error, unknown function, or invalid function argument.
+func ParseExpression(source string) (*Expression, error) {
+	parser := &exprParser{
+		source: source,
+	}
+
+	parser.skipSpace()
+
+	if parser.eof() {
+		return nil, parser.errorf(parser.pos, "expected an expression")
+	}
+
+	if root, err := parser.parseNode(); err == nil {
+		parser.skipSpace()
+
+		if !parser.eof() {
+			return nil, parser.errorf(parser.pos, "unexpected %q", string(parser.peek()))
+		}
+
+		expression := &Expression{
+			Source: source,
+			root:   root,
+		}
+
+		if err := expression.check(root); err != nil {
+			return nil, err
+		}
+
+		return expression, nil
+	} else {
+		return nil, err
+	}
+}
+
+// Evaluates the expression against the points in the given dataset between start and end.
+func (self *Expression) Evaluate(dataset *Dataset, start time.Time, end time.Time) ([]*Metric, error) {
+	context := &ExpressionContext{
+		Dataset: dataset,
+		Start:   start,
+		End:     end,
+	}
+
+	if value, err := self.evaluate(context, self.root); err == nil {
+		if metrics, ok := value.([]*Metric); ok {
+			return metrics, nil
+		} else {
+			return nil, self.errorf(self.root.Position, "expression must produce series, not a %v", self.root.Type)
+		}
+	} else {
+		return nil, err
+	}
+}
+
+func (self *Expression) evaluate(context *ExpressionContext, node *exprNode) (interface{}, error) {
+	switch node.Type {
+	case numberNode:
+		return node.Number, nil
+	case stringNode:
+		return node.Text, nil
+	case seriesNode:
+		if metrics, err := context.Dataset.Range(context.Start, context.End, node.Text); err == nil {
+			return metrics, nil
+		} else {
+			return nil, self.errorf(node.Position, "%v", err)
+		}
+	default:
+		fn, _ := GetExpressionFunction(node.Text)
+		args := make([]interface{}, len(node.Args))
+
+		for i, arg := range node.Args {
+			if value, err := self.evaluate(context, arg); err == nil {
+				args[i] = value
+			} else {
+				return nil, err
+			}
+		}
+
+		if metrics, err := fn.Fn(context, args...); err == nil {
+			return metrics, nil
+		} else if IsExpressionError(err) {
+			return nil, err
+		} else {
+			return nil, self.errorf(node.Position, "%s: %v", node.Text, err)
+		}
+	}
+}
+
+// Verifies that every function called by the expression exists and is given arguments of the
+// expected types.
+func (self *Expression) check(node *exprNode) error {
+	if node.Type != callNode {
+		return nil
+	}
+
+	fn, ok := GetExpressionFunction(node.Text)
+
+	if !ok {
+		return self.errorf(node.Position, "unknown function %q", node.Text)
+	}
+
+	required := 0
+
+	for _, arg := range fn.Args {
+		if !arg.Optional {
+			required++
+		}
+	}
+
+	if len(node.Args) < required {
+		return self.errorf(node.Position, "%s requires at least %d arguments, got %d", node.Text, required, len(node.Args))
+	} else if !fn.Variadic && len(node.Args) > len(fn.Args) {
+		return self.errorf(node.Args[len(fn.Args)].Position, "%s takes at most %d arguments", node.Text, len(fn.Args))
+	}
+
+	for i, arg := range node.Args {
+		var spec ExpressionArg
+
+		if i < len(fn.Args) {
+			spec = fn.Args[i]
+		} else {
+			spec = fn.Args[len(fn.Args)-1]
+		}
+
+		switch spec.Type {
+		case SeriesArg:
+			if arg.Type != seriesNode && arg.Type != callNode {
+				return self.errorf(arg.Position, "argument %q of %s must be a series, not a %v", spec.Name, node.Text, arg.Type)
+			}
+		case NumberArg:
+			if arg.Type != numberNode {
+				return self.errorf(arg.Position, "argument %q of %s must be a number, not a %v", spec.Name, node.Text, arg.Type)
+			}
+		case StringArg:
+			if arg.Type != stringNode {
+				return self.errorf(arg.Position, "argument %q of %s must be a string, not a %v", spec.Name, node.Text, arg.Type)
+			}
+		case DurationArg:
+			if arg.Type != stringNode {
+				return self.errorf(arg.Position, "argument %q of %s must be a duration string, not a %v", spec.Name, node.Text, arg.Type)
+			} else if _, err := time.ParseDuration(arg.Text); err != nil {
+				return self.errorf(arg.Position+1, "invalid duration %q", arg.Text)
+			}
+		case WindowArg:
+			if arg.Type == numberNode {
+				if arg.Number < 1 || arg.Number != float64(int(arg.Number)) {
+					return self.errorf(arg.Position, "a window of points must be a positive integer")
+				}
+			} else if arg.Type != stringNode {
+				return self.errorf(arg.Position, "argument %q of %s must be a duration string or number of points, not a %v", spec.Name, node.Text, arg.Type)
+			} else if _, err := ParseWindow(arg.Text); err != nil {
+				return self.errorf(arg.Position+1, "invalid window %q", arg.Text)
+			}
+		case ReducerArg:
+			if arg.Type != stringNode {
+				return self.errorf(arg.Position, "argument %q of %s must be a reducer name, not a %v", spec.Name, node.Text, arg.Type)
+			} else if _, ok := GetTimeReducer(arg.Text); ok {
+				return self.errorf(arg.Position+1, "time-weighted reducer %q cannot be used with %s", arg.Text, node.Text)
+			} else if _, ok := GetReducer(arg.Text); !ok {
+				return self.errorf(arg.Position+1, "unknown reducer %q", arg.Text)
+			}
+		case AnyReducerArg:
+			if arg.Type != stringNode {
+				return self.errorf(arg.Position, "argument %q of %s must be a reducer name, not a %v", spec.Name, node.Text, arg.Type)
+			} else if _, ok := LookupReducer(arg.Text); !ok {
+				return self.errorf(arg.Position+1, "unknown reducer %q", arg.Text)
+			}
+		}
+
+		if err := self.check(arg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (self *Expression) errorf(position int, format string, args ...interface{}) error {
+	return ExpressionError{
+		Expression: self.Source,
+		Position:   position,
+		Message:    fmt.Sprintf(format, args...),
+	}
+}
+
+type exprParser struct {
+	source string
+	pos    int
+}
+
+func (self *exprParser) parseNode() (*exprNode, error) {
+	self.skipSpace()
+
+	if self.eof() {
+		return nil, self.errorf(self.pos, "unexpected end of expression")
+	}
+
+	start := self.pos
+
+	switch c := self.peek(); c {
+	case '"', '\'':
+		if text, err := self.parseString(); err == nil {
+			return &exprNode{
+				Type:     stringNode,
+				Position: start,
+				Text:     text,
+			}, nil
+		} else {
+			return nil, err
+		}
+	case '(', ')', ',':
+		return nil, self.errorf(start, "unexpected %q", string(c))
+	}
+
+	word := self.parseWord()
+
+	if word == `` {
+		return nil, self.errorf(start, "unexpected %q", string(self.peek()))
+	}
+
+	if self.skipSpace(); !self.eof() && self.peek() == '(' {
+		if !isExprIdentifier(word) {
+			return nil, self.errorf(start, "invalid function name %q", word)
+		}
+
+		self.pos++
+
+		node := &exprNode{
+			Type:     callNode,
+			Position: start,
+			Text:     word,
+		}
+
+		if self.skipSpace(); !self.eof() && self.peek() == ')' {
+			self.pos++
+			return node, nil
+		}
+
+		for {
+			if arg, err := self.parseNode(); err == nil {
+				node.Args = append(node.Args, arg)
+			} else {
+				return nil, err
+			}
+
+			self.skipSpace()
+
+			if self.eof() {
+				return nil, self.errorf(self.pos, "expected ')' to close %s (opened at position %d)", word, start)
+			}
+
+			switch c := self.peek(); c {
+			case ',':
+				self.pos++
+			case ')':
+				self.pos++
+				return node, nil
+			default:
+				return nil, self.errorf(self.pos, "expected ',' or ')', got %q", string(c))
+			}
+		}
+	}
+
+	if strings.ContainsAny(word[:1], `0123456789+-.`) {
+		if number, err := strconv.ParseFloat(word, 64); err == nil {
+			return &exprNode{
+				Type:     numberNode,
+				Position: start,
+				Text:     word,
+				Number:   number,
+			}, nil
+		}
+	}
+
+	if _, err := parseNamePattern(word); err != nil {
+		return nil, self.errorf(start, "invalid series selector %q: %v", word, err)
+	}
+
+	return &exprNode{
+		Type:     seriesNode,
+		Position: start,
+		Text:     word,
+	}, nil
+}
+
+// Reads a bare word: a function name, number, or series selector.  Commas separate arguments,
+// except within the tag list of a selector (e.g. "app.req:env=prod,host=a"), where a comma that is
+// followed by another "tag=" continues the selector.
+func (self *exprParser) parseWord() string {
+	start := self.pos
+	inTags := false
+
+	for !self.eof() {
+		c := self.peek()
+
+		switch {
+		case c == ',' && inTags && self.continuesTags(self.pos+1):
+		case c == '(' || c == ')' || c == ',' || c == '"' || c == '\'' || unicode.IsSpace(rune(c)):
+			return self.source[start:self.pos]
+		case c == NameTagsDelimiter[0]:
+			inTags = true
+		}
+
+		self.pos++
+	}
+
+	return self.source[start:self.pos]
+}
+
+func (self *exprParser) continuesTags(offset int) bool {
+	for i := offset; i < len(self.source); i++ {
+		switch c := self.source[i]; {
+		case c == '=':
+			return i > offset
+		case c == '(' || c == ')' || c == ',' || c == '"' || c == '\'' || unicode.IsSpace(rune(c)):
+			return false
+		}
+	}
+
+	return false
+}
+
+func (self *exprParser) parseString() (string, error) {
+	start := self.pos
+	quote := self.peek()
+	text := make([]byte, 0)
+
+	self.pos++
+
+	for !self.eof() {
+		c := self.peek()
+		self.pos++
+
+		switch c {
+		case quote:
+			return string(text), nil
+		case '\\':
+			if self.eof() {
+				return ``, self.errorf(start, "unterminated string")
+			}
+
+			text = append(text, self.peek())
+			self.pos++
+		default:
+			text = append(text, c)
+		}
+	}
+
+	return ``, self.errorf(start, "unterminated string")
+}
+
+func (self *exprParser) skipSpace() {
+	for !self.eof() && unicode.IsSpace(rune(self.peek())) {
+		self.pos++
+	}
+}
+
+func (self *exprParser) peek() byte {
+	return self.source[self.pos]
+}
+
+func (self *exprParser) eof() bool {
+	return self.pos >= len(self.source)
+}
+
+func (self *exprParser) errorf(position int, format string, args ...interface{}) error {
+	return ExpressionError{
+		Expression: self.source,
+		Position:   position,
+		Message:    fmt.Sprintf(format, args...),
+	}
+}
+
+func isExprIdentifier(word string) bool {
+	for i, c := range word {
+		if !(c == '_' || unicode.IsLetter(c) || (i > 0 && unicode.IsDigit(c))) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,208 @@
+package mobius
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExpressionParseErrors(t *testing.T) {
+	assert := require.New(t)
+
+	for expr, position := range map[string]int{
+		``:                                    0,
+		`sumSeries(app.*`:                     15,
+		`sumSeries(app.*))`:                   16,
+		`nope(app.*)`:                         0,
+		`scale(app.*, "ten")`:                 13,
+		`scale(app.*)`:                        0,
+		`scale(app.*, 10, 20)`:                17,
+		`summarize(app.*, "5q")`:              18,
+		`groupByTag(app.*, "host", "bogus")`:  27,
+		`groupByTag(app.*, "host", "twa")`:    27,
+		`summarize(app.*, "1h", "bogus")`:     24,
+		`sumSeries(app.*, "unterminated)`:     17,
+		`sumSeries(scale(app.* 10))`:          22,
+		`movingAverage(app.*, ,)`:             21,
+		`movingMedian(app.*, 2.5)`:            20,
+		`movingMedian(app.*, "5x")`:           21,
+		`sumSeries(scale(app.*, 10), nope())`: 28,
+	} {
+		_, err := ParseExpression(expr)
+		assert.Error(err, expr)
+		assert.True(IsExpressionError(err), expr)
+		assert.Equal(position, err.(ExpressionError).Position, fmt.Sprintf("%s: %v", expr, err))
+	}
+
+	_, err := ParseExpression(`summarize(app.*, "1h", "time-weighted-percentile(99)")`)
+	assert.NoError(err)
+
+	_, err = ParseExpression(`scale(app.*, "ten")`)
+	assert.Equal("scale(app.*, \"ten\")\n             ^", err.(ExpressionError).Pointer())
+}
+
+func TestExpressionEvaluate(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+
+	for name, values := range map[string][]float64{
+		`app.a.latency:env=prod,host=a`: {1, 2, 3, 4},
+		`app.b.latency:env=prod,host=b`: {10, 20, 30, 40},
+		`app.c.latency:env=dev,host=a`:  {100, 200, 300, 400},
+	} {
+		metric := NewMetric(name)
+
+		for i, v := range values {
+			metric.Push(epoch.Add(time.Duration(i)*time.Minute), v)
+		}
+
+		assert.NoError(database.Write(metric))
+	}
+
+	evaluate := func(expr string) []*Metric {
+		expression, err := ParseExpression(expr)
+		assert.NoError(err, expr)
+
+		metrics, err := expression.Evaluate(database, epoch, epoch.Add(time.Hour))
+		assert.NoError(err, expr)
+		return metrics
+	}
+
+	metrics := evaluate(`sumSeries(scale(app.*.latency, 1000))`)
+	assert.Len(metrics, 1)
+	assert.Equal([]float64{111000, 222000, 333000, 444000}, metrics[0].Points().Values())
+
+	// commas continue the tag list of a selector when followed by another tag
+	metrics = evaluate(`sumSeries(app.*.latency:env=prod,host=a, app.b.latency)`)
+	assert.Len(metrics, 1)
+	assert.Equal([]float64{11, 22, 33, 44}, metrics[0].Points().Values())
+
+	metrics = evaluate(`groupByTag(app.*.latency, "host", "max")`)
+	assert.Len(metrics, 2)
+	assert.Equal([]float64{100, 200, 300, 400}, metrics[0].Points().Values())
+	assert.Equal([]float64{10, 20, 30, 40}, metrics[1].Points().Values())
+
+	metrics = evaluate(`movingAverage(groupByTag(app.*.latency:env=prod, "host", "sum"), '2m')`)
+	assert.Len(metrics, 2)
+	assert.Equal([]float64{1, 1.5, 2.5, 3.5}, metrics[0].Points().Values())
+
+	metrics = evaluate(`movingMax(app.b.latency, 2)`)
+	assert.Equal([]float64{10, 20, 30, 40}, metrics[0].Points().Values())
+
+	metrics = evaluate(`movingPercentile(app.b.latency, "10m", 75)`)
+	assert.Equal([]float64{25, 30}, metrics[0].Points().Values()[2:])
+
+	// time-weighted reducers rank, filter and smooth series too
+	metrics = evaluate(`topk(app.*.latency, 1, "integral")`)
+	assert.Len(metrics, 1)
+	assert.Equal(`app.c.latency`, metrics[0].GetName())
+
+	metrics = evaluate(`bottomk(app.*.latency, 1, "integral")`)
+	assert.Len(metrics, 1)
+	assert.Equal(`app.a.latency`, metrics[0].GetName())
+
+	metrics = evaluate(`above(app.*.latency, 1000, "integral")`)
+	assert.Len(metrics, 2)
+
+	metrics = evaluate(`below(app.*.latency, 100, "time-weighted-mean")`)
+	assert.Len(metrics, 2)
+
+	metrics = evaluate(`movingWindow(app.b.latency, 2, "integral")`)
+	assert.Equal([]float64{0, 600, 1200, 1800}, metrics[0].Points().Values())
+
+	metrics = evaluate(`ewma(app.b.latency, 0.5)`)
+	assert.Equal([]float64{10, 15, 22.5, 31.25}, metrics[0].Points().Values())
+
+	metrics = evaluate(`alias(summarize(offset(app.a.latency, -1), "1h", "sum"), "total")`)
+	assert.Len(metrics, 1)
+	assert.Equal(`total`, metrics[0].GetName())
+	assert.Equal([]float64{6}, metrics[0].Points().Values())
+
+	// one-to-one joins on a subset of tags keep only those tags
+	metrics = evaluate(`divide(app.b.latency, app.a.latency, "env")`)
+	assert.Len(metrics, 1)
+	assert.Equal(map[string]interface{}{`env`: `prod`}, metrics[0].GetTags())
+	assert.Equal([]float64{10, 10, 10, 10}, metrics[0].Points().Values())
+
+	metrics = evaluate(`divide(app.*.latency:env=prod, sumSeries(app.*.latency:env=prod), "env", "many-to-one")`)
+	assert.Len(metrics, 2)
+
+	for _, metric := range metrics {
+		share := 1.0 / 11
+
+		if metric.GetTag(`host`) == `b` {
+			share = 10.0 / 11
+		}
+
+		for _, value := range metric.Points().Values() {
+			assert.InDelta(share, value, 1e-9)
+		}
+	}
+
+	metrics = evaluate(`compare(app.*.latency, ">", scale(app.a.latency, 25), "host", "many-to-one")`)
+	assert.Len(metrics, 1)
+	assert.Equal(`app.c.latency`, metrics[0].GetName())
+	assert.Equal([]float64{100, 200, 300, 400}, metrics[0].Points().Values())
+
+	expression, err := ParseExpression(`divide(app.*.latency:env=prod, sumSeries(app.*.latency:env=prod), "env")`)
+	assert.NoError(err)
+	_, err = expression.Evaluate(database, epoch, epoch.Add(time.Hour))
+	assert.True(IsExpressionError(err))
+
+	// evaluation errors for bare values report their position too
+	expression, err = ParseExpression(`42`)
+	assert.NoError(err)
+	_, err = expression.Evaluate(database, epoch, epoch.Add(time.Hour))
+	assert.True(IsExpressionError(err))
+
+	server := NewServer(database)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, `/query?from=2006-01-02T15:00:00-07:00&to=2006-01-02T16:00:00-07:00&expr=`+url.QueryEscape(`maxSeries(app.*.latency)`), nil))
+	assert.Equal(200, recorder.Code)
+
+	var body []map[string]interface{}
+	jsonbody(recorder.Body, &body)
+	assert.Len(body, 1)
+	assert.Len(body[0][`points`], 4)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, `/query?expr=`+url.QueryEscape(`maxSeries(app.*.latency`), nil))
+	assert.Equal(400, recorder.Code)
+
+	var errBody map[string]interface{}
+	jsonbody(recorder.Body, &errBody)
+	assert.Equal(float64(23), errBody[`position`])
+
+	metrics = evaluate(`holtWintersForecast(app.b.latency, 1, 2)`)
+	assert.Len(metrics, 3)
+	assert.Equal(`app.b.latency.forecast`, metrics[0].GetName())
+	assert.Equal(`app.b.latency.forecast.upper`, metrics[1].GetName())
+	assert.Equal(`app.b.latency.forecast.lower`, metrics[2].GetName())
+	assert.Len(metrics[0].Points(), 3)
+	assert.InDelta(60, metrics[0].Points()[2].Value, 10)
+
+	metrics = evaluate(`anomalies(app.*.latency, "zscore")`)
+	assert.Len(metrics, 3)
+	assert.Equal(`app.a.latency.anomaly`, metrics[0].GetName())
+	assert.Equal([]float64{0, 0, 0, 0}, metrics[0].Points().Values())
+
+	metrics = evaluate(`anomalyScores(app.b.latency, "mad", 2)`)
+	assert.Len(metrics, 1)
+	assert.Len(metrics[0].Points(), 4)
+}
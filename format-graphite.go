@@ -2,7 +2,6 @@ package mobius
 
 import (
 	"fmt"
-	"strconv"
 )
 
 type CarbonFormatter struct {
@@ -10,8 +9,10 @@ type CarbonFormatter struct {
 }
 
 func (self CarbonFormatter) Format(metric *Metric, point Point) string {
-	if len(metric.GetUniqueName()) > 0 {
-		value := strconv.FormatFloat(point.Value, 'f', -1, 64)
+	if point.Type == FieldsType {
+		return formatEachField(self, metric, point)
+	} else if len(metric.GetUniqueName()) > 0 {
+		value := formatValue(point)
 
 		return fmt.Sprintf("%s %s %d",
 			metric.GetUniqueName(),
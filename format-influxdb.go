@@ -0,0 +1,50 @@
+package mobius
+
+import (
+	"fmt"
+	"github.com/ghetzel/go-stockutil/maputil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type InfluxFormatter struct {
+	Formatter
+}
+
+func (self InfluxFormatter) Format(metric *Metric, point Point) string {
+	if len(metric.GetName()) > 0 {
+		series := escapeInflux(metric.GetName())
+		fields := make([]string, 0)
+
+		if tags := metric.GetTags(); len(tags) > 0 {
+			pairs := make([]string, 0)
+
+			for _, key := range maputil.StringKeys(tags) {
+				pairs = append(pairs, escapeInflux(key)+`=`+escapeInflux(fmt.Sprintf("%v", tags[key])))
+			}
+
+			sort.Strings(pairs)
+			series = series + `,` + strings.Join(pairs, `,`)
+		}
+
+		switch point.Type {
+		case FieldsType:
+			for _, name := range (PointSet{point}).FieldNames() {
+				fields = append(fields, escapeInflux(name)+`=`+strconv.FormatFloat(point.Fields[name], 'f', -1, 64))
+			}
+		case IntegerType:
+			fields = append(fields, `value=`+formatValue(point)+`i`)
+		default:
+			fields = append(fields, `value=`+formatValue(point))
+		}
+
+		return fmt.Sprintf("%s %s %d",
+			series,
+			strings.Join(fields, `,`),
+			point.Timestamp.UnixNano(),
+		)
+	} else {
+		return ``
+	}
+}
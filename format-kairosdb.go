@@ -3,7 +3,6 @@ package mobius
 import (
 	"fmt"
 	"github.com/ghetzel/go-stockutil/maputil"
-	"strconv"
 )
 
 type KairosFormatter struct {
@@ -11,8 +10,10 @@ type KairosFormatter struct {
 }
 
 func (self KairosFormatter) Format(metric *Metric, point Point) string {
-	if len(metric.GetUniqueName()) > 0 {
-		value := strconv.FormatFloat(point.Value, 'f', -1, 64)
+	if point.Type == FieldsType {
+		return formatEachField(self, metric, point)
+	} else if len(metric.GetUniqueName()) > 0 {
+		value := formatValue(point)
 		tags := ``
 
 		if len(metric.GetTags()) > 0 {
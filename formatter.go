@@ -1,5 +1,10 @@
 package mobius
 
+import (
+	"strconv"
+	"strings"
+)
+
 type Formatter interface {
 	Format(*Metric, Point) string
 }
@@ -8,9 +13,38 @@ func GetFormatter(name string) (Formatter, bool) {
 	switch name {
 	case `graphite`:
 		return CarbonFormatter{}, true
+	case `influxdb`:
+		return InfluxFormatter{}, true
 	case `kairosdb`:
 		return KairosFormatter{}, true
 	default:
 		return nil, false
 	}
 }
+
+// Formats the value of the given point, preserving the exact value of integer points.
+func formatValue(point Point) string {
+	switch point.Type {
+	case IntegerType:
+		return strconv.FormatInt(point.Integer, 10)
+	default:
+		return strconv.FormatFloat(point.Value, 'f', -1, 64)
+	}
+}
+
+// Formats each field of a multi-field point as its own line, named as "<name>#<field>".
+func formatEachField(formatter Formatter, metric *Metric, point Point) string {
+	lines := make([]string, 0)
+
+	for _, field := range (PointSet{point}).FieldNames() {
+		fieldMetric := NewMetric(metric.GetName() + FieldDelimiter + field)
+		fieldMetric.SetTags(metric.GetTags())
+
+		lines = append(lines, formatter.Format(fieldMetric, Point{
+			Timestamp: point.Timestamp,
+			Value:     point.Fields[field],
+		}))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,138 @@
+package mobius
+
+import (
+	"fmt"
+	"github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
+	"io"
+	"time"
+)
+
+// The palette heatmap cells are colored from when the graph has none.
+var DefaultHeatmapPalette = PaletteHeat
+
+// The number of time buckets a heatmap is divided into when no interval is given.
+var DefaultHeatmapColumns = 60
+
+// Creates a heatmap graph of the given distribution.
+func NewHeatmapGraph(heatmap *Heatmap) *Graph {
+	graph := NewGraph(nil)
+	graph.Type = HeatmapGraph
+	graph.Heatmap = heatmap
+
+	return graph
+}
+
+// Draws each cell of the heatmap as a rectangle colored along the palette's gradient according to
+// its count relative to the greatest count.  Empty cells are left blank.
+func (self *Graph) renderHeatmap(w io.Writer, renderProvider chart.RendererProvider) error {
+	heatmap := self.Heatmap
+
+	if heatmap == nil || len(heatmap.Times) == 0 {
+		return fmt.Errorf("Nothing to graph")
+	}
+
+	palette := self.Palette
+
+	if len(palette) == 0 {
+		palette = DefaultHeatmapPalette
+	}
+
+	first := heatmap.Times[0]
+	last := heatmap.Times[len(heatmap.Times)-1].Add(heatmap.Interval)
+	lower := heatmap.Boundaries[0]
+	upper := heatmap.Boundaries[len(heatmap.Boundaries)-1]
+	maxCount := float64(heatmap.MaxCount())
+
+	graph := chart.Chart{
+		Title:      self.Options.Title,
+		TitleStyle: self.Style.Title,
+		Background: self.Style.Background,
+		Canvas:     self.Style.Canvas,
+		XAxis: chart.XAxis{
+			Style:          self.Style.XAxis,
+			NameStyle:      self.Style.XAxisTitle,
+			TickStyle:      self.Style.XAxisTicks,
+			GridMajorStyle: self.Style.XAxisGridMajor,
+			GridMinorStyle: self.Style.XAxisGridMinor,
+			Range: &chart.ContinuousRange{
+				Min: float64(first.UnixNano()),
+				Max: float64(last.UnixNano()),
+			},
+		},
+		YAxis: chart.YAxis{
+			Style:          self.Style.YAxis,
+			NameStyle:      self.Style.YAxisTitle,
+			TickStyle:      self.Style.YAxisTicks,
+			GridMajorStyle: self.Style.YAxisGridMajor,
+			GridMinorStyle: self.Style.YAxisGridMinor,
+			Range: &chart.ContinuousRange{
+				Min: lower,
+				Max: upper,
+			},
+		},
+		Series: []chart.Series{
+			// an invisible series spanning the heatmap, which gives the axes their ticks
+			chart.TimeSeries{
+				Style: chart.Style{
+					Show:        true,
+					StrokeColor: drawing.ColorTransparent,
+				},
+				XValues: []time.Time{first, last},
+				YValues: []float64{lower, upper},
+			},
+		},
+	}
+
+	if v := self.Options.Width; v > 0 {
+		graph.Width = v
+	}
+
+	if v := self.Options.Height; v > 0 {
+		graph.Height = v
+	}
+
+	if v := self.Options.DPI; v > 0 {
+		graph.DPI = v
+	} else {
+		graph.DPI = DefaultDPI
+	}
+
+	graph.Elements = []chart.Renderable{
+		func(r chart.Renderer, canvas chart.Box, defaults chart.Style) {
+			width := float64(canvas.Right - canvas.Left)
+			height := float64(canvas.Bottom - canvas.Top)
+			span := float64(last.Sub(first))
+
+			x := func(t time.Time) int {
+				return canvas.Left + int(width*float64(t.Sub(first))/span)
+			}
+
+			y := func(v float64) int {
+				return canvas.Bottom - int(height*(v-lower)/(upper-lower))
+			}
+
+			for i, tm := range heatmap.Times {
+				for j, count := range heatmap.Counts[i] {
+					if count == 0 || maxCount == 0 {
+						continue
+					}
+
+					x0, x1 := x(tm), x(tm.Add(heatmap.Interval))
+					y0, y1 := y(heatmap.Boundaries[j]), y(heatmap.Boundaries[j+1])
+
+					r.SetFillColor(palette.Gradient(float64(count) / maxCount))
+					r.SetStrokeWidth(0)
+					r.MoveTo(x0, y0)
+					r.LineTo(x1, y0)
+					r.LineTo(x1, y1)
+					r.LineTo(x0, y1)
+					r.Close()
+					r.Fill()
+				}
+			}
+		},
+	}
+
+	return graph.Render(renderProvider, w)
+}
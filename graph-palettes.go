@@ -16,6 +16,43 @@ func (self Palette) Get(index int) string {
 	return `#` + strings.TrimPrefix(self[index%len(self)], `#`)
 }
 
+// Returns the color at the given position (from 0 to 1) along a gradient running through each of the
+// palette's colors in turn.
+func (self Palette) Gradient(position float64) drawing.Color {
+	switch len(self) {
+	case 0:
+		return drawing.Color{}
+	case 1:
+		return drawing.ColorFromHex(strings.TrimPrefix(self[0], `#`))
+	}
+
+	if position <= 0 {
+		position = 0
+	} else if position >= 1 {
+		position = 1
+	}
+
+	scaled := position * float64(len(self)-1)
+	i := int(scaled)
+
+	if i >= len(self)-1 {
+		i = len(self) - 2
+	}
+
+	from := drawing.ColorFromHex(strings.TrimPrefix(self[i], `#`))
+	to := drawing.ColorFromHex(strings.TrimPrefix(self[i+1], `#`))
+	mix := func(a uint8, b uint8) uint8 {
+		return uint8(float64(a) + (float64(b)-float64(a))*(scaled-float64(i)) + 0.5)
+	}
+
+	return drawing.Color{
+		R: mix(from.R, to.R),
+		G: mix(from.G, to.G),
+		B: mix(from.B, to.B),
+		A: mix(from.A, to.A),
+	}
+}
+
 func MakeSimplePalette(each func(style *chart.Style), colors ...string) []chart.Style {
 	styles := make([]chart.Style, len(colors))
 
@@ -36,6 +73,12 @@ func MakeSimplePalette(each func(style *chart.Style), colors ...string) []chart.
 	return styles
 }
 
+// A gradient from pale yellow to dark red, suited to heatmaps.
+var PaletteHeat = Palette{
+	`ffffcc`, `ffeda0`, `fed976`, `feb24c`, `fd8d3c`,
+	`fc4e2a`, `e31a1c`, `bd0026`, `800026`,
+}
+
 var PaletteSpectrum14 = Palette{
 	`387aa3`, `649eb9`, `9dc2d3`, `a888c2`, `d8aad6`,
 	`e7cbe6`, `a1d05d`, `bbe468`, `d2ed82`, `716c49`,
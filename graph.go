@@ -3,12 +3,16 @@ package mobius
 import (
 	"fmt"
 	"github.com/wcharczuk/go-chart"
+	"github.com/wcharczuk/go-chart/drawing"
 	"io"
-	"time"
+	"math"
 )
 
 var DefaultDPI float64 = 72.0
 
+// The dash pattern of baseline series.
+var BaselineDashArray = []float64{5, 5}
+
 type RenderFormat string
 
 const (
@@ -16,15 +20,48 @@ const (
 	RenderFormatSVG              = `svg`
 )
 
+// Determines how a graph is drawn.
+type GraphType string
+
+const (
+	// Series are drawn as lines over time.
+	LineGraph GraphType = `line`
+
+	// Histograms are drawn as bars.
+	BarGraph GraphType = `bar`
+
+	// The distribution of values over time is drawn as cells colored by count.
+	HeatmapGraph GraphType = `heatmap`
+)
+
 type GraphOptions struct {
 	Title  string  `json:"title"`
 	Width  int     `json:"width"`
 	Height int     `json:"height"`
 	DPI    float64 `json:"dpi"`
+
+	// The most points drawn for any line.  Longer series are downsampled to this many points; if
+	// zero, the width of the graph in pixels is used, and if negative, series are drawn in full.
+	MaxDataPoints int              `json:"max_data_points"`
+	Downsample    DownsampleMethod `json:"downsample"`
 }
 
 type Graph struct {
-	Series  []*Metric
+	Series []*Metric
+
+	// Unsmoothed versions of the series, drawn faintly behind the series at the same index in the
+	// same color.
+	Raw []*Metric
+
+	// Distributions drawn by bar graphs.
+	Histograms []*Histogram
+
+	// The distribution over time drawn by heatmap graphs, in colors taken from a gradient through
+	// the palette.
+	Heatmap *Heatmap
+	Palette Palette
+
+	Type    GraphType
 	Options GraphOptions
 	Style   GraphStyle
 }
@@ -32,12 +69,38 @@ type Graph struct {
 func NewGraph(metrics []*Metric) *Graph {
 	return &Graph{
 		Series:  metrics,
+		Type:    LineGraph,
 		Options: GraphOptions{},
 		Style:   DefaultStyle,
 	}
 }
 
+// Creates a bar graph of the given histograms.
+func NewHistogramGraph(histograms []*Histogram) *Graph {
+	graph := NewGraph(nil)
+	graph.Type = BarGraph
+	graph.Histograms = histograms
+
+	return graph
+}
+
 func (self *Graph) Render(w io.Writer, format RenderFormat) error {
+	renderProvider, err := getRenderProvider(format)
+
+	if err != nil {
+		return err
+	}
+
+	switch self.Type {
+	case BarGraph:
+		return self.renderBars(w, renderProvider)
+	case HeatmapGraph:
+		return self.renderHeatmap(w, renderProvider)
+	case LineGraph, ``:
+	default:
+		return fmt.Errorf("Unsupported graph type %q", self.Type)
+	}
+
 	graph := chart.Chart{
 		Title:      self.Options.Title,
 		TitleStyle: self.Style.Title,
@@ -81,36 +144,212 @@ func (self *Graph) Render(w io.Writer, format RenderFormat) error {
 		graph.DPI = DefaultDPI
 	}
 
-	for i, metric := range self.Series {
-		series := chart.TimeSeries{
-			Name:    metric.GetUniqueName(),
-			Style:   self.Style.GetSeriesStyle(i),
-			XValues: make([]time.Time, 0),
-			YValues: make([]float64, 0),
+	// there's no use drawing more points than there are pixels to draw them in
+	maxPoints := self.Options.MaxDataPoints
+
+	if maxPoints == 0 {
+		if maxPoints = graph.Width; maxPoints <= 0 {
+			maxPoints = chart.DefaultChartWidth
 		}
+	}
+
+	// multi-field metrics are drawn as one line per field
+	metrics := make([]*Metric, 0)
+
+	for _, metric := range self.Series {
+		metrics = append(metrics, DownsampleMetrics(metric.SplitFields(), maxPoints, self.Options.Downsample)...)
+	}
+
+	bands := make([]chart.Series, 0)
+	i := 0
+
+	for _, metric := range metrics {
+		// confidence bands are shaded in the color of the forecast preceding them
+		if band, ok := metric.Metadata[`band`].(string); ok {
+			color := i - 1
+
+			if color < 0 {
+				color = 0
+			}
+
+			bands = append(bands, self.bandSeries(metric, band, self.Style.GetSeriesStyle(color))...)
+			continue
+		}
+
+		style := self.Style.GetSeriesStyle(i)
+		i++
+
+		// time-shifted baselines and forecasts are dashed
+		if v, ok := metric.Metadata[`baseline`].(bool); ok && v {
+			style.StrokeDashArray = BaselineDashArray
+		} else if v, ok := metric.Metadata[`forecast`].(bool); ok && v {
+			style.StrokeDashArray = BaselineDashArray
+		}
+
+		// lines are broken wherever the series has a gap (i.e.: NaN values)
+		for j, segment := range splitGaps(metric.Points()) {
+			series := chart.TimeSeries{
+				Style:   style,
+				XValues: segment.Timestamps(),
+				YValues: segment.Values(),
+			}
+
+			if j == 0 {
+				series.Name = metric.GetUniqueName()
+			}
+
+			graph.Series = append([]chart.Series{series}, graph.Series...)
+		}
+	}
+
+	// raw lines go first so that they are drawn beneath everything else
+	for i, metric := range DownsampleMetrics(expandFields(self.Raw), maxPoints, self.Options.Downsample) {
+		style := self.Style.GetSeriesStyle(i)
+		style.StrokeWidth = 1
+		style.StrokeColor = style.StrokeColor.WithAlpha(96)
+		style.FillColor = drawing.Color{}
+
+		for j, segment := range splitGaps(metric.Points()) {
+			series := chart.TimeSeries{
+				Style:   style,
+				XValues: segment.Timestamps(),
+				YValues: segment.Values(),
+			}
+
+			if j == 0 {
+				series.Name = metric.GetUniqueName() + ` (raw)`
+			}
+
+			graph.Series = append([]chart.Series{series}, graph.Series...)
+		}
+	}
+
+	// bands go beneath everything
+	graph.Series = append(bands, graph.Series...)
+
+	if err := graph.Render(renderProvider, w); err != nil {
+		return err
+	}
 
-		if points := metric.Points(); len(points) > 0 {
-			series.XValues = points.Timestamps()
-			series.YValues = points.Values()
+	return nil
+}
+
+// Draws the buckets of each histogram as bars labeled with their boundaries, with each histogram
+// in its own color.
+func (self *Graph) renderBars(w io.Writer, renderProvider chart.RendererProvider) error {
+	graph := chart.BarChart{
+		Title:      self.Options.Title,
+		TitleStyle: self.Style.Title,
+		Background: self.Style.Background,
+		Canvas:     self.Style.Canvas,
+		XAxis:      self.Style.XAxis,
+		YAxis: chart.YAxis{
+			Style:          self.Style.YAxis,
+			NameStyle:      self.Style.YAxisTitle,
+			TickStyle:      self.Style.YAxisTicks,
+			GridMajorStyle: self.Style.YAxisGridMajor,
+			GridMinorStyle: self.Style.YAxisGridMinor,
+		},
+		Bars: make([]chart.Value, 0),
+	}
+
+	if v := self.Options.Width; v > 0 {
+		graph.Width = v
+	}
+
+	if v := self.Options.Height; v > 0 {
+		graph.Height = v
+	}
+
+	if v := self.Options.DPI; v > 0 {
+		graph.DPI = v
+	} else {
+		graph.DPI = DefaultDPI
+	}
+
+	for i, histogram := range self.Histograms {
+		style := self.Style.GetSeriesStyle(i)
+		style.FillColor = style.StrokeColor
+
+		for _, bucket := range histogram.Buckets {
+			graph.Bars = append(graph.Bars, chart.Value{
+				Style: style,
+				Label: fmt.Sprintf("%g-%g", bucket.Lower, bucket.Upper),
+				Value: float64(bucket.Count),
+			})
 		}
+	}
 
-		graph.Series = append([]chart.Series{series}, graph.Series...)
+	if len(graph.Bars) == 0 {
+		return fmt.Errorf("Nothing to graph")
 	}
 
-	var renderProvider chart.RendererProvider
+	return graph.Render(renderProvider, w)
+}
 
+func getRenderProvider(format RenderFormat) (chart.RendererProvider, error) {
 	switch format {
 	case RenderFormatPNG:
-		renderProvider = chart.PNG
+		return chart.PNG, nil
 	case RenderFormatSVG:
-		renderProvider = chart.SVG
+		return chart.SVG, nil
 	default:
-		return fmt.Errorf("Unsupported format %q", format)
+		return nil, fmt.Errorf("Unsupported format %q", format)
 	}
+}
 
-	if err := graph.Render(renderProvider, w); err != nil {
-		return err
+// Draws one edge of a confidence band.  The upper edge is filled down to the bottom of the canvas with
+// a translucent color, and the lower edge is filled with the canvas color, leaving the area between
+// the edges shaded.
+func (self *Graph) bandSeries(metric *Metric, band string, style chart.Style) []chart.Series {
+	output := make([]chart.Series, 0)
+	bandStyle := chart.Style{
+		Show:        true,
+		StrokeWidth: 0,
+		StrokeColor: drawing.ColorTransparent,
 	}
 
-	return nil
+	if band == `upper` {
+		bandStyle.FillColor = style.StrokeColor.WithAlpha(48)
+	} else if fill := self.Style.Canvas.FillColor; !fill.IsZero() {
+		bandStyle.FillColor = fill
+	} else if fill := self.Style.Background.FillColor; !fill.IsZero() {
+		bandStyle.FillColor = fill
+	} else {
+		bandStyle.FillColor = drawing.ColorWhite
+	}
+
+	for _, segment := range splitGaps(metric.Points()) {
+		output = append(output, chart.TimeSeries{
+			Style:   bandStyle,
+			XValues: segment.Timestamps(),
+			YValues: segment.Values(),
+		})
+	}
+
+	return output
+}
+
+// Splits a set of points into runs of consecutive points with non-NaN values.
+func splitGaps(points PointSet) []PointSet {
+	segments := make([]PointSet, 0)
+	var segment PointSet
+
+	for _, point := range points {
+		if math.IsNaN(point.Value) && point.Type != FieldsType {
+			if len(segment) > 0 {
+				segments = append(segments, segment)
+			}
+
+			segment = nil
+		} else {
+			segment = append(segment, point)
+		}
+	}
+
+	if len(segment) > 0 {
+		segments = append(segments, segment)
+	}
+
+	return segments
 }
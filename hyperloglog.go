@@ -0,0 +1,147 @@
+package mobius
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// The precision of new HyperLogLog sketches.  Sketches use 2^precision one-byte registers and have a
+// standard error of roughly 1.04/sqrt(2^precision), or about 1.6% at the default precision of 12.
+var DefaultHyperLogLogPrecision uint8 = 12
+
+const hllEncodingVersion = 1
+
+// A HyperLogLog estimates the number of distinct members that have been added to it using a fixed
+// amount of memory.  HyperLogLogs with the same precision can be merged, producing an estimate of the
+// number of distinct members in the union of their sets.
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+func NewHyperLogLog() *HyperLogLog {
+	return NewHyperLogLogWithPrecision(DefaultHyperLogLogPrecision)
+}
+
+func NewHyperLogLogWithPrecision(precision uint8) *HyperLogLog {
+	if precision < 4 {
+		precision = 4
+	} else if precision > 18 {
+		precision = 18
+	}
+
+	return &HyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}
+}
+
+// Adds a member to the set.
+func (self *HyperLogLog) Add(member string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(member))
+	x := mix64(hash.Sum64())
+
+	index := x >> (64 - self.precision)
+	rank := uint8(bits.LeadingZeros64((x<<self.precision)|(1<<(self.precision-1)))) + 1
+
+	if rank > self.registers[index] {
+		self.registers[index] = rank
+	}
+}
+
+// Merges the members of another HyperLogLog into this one.
+func (self *HyperLogLog) Merge(other *HyperLogLog) error {
+	if other == nil {
+		return nil
+	}
+
+	if self.precision != other.precision {
+		return fmt.Errorf("Cannot merge HyperLogLogs with different precisions (%d, %d)", self.precision, other.precision)
+	}
+
+	for i, rank := range other.registers {
+		if rank > self.registers[i] {
+			self.registers[i] = rank
+		}
+	}
+
+	return nil
+}
+
+func (self *HyperLogLog) Clone() *HyperLogLog {
+	clone := NewHyperLogLogWithPrecision(self.precision)
+	copy(clone.registers, self.registers)
+	return clone
+}
+
+// Returns the estimated number of distinct members in the set.
+func (self *HyperLogLog) Estimate() float64 {
+	m := float64(len(self.registers))
+	sum := 0.0
+	zeroes := 0
+
+	for _, rank := range self.registers {
+		sum += math.Pow(2, -float64(rank))
+
+		if rank == 0 {
+			zeroes++
+		}
+	}
+
+	var alpha float64
+
+	switch len(self.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	estimate := alpha * m * m / sum
+
+	// use linear counting for small cardinalities, where the raw estimate is biased
+	if estimate <= 2.5*m && zeroes > 0 {
+		estimate = m * math.Log(m/float64(zeroes))
+	}
+
+	return math.Floor(estimate + 0.5)
+}
+
+func (self *HyperLogLog) MarshalBinary() ([]byte, error) {
+	return append([]byte{hllEncodingVersion, self.precision}, self.registers...), nil
+}
+
+func (self *HyperLogLog) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("HyperLogLog data is truncated")
+	} else if data[0] != hllEncodingVersion {
+		return fmt.Errorf("Unsupported HyperLogLog encoding version %d", data[0])
+	}
+
+	*self = *NewHyperLogLogWithPrecision(data[1])
+
+	if len(data)-2 != len(self.registers) {
+		return fmt.Errorf("Expected %d HyperLogLog registers, got %d", len(self.registers), len(data)-2)
+	}
+
+	copy(self.registers, data[2:])
+
+	return nil
+}
+
+// the finalizer from MurmurHash3, used to spread the bits of the FNV hash evenly
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,143 @@
+package mobius
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal(float64(0), NewHyperLogLog().Estimate())
+
+	for _, n := range []int{1, 10, 1000, 100000} {
+		set := NewHyperLogLog()
+
+		for i := 0; i < n; i++ {
+			set.Add(fmt.Sprintf("user-%d", i))
+
+			// re-adding a member does not change the estimate
+			set.Add(fmt.Sprintf("user-%d", i))
+		}
+
+		assert.InDelta(float64(n), set.Estimate(), float64(n)*0.05+1)
+	}
+}
+
+func TestHyperLogLogMergeAndEncoding(t *testing.T) {
+	assert := require.New(t)
+	a := NewHyperLogLog()
+	b := NewHyperLogLog()
+
+	for i := 0; i < 6000; i++ {
+		a.Add(fmt.Sprintf("user-%d", i))
+		b.Add(fmt.Sprintf("user-%d", i+4000))
+	}
+
+	assert.NoError(a.Merge(b))
+	assert.InDelta(10000, a.Estimate(), 500)
+
+	data, err := a.MarshalBinary()
+	assert.NoError(err)
+
+	decoded := NewHyperLogLog()
+	assert.NoError(decoded.UnmarshalBinary(data))
+	assert.Equal(a.Estimate(), decoded.Estimate())
+	assert.Error(decoded.UnmarshalBinary(data[:100]))
+
+	assert.Error(a.Merge(NewHyperLogLogWithPrecision(10)))
+}
+
+func TestHyperLogLogMetricRollup(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	// host a sees users 0-119, host b sees users 60-179; each user visits every 10s bucket of
+	// the minute they belong to
+	epoch := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for host, offset := range map[string]int{`a`: 0, `b`: 60} {
+		for i := 0; i < 120; i++ {
+			for j := 0; j < 6; j++ {
+				set := NewHyperLogLog()
+				set.Add(fmt.Sprintf("user-%d", offset+i))
+
+				m := NewMetric(`app.visitors:host=` + host)
+				m.PushUnique(epoch.Add(time.Duration(i/20)*time.Minute+time.Duration(j)*10*time.Second), set)
+				assert.NoError(database.Write(m))
+			}
+		}
+	}
+
+	metrics, err := database.Range(epoch, epoch.Add(time.Hour), `app.visitors:*`)
+	assert.NoError(err)
+	assert.Len(metrics, 2)
+
+	for _, metric := range metrics {
+		assert.Equal(UniqueType, metric.Type)
+		assert.Equal(36, len(metric.Points()))
+
+		// each 10s bucket holds the 20 users for that minute
+		assert.InDelta(20, metric.Points()[0].Value, 1)
+	}
+
+	// distinct users per minute for host a
+	perMinute := ConsolidateMetric(metrics[0], time.Minute, Sum)
+	assert.Equal(6, len(perMinute.Points()))
+
+	for _, point := range perMinute.Points() {
+		assert.InDelta(20, point.Value, 1)
+	}
+
+	// distinct users across both hosts and all buckets
+	merged := MergeMetrics(metrics, `name`)
+	assert.Len(merged, 1)
+	assert.Equal(UniqueType, merged[0].Type)
+	assert.InDelta(180, SummarizeMetric(merged[0], Sum)[0], 5)
+
+	// every reducer summarizes a distinct-count series as the count of the union of its sets
+	summary := SummarizeMetric(merged[0], Sum, Mean, Maximum, Count)
+
+	for _, value := range summary[1:] {
+		assert.Equal(summary[0], value)
+	}
+}
+
+func TestHyperLogLogAddUnique(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+	assert.NoError(Initialize(tempPath, nil))
+	defer Cleanup()
+
+	// members are gathered in memory until flushed
+	for i := 0; i < 1000; i++ {
+		AddUnique(`app.visitors`, fmt.Sprintf("user-%d", i%100))
+	}
+
+	metrics, err := Database.Range(time.Time{}, time.Now().Add(UniqueInterval), `app.visitors`)
+	assert.NoError(err)
+	assert.Empty(metrics)
+
+	FlushUnique()
+
+	metrics, err = Database.Range(time.Time{}, time.Now().Add(UniqueInterval), `app.visitors`)
+	assert.NoError(err)
+	assert.Len(metrics, 1)
+	assert.InDelta(100, SummarizeMetric(metrics[0], Sum)[0], 3)
+}
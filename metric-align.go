@@ -0,0 +1,230 @@
+package mobius
+
+import (
+	"fmt"
+	"github.com/montanaflynn/stats"
+	"math"
+	"sort"
+	"time"
+)
+
+// The most timestamps at which aligning series on a fixed step will sample them.
+var MaxAlignedPoints = 100000
+
+// How the value of a series is estimated at a time between two of its points.
+type InterpolationMethod int
+
+const (
+	// Interpolates along the line between the points on either side.
+	LinearInterpolation InterpolationMethod = iota
+
+	// Takes the value of the most recent point (a step function.)
+	PreviousInterpolation
+
+	// Takes the value of the closest point, preferring the earlier one when equidistant.
+	NearestInterpolation
+)
+
+func ParseInterpolationMethod(name string) (InterpolationMethod, error) {
+	switch name {
+	case ``, `linear`:
+		return LinearInterpolation, nil
+	case `previous`, `step`:
+		return PreviousInterpolation, nil
+	case `nearest`:
+		return NearestInterpolation, nil
+	default:
+		return LinearInterpolation, fmt.Errorf("unknown interpolation method %q", name)
+	}
+}
+
+func (self InterpolationMethod) String() string {
+	switch self {
+	case PreviousInterpolation:
+		return `previous`
+	case NearestInterpolation:
+		return `nearest`
+	default:
+		return `linear`
+	}
+}
+
+// Resamples this metric and another onto a common set of timestamps covering only the time range
+// in which both have points, estimating the value of each at every timestamp with the given
+// interpolation method.  The timestamps are multiples of step; if step is zero, they are the
+// timestamps of the points of both metrics.  Two new metrics with the same number of points are
+// returned, which will be empty if the metrics do not overlap.
+func (self *Metric) Align(other *Metric, step time.Duration, method InterpolationMethod) (*Metric, *Metric) {
+	left := NewMetric(self.GetName())
+	left.SetTags(self.GetTags())
+
+	right := NewMetric(other.GetName())
+	right.SetTags(other.GetTags())
+
+	leftPoints := sortedPoints(self.Points())
+	rightPoints := sortedPoints(other.Points())
+
+	if len(leftPoints) == 0 || len(rightPoints) == 0 {
+		return left, right
+	}
+
+	start := leftPoints[0].Timestamp
+	end := leftPoints[len(leftPoints)-1].Timestamp
+
+	if t := rightPoints[0].Timestamp; t.After(start) {
+		start = t
+	}
+
+	if t := rightPoints[len(rightPoints)-1].Timestamp; t.Before(end) {
+		end = t
+	}
+
+	for _, t := range alignmentGrid(start, end, step, leftPoints, rightPoints) {
+		left.Push(t, interpolate(leftPoints, t, method))
+		right.Push(t, interpolate(rightPoints, t, method))
+	}
+
+	return left, right
+}
+
+// Returns an error if the given step is negative, or if aligning the given metrics on it would sample
+// them at more than MaxAlignedPoints timestamps.
+func CheckAlignmentStep(metrics []*Metric, step time.Duration) error {
+	if step < 0 {
+		return fmt.Errorf("step must not be negative")
+	} else if step == 0 {
+		return nil
+	}
+
+	var first, last time.Time
+
+	for _, metric := range metrics {
+		for _, point := range metric.Points() {
+			if first.IsZero() || point.Timestamp.Before(first) {
+				first = point.Timestamp
+			}
+
+			if last.IsZero() || point.Timestamp.After(last) {
+				last = point.Timestamp
+			}
+		}
+	}
+
+	if n := last.Sub(first)/step + 1; n > time.Duration(MaxAlignedPoints) {
+		return fmt.Errorf("a step of %v would align the series at more than %d points", step, MaxAlignedPoints)
+	}
+
+	return nil
+}
+
+// Returns the distinct timestamps within [start, end] at which aligned series are sampled.  Grids on
+// a fixed step stop after MaxAlignedPoints timestamps.
+func alignmentGrid(start time.Time, end time.Time, step time.Duration, pointsets ...PointSet) []time.Time {
+	grid := make([]time.Time, 0)
+
+	if step > 0 {
+		t := start.Truncate(step)
+
+		if t.Before(start) {
+			t = t.Add(step)
+		}
+
+		for ; !t.After(end) && len(grid) < MaxAlignedPoints; t = t.Add(step) {
+			grid = append(grid, t)
+		}
+
+		return grid
+	}
+
+	for _, points := range pointsets {
+		for _, point := range points {
+			if !point.Timestamp.Before(start) && !point.Timestamp.After(end) {
+				grid = append(grid, point.Timestamp)
+			}
+		}
+	}
+
+	sort.Slice(grid, func(i, j int) bool {
+		return grid[i].Before(grid[j])
+	})
+
+	distinct := grid[:0]
+
+	for _, t := range grid {
+		if l := len(distinct); l == 0 || !distinct[l-1].Equal(t) {
+			distinct = append(distinct, t)
+		}
+	}
+
+	return distinct
+}
+
+// Estimates the value of a sorted, non-empty PointSet at the given time.  Times outside the range of
+// the points take the value of the nearest point.
+func interpolate(points PointSet, t time.Time, method InterpolationMethod) float64 {
+	i := sort.Search(len(points), func(i int) bool {
+		return !points[i].Timestamp.Before(t)
+	})
+
+	switch {
+	case i == len(points):
+		return points[i-1].Value
+	case i == 0 || points[i].Timestamp.Equal(t):
+		return points[i].Value
+	}
+
+	before := points[i-1]
+	after := points[i]
+
+	switch method {
+	case PreviousInterpolation:
+		return before.Value
+	case NearestInterpolation:
+		if after.Timestamp.Sub(t) < t.Sub(before.Timestamp) {
+			return after.Value
+		}
+
+		return before.Value
+	default:
+		fraction := float64(t.Sub(before.Timestamp)) / float64(after.Timestamp.Sub(before.Timestamp))
+		return before.Value + (after.Value-before.Value)*fraction
+	}
+}
+
+// Computes the correlation of every pair of the given metrics after aligning each pair with the
+// given step and interpolation method.  Pairs whose correlation cannot be computed (e.g. because they
+// do not overlap) are NaN.
+func CorrelateMetrics(metrics []*Metric, step time.Duration, method InterpolationMethod) [][]float64 {
+	matrix := make([][]float64, len(metrics))
+
+	for i := range metrics {
+		matrix[i] = make([]float64, len(metrics))
+	}
+
+	for i, a := range metrics {
+		for j := i; j < len(metrics); j++ {
+			left, right := a.Align(metrics[j], step, method)
+
+			if c, err := stats.Correlation(
+				stats.Float64Data(left.points.Values()),
+				stats.Float64Data(right.points.Values()),
+			); err == nil {
+				matrix[i][j] = c
+			} else {
+				matrix[i][j] = math.NaN()
+			}
+
+			matrix[j][i] = matrix[i][j]
+		}
+	}
+
+	return matrix
+}
+
+func sortedPoints(points PointSet) PointSet {
+	sorted := make(PointSet, len(points))
+	copy(sorted, points)
+	sort.Sort(sorted)
+
+	return sorted
+}
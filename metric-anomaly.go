@@ -0,0 +1,287 @@
+package mobius
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// The absolute score at or above which a point is considered anomalous.
+var DefaultAnomalyThreshold = 3.0
+
+// The fewest points a point can be compared against to be scored.
+var MinAnomalyHistory = 5
+
+// The number of trailing points each point is compared against when no window is given.
+var DefaultAnomalyWindow = 100
+
+// Scales the median absolute deviation so that scores based on it are comparable to z-scores of
+// normally distributed data.
+const madScale = 0.6745
+
+// Scores how unusual each point of a series is.
+type AnomalyDetector string
+
+const (
+	// Scores points by the number of standard deviations they lie from the mean.
+	ZScoreDetector AnomalyDetector = `zscore`
+
+	// Scores points by their distance from the median in units of the median absolute deviation,
+	// which is less affected by the anomalies themselves than the standard deviation.
+	MADDetector AnomalyDetector = `mad`
+
+	// Scores points against the values at the same time in previous seasons, using MAD scoring of
+	// the differences.
+	SeasonalDetector AnomalyDetector = `seasonal`
+)
+
+// Parses the name of an anomaly detector.  An empty name means MADDetector.
+func ParseAnomalyDetector(name string) (AnomalyDetector, error) {
+	switch detector := AnomalyDetector(strings.ToLower(name)); detector {
+	case ``:
+		return MADDetector, nil
+	case ZScoreDetector, MADDetector, SeasonalDetector:
+		return detector, nil
+	default:
+		return MADDetector, fmt.Errorf("unknown anomaly detector %q", name)
+	}
+}
+
+// Describes how anomalies are detected.
+type AnomalyOptions struct {
+	Detector AnomalyDetector
+
+	// For z-score and MAD scoring, the trailing window of points each point is compared against (not
+	// including the point itself.)  If empty, each point is compared against the DefaultAnomalyWindow
+	// points before it.  For seasonal scoring, the length of a season.
+	Window Window
+
+	// The absolute score at or above which a point is anomalous.  Defaults to
+	// DefaultAnomalyThreshold.
+	Threshold float64
+}
+
+// The result of scoring a series for anomalies.
+type Anomalies struct {
+	// The series that was scored.
+	Metric *Metric
+
+	// The score of each point.  Points that could not be scored (e.g. those with too little history)
+	// are NaN.
+	Scores *Metric
+
+	// A value of 1 for each anomalous point, and 0 otherwise.
+	Anomalous *Metric
+}
+
+// Returns the largest absolute score of any point.
+func (self *Anomalies) Severity() float64 {
+	severity := 0.0
+
+	for _, point := range self.Scores.Points() {
+		if v := math.Abs(point.Value); v > severity {
+			severity = v
+		}
+	}
+
+	return severity
+}
+
+// Returns the points of the scored series that are anomalous.
+func (self *Anomalies) Points() PointSet {
+	output := make(PointSet, 0)
+	flags := self.Anomalous.Points()
+
+	for i, point := range sortedPoints(self.Metric.Points()) {
+		if i < len(flags) && flags[i].Value != 0 {
+			output = append(output, point)
+		}
+	}
+
+	return output
+}
+
+// Scores each point of this metric using the given detector, and flags those whose absolute score is
+// at or above the threshold as anomalous.
+func (self *Metric) DetectAnomalies(options AnomalyOptions) (*Anomalies, error) {
+	threshold := options.Threshold
+
+	if threshold <= 0 {
+		threshold = DefaultAnomalyThreshold
+	}
+
+	points := sortedPoints(self.Points())
+	var scores []float64
+
+	switch options.Detector {
+	case ZScoreDetector, MADDetector, ``:
+		scores = make([]float64, len(points))
+		values := points.Values()
+		window := options.Window
+
+		if window.Points <= 0 && window.Duration <= 0 {
+			window.Points = DefaultAnomalyWindow
+		}
+
+		// the start of the trailing window only ever moves forward
+		start := 0
+
+		for i, point := range points {
+			for start < i && point.Timestamp.Sub(points[start].Timestamp) > window.Duration {
+				start++
+			}
+
+			first := i - window.Points
+
+			if first < 0 {
+				first = 0
+			}
+
+			if start < first {
+				first = start
+			}
+
+			if options.Detector == ZScoreDetector {
+				scores[i] = zScore(point.Value, values[first:i])
+			} else {
+				scores[i] = madScore(point.Value, values[first:i])
+			}
+		}
+
+	case SeasonalDetector:
+		if options.Window.Duration <= 0 {
+			return nil, fmt.Errorf("seasonal anomaly detection requires a season length")
+		}
+
+		scores = seasonalScores(points, options.Window)
+
+	default:
+		return nil, fmt.Errorf("unknown anomaly detector %q", options.Detector)
+	}
+
+	anomalies := &Anomalies{
+		Metric:    self,
+		Scores:    NewMetric(self.GetName() + `.anomaly.score`),
+		Anomalous: NewMetric(self.GetName() + `.anomaly`),
+	}
+
+	anomalies.Scores.SetTags(self.GetTags())
+	anomalies.Anomalous.SetTags(self.GetTags())
+
+	for i, point := range points {
+		anomalies.Scores.Push(point.Timestamp, scores[i])
+
+		if math.Abs(scores[i]) >= threshold {
+			anomalies.Anomalous.Push(point.Timestamp, 1)
+		} else {
+			anomalies.Anomalous.Push(point.Timestamp, 0)
+		}
+	}
+
+	return anomalies, nil
+}
+
+// Scores each of the given metrics, returning those with at least one anomalous point in descending
+// order of severity.
+func RankAnomalies(metrics []*Metric, options AnomalyOptions) ([]*Anomalies, error) {
+	output := make([]*Anomalies, 0)
+
+	for _, metric := range expandFields(metrics) {
+		if anomalies, err := metric.DetectAnomalies(options); err == nil {
+			if len(anomalies.Points()) > 0 {
+				output = append(output, anomalies)
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(output, func(i, j int) bool {
+		return output[i].Severity() > output[j].Severity()
+	})
+
+	return output, nil
+}
+
+// Scores points against the same phase of previous seasons.  The difference between each point and
+// the median of the points one or more seasons before it is MAD-scored against all such differences
+// in the series.
+func seasonalScores(points PointSet, season Window) []float64 {
+	scores := make([]float64, len(points))
+	residuals := make([]float64, len(points))
+	valid := make([]float64, 0)
+
+	var tolerance int64
+
+	if n := len(points); n > 1 {
+		tolerance = int64(points[n-1].Timestamp.Sub(points[0].Timestamp)) / int64(n-1) / 2
+	}
+
+	for i, point := range points {
+		baseline := make([]float64, 0)
+
+		for target := point.Timestamp.Add(-season.Duration); !target.Before(points[0].Timestamp.Add(-season.Duration / 2)); target = target.Add(-season.Duration) {
+			j := sort.Search(len(points), func(k int) bool {
+				return !points[k].Timestamp.Before(target)
+			})
+
+			// choose whichever neighbor of the target time is nearest
+			for _, k := range []int{j - 1, j} {
+				if k >= 0 && k < i {
+					if d := int64(points[k].Timestamp.Sub(target)); d <= tolerance && -d <= tolerance {
+						baseline = append(baseline, points[k].Value)
+						break
+					}
+				}
+			}
+		}
+
+		if len(baseline) > 0 {
+			residuals[i] = point.Value - Reduce(Median, baseline...)
+			valid = append(valid, residuals[i])
+		} else {
+			residuals[i] = math.NaN()
+		}
+	}
+
+	for i, residual := range residuals {
+		if math.IsNaN(residual) {
+			scores[i] = math.NaN()
+		} else {
+			scores[i] = madScore(residual, valid)
+		}
+	}
+
+	return scores
+}
+
+func zScore(value float64, reference []float64) float64 {
+	if len(reference) < MinAnomalyHistory {
+		return math.NaN()
+	}
+
+	return deviationScore(value-Reduce(Mean, reference...), Reduce(StandardDeviation, reference...))
+}
+
+func madScore(value float64, reference []float64) float64 {
+	if len(reference) < MinAnomalyHistory {
+		return math.NaN()
+	}
+
+	return madScale * deviationScore(value-Reduce(Median, reference...), Reduce(MedianAbsoluteDeviation, reference...))
+}
+
+// Divides a deviation by a measure of spread.  If there is no spread at all, any deviation is
+// infinitely unusual.
+func deviationScore(deviation float64, spread float64) float64 {
+	if spread == 0 {
+		if deviation == 0 {
+			return 0
+		}
+
+		return math.Inf(int(math.Copysign(1, deviation)))
+	}
+
+	return deviation / spread
+}
@@ -0,0 +1,287 @@
+package mobius
+
+import (
+	"fmt"
+	"github.com/ghetzel/go-stockutil/sliceutil"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A BinaryOperator combines the aligned values of two series.
+type BinaryOperator string
+
+const (
+	Add            BinaryOperator = `+`
+	Subtract       BinaryOperator = `-`
+	Multiply       BinaryOperator = `*`
+	Divide         BinaryOperator = `/`
+	GreaterThan    BinaryOperator = `>`
+	GreaterOrEqual BinaryOperator = `>=`
+	LessThan       BinaryOperator = `<`
+	LessOrEqual    BinaryOperator = `<=`
+	EqualTo        BinaryOperator = `==`
+	NotEqualTo     BinaryOperator = `!=`
+)
+
+// Parses an operator symbol or its name (e.g. "/" or "divide".)
+func ParseBinaryOperator(op string) (BinaryOperator, error) {
+	switch strings.ToLower(op) {
+	case `+`, `add`:
+		return Add, nil
+	case `-`, `subtract`:
+		return Subtract, nil
+	case `*`, `multiply`:
+		return Multiply, nil
+	case `/`, `divide`:
+		return Divide, nil
+	case `>`, `gt`:
+		return GreaterThan, nil
+	case `>=`, `gte`:
+		return GreaterOrEqual, nil
+	case `<`, `lt`:
+		return LessThan, nil
+	case `<=`, `lte`:
+		return LessOrEqual, nil
+	case `==`, `eq`:
+		return EqualTo, nil
+	case `!=`, `ne`:
+		return NotEqualTo, nil
+	default:
+		return ``, fmt.Errorf("unknown operator %q", op)
+	}
+}
+
+// Returns whether the operator is a comparison, which filters the left-hand series rather than
+// producing new values.
+func (self BinaryOperator) IsComparison() bool {
+	switch self {
+	case Add, Subtract, Multiply, Divide:
+		return false
+	default:
+		return true
+	}
+}
+
+// Applies the operator to a pair of values.  For comparisons, the left-hand value is returned along
+// with whether the comparison holds.  The result is not ok if it is not a finite number.
+func (self BinaryOperator) Apply(left float64, right float64) (float64, bool) {
+	var value float64
+
+	switch self {
+	case Add:
+		value = left + right
+	case Subtract:
+		value = left - right
+	case Multiply:
+		value = left * right
+	case Divide:
+		value = left / right
+	case GreaterThan:
+		return left, left > right
+	case GreaterOrEqual:
+		return left, left >= right
+	case LessThan:
+		return left, left < right
+	case LessOrEqual:
+		return left, left <= right
+	case EqualTo:
+		return left, left == right
+	case NotEqualTo:
+		return left, left != right
+	default:
+		return 0, false
+	}
+
+	return value, !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+type JoinType int
+
+const (
+	// Each series on the left is paired with exactly one series on the right, and vice versa.
+	OneToOne JoinType = iota
+
+	// Any number of series on the left may be paired with the same series on the right.
+	ManyToOne
+)
+
+// Describes how two sets of series are aligned and paired with each other.
+type JoinOptions struct {
+	Type JoinType
+
+	// The width of the intervals of the common timestamp grid both sides are aligned to (defaults to
+	// ExpressionResolution.)  Points from either side falling within the same interval are combined with
+	// Reducer (defaults to Mean), and intervals without a point on both sides are omitted.
+	Step    time.Duration
+	Reducer ReducerFunc
+
+	// Pair series whose values for only these tags are equal.  If empty, series are paired on all of
+	// their tags except those listed in Ignoring.
+	On       []string
+	Ignoring []string
+}
+
+func (self JoinOptions) key(metric *Metric) string {
+	tags := metric.GetTags()
+	pairs := make([]string, 0, len(tags))
+
+	if len(self.On) > 0 {
+		for _, name := range self.On {
+			if value, ok := tags[name]; ok {
+				pairs = append(pairs, fmt.Sprintf("%s=%v", name, value))
+			}
+		}
+	} else {
+		for name, value := range tags {
+			if !sliceutil.ContainsString(self.Ignoring, name) {
+				pairs = append(pairs, fmt.Sprintf("%s=%v", name, value))
+			}
+		}
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, InlineTagSeparator)
+}
+
+// Applies an operator to each aligned pair of points in this metric and another.  Arithmetic yields a
+// new series named "<left><op><right>" holding the result for every interval of the given width in
+// which both series have a point (intervals where the result is not a finite number, such as division
+// by zero, are omitted.)  Comparisons yield the aligned values of this metric for which the comparison
+// holds.
+// Tags are ignored; see ApplyMetrics for joining sets of series on their tags.
+func (self *Metric) Apply(op BinaryOperator, other *Metric, step time.Duration) *Metric {
+	return applyPair(op, self, other, JoinOptions{
+		Step: step,
+	})
+}
+
+// Applies an operator to every point in this metric and a constant.
+func (self *Metric) ApplyScalar(op BinaryOperator, value float64) *Metric {
+	metric := NewMetric(self.GetName())
+	metric.SetTags(self.GetTags())
+
+	for _, point := range self.Points() {
+		if v, ok := op.Apply(point.Value, value); ok {
+			metric.Push(point.Timestamp, v)
+		}
+	}
+
+	return metric
+}
+
+// Applies an operator between two sets of series, pairing each series on the left with its
+// counterpart on the right as described by the join options.  Series on the left without a
+// counterpart (or without any resulting points) are omitted, and an error is returned if the
+// pairing is ambiguous.
+func ApplyMetrics(op BinaryOperator, left []*Metric, right []*Metric, join JoinOptions) ([]*Metric, error) {
+	left = expandFields(left)
+	rightByKey := make(map[string]*Metric)
+	leftKeys := make(map[string]bool)
+	output := make([]*Metric, 0)
+
+	for _, metric := range expandFields(right) {
+		key := join.key(metric)
+
+		if _, ok := rightByKey[key]; ok {
+			return nil, fmt.Errorf("multiple series on the right-hand side match {%s}", key)
+		}
+
+		rightByKey[key] = metric
+	}
+
+	for _, metric := range left {
+		key := join.key(metric)
+
+		if join.Type == OneToOne {
+			if leftKeys[key] {
+				return nil, fmt.Errorf("multiple series on the left-hand side match {%s}; use a many-to-one join", key)
+			}
+
+			leftKeys[key] = true
+		}
+
+		if other, ok := rightByKey[key]; ok {
+			result := applyPair(op, metric, other, join)
+
+			if result.IsEmpty() {
+				continue
+			}
+
+			// one-to-one matches on a subset of tags only retain those tags
+			if join.Type == OneToOne && !op.IsComparison() {
+				tags := make(map[string]interface{})
+
+				for name, value := range metric.GetTags() {
+					if len(join.On) > 0 && sliceutil.ContainsString(join.On, name) || len(join.On) == 0 && !sliceutil.ContainsString(join.Ignoring, name) {
+						tags[name] = value
+					}
+				}
+
+				result.SetTags(tags)
+			}
+
+			output = append(output, result)
+		}
+	}
+
+	return output, nil
+}
+
+func applyPair(op BinaryOperator, left *Metric, right *Metric, join JoinOptions) *Metric {
+	name := left.GetName()
+
+	if !op.IsComparison() {
+		name = left.GetName() + string(op) + right.GetName()
+	}
+
+	metric := NewMetric(name)
+	metric.SetTags(left.GetTags())
+
+	step := join.Step
+	reducer := join.Reducer
+
+	if step <= 0 {
+		step = ExpressionResolution
+	}
+
+	if reducer == nil {
+		reducer = Mean
+	}
+
+	rightGrid := alignToGrid(right, step, reducer)
+
+	for _, point := range alignToGrid(left, step, reducer) {
+		if i := sort.Search(len(rightGrid), func(i int) bool {
+			return !rightGrid[i].Timestamp.Before(point.Timestamp)
+		}); i < len(rightGrid) && rightGrid[i].Timestamp.Equal(point.Timestamp) {
+			if value, ok := op.Apply(point.Value, rightGrid[i].Value); ok {
+				metric.Push(point.Timestamp, value)
+			}
+		}
+	}
+
+	return metric
+}
+
+// Reduces the points of a metric falling within each interval of the given width (aligned to the
+// epoch, as when consolidating) to a single point stamped at the start of the interval.
+func alignToGrid(metric *Metric, step time.Duration, reducer Reducer) PointSet {
+	output := make(PointSet, 0)
+	bucketing := TimeBucketing{
+		Size: step,
+	}
+
+	for _, bucket := range bucketing.Buckets(metric.Points()) {
+		start := bucketing.Start(bucket[0].Timestamp)
+
+		output = append(output, Point{
+			Timestamp: start,
+			Value:     newObservations(bucket).reduce(reducer, start, bucketing.Next(start)),
+		})
+	}
+
+	return output
+}
@@ -11,74 +11,202 @@ import (
 
 // Summarizes the given metric by reducing all points down to a single number. A slice of float64's
 // will be returned that is the same length as the number of reducers given, with each value corresponding
-// to its respective reducer.
-func SummarizeMetric(inputMetric *Metric, reducers ...ReducerFunc) []float64 {
+// to its respective reducer.  Time-weighted reducers are given the period from the first point to the
+// last.  Distinct-count metrics summarize to the distinct count of the union of all of their sets,
+// regardless of the reducer (as when they are consolidated.)
+func SummarizeMetric(inputMetric *Metric, reducers ...Reducer) []float64 {
 	summary := make([]float64, len(reducers))
+	points := sortedPoints(inputMetric.Points())
+
+	if len(points) == 0 {
+		return summary
+	}
+
+	start, end := points[0].Timestamp, points[len(points)-1].Timestamp
+
+	// the distinct count of a whole distinct-count series is that of the union of all of its sets
+	if inputMetric.Type == UniqueType {
+		estimate := inputMetric.Points().MergedUnique().Estimate()
+
+		for i := range reducers {
+			summary[i] = estimate
+		}
+
+		return summary
+	}
+
+	observations := newObservations(points)
 
 	for i, reducer := range reducers {
-		summary[i] = Reduce(reducer, inputMetric.Points().Values()...)
+		summary[i] = observations.reduce(reducer, start, end)
 	}
 
 	return summary
 }
 
-// Divides the points contained in given Metric into buckets spanning a given duration of time, then applies
-// a reducer function to the values in each bucket.  A new Metric is returned containing the consolidated
-// points.
-func ConsolidateMetric(inputMetric *Metric, bucketSize time.Duration, reducer ReducerFunc) *Metric {
+// Divides the points contained in given Metric into buckets spanning a given duration of time (aligned
+// to the Unix epoch), then applies a reducer function to the values in each bucket.  A new Metric is
+// returned containing the consolidated points, each timestamped with the start of its bucket.
+//
+// The sketches of sketch-valued metrics are merged within each bucket, and the reducer is applied to the
+// observations of the merged sketch.  The resulting metric retains the merged sketches, so it may itself
+// be consolidated further without losing accuracy.  Likewise, the sets of distinct-count metrics are
+// merged within each bucket; the value of each consolidated point is the distinct count of the merged
+// set, regardless of the reducer.
+//
+// Time-weighted reducers are given the points of each bucket, with the last point's value holding until
+// the end of the bucket.
+func ConsolidateMetric(inputMetric *Metric, bucketSize time.Duration, reducer Reducer) *Metric {
+	return ConsolidateMetricBuckets(inputMetric, TimeBucketing{
+		Size: bucketSize,
+	}, reducer)
+}
+
+// Works like ConsolidateMetric, except that the points are divided into buckets according to the
+// given bucketing (e.g. calendar days in a particular time zone.)
+func ConsolidateMetricBuckets(inputMetric *Metric, bucketing TimeBucketing, reducer Reducer) *Metric {
 	// clears the points out of the input metric, and returns a copy of the old PointSet
 	metric := NewMetric(inputMetric.GetName())
 	metric.SetTags(inputMetric.GetTags())
 
-	// divide the old PointSet into buckets that are bucketSize wide
-	for _, bucket := range MakeTimeBuckets(inputMetric.Points(), bucketSize) {
-		// consolidate the bucket values according to the given reducer function
-		consolidatedValue := Reduce(reducer, bucket.Values()...)
+	// integer series stay integers if the reducer has an exact integer implementation
+	valueReducer, _ := reducer.(ReducerFunc)
+	integerReducer, isInteger := GetIntegerReducer(valueReducer)
+	isInteger = (isInteger && inputMetric.Type == IntegerType)
+
+	if isInteger {
+		metric.Type = IntegerType
+	}
+
+	// divide the old PointSet into buckets
+	for _, bucket := range bucketing.Buckets(inputMetric.Points()) {
+		start := bucketing.Start(bucket[0].Timestamp)
+		end := bucketing.Next(start)
+
+		if inputMetric.Type == SketchType {
+			merged := bucket.MergedSketch()
+
+			metric.Type = SketchType
+			metric.push(Point{
+				Timestamp: start,
+				Value:     newSketchObservations(bucket, merged).reduce(reducer, start, end),
+				Sketch:    merged,
+				Type:      SketchType,
+			})
+		} else if inputMetric.Type == UniqueType {
+			metric.PushUnique(start, bucket.MergedUnique())
+		} else if inputMetric.Type == FieldsType {
+			// multi-field points have each of their fields consolidated independently
+			fields := make(map[string]float64)
+
+			for _, field := range bucket.FieldNames() {
+				fieldPoints := bucket.FieldPoints(field)
+				fields[field] = reduceValues(reducer, fieldPoints, fieldPoints.Values(), start, end)
+			}
+
+			metric.PushFields(start, fields)
+		} else if isInteger {
+			metric.PushInt(start, ReduceInteger(integerReducer, bucket.Integers()...))
+		} else {
+			// consolidate the bucket values according to the given reducer function
+			consolidatedValue := reduceValues(reducer, bucket, bucket.Values(), start, end)
 
-		// push the consolidated point to our metric
-		metric.Push(bucket.Newest().Timestamp, consolidatedValue)
+			// push the consolidated point to our metric
+			metric.Push(start, consolidatedValue)
+		}
 	}
 
 	return metric
 }
 
-// Takes multiple input metrics and produces a set of metrics grouped by the given
-// name or tag name, with all metrics in like groups being merged together such that all
-// of the original points are in the same series.
-func MergeMetrics(metrics []*Metric, groupBy string) []*Metric {
-	output := make([]*Metric, 0)
-	groupNamePairs := make(map[string]string)
-	groupTags := make(map[string]map[string]interface{})
-	groups := make(map[string][]*Metric)
+// The observations represented by a set of points.  Sketches are merged, and are only expanded into
+// the observations they summarize for reducers that need them; quantiles are answered from the merged
+// sketch itself.
+type observations struct {
+	points PointSet
+	sketch *Sketch
+	values []float64
+}
 
-	// split the input metrics into groups keyed on the field named in groupBy
-	for _, metric := range metrics {
-		var current []*Metric
-		var currentGroup string
+func newObservations(points PointSet) *observations {
+	for _, point := range points {
+		if point.Type == SketchType && point.Sketch != nil {
+			return newSketchObservations(points, points.MergedSketch())
+		}
+	}
 
-		switch groupBy {
-		case `name`:
-			currentGroup = metric.GetName()
-		case `unique`:
-			currentGroup = metric.GetUniqueName()
-		default:
-			if tagValue := metric.GetTag(groupBy); tagValue != nil {
-				currentGroup = fmt.Sprintf("tag:%v:%v", groupBy, tagValue)
-			} else {
-				currentGroup = ``
+	return &observations{
+		points: points,
+		values: points.Values(),
+	}
+}
+
+func newSketchObservations(points PointSet, merged *Sketch) *observations {
+	observations := &observations{
+		points: points,
+		sketch: merged,
+	}
+
+	// points that aren't sketches are counted as single observations
+	for _, point := range points {
+		if point.Type != SketchType || point.Sketch == nil {
+			observations.sketch = merged.Clone()
+
+			for _, point := range points {
+				if point.Type != SketchType || point.Sketch == nil {
+					observations.sketch.Add(point.Value)
+				}
 			}
-		}
 
-		if c, ok := groups[currentGroup]; ok {
-			current = c
-		} else {
-			current = make([]*Metric, 0)
+			break
 		}
+	}
+
+	return observations
+}
 
-		current = append(current, metric)
-		groups[currentGroup] = current
+func (self *observations) reduce(reducer Reducer, start time.Time, end time.Time) float64 {
+	if q, ok := reducer.(quantileReducer); ok && self.sketch != nil {
+		return self.sketch.Quantile(q.quantile)
+	} else if self.values == nil {
+		self.values = self.sketch.Values()
 	}
 
+	return reduceValues(reducer, self.points, self.values, start, end)
+}
+
+// Applies a reducer to the given values, unless it is time-weighted, in which case it is applied to
+// the points they came from.
+func reduceValues(reducer Reducer, points PointSet, values []float64, start time.Time, end time.Time) float64 {
+	switch fn := reducer.(type) {
+	case ReducerFunc:
+		return Reduce(fn, values...)
+	case quantileReducer:
+		return Reduce(fn.fn, values...)
+	default:
+		return reducer.ReducePoints(points, start, end)
+	}
+}
+
+// Takes multiple input metrics and produces a set of metrics grouped by the given
+// name or tag name(s), with all metrics in like groups being merged together such that all
+// of the original points are in the same series.  Several tag names may be given separated
+// by commas (e.g. "region,env"), in which case metrics are grouped by the combination of
+// their values for those tags.
+//
+// If a reducer is given, the series in each group are instead combined point-by-point with it
+// (e.g. summed across hosts at each time) as AggregateMetrics does, in ExpressionResolution-wide
+// intervals.
+func MergeMetrics(metrics []*Metric, groupBy string, reducer ...Reducer) []*Metric {
+	if len(reducer) > 0 {
+		return AggregateMetrics(metrics, groupBy, ExpressionResolution, reducer[0])
+	}
+
+	output := make([]*Metric, 0)
+	groupNamePairs := make(map[string]string)
+	groupTags := make(map[string]map[string]interface{})
+	groups := groupMetrics(metrics, groupBy)
+
 	// figure out what the merged metric name and tags should look like for each group
 	for group, groupMetrics := range groups {
 		names := make([]string, 0)
@@ -109,12 +237,31 @@ func MergeMetrics(metrics []*Metric, groupBy string) []*Metric {
 					mergedMetric.SetTags(v)
 				}
 
+				// the merged series retains its value type only if all of its inputs share it
+				mergedMetric.Type = metrics[0].Type
+
 				for _, m := range metrics {
-					mergedMetric.points = append(mergedMetric.points, m.points...)
+					if m.Type != mergedMetric.Type {
+						mergedMetric.Type = FloatType
+					}
+				}
+
+				for _, m := range metrics {
+					for _, point := range m.points {
+						if p, err := point.As(mergedMetric.Type); err == nil {
+							mergedMetric.points = append(mergedMetric.points, p)
+						}
+					}
 				}
 
 				if !mergedMetric.IsEmpty() {
 					sort.Sort(mergedMetric.points)
+
+					// sketches and sets observed at the same time are merged into a single point
+					if isMergeableType(mergedMetric.Type) {
+						mergedMetric.points = mergeCoincidentPoints(mergedMetric.points)
+					}
+
 					output = append(output, mergedMetric)
 				}
 			}
@@ -123,3 +270,173 @@ func MergeMetrics(metrics []*Metric, groupBy string) []*Metric {
 
 	return output
 }
+
+// Splits the given metrics into groups keyed on the name, unique name, or values of the tag(s)
+// named in groupBy.  Metrics that have none of the named tags are grouped together.
+func groupMetrics(metrics []*Metric, groupBy string) map[string][]*Metric {
+	groups := make(map[string][]*Metric)
+
+	for _, metric := range metrics {
+		var currentGroup string
+
+		switch groupBy {
+		case `name`:
+			currentGroup = metric.GetName()
+		case `unique`:
+			currentGroup = metric.GetUniqueName()
+		default:
+			pairs := make([]string, 0)
+
+			for _, tag := range strings.Split(groupBy, `,`) {
+				if tagValue := metric.GetTag(tag); tagValue != nil {
+					pairs = append(pairs, fmt.Sprintf("%v:%v", tag, tagValue))
+				}
+			}
+
+			if len(pairs) > 0 {
+				currentGroup = `tag:` + strings.Join(pairs, `,`)
+			}
+		}
+
+		groups[currentGroup] = append(groups[currentGroup], metric)
+	}
+
+	return groups
+}
+
+// Groups the given metrics as MergeMetrics does, then combines the series in each group into a
+// single series by reducing the values of all series within each interval of the given width.
+// Each series is first consolidated into the intervals with the reducer, then the values of all of
+// the series in each interval are reduced again (so that e.g. the "sum" of ten hosts is the sum of
+// their values at each time, not an interleaving of their points.)  Sketches and distinct-count sets
+// are instead merged across series within each interval.  Time-weighted reducers are applied to the
+// points of each series within an interval, and the results for the series are averaged.
+//
+// Intervals are aligned to the epoch (as in ConsolidateMetric) and points are stamped at the start
+// of their interval.  The name of each resulting series is the longest common prefix of the names in
+// its group, and it is tagged only with the tags that all of the series in its group have in common.
+func AggregateMetrics(metrics []*Metric, groupBy string, step time.Duration, reducer Reducer) []*Metric {
+	output := make([]*Metric, 0)
+	groups := groupMetrics(expandFields(metrics), groupBy)
+	keys := maputil.StringKeys(groups)
+	sort.Strings(keys)
+
+	if step <= 0 {
+		step = ExpressionResolution
+	}
+
+	bucketing := TimeBucketing{
+		Size: step,
+	}
+
+	// time-weighted values of different series all hold for the whole interval
+	acrossSeries := reducer
+
+	if _, ok := reducer.(TimeReducerFunc); ok {
+		acrossSeries = Mean
+	}
+
+	for _, key := range keys {
+		members := groups[key]
+		names := make([]string, 0, len(members))
+		buckets := make(map[int64]PointSet)
+		valueType := members[0].Type
+
+		for _, metric := range members {
+			names = append(names, metric.GetName())
+
+			if metric.Type != valueType {
+				valueType = FloatType
+			}
+		}
+
+		merged := NewMetric(strings.Trim(stringutil.LongestCommonPrefix(names), `.,`))
+
+		// keep only the tags that all series in the group agree on
+		for tag, value := range members[0].GetTags() {
+			shared := true
+
+			for _, metric := range members[1:] {
+				if fmt.Sprintf("%v", metric.GetTag(tag)) != fmt.Sprintf("%v", value) {
+					shared = false
+					break
+				}
+			}
+
+			if shared {
+				merged.SetTag(tag, value)
+			}
+		}
+
+		for _, metric := range members {
+			if isMergeableType(valueType) {
+				// sketches and sets are merged in their entirety rather than reduced per series
+				for _, point := range metric.Points() {
+					t := bucketing.Start(point.Timestamp).UnixNano()
+					buckets[t] = append(buckets[t], point)
+				}
+			} else {
+				for _, point := range alignToGrid(metric, step, reducer) {
+					t := point.Timestamp.UnixNano()
+					buckets[t] = append(buckets[t], point)
+				}
+			}
+		}
+
+		times := make([]int64, 0, len(buckets))
+
+		for t := range buckets {
+			times = append(times, t)
+		}
+
+		sort.Slice(times, func(i, j int) bool {
+			return times[i] < times[j]
+		})
+
+		for _, t := range times {
+			bucket := buckets[t]
+			timestamp := time.Unix(0, t)
+			end := bucketing.Next(timestamp)
+
+			switch valueType {
+			case SketchType:
+				sketch := bucket.MergedSketch()
+
+				merged.Type = SketchType
+				merged.push(Point{
+					Timestamp: timestamp,
+					Value:     newSketchObservations(bucket, sketch).reduce(reducer, timestamp, end),
+					Sketch:    sketch,
+					Type:      SketchType,
+				})
+			case UniqueType:
+				merged.PushUnique(timestamp, bucket.MergedUnique())
+			default:
+				merged.Push(timestamp, reduceValues(acrossSeries, bucket, bucket.Values(), timestamp, end))
+			}
+		}
+
+		if !merged.IsEmpty() {
+			output = append(output, merged)
+		}
+	}
+
+	return output
+}
+
+// Merges consecutive points of a mergeable type that share a timestamp in a sorted PointSet.
+func mergeCoincidentPoints(points PointSet) PointSet {
+	output := make(PointSet, 0, len(points))
+
+	for _, point := range points {
+		if l := len(output); l > 0 && output[l-1].Timestamp.Equal(point.Timestamp) {
+			if merged, err := mergePoints(output[l-1], point); err == nil {
+				output[l-1] = merged
+			}
+		} else {
+			output = append(output, point)
+		}
+	}
+
+	return output
+}
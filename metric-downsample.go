@@ -0,0 +1,215 @@
+package mobius
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Determines which points are kept when a series is reduced to fewer points for display.
+type DownsampleMethod string
+
+const (
+	// Largest-Triangle-Three-Buckets: keeps the point of each bucket that forms the largest triangle
+	// with the point kept from the previous bucket and the average of the next bucket, which
+	// preserves the visual shape of the series (including its peaks) with one point per bucket.
+	LTTBDownsampling DownsampleMethod = `lttb`
+
+	// Keeps the smallest and largest points of each bucket, so that no extreme is ever lost at the
+	// cost of using two points per bucket.
+	MinMaxDownsampling DownsampleMethod = `minmax`
+)
+
+// Parses the name of a downsampling method.  An empty name means LTTBDownsampling.
+func ParseDownsampleMethod(name string) (DownsampleMethod, error) {
+	switch method := DownsampleMethod(strings.ToLower(name)); method {
+	case ``:
+		return LTTBDownsampling, nil
+	case LTTBDownsampling, MinMaxDownsampling:
+		return method, nil
+	default:
+		return LTTBDownsampling, fmt.Errorf("unknown downsampling method %q", name)
+	}
+}
+
+// Reduces this metric to at most the given number of points using the given method, choosing which of
+// the original points to keep rather than averaging them (as Consolidate does), so that peaks and
+// troughs survive.  Gaps (NaN values) spanning a whole bucket are kept.  If the metric already has few
+// enough points, or has multiple fields, it is returned as-is.
+func (self *Metric) Downsample(maxPoints int, method DownsampleMethod) *Metric {
+	points := sortedPoints(self.Points())
+
+	if maxPoints <= 0 || len(points) <= maxPoints || self.Type == FieldsType {
+		return self
+	}
+
+	var sampled PointSet
+
+	switch method {
+	case MinMaxDownsampling:
+		sampled = minMaxPoints(points, maxPoints)
+	default:
+		sampled = lttbPoints(points, maxPoints)
+	}
+
+	metric := NewMetric(self.GetName())
+	metric.SetTags(self.GetTags())
+	metric.Type = self.Type
+
+	for k, v := range self.Metadata {
+		metric.Metadata[k] = v
+	}
+
+	for _, point := range sampled {
+		metric.push(point)
+	}
+
+	return metric
+}
+
+// Downsamples each of the given metrics (see Downsample.)
+func DownsampleMetrics(metrics []*Metric, maxPoints int, method DownsampleMethod) []*Metric {
+	output := make([]*Metric, len(metrics))
+
+	for i, metric := range metrics {
+		output[i] = metric.Downsample(maxPoints, method)
+	}
+
+	return output
+}
+
+// Selects n points (at least three) from the given sorted points using Largest-Triangle-Three-Buckets.
+// The first and last points are always kept, and the rest are divided into n-2 buckets.
+func lttbPoints(points PointSet, n int) PointSet {
+	if n < 3 {
+		n = 3
+	}
+
+	if len(points) <= n {
+		return points
+	}
+
+	// times are measured in seconds from the first point to keep the areas within float precision
+	first := points[0].Timestamp
+	x := func(i int) float64 {
+		return points[i].Timestamp.Sub(first).Seconds()
+	}
+
+	sampled := make(PointSet, 0, n)
+	sampled = append(sampled, points[0])
+
+	every := float64(len(points)-2) / float64(n-2)
+	a := 0
+
+	for i := 0; i < n-2; i++ {
+		// the average of the next bucket (or the last point, for the last bucket)
+		nextStart := int(math.Floor(float64(i+1)*every)) + 1
+		nextEnd := int(math.Floor(float64(i+2)*every)) + 1
+
+		if nextEnd > len(points) {
+			nextEnd = len(points)
+		}
+
+		var avgX, avgY float64
+		var count int
+
+		for j := nextStart; j < nextEnd; j++ {
+			if !math.IsNaN(points[j].Value) {
+				avgX += x(j)
+				avgY += points[j].Value
+				count++
+			}
+		}
+
+		if count > 0 {
+			avgX /= float64(count)
+			avgY /= float64(count)
+		} else {
+			avgX = x(len(points) - 1)
+			avgY = points[len(points)-1].Value
+		}
+
+		// the point of this bucket forming the largest triangle; buckets with no values at all keep a
+		// gap, and a NaN neighbor leaves the first value of the bucket
+		start := int(math.Floor(float64(i)*every)) + 1
+		end := int(math.Floor(float64(i+1)*every)) + 1
+		chosen := -1
+		maxArea := -1.0
+		ax, ay := x(a), points[a].Value
+
+		for j := start; j < end; j++ {
+			if math.IsNaN(points[j].Value) {
+				continue
+			} else if chosen < 0 {
+				chosen = j
+			}
+
+			area := math.Abs((ax-avgX)*(points[j].Value-ay)-(ax-x(j))*(avgY-ay)) / 2
+
+			if area > maxArea {
+				maxArea = area
+				chosen = j
+			}
+		}
+
+		if chosen < 0 {
+			chosen = start
+		}
+
+		sampled = append(sampled, points[chosen])
+		a = chosen
+	}
+
+	return append(sampled, points[len(points)-1])
+}
+
+// Selects at most n points from the given sorted points by dividing them into n/2 buckets and keeping
+// the smallest and largest points of each, in time order.
+func minMaxPoints(points PointSet, n int) PointSet {
+	buckets := n / 2
+
+	if buckets < 1 {
+		buckets = 1
+	}
+
+	size := float64(len(points)) / float64(buckets)
+	sampled := make(PointSet, 0, 2*buckets)
+
+	for b := 0; b < buckets; b++ {
+		start := int(math.Floor(float64(b) * size))
+		end := int(math.Floor(float64(b+1) * size))
+
+		if b == buckets-1 {
+			end = len(points)
+		}
+
+		min, max := -1, -1
+
+		for j := start; j < end; j++ {
+			if v := points[j].Value; math.IsNaN(v) {
+				continue
+			} else if min < 0 {
+				min, max = j, j
+			} else if v < points[min].Value {
+				min = j
+			} else if v > points[max].Value {
+				max = j
+			}
+		}
+
+		switch {
+		case min < 0:
+			if start < end {
+				sampled = append(sampled, points[start])
+			}
+		case min == max:
+			sampled = append(sampled, points[min])
+		case min < max:
+			sampled = append(sampled, points[min], points[max])
+		default:
+			sampled = append(sampled, points[max], points[min])
+		}
+	}
+
+	return sampled
+}
@@ -0,0 +1,133 @@
+package mobius
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// The most buckets that filling a series will produce.
+var MaxFilledBuckets = 100000
+
+// Determines the values given to buckets that contain no points.
+type FillPolicy string
+
+const (
+	// Empty buckets are omitted.
+	FillNone FillPolicy = `none`
+
+	// Empty buckets are given a value of NaN, which is encoded as null in JSON.
+	FillNull FillPolicy = `null`
+
+	// Empty buckets are given a value of zero.
+	FillZero FillPolicy = `zero`
+
+	// Empty buckets are given the value of the last non-empty bucket before them.
+	FillPrevious FillPolicy = `previous`
+
+	// Empty buckets are given values interpolated between the non-empty buckets on either side.
+	FillLinear FillPolicy = `linear`
+)
+
+// Parses the name of a fill policy.  An empty name means FillNone, and "nan" is accepted as an alias
+// of FillNull.
+func ParseFillPolicy(name string) (FillPolicy, error) {
+	switch policy := FillPolicy(strings.ToLower(name)); policy {
+	case ``:
+		return FillNone, nil
+	case `nan`:
+		return FillNull, nil
+	case FillNone, FillNull, FillZero, FillPrevious, FillLinear:
+		return policy, nil
+	default:
+		return FillNone, fmt.Errorf("unknown fill policy %q", name)
+	}
+}
+
+// Adds a point at the start of every bucket of the given bucketing from start to end that this
+// (already consolidated) metric has no point in, with values given by the fill policy.  If start or
+// end are zero, the metric's oldest or newest point is used instead.  Buckets that cannot be filled
+// from neighboring values (e.g. those before the first point with FillPrevious) are filled with NaN.
+//
+// Only single-valued metrics are filled; others are returned as-is.
+func (self *Metric) FillBuckets(bucketing TimeBucketing, policy FillPolicy, start time.Time, end time.Time) *Metric {
+	if policy == FillNone || self.IsEmpty() {
+		return self
+	}
+
+	switch self.Type {
+	case FloatType, IntegerType:
+	default:
+		return self
+	}
+
+	points := sortedPoints(self.Points())
+
+	if start.IsZero() {
+		start = points[0].Timestamp
+	}
+
+	if end.IsZero() {
+		end = points[len(points)-1].Timestamp
+	}
+
+	metric := NewMetric(self.GetName())
+	metric.SetTags(self.GetTags())
+	metric.Type = self.Type
+
+	for k, v := range self.Metadata {
+		metric.Metadata[k] = v
+	}
+
+	var previous *Point
+	i := 0
+
+	for t, n := bucketing.Start(start), 0; !t.After(end) && n < MaxFilledBuckets; n++ {
+		filled := false
+
+		for i < len(points) && !bucketing.Start(points[i].Timestamp).After(t) {
+			if bucketing.Start(points[i].Timestamp).Equal(t) {
+				filled = true
+			}
+
+			metric.PushPoint(points[i])
+			previous = &points[i]
+			i++
+		}
+
+		if !filled {
+			value := math.NaN()
+
+			switch policy {
+			case FillZero:
+				value = 0
+			case FillPrevious:
+				if previous != nil {
+					value = previous.Value
+				}
+			case FillLinear:
+				if previous != nil && i < len(points) {
+					next := points[i]
+					ratio := float64(t.Sub(previous.Timestamp)) / float64(next.Timestamp.Sub(previous.Timestamp))
+					value = previous.Value + ratio*(next.Value-previous.Value)
+				}
+			}
+
+			metric.Push(t, value)
+		}
+
+		// stop if the bucketing cannot advance any further
+		if next := bucketing.Next(t); next.After(t) {
+			t = next
+		} else {
+			break
+		}
+	}
+
+	for ; i < len(points); i++ {
+		metric.PushPoint(points[i])
+	}
+
+	return metric
+}
@@ -0,0 +1,172 @@
+package mobius
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// The default smoothing factors of Holt-Winters forecasts.
+var DefaultForecastAlpha = 0.5
+var DefaultForecastBeta = 0.1
+var DefaultForecastGamma = 0.3
+
+// The default width of forecast confidence bands, in standard deviations of the model's errors.
+var DefaultForecastDeviations = 2.0
+
+// Describes a Holt-Winters (triple exponential smoothing) forecast.
+type ForecastOptions struct {
+	// The length of one season, as either a duration or a number of points.  Seasons shorter than
+	// two points disable seasonality.
+	Season Window
+
+	// The number of intervals to project beyond the last point.
+	Ahead int
+
+	// Smoothing factors (0-1) for the level, trend, and seasonal components.  Zero values take the
+	// package defaults.
+	Alpha float64
+	Beta  float64
+	Gamma float64
+
+	// The half-width of the confidence bands, in standard deviations.
+	Deviations float64
+}
+
+// The result of forecasting a series: the projected values and the upper and lower bounds of their
+// confidence band.  Each starts at the last point of the forecasted series.
+type Forecast struct {
+	Forecast *Metric
+	Upper    *Metric
+	Lower    *Metric
+}
+
+// Returns the forecast and its confidence bands as a list of metrics.
+func (self *Forecast) Metrics() []*Metric {
+	return []*Metric{self.Forecast, self.Upper, self.Lower}
+}
+
+// Projects this metric forward using additive Holt-Winters (triple exponential smoothing.)  The metric
+// is assumed to have regularly spaced points (e.g. as produced by Consolidate), whose average spacing
+// is the interval of the projected points.  At least two seasons of points are required.
+//
+// The confidence bands are the given number of standard deviations of the model's one-step errors
+// either side of the forecast, widening with the square root of the distance ahead.
+func (self *Metric) HoltWinters(options ForecastOptions) (*Forecast, error) {
+	points := sortedPoints(self.Points())
+	values := points.Values()
+	n := len(values)
+
+	alpha := forecastFactor(options.Alpha, DefaultForecastAlpha)
+	beta := forecastFactor(options.Beta, DefaultForecastBeta)
+	gamma := forecastFactor(options.Gamma, DefaultForecastGamma)
+	deviations := forecastFactor(options.Deviations, DefaultForecastDeviations)
+
+	for _, factor := range []float64{alpha, beta, gamma} {
+		if factor < 0 || factor > 1 {
+			return nil, fmt.Errorf("smoothing factors must be between 0 and 1")
+		}
+	}
+
+	if options.Ahead < 1 {
+		return nil, fmt.Errorf("must forecast at least one interval ahead")
+	} else if n < 2 {
+		return nil, fmt.Errorf("at least two points are required to forecast")
+	}
+
+	interval := points[n-1].Timestamp.Sub(points[0].Timestamp) / time.Duration(n-1)
+
+	if interval <= 0 {
+		return nil, fmt.Errorf("points must span a period of time to forecast")
+	}
+
+	season := options.Season.Points
+
+	if options.Season.Duration > 0 {
+		season = int(options.Season.Duration / interval)
+	}
+
+	if season < 2 {
+		season = 1
+		gamma = 0
+	}
+
+	if n < 2*season {
+		return nil, fmt.Errorf("at least two seasons (%d points) are required to forecast, got %d", 2*season, n)
+	}
+
+	// initialize from the first two seasons, taking the level to be that at the end of the first
+	// season and the seasonal components to be the detrended deviations from it
+	first := Reduce(Mean, values[:season]...)
+	second := Reduce(Mean, values[season:2*season]...)
+	trend := (second - first) / float64(season)
+	middle := float64(season-1) / 2
+	level := first + trend*middle
+	seasonal := make([]float64, season)
+
+	for i := 0; i < season; i++ {
+		seasonal[i] = values[i] - (first + trend*(float64(i)-middle))
+	}
+
+	errors := make([]float64, 0, n)
+
+	for t := season; t < n; t++ {
+		value := values[t]
+		s := seasonal[t%season]
+
+		errors = append(errors, value-(level+trend+s))
+
+		previousLevel := level
+		level = alpha*(value-s) + (1-alpha)*(level+trend)
+		trend = beta*(level-previousLevel) + (1-beta)*trend
+		seasonal[t%season] = gamma*(value-level) + (1-gamma)*s
+	}
+
+	var sigma float64
+
+	if len(errors) > 1 {
+		sigma = Reduce(StandardDeviation, errors...)
+	}
+
+	last := points[n-1]
+	forecast := &Forecast{
+		Forecast: self.forecastMetric(`forecast`),
+		Upper:    self.forecastMetric(`forecast.upper`),
+		Lower:    self.forecastMetric(`forecast.lower`),
+	}
+
+	forecast.Forecast.Metadata[`forecast`] = true
+	forecast.Upper.Metadata[`band`] = `upper`
+	forecast.Lower.Metadata[`band`] = `lower`
+
+	for _, metric := range forecast.Metrics() {
+		metric.Push(last.Timestamp, last.Value)
+	}
+
+	for h := 1; h <= options.Ahead; h++ {
+		tm := last.Timestamp.Add(time.Duration(h) * interval)
+		value := level + float64(h)*trend + seasonal[(n+h-1)%season]
+		width := deviations * sigma * math.Sqrt(float64(h))
+
+		forecast.Forecast.Push(tm, value)
+		forecast.Upper.Push(tm, value+width)
+		forecast.Lower.Push(tm, value-width)
+	}
+
+	return forecast, nil
+}
+
+func (self *Metric) forecastMetric(suffix string) *Metric {
+	metric := NewMetric(self.GetName() + `.` + suffix)
+	metric.SetTags(self.GetTags())
+
+	return metric
+}
+
+func forecastFactor(value float64, fallback float64) float64 {
+	if value == 0 {
+		return fallback
+	}
+
+	return value
+}
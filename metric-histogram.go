@@ -0,0 +1,355 @@
+package mobius
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The number of buckets in a histogram when none is given.
+var DefaultHistogramBuckets = 10
+
+// The most buckets a histogram may have.
+var MaxHistogramBuckets = 10000
+
+// Determines how the boundaries of histogram buckets are spaced.
+type HistogramScale string
+
+const (
+	// Buckets of equal width.
+	LinearHistogram HistogramScale = `linear`
+
+	// Buckets whose boundaries grow by a constant factor, for values spanning orders of magnitude.
+	LogHistogram HistogramScale = `log`
+)
+
+// Describes the buckets of a histogram.  If Boundaries are given, they are used as-is; otherwise the
+// given number of buckets are spaced according to the scale between Min and Max.  A Min or Max that
+// is NaN (or both, if both are zero) is taken from the smallest or largest value, or the smallest
+// positive value for log scales.
+type HistogramOptions struct {
+	Scale      HistogramScale
+	Buckets    int
+	Min        float64
+	Max        float64
+	Boundaries []float64
+}
+
+// A count of the values falling within [Lower, Upper).  The last bucket of a histogram also includes
+// its upper boundary.
+type HistogramBucket struct {
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+	Count int     `json:"count"`
+}
+
+// The distribution of the values of a series.  Values outside the range of the buckets are counted
+// in Underflow and Overflow.
+type Histogram struct {
+	Name      string                 `json:"name"`
+	Tags      map[string]interface{} `json:"tags,omitempty"`
+	Buckets   []HistogramBucket      `json:"buckets"`
+	Underflow int                    `json:"underflow"`
+	Overflow  int                    `json:"overflow"`
+}
+
+// Returns the total number of values counted in the histogram's buckets.
+func (self *Histogram) Count() int {
+	total := 0
+
+	for _, bucket := range self.Buckets {
+		total += bucket.Count
+	}
+
+	return total
+}
+
+// Parses a comma-separated list of bucket boundaries, which must be in increasing order.
+func ParseHistogramBoundaries(spec string) ([]float64, error) {
+	boundaries := make([]float64, 0)
+
+	for _, part := range strings.Split(spec, `,`) {
+		if v, err := strconv.ParseFloat(strings.TrimSpace(part), 64); err == nil {
+			boundaries = append(boundaries, v)
+		} else {
+			return nil, fmt.Errorf("invalid bucket boundary %q", part)
+		}
+	}
+
+	if err := checkBoundaries(boundaries); err != nil {
+		return nil, err
+	}
+
+	return boundaries, nil
+}
+
+// Computes the bucket boundaries described by these options for the given values.
+func (self HistogramOptions) BoundariesFor(values []float64) ([]float64, error) {
+	if len(self.Boundaries) > MaxHistogramBuckets+1 {
+		return nil, fmt.Errorf("histograms may have at most %d buckets", MaxHistogramBuckets)
+	} else if len(self.Boundaries) > 0 {
+		return self.Boundaries, checkBoundaries(self.Boundaries)
+	}
+
+	n := self.Buckets
+
+	if n <= 0 {
+		n = DefaultHistogramBuckets
+	} else if n > MaxHistogramBuckets {
+		return nil, fmt.Errorf("histograms may have at most %d buckets", MaxHistogramBuckets)
+	}
+
+	min, max := self.Min, self.Max
+
+	if min == 0 && max == 0 {
+		min, max = math.NaN(), math.NaN()
+	}
+
+	if findMin, findMax := math.IsNaN(min), math.IsNaN(max); findMin || findMax {
+		low, high := math.Inf(1), math.Inf(-1)
+
+		for _, v := range values {
+			if math.IsNaN(v) || (self.Scale == LogHistogram && v <= 0) {
+				continue
+			}
+
+			low = math.Min(low, v)
+			high = math.Max(high, v)
+		}
+
+		if math.IsInf(low, 1) {
+			return nil, fmt.Errorf("no values to compute histogram buckets from")
+		}
+
+		switch {
+		case findMin && findMax:
+			min, max = low, high
+
+			if min == max {
+				max = min + 1
+			}
+		case findMin:
+			if min = low; min >= max {
+				min = max - 1
+			}
+		default:
+			if max = high; max <= min {
+				max = min + 1
+			}
+		}
+	}
+
+	if max <= min {
+		return nil, fmt.Errorf("histogram maximum must be greater than the minimum")
+	}
+
+	boundaries := make([]float64, n+1)
+
+	switch self.Scale {
+	case LinearHistogram, ``:
+		for i := range boundaries {
+			boundaries[i] = min + (max-min)*float64(i)/float64(n)
+		}
+
+	case LogHistogram:
+		if min <= 0 {
+			return nil, fmt.Errorf("logarithmic histograms require a positive minimum")
+		}
+
+		for i := range boundaries {
+			boundaries[i] = min * math.Pow(max/min, float64(i)/float64(n))
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown histogram scale %q", self.Scale)
+	}
+
+	// avoid rounding error excluding the largest value
+	boundaries[n] = max
+
+	return boundaries, nil
+}
+
+// Counts the values of this metric falling within each of the buckets described by the given options.
+// Sketch-valued metrics contribute the observations of their sketches, counted a bucket at a time.
+func (self *Metric) Histogram(options HistogramOptions) (*Histogram, error) {
+	observations := self.Points().weightedObservations()
+
+	if boundaries, err := options.BoundariesFor(observedValues(observations)); err == nil {
+		return makeHistogram(self, boundaries, observations), nil
+	} else {
+		return nil, err
+	}
+}
+
+// Computes the histograms of each of the given metrics.  Unless explicit boundaries are given, the
+// boundaries are computed from the values of all of the metrics, so that the histograms are
+// comparable with one another.
+func HistogramMetrics(metrics []*Metric, options HistogramOptions) ([]*Histogram, error) {
+	metrics = expandFields(metrics)
+	observations := make([][]sketchBucket, len(metrics))
+	all := make([]float64, 0)
+
+	for i, metric := range metrics {
+		observations[i] = metric.Points().weightedObservations()
+		all = append(all, observedValues(observations[i])...)
+	}
+
+	boundaries, err := options.BoundariesFor(all)
+
+	if err != nil {
+		return nil, err
+	}
+
+	output := make([]*Histogram, len(metrics))
+
+	for i, metric := range metrics {
+		output[i] = makeHistogram(metric, boundaries, observations[i])
+	}
+
+	return output, nil
+}
+
+func makeHistogram(metric *Metric, boundaries []float64, observations []sketchBucket) *Histogram {
+	histogram := &Histogram{
+		Name:    metric.GetName(),
+		Tags:    metric.GetTags(),
+		Buckets: make([]HistogramBucket, len(boundaries)-1),
+	}
+
+	for i := range histogram.Buckets {
+		histogram.Buckets[i].Lower = boundaries[i]
+		histogram.Buckets[i].Upper = boundaries[i+1]
+	}
+
+	last := boundaries[len(boundaries)-1]
+
+	for _, observation := range observations {
+		v, count := observation.value, int(observation.count)
+
+		if math.IsNaN(v) {
+			continue
+		} else if v < boundaries[0] {
+			histogram.Underflow += count
+		} else if v > last {
+			histogram.Overflow += count
+		} else if v == last {
+			histogram.Buckets[len(histogram.Buckets)-1].Count += count
+		} else {
+			// the first boundary greater than the value is the upper bound of its bucket
+			i := sort.SearchFloat64s(boundaries, v)
+
+			if i < len(boundaries) && boundaries[i] == v {
+				i++
+			}
+
+			histogram.Buckets[i-1].Count += count
+		}
+	}
+
+	return histogram
+}
+
+func observedValues(observations []sketchBucket) []float64 {
+	values := make([]float64, len(observations))
+
+	for i, observation := range observations {
+		values[i] = observation.value
+	}
+
+	return values
+}
+
+func checkBoundaries(boundaries []float64) error {
+	if len(boundaries) < 2 {
+		return fmt.Errorf("at least two bucket boundaries are required")
+	}
+
+	for i := 1; i < len(boundaries); i++ {
+		if !(boundaries[i] > boundaries[i-1]) {
+			return fmt.Errorf("bucket boundaries must be in increasing order")
+		}
+	}
+
+	return nil
+}
+
+// The distribution of values over time: the points of one or more series divided into time buckets,
+// then counted into value buckets.
+type Heatmap struct {
+	// The start of each time bucket.
+	Times []time.Time `json:"times"`
+
+	// The width of each time bucket.
+	Interval time.Duration `json:"interval"`
+
+	// The boundaries of the value buckets shared by all time buckets.
+	Boundaries []float64 `json:"boundaries"`
+
+	// The number of values in each value bucket of each time bucket, indexed by time then value.
+	Counts [][]int `json:"counts"`
+}
+
+// Returns the greatest count of any cell in the heatmap.
+func (self *Heatmap) MaxCount() int {
+	max := 0
+
+	for _, row := range self.Counts {
+		for _, count := range row {
+			if count > max {
+				max = count
+			}
+		}
+	}
+
+	return max
+}
+
+// Divides the points of the given metrics into time buckets of the given width (see
+// MakeTimeBuckets), then counts the values in each time bucket into value buckets described by the
+// given options.  The value buckets are computed from the values of all of the metrics.
+func MakeHeatmap(metrics []*Metric, interval time.Duration, options HistogramOptions) (*Heatmap, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("heatmap interval must be positive")
+	}
+
+	points := make(PointSet, 0)
+
+	for _, metric := range expandFields(metrics) {
+		points = append(points, metric.Points()...)
+	}
+
+	boundaries, err := options.BoundariesFor(observedValues(points.weightedObservations()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	heatmap := &Heatmap{
+		Times:      make([]time.Time, 0),
+		Interval:   interval,
+		Boundaries: boundaries,
+		Counts:     make([][]int, 0),
+	}
+
+	bucketing := TimeBucketing{
+		Size: interval,
+	}
+
+	for _, bucket := range MakeTimeBuckets(points, interval) {
+		histogram := makeHistogram(NewMetric(``), boundaries, bucket.weightedObservations())
+		counts := make([]int, len(histogram.Buckets))
+
+		for i, b := range histogram.Buckets {
+			counts[i] = b.Count
+		}
+
+		heatmap.Times = append(heatmap.Times, bucketing.Start(bucket[0].Timestamp))
+		heatmap.Counts = append(heatmap.Counts, counts)
+	}
+
+	return heatmap, nil
+}
@@ -0,0 +1,191 @@
+package mobius
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The reducer used to rank series when none is given.
+var DefaultSelectionReducer = `mean`
+
+// The name of the series aggregating all series that were not selected.
+var OtherSeriesName = `other`
+
+// Chooses some of the given series, returning those that were selected and the rest.
+type SeriesSelector func(metrics []*Metric) (selected []*Metric, rest []*Metric)
+
+// Sorts the given series in descending order of their values summarized with the given reducer
+// (series that summarize to NaN come last.)  Series with equal values keep their order.
+func RankMetrics(metrics []*Metric, reducer Reducer) []*Metric {
+	return rankMetrics(metrics, reducer, true)
+}
+
+// Selects the n series with the greatest values summarized with the given reducer.
+func TopK(metrics []*Metric, n int, reducer Reducer) ([]*Metric, []*Metric) {
+	return splitMetrics(rankMetrics(metrics, reducer, true), n)
+}
+
+// Selects the n series with the least values summarized with the given reducer.
+func BottomK(metrics []*Metric, n int, reducer Reducer) ([]*Metric, []*Metric) {
+	return splitMetrics(rankMetrics(metrics, reducer, false), n)
+}
+
+func rankMetrics(metrics []*Metric, reducer Reducer, descending bool) []*Metric {
+	ranked := make([]*Metric, len(metrics))
+	values := make(map[*Metric]float64)
+
+	for i, metric := range metrics {
+		ranked[i] = metric
+		values[metric] = SummarizeMetric(metric, reducer)[0]
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := values[ranked[i]], values[ranked[j]]
+
+		if descending {
+			a, b = -a, -b
+		}
+
+		return a < b || (!math.IsNaN(a) && math.IsNaN(b))
+	})
+
+	return ranked
+}
+
+// Selects the series whose values summarized with the given reducer are greater than a threshold.
+func Above(metrics []*Metric, threshold float64, reducer Reducer) ([]*Metric, []*Metric) {
+	return filterMetrics(metrics, func(metric *Metric) bool {
+		return SummarizeMetric(metric, reducer)[0] > threshold
+	})
+}
+
+// Selects the series whose values summarized with the given reducer are less than a threshold.
+func Below(metrics []*Metric, threshold float64, reducer Reducer) ([]*Metric, []*Metric) {
+	return filterMetrics(metrics, func(metric *Metric) bool {
+		return SummarizeMetric(metric, reducer)[0] < threshold
+	})
+}
+
+// Selects the n series with the greatest standard deviation.
+func MostDeviant(metrics []*Metric, n int) ([]*Metric, []*Metric) {
+	return TopK(metrics, n, StandardDeviation)
+}
+
+// Combines the given series into a single series named OtherSeriesName, summing the points that fall
+// within the same ExpressionResolution-wide bucket.  Returns nil if no series are given.
+func OtherSeries(metrics []*Metric) *Metric {
+	if combined, err := combineSeries(metrics, ``, `sum`); err == nil && len(combined) > 0 {
+		other := NewMetric(OtherSeriesName)
+		other.Type = combined[0].Type
+		other.points = combined[0].points
+
+		return other
+	}
+
+	return nil
+}
+
+// Parses a series selection such as "topk(5, max)", "bottomk(5)", "above(90, percent95)",
+// "below(10)", or "mostDeviant(3)".  The reducer used for ranking defaults to
+// DefaultSelectionReducer.
+func ParseSeriesSelector(spec string) (SeriesSelector, error) {
+	spec = strings.TrimSpace(spec)
+	open := strings.Index(spec, `(`)
+
+	if open < 0 || !strings.HasSuffix(spec, `)`) {
+		return nil, fmt.Errorf("invalid selection %q, expected e.g. 'topk(5, mean)'", spec)
+	}
+
+	name := strings.TrimSpace(spec[:open])
+	args := strings.Split(spec[open+1:len(spec)-1], `,`)
+
+	for i, arg := range args {
+		args[i] = strings.TrimSpace(arg)
+	}
+
+	number, err := strconv.ParseFloat(args[0], 64)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid number %q", name, args[0])
+	}
+
+	reducerName := DefaultSelectionReducer
+	maxArgs := 2
+
+	if name == `mostDeviant` {
+		maxArgs = 1
+	}
+
+	if len(args) > maxArgs {
+		return nil, fmt.Errorf("%s takes at most %d arguments", name, maxArgs)
+	} else if len(args) > 1 {
+		reducerName = args[1]
+	}
+
+	reducer, ok := LookupReducer(reducerName)
+
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown reducer %q", name, reducerName)
+	}
+
+	switch name {
+	case `topk`, `bottomk`, `mostDeviant`:
+		n := int(number)
+
+		if float64(n) != number || n < 0 {
+			return nil, fmt.Errorf("%s: the number of series must be a non-negative integer", name)
+		}
+
+		return func(metrics []*Metric) ([]*Metric, []*Metric) {
+			switch name {
+			case `topk`:
+				return TopK(metrics, n, reducer)
+			case `bottomk`:
+				return BottomK(metrics, n, reducer)
+			default:
+				return MostDeviant(metrics, n)
+			}
+		}, nil
+
+	case `above`:
+		return func(metrics []*Metric) ([]*Metric, []*Metric) {
+			return Above(metrics, number, reducer)
+		}, nil
+
+	case `below`:
+		return func(metrics []*Metric) ([]*Metric, []*Metric) {
+			return Below(metrics, number, reducer)
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown selection %q", name)
+	}
+}
+
+func splitMetrics(metrics []*Metric, n int) ([]*Metric, []*Metric) {
+	if n > len(metrics) {
+		n = len(metrics)
+	} else if n < 0 {
+		n = 0
+	}
+
+	return metrics[:n], metrics[n:]
+}
+
+func filterMetrics(metrics []*Metric, fn func(metric *Metric) bool) ([]*Metric, []*Metric) {
+	selected := make([]*Metric, 0)
+	rest := make([]*Metric, 0)
+
+	for _, metric := range metrics {
+		if fn(metric) {
+			selected = append(selected, metric)
+		} else {
+			rest = append(rest, metric)
+		}
+	}
+
+	return selected, rest
+}
@@ -0,0 +1,248 @@
+package mobius
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Compares a series to a time-shifted baseline of itself.
+type BaselineComparison string
+
+const (
+	// The percentage by which the series differs from its baseline.
+	PercentChange BaselineComparison = `percent`
+
+	// The series divided by its baseline.
+	BaselineRatio BaselineComparison = `ratio`
+)
+
+// Returns a copy of this metric with every point moved later in time by the given duration (or
+// earlier, if negative.)  Shifted metrics are marked as baselines, which graphs draw dashed.
+func (self *Metric) TimeShift(shift time.Duration) *Metric {
+	metric := NewMetric(self.GetName())
+	metric.SetTags(self.GetTags())
+	metric.Type = self.Type
+
+	for k, v := range self.Metadata {
+		metric.Metadata[k] = v
+	}
+
+	for _, point := range self.Points() {
+		point.Timestamp = point.Timestamp.Add(shift)
+		metric.points = append(metric.points, point)
+	}
+
+	metric.Metadata[`baseline`] = true
+
+	return metric
+}
+
+// Returns the percentage by which each point of this metric differs from the point of the baseline
+// at the same time, after aligning both to intervals of the given width.
+func (self *Metric) PercentChange(baseline *Metric, step time.Duration) *Metric {
+	return self.Ratio(baseline, step).ApplyScalar(Subtract, 1).ApplyScalar(Multiply, 100)
+}
+
+// Returns each point of this metric divided by the point of the baseline at the same time, after
+// aligning both to intervals of the given width.
+func (self *Metric) Ratio(baseline *Metric, step time.Duration) *Metric {
+	metric := self.Apply(Divide, baseline, step)
+	metric.SetName(self.GetName())
+	metric.SetTags(self.GetTags())
+
+	return metric
+}
+
+// Splits a selector with an optional time shift in square brackets (e.g. "app.requests [-7d]") into
+// the series pattern and the shift.  Shifts are written as (optionally negative) durations using the
+// units ms, s, m, h, d, w, and y.  To avoid confusion with character classes in patterns, the shift
+// must either be separated from the pattern by a space or begin with a sign.
+func ParseShiftedSelector(selector string) (string, time.Duration, error) {
+	selector = strings.TrimSpace(selector)
+	i := strings.LastIndex(selector, `[`)
+
+	if i <= 0 || !strings.HasSuffix(selector, `]`) {
+		return selector, 0, nil
+	}
+
+	label := strings.TrimSpace(selector[i+1 : len(selector)-1])
+	negative := strings.HasPrefix(label, `-`)
+
+	if selector[i-1] != ' ' && !strings.HasPrefix(label, `-`) && !strings.HasPrefix(label, `+`) {
+		return selector, 0, nil
+	}
+
+	if shift, err := parsePromDuration(strings.TrimLeft(label, `+-`)); err == nil {
+		if negative {
+			shift = -shift
+		}
+
+		return strings.TrimSpace(selector[:i]), shift, nil
+	} else {
+		return ``, 0, fmt.Errorf("invalid time shift in %q: %v", selector, err)
+	}
+}
+
+// Works like Range, except that selectors may carry a time shift (see ParseShiftedSelector.)  The
+// series matched by a shifted selector are read from the time range offset by the shift, then moved
+// back into the requested time range so that they line up with the unshifted series.  The names of
+// shifted series are suffixed with the shift, e.g. "app.requests [-7d]".
+func (self *Dataset) RangeShifted(start time.Time, end time.Time, selectors ...string) ([]*Metric, error) {
+	unshifted := make([]string, 0)
+	output := make([]*Metric, 0)
+
+	for _, selector := range selectors {
+		pattern, shift, err := ParseShiftedSelector(selector)
+
+		if err != nil {
+			return nil, err
+		} else if shift == 0 {
+			unshifted = append(unshifted, pattern)
+			continue
+		}
+
+		label := strings.TrimSpace(selector[strings.LastIndex(selector, `[`):])
+
+		if metrics, err := self.Range(start.Add(shift), end.Add(shift), pattern); err == nil {
+			for _, metric := range metrics {
+				shifted := metric.TimeShift(-shift)
+				shifted.SetName(metric.GetName() + ` ` + label)
+				shifted.SetTags(metric.GetTags())
+
+				output = append(output, shifted)
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	if len(unshifted) > 0 {
+		if metrics, err := self.Range(start, end, unshifted...); err == nil {
+			output = append(metrics, output...)
+		} else {
+			return nil, err
+		}
+	}
+
+	return output, nil
+}
+
+// Replaces each time-shifted series (as returned by RangeShifted) that has an unshifted counterpart
+// with the same name and tags with a comparison of that counterpart against it.  The comparison is
+// named after the shifted series, with the kind of comparison appended to its label (e.g.
+// "app.requests [-7d percent]".)
+func CompareToBaselines(metrics []*Metric, comparison BaselineComparison, step time.Duration) ([]*Metric, error) {
+	switch comparison {
+	case PercentChange, BaselineRatio:
+	default:
+		return nil, fmt.Errorf("unknown baseline comparison %q", comparison)
+	}
+
+	current := make(map[string]*Metric)
+
+	for _, metric := range metrics {
+		current[metric.GetUniqueName()] = metric
+	}
+
+	output := make([]*Metric, 0, len(metrics))
+
+	for _, metric := range metrics {
+		if name, label := splitShiftLabel(metric.GetName()); label != `` {
+			counterpart := NewMetric(name)
+			counterpart.SetTags(metric.GetTags())
+
+			if c, ok := current[counterpart.GetUniqueName()]; ok {
+				var compared *Metric
+
+				if comparison == PercentChange {
+					compared = c.PercentChange(metric, step)
+				} else {
+					compared = c.Ratio(metric, step)
+				}
+
+				compared.SetName(name + ` ` + strings.TrimSuffix(label, `]`) + ` ` + string(comparison) + `]`)
+				compared.SetTags(metric.GetTags())
+
+				output = append(output, compared)
+				continue
+			}
+		}
+
+		output = append(output, metric)
+	}
+
+	return output, nil
+}
+
+// Works like MergeMetrics, except that series with different time shifts (see RangeShifted) are
+// never merged with each other.
+func MergeShiftedMetrics(metrics []*Metric, groupBy string) []*Metric {
+	return eachShift(metrics, func(set []*Metric) []*Metric {
+		return MergeMetrics(set, groupBy)
+	})
+}
+
+// Works like AggregateMetrics, except that series with different time shifts (see RangeShifted) are
+// never aggregated with each other.
+func AggregateShiftedMetrics(metrics []*Metric, groupBy string, step time.Duration, reducer Reducer) []*Metric {
+	return eachShift(metrics, func(set []*Metric) []*Metric {
+		return AggregateMetrics(set, groupBy, step, reducer)
+	})
+}
+
+// Applies a function to each set of series sharing the same time shift, with the shift labels
+// removed from their names, then restores the labels on the results.
+func eachShift(metrics []*Metric, fn func(set []*Metric) []*Metric) []*Metric {
+	labels := make([]string, 0)
+	sets := make(map[string][]*Metric)
+
+	for _, metric := range metrics {
+		name, label := splitShiftLabel(metric.GetName())
+
+		if _, ok := sets[label]; !ok {
+			labels = append(labels, label)
+		}
+
+		unlabeled := NewMetric(name)
+		unlabeled.SetTags(metric.GetTags())
+		unlabeled.Type = metric.Type
+		unlabeled.points = metric.points
+
+		sets[label] = append(sets[label], unlabeled)
+	}
+
+	output := make([]*Metric, 0)
+
+	for _, label := range labels {
+		for _, result := range fn(sets[label]) {
+			if label != `` {
+				tags := result.GetTags()
+				result.SetName(result.GetName() + ` ` + label)
+				result.SetTags(tags)
+				result.Metadata[`baseline`] = true
+			}
+
+			output = append(output, result)
+		}
+	}
+
+	return output
+}
+
+// Returns whether the given metric is a time-shifted series.
+func IsShifted(metric *Metric) bool {
+	_, label := splitShiftLabel(metric.GetName())
+	return label != ``
+}
+
+// Splits the name of a time-shifted series into the original name and the shift label.
+func splitShiftLabel(name string) (string, string) {
+	if i := strings.LastIndex(name, ` [`); i >= 0 {
+		if _, shift, err := ParseShiftedSelector(name); err == nil && shift != 0 {
+			return name[:i], name[i+1:]
+		}
+	}
+
+	return name, ``
+}
@@ -0,0 +1,176 @@
+package mobius
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A TransformFunc derives a new series from the points of a metric.
+type TransformFunc func(metric *Metric) *Metric
+
+// Returns the difference between each point and the one before it.  The first point is omitted.
+func (self *Metric) Delta() *Metric {
+	return self.pairwise(func(prev Point, cur Point) float64 {
+		return cur.Value - prev.Value
+	})
+}
+
+// Returns the rate of change between each point and the one before it, per unit of time.  The first
+// point is omitted.
+func (self *Metric) Derivative(unit time.Duration) *Metric {
+	return self.pairwise(func(prev Point, cur Point) float64 {
+		return (cur.Value - prev.Value) * float64(unit) / float64(cur.Timestamp.Sub(prev.Timestamp))
+	})
+}
+
+// Returns the rate of increase of a counter per unit of time.  A decrease in value is taken to be a
+// reset of the counter to zero, so the increase since the previous point is the current value.  If
+// maxValue is non-zero and the previous value was in the upper half of the counter's range, the
+// decrease is instead taken to be the counter wrapping around past maxValue.
+func (self *Metric) NonNegativeDerivative(unit time.Duration, maxValue float64) *Metric {
+	return self.pairwise(func(prev Point, cur Point) float64 {
+		increase := cur.Value - prev.Value
+
+		if increase < 0 {
+			if maxValue > 0 && prev.Value > maxValue/2 {
+				increase = (maxValue - prev.Value) + cur.Value + 1
+			} else {
+				increase = cur.Value
+			}
+		}
+
+		return increase * float64(unit) / float64(cur.Timestamp.Sub(prev.Timestamp))
+	})
+}
+
+// Returns the per-second rate of increase of a counter, compensating for counter resets.
+func (self *Metric) PerSecond() *Metric {
+	return self.NonNegativeDerivative(time.Second, 0)
+}
+
+// Returns the running area under the series in value-units of time, using the trapezoidal rule
+// between consecutive points.  The first point is always zero.
+func (self *Metric) Integral(unit time.Duration) *Metric {
+	metric := self.derived()
+	points := sortedPoints(self.Points())
+	var area float64
+
+	for i, point := range points {
+		if i > 0 {
+			prev := points[i-1]
+			area += (prev.Value + point.Value) / 2 * float64(point.Timestamp.Sub(prev.Timestamp)) / float64(unit)
+		}
+
+		metric.Push(point.Timestamp, area)
+	}
+
+	return metric
+}
+
+// Returns the running total of the values of the series, such as the total count of a counter whose
+// points are increments.
+func (self *Metric) CumulativeSum() *Metric {
+	metric := self.derived()
+	var sum float64
+
+	for _, point := range sortedPoints(self.Points()) {
+		sum += point.Value
+		metric.Push(point.Timestamp, sum)
+	}
+
+	return metric
+}
+
+// Builds a series from a function of each pair of consecutive points (in time order), skipping
+// pairs with the same timestamp.
+func (self *Metric) pairwise(fn func(prev Point, cur Point) float64) *Metric {
+	metric := self.derived()
+	points := sortedPoints(self.Points())
+
+	for i := 1; i < len(points); i++ {
+		if !points[i].Timestamp.After(points[i-1].Timestamp) {
+			continue
+		}
+
+		metric.Push(points[i].Timestamp, fn(points[i-1], points[i]))
+	}
+
+	return metric
+}
+
+func (self *Metric) derived() *Metric {
+	metric := NewMetric(self.GetName())
+	metric.SetTags(self.GetTags())
+
+	return metric
+}
+
+var transformNameMap = map[string]TransformFunc{
+	`cumulative-sum`: (*Metric).CumulativeSum,
+	`delta`:          (*Metric).Delta,
+	`derivative`: func(metric *Metric) *Metric {
+		return metric.Derivative(time.Second)
+	},
+	`integral`: func(metric *Metric) *Metric {
+		return metric.Integral(time.Second)
+	},
+	`non-negative-derivative`: func(metric *Metric) *Metric {
+		return metric.NonNegativeDerivative(time.Second, 0)
+	},
+	`per-second`: (*Metric).PerSecond,
+}
+
+var transformAliasMap = map[string]string{
+	`cumsum`: `cumulative-sum`,
+	`diff`:   `delta`,
+	`rate`:   `per-second`,
+}
+
+// Returns the named transform.  Rates and integrals are per second.
+func GetTransform(name string) (TransformFunc, bool) {
+	if alias, ok := transformAliasMap[name]; ok {
+		name = alias
+	}
+
+	transform, ok := transformNameMap[name]
+	return transform, ok
+}
+
+// Parses a comma-separated list of transform names.
+func ParseTransforms(names string) ([]TransformFunc, error) {
+	transforms := make([]TransformFunc, 0)
+
+	for _, name := range strings.Split(names, `,`) {
+		if name = strings.TrimSpace(name); name == `` {
+			continue
+		} else if transform, ok := GetTransform(name); ok {
+			transforms = append(transforms, transform)
+		} else {
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+	}
+
+	return transforms, nil
+}
+
+// Applies each of the given transforms in turn to each metric.  Multi-field metrics are split into
+// one metric per field first.
+func TransformMetrics(metrics []*Metric, transforms ...TransformFunc) []*Metric {
+	if len(transforms) == 0 {
+		return metrics
+	}
+
+	metrics = expandFields(metrics)
+	output := make([]*Metric, len(metrics))
+
+	for i, metric := range metrics {
+		for _, transform := range transforms {
+			metric = transform(metric)
+		}
+
+		output[i] = metric
+	}
+
+	return output
+}
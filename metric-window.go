@@ -0,0 +1,113 @@
+package mobius
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// A Window describes the trailing points that a moving function considers at each point: either
+// those within a span of time, or a fixed number of points.
+type Window struct {
+	Duration time.Duration
+	Points   int
+}
+
+// Parses a window given as either a duration (e.g. "5m") or a number of points (e.g. "10".)
+func ParseWindow(spec string) (Window, error) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n > 0 {
+			return Window{
+				Points: n,
+			}, nil
+		}
+	} else if d, err := time.ParseDuration(spec); err == nil && d > 0 {
+		return Window{
+			Duration: d,
+		}, nil
+	}
+
+	return Window{}, fmt.Errorf("invalid window %q, expected a duration or a number of points", spec)
+}
+
+func (self Window) String() string {
+	if self.Points > 0 {
+		return strconv.Itoa(self.Points)
+	} else {
+		return self.Duration.String()
+	}
+}
+
+// Replaces each point with the result of the given reducer applied to all points in the trailing
+// window ending at it.  Time-weighted reducers see the window as ending at the point.
+func (self *Metric) Moving(window Window, reducer Reducer) *Metric {
+	if window.Points > 0 {
+		return movingPoints(self, window.Points, reducer)
+	} else {
+		return MovingWindow(self, window.Duration, reducer)
+	}
+}
+
+// Replaces each point with the exponentially-weighted moving average of the points up to and
+// including it, where alpha (between 0 and 1) is the weight given to the newest point.
+func (self *Metric) EWMA(alpha float64) *Metric {
+	metric := NewMetric(self.GetName())
+	metric.SetTags(self.GetTags())
+
+	var average float64
+
+	for i, point := range sortedPoints(self.Points()) {
+		if i == 0 {
+			average = point.Value
+		} else {
+			average = alpha*point.Value + (1-alpha)*average
+		}
+
+		metric.Push(point.Timestamp, average)
+	}
+
+	return metric
+}
+
+// Replaces each point with the result of the given reducer applied to all points within the
+// trailing window (t - window, t].
+func MovingWindow(inputMetric *Metric, window time.Duration, reducer Reducer) *Metric {
+	metric := NewMetric(inputMetric.GetName())
+	metric.SetTags(inputMetric.GetTags())
+
+	points := sortedPoints(inputMetric.Points())
+	values := points.Values()
+	first := 0
+
+	for i, point := range points {
+		for first < i && !points[first].Timestamp.After(point.Timestamp.Add(-window)) {
+			first++
+		}
+
+		metric.Push(point.Timestamp, reduceValues(reducer, points[first:i+1], values[first:i+1], point.Timestamp.Add(-window), point.Timestamp))
+	}
+
+	return metric
+}
+
+// Replaces each point with the result of the given reducer applied to it and up to n-1 points
+// before it.
+func movingPoints(inputMetric *Metric, n int, reducer Reducer) *Metric {
+	metric := NewMetric(inputMetric.GetName())
+	metric.SetTags(inputMetric.GetTags())
+
+	points := sortedPoints(inputMetric.Points())
+	values := points.Values()
+
+	for i, point := range points {
+		first := i - n + 1
+
+		if first < 0 {
+			first = 0
+		}
+
+		metric.Push(point.Timestamp, reduceValues(reducer, points[first:i+1], values[first:i+1], points[first].Timestamp, point.Timestamp))
+	}
+
+	return metric
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/ghetzel/go-stockutil/stringutil"
 	"github.com/ghetzel/go-stockutil/typeutil"
 	"github.com/montanaflynn/stats"
+	"math"
 	"regexp"
 	"sort"
 	"strings"
@@ -21,6 +22,7 @@ var InlineTagSeparator = `,`
 type Metric struct {
 	Metadata map[string]interface{} `json:"metadata,omitempty"`
 	MaxSize  int
+	Type     ValueType
 	name     string
 	tags     map[string]interface{}
 	points   PointSet
@@ -109,15 +111,131 @@ func (self *Metric) GetUniqueName() string {
 	return name
 }
 
+// Appends the given point to this metric.  If the metric is empty, it will adopt the value type of
+// the point; otherwise the point is converted to the metric's value type.  If it can't be, both are
+// converted to floating point, and points that can't be either (e.g. multi-field points pushed to a
+// single-valued metric, or vice versa) are dropped.
 func (self *Metric) PushPoint(point Point) *Metric {
-	return self.Push(point.Timestamp, point.Value)
+	if self.IsEmpty() {
+		self.Type = point.Type
+	} else if p, err := point.As(self.Type); err == nil {
+		point = p
+	} else if p, err := point.As(FloatType); err == nil && self.Type != FieldsType {
+		self.convertPoints(FloatType)
+		point = p
+	} else {
+		return self
+	}
+
+	return self.push(point)
 }
 
+// Appends a value to this metric.  Integral values pushed to an integer metric are stored exactly,
+// and values pushed to a sketch metric become single-observation sketches; any other value converts
+// the metric to floating point.  Values pushed to a multi-field metric are dropped.
 func (self *Metric) Push(timestamp time.Time, value float64) *Metric {
-	self.points = append(self.points, Point{
+	point := Point{
 		Timestamp: timestamp,
 		Value:     value,
-	})
+	}
+
+	switch self.Type {
+	case FieldsType:
+		if !self.IsEmpty() {
+			return self
+		}
+
+		self.Type = FloatType
+	case IntegerType, SketchType, UniqueType:
+		if p, err := point.As(self.Type); err == nil {
+			point = p
+		} else {
+			self.convertPoints(FloatType)
+		}
+	}
+
+	return self.push(point)
+}
+
+// Appends an exact integer value to this metric.  If the metric is empty, it will become an
+// integer-valued metric.
+func (self *Metric) PushInt(timestamp time.Time, value int64) *Metric {
+	return self.PushPoint(IntegerPoint(timestamp, value))
+}
+
+// Appends a point holding a quantile sketch to this metric.  If the metric is empty, it will become a
+// sketch-valued metric.
+func (self *Metric) PushSketch(timestamp time.Time, sketch *Sketch) *Metric {
+	return self.PushPoint(SketchPoint(timestamp, sketch))
+}
+
+// Appends a point holding a set of distinct members to this metric.  If the metric is empty, it will
+// become a distinct-count metric.
+func (self *Metric) PushUnique(timestamp time.Time, set *HyperLogLog) *Metric {
+	return self.PushPoint(UniquePoint(timestamp, set))
+}
+
+// Appends a point holding several named values to this metric.  If the metric is empty, it will
+// become a multi-field metric.
+func (self *Metric) PushFields(timestamp time.Time, fields map[string]float64) *Metric {
+	return self.PushPoint(FieldsPoint(timestamp, fields))
+}
+
+// Returns the names of all fields present in this metric's points.
+func (self *Metric) FieldNames() []string {
+	return self.points.FieldNames()
+}
+
+// Returns a single-valued metric containing the values of the named field, named as
+// "<name>#<field>".  Points that do not contain the field are omitted.
+func (self *Metric) Field(name string) *Metric {
+	metric := NewMetric(self.GetName() + FieldDelimiter + name)
+	metric.SetTags(self.GetTags())
+
+	for k, v := range self.Metadata {
+		metric.Metadata[k] = v
+	}
+
+	for _, point := range self.points {
+		if v, ok := point.Fields[name]; ok {
+			metric.push(Point{
+				Timestamp: point.Timestamp,
+				Value:     v,
+			})
+		}
+	}
+
+	return metric
+}
+
+// Splits a multi-field metric into one single-valued metric per field.  Metrics that are not
+// multi-field are returned as-is.
+func (self *Metric) SplitFields() []*Metric {
+	if self.Type != FieldsType {
+		return []*Metric{self}
+	}
+
+	metrics := make([]*Metric, 0)
+
+	for _, field := range self.FieldNames() {
+		metrics = append(metrics, self.Field(field))
+	}
+
+	return metrics
+}
+
+func (self *Metric) convertPoints(valueType ValueType) {
+	for i, point := range self.points {
+		if p, err := point.As(valueType); err == nil {
+			self.points[i] = p
+		}
+	}
+
+	self.Type = valueType
+}
+
+func (self *Metric) push(point Point) *Metric {
+	self.points = append(self.points, point)
 
 	// if we've exceeded MaxSize, shift the points slice such that it only includes the
 	// most recent <MaxSize> elements.
@@ -128,35 +246,52 @@ func (self *Metric) Push(timestamp time.Time, value float64) *Metric {
 	return self
 }
 
-// Returns the value that represents a given standing within this metric's data.
+// Returns the value that represents a given standing within this metric's data.  Sketch-valued
+// metrics answer from the merge of their sketches.
 func (self *Metric) Percentile(percent float64) (float64, error) {
-	return stats.Percentile(stats.Float64Data(self.points.Values()), percent)
+	if self.Type == SketchType {
+		if percent <= 0 || percent > 100 {
+			return math.NaN(), fmt.Errorf("percentile must be greater than 0 and at most 100")
+		}
+
+		return self.points.MergedSketch().Quantile(percent / 100), nil
+	}
+
+	return stats.Percentile(stats.Float64Data(self.points.Observations()), percent)
 }
 
-// Describes the degree of relationship between this metric and another one.
+// Describes the degree of relationship between this metric and another one.  The metrics are first
+// aligned to the timestamps of both using linear interpolation (see Align.)
 func (self *Metric) Correlation(other *Metric) (float64, error) {
+	left, right := self.Align(other, 0, LinearInterpolation)
+
 	return stats.Correlation(
-		stats.Float64Data(self.points.Values()),
-		stats.Float64Data(other.points.Values()),
+		stats.Float64Data(left.points.Values()),
+		stats.Float64Data(right.points.Values()),
 	)
 }
 
-// Covariance is a measure of how much this metric changes with respect to another.
+// Covariance is a measure of how much this metric changes with respect to another.  The metrics are
+// first aligned to the timestamps of both using linear interpolation (see Align.)
 func (self *Metric) Covariance(other *Metric) (float64, error) {
+	left, right := self.Align(other, 0, LinearInterpolation)
+
 	return stats.Covariance(
-		stats.Float64Data(self.points.Values()),
-		stats.Float64Data(other.points.Values()),
+		stats.Float64Data(left.points.Values()),
+		stats.Float64Data(right.points.Values()),
 	)
 }
 
 func (self *Metric) CovariancePopulation(other *Metric) (float64, error) {
+	left, right := self.Align(other, 0, LinearInterpolation)
+
 	return stats.CovariancePopulation(
-		stats.Float64Data(self.points.Values()),
-		stats.Float64Data(other.points.Values()),
+		stats.Float64Data(left.points.Values()),
+		stats.Float64Data(right.points.Values()),
 	)
 }
 
-func (self *Metric) Summarize(reducers ...ReducerFunc) []float64 {
+func (self *Metric) Summarize(reducers ...Reducer) []float64 {
 	return SummarizeMetric(self, reducers...)
 }
 
@@ -170,6 +305,10 @@ func (self *Metric) MarshalJSON() ([]byte, error) {
 		rv[`tags`] = v
 	}
 
+	if self.Type != FloatType {
+		rv[`type`] = self.Type.String()
+	}
+
 	if v, err := maputil.Compact(self.Metadata); err == nil {
 		if len(v) > 0 {
 			rv[`metadata`] = v
@@ -185,10 +324,30 @@ func (self *Metric) MarshalJSON() ([]byte, error) {
 	return json.Marshal(rv)
 }
 
-func (self *Metric) Consolidate(size time.Duration, reducer ReducerFunc) *Metric {
+func (self *Metric) Consolidate(size time.Duration, reducer Reducer) *Metric {
 	return ConsolidateMetric(self, size, reducer)
 }
 
+// Consolidates this metric into buckets aligned to the given bucketing (see ConsolidateMetricBuckets.)
+func (self *Metric) ConsolidateBuckets(bucketing TimeBucketing, reducer Reducer) *Metric {
+	return ConsolidateMetricBuckets(self, bucketing, reducer)
+}
+
+// Splits a "name#field" selector into the name and field portions.  Tags following the name are
+// preserved in the returned name.
+func SplitNameField(name string) (string, string) {
+	parts := strings.SplitN(name, NameTagsDelimiter, 2)
+
+	if i := strings.Index(parts[0], FieldDelimiter); i >= 0 {
+		field := parts[0][i+len(FieldDelimiter):]
+		parts[0] = parts[0][:i]
+
+		return strings.Join(parts, NameTagsDelimiter), field
+	}
+
+	return name, ``
+}
+
 func SplitNameTags(name string) (string, map[string]interface{}) {
 	tags := make(map[string]interface{})
 	parts := strings.SplitN(name, NameTagsDelimiter, 2)
@@ -1,7 +1,10 @@
 package mobius
 
 import (
+	"encoding/json"
 	"github.com/stretchr/testify/require"
+	"github.com/wcharczuk/go-chart/drawing"
+	"math"
 	"math/rand"
 	"sort"
 	"testing"
@@ -80,25 +83,25 @@ func TestMetricConsolidation(t *testing.T) {
 	for _, rv := range []reducerValues{
 		{
 			Reducer: Sum,
-			Values:  []float64{45, 735, 1635, 2535},
+			Values:  []float64{435, 1335, 2235, 945},
 		}, {
 			Reducer: Minimum,
-			Values:  []float64{0, 10, 40, 70},
+			Values:  []float64{0, 30, 60, 90},
 		}, {
 			Reducer: Maximum,
-			Values:  []float64{9, 39, 69, 99},
+			Values:  []float64{29, 59, 89, 99},
 		}, {
 			Reducer: Mean,
-			Values:  []float64{4.5, 24.5, 54.5, 84.5},
+			Values:  []float64{14.5, 44.5, 74.5, 94.5},
 		},
 	} {
 		consolidated := metric.Consolidate(30*time.Second, rv.Reducer)
 		points := consolidated.Points()
 		assert.Len(points, 4)
-		assert.Equal(time.Date(2006, 1, 2, 15, 4, 9, 0, mst), points[0].Timestamp)
-		assert.Equal(time.Date(2006, 1, 2, 15, 4, 39, 0, mst), points[1].Timestamp)
-		assert.Equal(time.Date(2006, 1, 2, 15, 5, 9, 0, mst), points[2].Timestamp)
-		assert.Equal(time.Date(2006, 1, 2, 15, 5, 39, 0, mst), points[3].Timestamp)
+		assert.Equal(time.Date(2006, 1, 2, 15, 4, 0, 0, mst), points[0].Timestamp)
+		assert.Equal(time.Date(2006, 1, 2, 15, 4, 30, 0, mst), points[1].Timestamp)
+		assert.Equal(time.Date(2006, 1, 2, 15, 5, 0, 0, mst), points[2].Timestamp)
+		assert.Equal(time.Date(2006, 1, 2, 15, 5, 30, 0, mst), points[3].Timestamp)
 		assert.Equal(rv.Values[0], points[0].Value)
 		assert.Equal(rv.Values[1], points[1].Value)
 		assert.Equal(rv.Values[2], points[2].Value)
@@ -217,3 +220,1006 @@ func TestMetricMergeOnTags(t *testing.T) {
 		`instance`: []interface{}{int64(3), int64(2)},
 	}, merge2.GetTags())
 }
+
+func TestMetricIntegerConsolidation(t *testing.T) {
+	assert := require.New(t)
+
+	metric := NewMetric(`mobius.test.metrics.bytes`)
+	base := int64(1) << 60
+
+	for i := 0; i < 10; i++ {
+		metric.PushInt(time.Date(2006, 1, 2, 15, 4, i, 0, mst), base+int64(i))
+	}
+
+	assert.Equal(IntegerType, metric.Type)
+
+	summed := metric.Consolidate(5*time.Second, Sum)
+	assert.Equal(IntegerType, summed.Type)
+	assert.Len(summed.Points(), 2)
+	assert.Equal(5*base+10, summed.Points()[0].Int64())
+	assert.Equal(5*base+35, summed.Points()[1].Int64())
+
+	maxed := metric.Consolidate(5*time.Second, Maximum)
+	assert.Equal(IntegerType, maxed.Type)
+	assert.Equal(base+9, maxed.Points()[1].Int64())
+
+	// reducers without an exact integer form produce floating point series
+	averaged := metric.Consolidate(5*time.Second, Mean)
+	assert.Equal(FloatType, averaged.Type)
+
+	// pushing a non-integer value converts the series to floating point
+	metric.Push(time.Date(2006, 1, 2, 15, 4, 11, 0, mst), 1.5)
+	metric.PushPoint(Point{Timestamp: time.Date(2006, 1, 2, 15, 4, 12, 0, mst), Value: 2.5})
+	assert.Equal(FloatType, metric.Type)
+	assert.Equal(float64(base+9), metric.Points()[9].Value)
+	assert.Equal(1.5, metric.Points()[10].Value)
+	assert.Equal(2.5, metric.Points()[11].Value)
+}
+
+func TestMetricPushMismatchedPoints(t *testing.T) {
+	assert := require.New(t)
+	epoch := time.Date(2006, 1, 2, 15, 4, 5, 0, mst)
+
+	// multi-field points can't join a single-valued metric, nor the reverse
+	metric := NewMetric(`mobius.test.push.scalar`)
+	metric.PushInt(epoch, 1)
+	metric.PushFields(epoch.Add(time.Second), map[string]float64{`a`: 2})
+	assert.Equal(IntegerType, metric.Type)
+	assert.Len(metric.Points(), 1)
+
+	metric = NewMetric(`mobius.test.push.fields`)
+	metric.PushFields(epoch, map[string]float64{`a`: 1})
+	metric.Push(epoch.Add(time.Second), 2)
+	metric.PushInt(epoch.Add(2*time.Second), 3)
+	assert.Equal(FieldsType, metric.Type)
+	assert.Len(metric.Points(), 1)
+
+	// points that can be represented as floats convert the metric
+	metric = NewMetric(`mobius.test.push.integer`)
+	metric.PushInt(epoch, 1)
+	metric.Push(epoch.Add(time.Second), 1.5)
+	assert.Equal(FloatType, metric.Type)
+
+	for _, point := range metric.Points() {
+		assert.Equal(FloatType, point.Type)
+	}
+
+	assert.Equal([]float64{1, 1.5}, metric.Points().Values())
+}
+
+func TestMetricApply(t *testing.T) {
+	assert := require.New(t)
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+	errors := NewMetric(`app.errors:host=a`)
+	requests := NewMetric(`app.requests:host=a`)
+
+	// points on either side are aligned to the same second even if they were not written together
+	for i, v := range []float64{1, 2, 0, 4} {
+		errors.Push(epoch.Add(time.Duration(i)*time.Second+200*time.Millisecond), v)
+		requests.Push(epoch.Add(time.Duration(i)*time.Second+700*time.Millisecond), float64(i*10))
+	}
+
+	ratio := errors.Apply(Divide, requests, time.Second)
+	assert.Equal(`app.errors/app.requests`, ratio.GetName())
+	assert.Equal(map[string]interface{}{`host`: `a`}, ratio.GetTags())
+
+	// division by zero is omitted
+	assert.Equal([]float64{0.2, 0, 4.0 / 30}, ratio.Points().Values())
+	assert.True(ratio.Points()[0].Timestamp.Equal(epoch.Add(time.Second)))
+
+	assert.Equal([]float64{-8, -20, -26}, errors.Apply(Subtract, requests, time.Second).Points().Values()[1:])
+
+	filtered := requests.Apply(GreaterThan, errors, time.Second)
+	assert.Equal(`app.requests`, filtered.GetName())
+	assert.Equal([]float64{10, 20, 30}, filtered.Points().Values())
+
+	assert.Equal([]float64{0, 20, 40, 60}, requests.ApplyScalar(Multiply, 2).Points().Values())
+
+	op, err := ParseBinaryOperator(`divide`)
+	assert.NoError(err)
+	assert.Equal(Divide, op)
+
+	_, err = ParseBinaryOperator(`%`)
+	assert.Error(err)
+}
+
+func TestApplyMetrics(t *testing.T) {
+	assert := require.New(t)
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+
+	series := func(name string, values ...float64) *Metric {
+		metric := NewMetric(name)
+
+		for i, v := range values {
+			metric.Push(epoch.Add(time.Duration(i)*time.Second), v)
+		}
+
+		return metric
+	}
+
+	bytesIn := []*Metric{
+		series(`net.in:host=a,dc=east`, 10, 20),
+		series(`net.in:host=b,dc=east`, 30, 40),
+		series(`net.in:host=c,dc=west`, 50, 60),
+	}
+
+	bytesOut := []*Metric{
+		series(`net.out:host=b,dc=east`, 3, 4),
+		series(`net.out:host=a,dc=east`, 1, 2),
+	}
+
+	// one-to-one on all tags; unmatched series are omitted
+	results, err := ApplyMetrics(Subtract, bytesIn, bytesOut, JoinOptions{})
+	assert.NoError(err)
+	assert.Len(results, 2)
+	assert.Equal(`a`, results[0].GetTag(`host`))
+	assert.Equal([]float64{9, 18}, results[0].Points().Values())
+	assert.Equal([]float64{27, 36}, results[1].Points().Values())
+
+	// many-to-one on a tag
+	totals := []*Metric{
+		series(`net.total:dc=east`, 40, 60),
+		series(`net.total:dc=west`, 50, 60),
+	}
+
+	results, err = ApplyMetrics(Divide, bytesIn, totals, JoinOptions{
+		Type: ManyToOne,
+		On:   []string{`dc`},
+	})
+
+	assert.NoError(err)
+	assert.Len(results, 3)
+	assert.Equal(map[string]interface{}{`host`: `a`, `dc`: `east`}, results[0].GetTags())
+	assert.Equal([]float64{0.25, 1.0 / 3}, results[0].Points().Values())
+	assert.Equal([]float64{1, 1}, results[2].Points().Values())
+
+	// ignoring a tag leaves the others to match on
+	results, err = ApplyMetrics(Add, bytesIn[:1], []*Metric{series(`net.out:host=z,dc=east`, 1, 1)}, JoinOptions{
+		Type:     ManyToOne,
+		Ignoring: []string{`host`},
+	})
+
+	assert.NoError(err)
+	assert.Len(results, 1)
+	assert.Equal([]float64{11, 21}, results[0].Points().Values())
+
+	// ambiguous matches are rejected
+	_, err = ApplyMetrics(Divide, bytesIn, totals, JoinOptions{
+		On: []string{`dc`},
+	})
+
+	assert.Error(err)
+
+	_, err = ApplyMetrics(Divide, totals, bytesIn, JoinOptions{
+		Type: ManyToOne,
+		On:   []string{`dc`},
+	})
+
+	assert.Error(err)
+}
+
+func TestMetricAlign(t *testing.T) {
+	assert := require.New(t)
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+	a := NewMetric(`mobius.test.align.a`)
+	b := NewMetric(`mobius.test.align.b`)
+
+	// a is sampled every 10s, b every 15s starting 5s later
+	for i := 0; i <= 6; i++ {
+		a.Push(epoch.Add(time.Duration(i*10)*time.Second), float64(i*10))
+	}
+
+	for i := 0; i <= 3; i++ {
+		b.Push(epoch.Add(time.Duration(5+i*15)*time.Second), float64(100+i*15))
+	}
+
+	// the overlap is 5s-50s, sampled at the timestamps of both
+	left, right := a.Align(b, 0, LinearInterpolation)
+	assert.Equal([]float64{5, 10, 20, 30, 35, 40, 50}, left.Points().Values())
+	assert.Equal([]float64{100, 105, 115, 125, 130, 135, 145}, right.Points().Values())
+	assert.True(left.Points()[0].Timestamp.Equal(epoch.Add(5 * time.Second)))
+
+	left, right = a.Align(b, 20*time.Second, PreviousInterpolation)
+	assert.Equal([]float64{20, 40}, left.Points().Values())
+	assert.Equal([]float64{115, 130}, right.Points().Values())
+
+	left, right = a.Align(b, 0, NearestInterpolation)
+	assert.Equal([]float64{0, 10, 20, 30, 30, 40, 50}, left.Points().Values())
+	assert.Equal([]float64{100, 100, 115, 130, 130, 130, 145}, right.Points().Values())
+
+	// differently-sampled series of the same line are perfectly correlated
+	correlation, err := a.Correlation(b)
+	assert.NoError(err)
+	assert.InDelta(1, correlation, 1e-9)
+
+	left, right = a.Align(NewMetric(`mobius.test.align.empty`), 0, LinearInterpolation)
+	assert.True(left.IsEmpty())
+	assert.True(right.IsEmpty())
+
+	method, err := ParseInterpolationMethod(`step`)
+	assert.NoError(err)
+	assert.Equal(PreviousInterpolation, method)
+
+	_, err = ParseInterpolationMethod(`cubic`)
+	assert.Error(err)
+}
+
+func TestMetricTransforms(t *testing.T) {
+	assert := require.New(t)
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+	counter := NewMetric(`mobius.test.transforms.counter:host=a`)
+
+	// a counter sampled every 10s that resets after its fourth sample
+	for i, v := range []float64{0, 50, 100, 200, 30, 80} {
+		counter.Push(epoch.Add(time.Duration(i*10)*time.Second), v)
+	}
+
+	assert.Equal([]float64{50, 50, 100, -170, 50}, counter.Delta().Points().Values())
+	assert.Equal([]float64{5, 5, 10, -17, 5}, counter.Derivative(time.Second).Points().Values())
+	assert.Equal([]float64{5, 5, 10, 3, 5}, counter.PerSecond().Points().Values())
+	assert.Equal([]float64{300, 300, 600, 180, 300}, counter.NonNegativeDerivative(time.Minute, 0).Points().Values())
+	assert.Equal(map[string]interface{}{`host`: `a`}, counter.PerSecond().GetTags())
+	assert.True(counter.PerSecond().Points()[0].Timestamp.Equal(epoch.Add(10 * time.Second)))
+
+	// an 8-bit counter wrapping around
+	wrapping := NewMetric(`mobius.test.transforms.wrapping`)
+	wrapping.Push(epoch, 250)
+	wrapping.Push(epoch.Add(time.Second), 4)
+	assert.Equal([]float64{10}, wrapping.NonNegativeDerivative(time.Second, 255).Points().Values())
+
+	// increments accumulate into a total, and the integral of a constant rate is a line
+	assert.Equal([]float64{0, 50, 150, 350, 380, 460}, counter.CumulativeSum().Points().Values())
+
+	rate := NewMetric(`mobius.test.transforms.rate`)
+
+	for i := 0; i < 4; i++ {
+		rate.Push(epoch.Add(time.Duration(i)*time.Minute), 2)
+	}
+
+	assert.Equal([]float64{0, 2, 4, 6}, rate.Integral(time.Minute).Points().Values())
+	assert.Equal([]float64{0, 120, 240, 360}, rate.Integral(time.Second).Points().Values())
+
+	transforms, err := ParseTransforms(`rate, cumulative-sum`)
+	assert.NoError(err)
+	assert.Len(transforms, 2)
+
+	results := TransformMetrics([]*Metric{counter}, transforms...)
+	assert.Len(results, 1)
+	assert.Equal([]float64{5, 10, 20, 23, 28}, results[0].Points().Values())
+
+	_, err = ParseTransforms(`per-second,bogus`)
+	assert.Error(err)
+}
+
+func TestMetricMoving(t *testing.T) {
+	assert := require.New(t)
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+	metric := NewMetric(`mobius.test.moving:host=a`)
+
+	for i, v := range []float64{4, 8, 2, 6, 10, 0} {
+		metric.Push(epoch.Add(time.Duration(i)*time.Minute), v)
+	}
+
+	window, err := ParseWindow(`3`)
+	assert.NoError(err)
+	assert.Equal(Window{Points: 3}, window)
+
+	assert.Equal([]float64{4, 6, 14.0 / 3, 16.0 / 3, 6, 16.0 / 3}, metric.Moving(window, Mean).Points().Values())
+	assert.Equal([]float64{4, 6, 4, 6, 6, 6}, metric.Moving(window, Median).Points().Values())
+	assert.Equal([]float64{4, 4, 2, 2, 2, 0}, metric.Moving(window, Minimum).Points().Values())
+
+	window, err = ParseWindow(`2m`)
+	assert.NoError(err)
+	assert.Equal(Window{Duration: 2 * time.Minute}, window)
+	assert.Equal([]float64{4, 8, 8, 6, 10, 10}, metric.Moving(window, Maximum).Points().Values())
+	assert.Equal(map[string]interface{}{`host`: `a`}, metric.Moving(window, Maximum).GetTags())
+
+	assert.Equal([]float64{4, 6, 4, 5, 7.5, 3.75}, metric.EWMA(0.5).Points().Values())
+
+	for _, spec := range []string{``, `0`, `-5m`, `five`} {
+		_, err = ParseWindow(spec)
+		assert.Error(err, spec)
+	}
+}
+
+func TestMetricTimeShift(t *testing.T) {
+	assert := require.New(t)
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+	current := NewMetric(`mobius.test.shift:host=a`)
+	lastWeek := NewMetric(`mobius.test.shift:host=a`)
+
+	for i, v := range []float64{10, 20, 30} {
+		current.Push(epoch.Add(time.Duration(i)*time.Minute), v*1.5)
+		lastWeek.Push(epoch.Add(time.Duration(i)*time.Minute-7*24*time.Hour), v)
+	}
+
+	baseline := lastWeek.TimeShift(7 * 24 * time.Hour)
+	assert.Equal(map[string]interface{}{`host`: `a`}, baseline.GetTags())
+	assert.Equal(true, baseline.Metadata[`baseline`])
+	assert.True(baseline.Points()[0].Timestamp.Equal(epoch))
+	assert.True(lastWeek.Points()[0].Timestamp.Equal(epoch.Add(-7 * 24 * time.Hour)))
+
+	ratio := current.Ratio(baseline, time.Minute)
+	assert.Equal(`mobius.test.shift`, ratio.GetName())
+	assert.Equal([]float64{1.5, 1.5, 1.5}, ratio.Points().Values())
+
+	for _, v := range current.PercentChange(baseline, time.Minute).Points().Values() {
+		assert.InDelta(50, v, 1e-9)
+	}
+
+	for selector, expected := range map[string]time.Duration{
+		`app.req`:           0,
+		`app.req [-7d]`:     -7 * 24 * time.Hour,
+		`app.req[-1h30m]`:   -90 * time.Minute,
+		`app.req [1w]`:      7 * 24 * time.Hour,
+		`app.req:a=b [-1d]`: -24 * time.Hour,
+		`app.req[12]`:       0,
+	} {
+		_, shift, err := ParseShiftedSelector(selector)
+		assert.NoError(err, selector)
+		assert.Equal(expected, shift, selector)
+	}
+
+	pattern, _, _ := ParseShiftedSelector(`app.req:a=b [-1d]`)
+	assert.Equal(`app.req:a=b`, pattern)
+
+	_, _, err := ParseShiftedSelector(`app.req [-7q]`)
+	assert.Error(err)
+}
+
+func TestSeriesSelection(t *testing.T) {
+	assert := require.New(t)
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+	metrics := make([]*Metric, 0)
+
+	for i, values := range [][]float64{
+		{1, 2, 3},
+		{10, 10, 10},
+		{0, 50, 5},
+		{4, 4, 4},
+	} {
+		metric := NewMetric(`mobius.test.select.cpu:host=` + string(rune('a'+i)))
+
+		for j, v := range values {
+			metric.Push(epoch.Add(time.Duration(j)*time.Second), v)
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	hosts := func(metrics []*Metric) []interface{} {
+		out := make([]interface{}, len(metrics))
+
+		for i, metric := range metrics {
+			out[i] = metric.GetTag(`host`)
+		}
+
+		return out
+	}
+
+	selected, rest := TopK(metrics, 2, Mean)
+	assert.Equal([]interface{}{`c`, `b`}, hosts(selected))
+	assert.Len(rest, 2)
+
+	selected, _ = TopK(metrics, 1, Last)
+	assert.Equal([]interface{}{`b`}, hosts(selected))
+
+	selected, _ = BottomK(metrics, 2, Maximum)
+	assert.Equal([]interface{}{`a`, `d`}, hosts(selected))
+
+	selected, _ = TopK(metrics, 10, Mean)
+	assert.Len(selected, 4)
+
+	selected, rest = Above(metrics, 5, Mean)
+	assert.Equal([]interface{}{`b`, `c`}, hosts(selected))
+	assert.Equal([]interface{}{`a`, `d`}, hosts(rest))
+
+	selected, _ = Below(metrics, 4, Maximum)
+	assert.Equal([]interface{}{`a`}, hosts(selected))
+
+	selected, _ = MostDeviant(metrics, 1)
+	assert.Equal([]interface{}{`c`}, hosts(selected))
+
+	// everything not selected is summed into one series
+	_, rest = TopK(metrics, 2, Mean)
+	other := OtherSeries(rest)
+	assert.Equal(OtherSeriesName, other.GetName())
+	assert.Equal([]float64{5, 6, 7}, other.Points().Values())
+	assert.Nil(OtherSeries(nil))
+
+	selector, err := ParseSeriesSelector(`bottomk(1, max)`)
+	assert.NoError(err)
+	selected, _ = selector(metrics)
+	assert.Equal([]interface{}{`a`}, hosts(selected))
+
+	for _, spec := range []string{`topk`, `topk(x)`, `topk(1.5)`, `topk(2, bogus)`, `mostDeviant(2, mean)`, `nope(1)`} {
+		_, err := ParseSeriesSelector(spec)
+		assert.Error(err, spec)
+	}
+}
+
+func TestAggregateMetrics(t *testing.T) {
+	assert := require.New(t)
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+	metrics := make([]*Metric, 0)
+
+	for i, tags := range []string{
+		`region=us,env=prod,host=a`,
+		`region=us,env=prod,host=b`,
+		`region=us,env=dev,host=c`,
+		`region=eu,env=prod,host=d`,
+	} {
+		metric := NewMetric(`mobius.test.aggregate.requests:` + tags)
+
+		// each host reports at a slightly different offset within each second
+		for j := 0; j < 3; j++ {
+			metric.Push(epoch.Add(time.Duration(j)*time.Second+time.Duration(i*100)*time.Millisecond), float64((i+1)*10))
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	// merging only interleaves the points, unless a reducer is given
+	merged := MergeMetrics(metrics, `region`)
+	assert.Len(merged, 2)
+	assert.Len(merged[1].Points(), 9)
+
+	merged = MergeMetrics(metrics, `region`, Sum)
+	assert.Len(merged, 2)
+	assert.Equal([]float64{60, 60, 60}, merged[1].Points().Values())
+
+	aggregated := AggregateMetrics(metrics, `region`, time.Second, Sum)
+	assert.Len(aggregated, 2)
+	assert.Equal(`mobius.test.aggregate.requests`, aggregated[0].GetName())
+	assert.Equal(map[string]interface{}{`region`: `eu`, `env`: `prod`, `host`: `d`}, aggregated[0].GetTags())
+	assert.Equal([]float64{40, 40, 40}, aggregated[0].Points().Values())
+	assert.Equal(map[string]interface{}{`region`: `us`}, aggregated[1].GetTags())
+	assert.Equal([]float64{60, 60, 60}, aggregated[1].Points().Values())
+	assert.True(aggregated[1].Points()[1].Timestamp.Equal(epoch.Add(time.Second)))
+
+	aggregated = AggregateMetrics(metrics, `region,env`, time.Second, Maximum)
+	assert.Len(aggregated, 3)
+	assert.Equal(map[string]interface{}{`region`: `us`, `env`: `prod`}, aggregated[2].GetTags())
+	assert.Equal([]float64{20, 20, 20}, aggregated[2].Points().Values())
+
+	assert.Len(MergeMetrics(metrics, `region,env`), 3)
+
+	// everything is aggregated together if there is no grouping
+	aggregated = AggregateMetrics(metrics, ``, time.Minute, Mean)
+	assert.Len(aggregated, 1)
+	assert.Equal([]float64{25}, aggregated[0].Points().Values())
+
+	// intervals are aligned to the epoch even when they don't divide an hour
+	bucketing := TimeBucketing{
+		Size: 7 * time.Minute,
+	}
+
+	aggregated = AggregateMetrics(metrics, ``, 7*time.Minute, Sum)
+	assert.Len(aggregated, 1)
+	assert.True(aggregated[0].Points()[0].Timestamp.Equal(bucketing.Start(epoch)))
+
+	// time-weighted reducers are applied to each series, then averaged across them
+	twa, ok := LookupReducer(`time-weighted-mean`)
+	assert.True(ok)
+
+	aggregated = AggregateMetrics(metrics, `region`, time.Second, twa)
+	assert.Equal([]float64{20, 20, 20}, aggregated[1].Points().Values())
+
+	// sketches are merged across series
+	latencies := make([]*Metric, 0)
+
+	for _, host := range []string{`a`, `b`} {
+		metric := NewMetric(`mobius.test.aggregate.latency:host=` + host)
+
+		for i := 1; i <= 50; i++ {
+			sketch := NewSketch()
+
+			if host == `a` {
+				sketch.Add(float64(i))
+			} else {
+				sketch.Add(float64(i + 50))
+			}
+
+			metric.PushSketch(epoch, sketch)
+		}
+
+		latencies = append(latencies, metric)
+	}
+
+	aggregated = AggregateMetrics(latencies, ``, time.Second, Percent50)
+	assert.Len(aggregated, 1)
+	assert.Equal(SketchType, aggregated[0].Type)
+	assert.Equal(uint64(100), aggregated[0].Points()[0].Sketch.Count())
+	assert.InDelta(50, aggregated[0].Points()[0].Value, 2)
+}
+
+func TestMetricFill(t *testing.T) {
+	assert := require.New(t)
+
+	epoch := time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC)
+	bucketing := TimeBucketing{
+		Size: time.Minute,
+	}
+
+	metric := NewMetric(`mobius.test.fill`)
+	metric.Push(epoch.Add(1*time.Minute+5*time.Second), 10)
+	metric.Push(epoch.Add(2*time.Minute+5*time.Second), 20)
+	metric.Push(epoch.Add(5*time.Minute+5*time.Second), 50)
+
+	consolidated := metric.ConsolidateBuckets(bucketing, Sum)
+	assert.Len(consolidated.Points(), 3)
+
+	_, err := ParseFillPolicy(`sideways`)
+	assert.Error(err)
+
+	policy, err := ParseFillPolicy(`nan`)
+	assert.NoError(err)
+	assert.Equal(FillNull, policy)
+
+	start := epoch
+	end := epoch.Add(6*time.Minute + 30*time.Second)
+
+	assert.Equal(consolidated, consolidated.FillBuckets(bucketing, FillNone, start, end))
+
+	filled := consolidated.FillBuckets(bucketing, FillNull, start, end)
+	values := filled.Points().Values()
+	assert.Len(values, 7)
+	assert.True(math.IsNaN(values[0]))
+	assert.Equal([]float64{10, 20}, values[1:3])
+	assert.True(math.IsNaN(values[3]))
+	assert.True(math.IsNaN(values[4]))
+	assert.Equal(float64(50), values[5])
+	assert.True(math.IsNaN(values[6]))
+	assert.True(filled.Points()[3].Timestamp.Equal(epoch.Add(3 * time.Minute)))
+
+	assert.Equal([]float64{0, 10, 20, 0, 0, 50, 0}, consolidated.FillBuckets(bucketing, FillZero, start, end).Points().Values())
+	assert.Equal([]float64{10, 20, 20, 20, 50, 50}, consolidated.FillBuckets(bucketing, FillPrevious, start, end).Points().Values()[1:])
+	assert.Equal([]float64{10, 20, 30, 40, 50}, consolidated.FillBuckets(bucketing, FillLinear, start, end).Points().Values()[1:6])
+
+	// without a range, only the gaps between the first and last points are filled
+	assert.Equal([]float64{10, 20, 0, 0, 50}, consolidated.FillBuckets(bucketing, FillZero, time.Time{}, time.Time{}).Points().Values())
+
+	data, err := json.Marshal(filled.Points()[:2])
+	assert.NoError(err)
+	assert.Equal(`[{"time":"2006-01-02T15:00:00Z","value":null},{"time":"2006-01-02T15:01:00Z","value":10}]`, string(data))
+}
+
+func TestMetricHoltWinters(t *testing.T) {
+	assert := require.New(t)
+
+	epoch := time.Date(2006, 1, 2, 0, 0, 0, 0, time.UTC)
+	pattern := []float64{0, 5, 0, -5}
+	metric := NewMetric(`mobius.test.forecast:host=a`)
+
+	for i := 0; i < 40; i++ {
+		metric.Push(epoch.Add(time.Duration(i)*time.Hour), 100+float64(i)+pattern[i%4])
+	}
+
+	forecast, err := metric.HoltWinters(ForecastOptions{
+		Season: Window{Duration: 4 * time.Hour},
+		Ahead:  8,
+		Alpha:  0.5,
+		Beta:   0.5,
+		Gamma:  0.5,
+	})
+
+	assert.NoError(err)
+	assert.Equal(`mobius.test.forecast.forecast`, forecast.Forecast.GetName())
+	assert.Equal(map[string]interface{}{`host`: `a`}, forecast.Upper.GetTags())
+	assert.Equal(true, forecast.Forecast.Metadata[`forecast`])
+	assert.Equal(`lower`, forecast.Lower.Metadata[`band`])
+
+	points := forecast.Forecast.Points()
+	assert.Len(points, 9)
+	assert.True(points[0].Timestamp.Equal(epoch.Add(39 * time.Hour)))
+	assert.True(points[8].Timestamp.Equal(epoch.Add(47 * time.Hour)))
+
+	// the trend and season continue
+	for h := 1; h <= 8; h++ {
+		i := 39 + h
+		assert.InDelta(100+float64(i)+pattern[i%4], points[h].Value, 0.5)
+		assert.True(forecast.Upper.Points()[h].Value >= points[h].Value)
+		assert.True(forecast.Lower.Points()[h].Value <= points[h].Value)
+	}
+
+	// the bands widen further ahead
+	width := func(h int) float64 {
+		return forecast.Upper.Points()[h].Value - forecast.Lower.Points()[h].Value
+	}
+
+	assert.True(width(8) >= width(1))
+
+	_, err = metric.HoltWinters(ForecastOptions{
+		Season: Window{Points: 30},
+		Ahead:  1,
+	})
+
+	assert.Error(err)
+
+	_, err = metric.HoltWinters(ForecastOptions{
+		Season: Window{Points: 4},
+		Ahead:  1,
+		Alpha:  2,
+	})
+
+	assert.Error(err)
+
+	// without seasonality, a straight line is projected
+	line := NewMetric(`mobius.test.forecast.line`)
+
+	for i := 0; i < 10; i++ {
+		line.Push(epoch.Add(time.Duration(i)*time.Minute), float64(2*i))
+	}
+
+	forecast, err = line.HoltWinters(ForecastOptions{
+		Ahead: 2,
+	})
+
+	assert.NoError(err)
+	assert.InDelta(20, forecast.Forecast.Points()[1].Value, 0.001)
+	assert.InDelta(22, forecast.Forecast.Points()[2].Value, 0.001)
+}
+
+func TestMetricAnomalies(t *testing.T) {
+	assert := require.New(t)
+
+	epoch := time.Date(2006, 1, 2, 0, 0, 0, 0, time.UTC)
+	metric := NewMetric(`mobius.test.anomalies:host=a`)
+
+	for i := 0; i < 50; i++ {
+		value := float64(i % 5)
+
+		if i == 30 {
+			value = 100
+		}
+
+		metric.Push(epoch.Add(time.Duration(i)*time.Minute), value)
+	}
+
+	_, err := ParseAnomalyDetector(`tealeaves`)
+	assert.Error(err)
+
+	for _, options := range []AnomalyOptions{
+		{Detector: MADDetector},
+		{Detector: ZScoreDetector, Window: Window{Points: 10}},
+		{Detector: MADDetector, Window: Window{Duration: 10 * time.Minute}},
+	} {
+		anomalies, err := metric.DetectAnomalies(options)
+		assert.NoError(err)
+		assert.Equal(`mobius.test.anomalies.anomaly.score`, anomalies.Scores.GetName())
+		assert.Equal(map[string]interface{}{`host`: `a`}, anomalies.Anomalous.GetTags())
+		assert.Len(anomalies.Scores.Points(), 50)
+
+		flagged := anomalies.Points()
+		assert.Len(flagged, 1, "%+v", options)
+		assert.Equal(float64(100), flagged[0].Value)
+		assert.True(flagged[0].Timestamp.Equal(epoch.Add(30 * time.Minute)))
+		assert.Equal(float64(1), anomalies.Anomalous.Points()[30].Value)
+		assert.True(anomalies.Severity() > 10)
+	}
+
+	// by default, points are compared against a bounded trailing window, so a level shift is only
+	// anomalous until the window has caught up with it
+	shifted := NewMetric(`mobius.test.anomalies.shifted`)
+
+	for i := 0; i < 4*DefaultAnomalyWindow; i++ {
+		value := float64(i % 5)
+
+		if i >= 2*DefaultAnomalyWindow {
+			value += 1000
+		}
+
+		shifted.Push(epoch.Add(time.Duration(i)*time.Minute), value)
+	}
+
+	anomalies, err := shifted.DetectAnomalies(AnomalyOptions{})
+	assert.NoError(err)
+	assert.NotEmpty(anomalies.Points())
+
+	for _, point := range anomalies.Points() {
+		offset := int(point.Timestamp.Sub(epoch) / time.Minute)
+		assert.True(offset >= 2*DefaultAnomalyWindow && offset < 3*DefaultAnomalyWindow, "%d", offset)
+	}
+
+	// rolling scores need some history
+	anomalies, err = metric.DetectAnomalies(AnomalyOptions{
+		Detector: ZScoreDetector,
+		Window:   Window{Points: 10},
+	})
+
+	assert.NoError(err)
+	assert.True(math.IsNaN(anomalies.Scores.Points()[0].Value))
+
+	// a value that is normal at one time of day is anomalous at another
+	daily := NewMetric(`mobius.test.anomalies.daily`)
+
+	for i := 0; i < 72; i++ {
+		value := float64(i % 24)
+
+		if i == 60 {
+			value = 1
+		}
+
+		daily.Push(epoch.Add(time.Duration(i)*time.Hour), value)
+	}
+
+	anomalies, err = daily.DetectAnomalies(AnomalyOptions{
+		Detector: SeasonalDetector,
+		Window:   Window{Duration: 24 * time.Hour},
+	})
+
+	assert.NoError(err)
+	assert.Len(anomalies.Points(), 1)
+	assert.True(anomalies.Points()[0].Timestamp.Equal(epoch.Add(60 * time.Hour)))
+
+	_, err = daily.DetectAnomalies(AnomalyOptions{
+		Detector: SeasonalDetector,
+	})
+
+	assert.Error(err)
+
+	ranked, err := RankAnomalies([]*Metric{daily, metric}, AnomalyOptions{})
+	assert.NoError(err)
+	assert.Len(ranked, 1)
+	assert.Equal(metric, ranked[0].Metric)
+}
+
+func TestMetricHistogram(t *testing.T) {
+	assert := require.New(t)
+
+	epoch := time.Date(2006, 1, 2, 0, 0, 0, 0, time.UTC)
+	metric := NewMetric(`mobius.test.histogram:host=a`)
+
+	for i := 1; i <= 100; i++ {
+		metric.Push(epoch.Add(time.Duration(i)*time.Second), float64(i))
+	}
+
+	histogram, err := metric.Histogram(HistogramOptions{
+		Buckets: 4,
+	})
+
+	assert.NoError(err)
+	assert.Equal(`mobius.test.histogram`, histogram.Name)
+	assert.Len(histogram.Buckets, 4)
+	assert.Equal(float64(1), histogram.Buckets[0].Lower)
+	assert.Equal(float64(100), histogram.Buckets[3].Upper)
+	assert.Equal(100, histogram.Count())
+
+	histogram, err = metric.Histogram(HistogramOptions{
+		Boundaries: []float64{10, 20, 50},
+	})
+
+	assert.NoError(err)
+	assert.Equal(10, histogram.Buckets[0].Count)
+	assert.Equal(31, histogram.Buckets[1].Count)
+	assert.Equal(9, histogram.Underflow)
+	assert.Equal(50, histogram.Overflow)
+
+	histogram, err = metric.Histogram(HistogramOptions{
+		Scale:   LogHistogram,
+		Buckets: 2,
+	})
+
+	assert.NoError(err)
+	assert.InDelta(10, histogram.Buckets[0].Upper, 1e-9)
+	assert.Equal(9, histogram.Buckets[0].Count)
+	assert.Equal(91, histogram.Buckets[1].Count)
+
+	_, err = metric.Histogram(HistogramOptions{
+		Scale: LogHistogram,
+		Min:   -1,
+		Max:   10,
+	})
+
+	assert.Error(err)
+
+	_, err = metric.Histogram(HistogramOptions{
+		Buckets: MaxHistogramBuckets + 1,
+	})
+
+	assert.Error(err)
+
+	// only the missing bound is taken from the data
+	histogram, err = metric.Histogram(HistogramOptions{
+		Buckets: 2,
+		Min:     math.NaN(),
+		Max:     50,
+	})
+
+	assert.NoError(err)
+	assert.Equal(float64(1), histogram.Buckets[0].Lower)
+	assert.Equal(float64(50), histogram.Buckets[1].Upper)
+	assert.Equal(50, histogram.Overflow)
+
+	_, err = ParseHistogramBoundaries(`1,5,3`)
+	assert.Error(err)
+
+	boundaries, err := ParseHistogramBoundaries(`0, 0.5, 1`)
+	assert.NoError(err)
+	assert.Equal([]float64{0, 0.5, 1}, boundaries)
+
+	// histograms of several series share their boundaries
+	other := NewMetric(`mobius.test.histogram:host=b`)
+	other.Push(epoch, 1000)
+
+	histograms, err := HistogramMetrics([]*Metric{metric, other}, HistogramOptions{
+		Buckets: 10,
+	})
+
+	assert.NoError(err)
+	assert.Len(histograms, 2)
+	assert.Equal(100, histograms[0].Buckets[0].Count)
+	assert.Equal(1, histograms[1].Buckets[9].Count)
+	assert.Equal(float64(100.9), histograms[1].Buckets[0].Upper)
+}
+
+func TestMetricHeatmap(t *testing.T) {
+	assert := require.New(t)
+
+	epoch := time.Date(2006, 1, 2, 0, 0, 0, 0, time.UTC)
+	fast := NewMetric(`mobius.test.heatmap.latency:host=a`)
+	slow := NewMetric(`mobius.test.heatmap.latency:host=b`)
+
+	for i := 0; i < 120; i++ {
+		fast.Push(epoch.Add(time.Duration(i)*time.Second), float64(1+i%10))
+
+		if i >= 60 {
+			slow.Push(epoch.Add(time.Duration(i)*time.Second), 100)
+		}
+	}
+
+	_, err := MakeHeatmap([]*Metric{fast, slow}, 0, HistogramOptions{})
+	assert.Error(err)
+
+	heatmap, err := MakeHeatmap([]*Metric{fast, slow}, time.Minute, HistogramOptions{
+		Boundaries: []float64{0, 10, 50, 100},
+	})
+
+	assert.NoError(err)
+	assert.Len(heatmap.Times, 2)
+	assert.True(heatmap.Times[1].Equal(epoch.Add(time.Minute)))
+	assert.Equal([][]int{{54, 6, 0}, {54, 6, 60}}, heatmap.Counts)
+	assert.Equal(60, heatmap.MaxCount())
+
+	assert.Equal(drawing.ColorFromHex(`ffffcc`), PaletteHeat.Gradient(0))
+	assert.Equal(drawing.ColorFromHex(`800026`), PaletteHeat.Gradient(1))
+	assert.Equal(drawing.ColorFromHex(`800026`), PaletteHeat.Gradient(2))
+}
+
+func TestMetricTimeWeighted(t *testing.T) {
+	assert := require.New(t)
+
+	// a gauge that sat at 100 for an hour, except for one second at 0
+	metric := NewMetric(`mobius.test.time_weighted`)
+	metric.Push(time.Date(2006, 1, 2, 10, 0, 0, 0, time.UTC), 100)
+	metric.Push(time.Date(2006, 1, 2, 10, 59, 59, 0, time.UTC), 0)
+	metric.Push(time.Date(2006, 1, 2, 11, 0, 0, 0, time.UTC), 100)
+
+	twp1, ok := GetTimeReducer(`time-weighted-percentile(0.01)`)
+	assert.True(ok)
+	twp50, ok := GetTimeReducer(`twp(50)`)
+	assert.True(ok)
+	above, ok := GetTimeReducer(`duration-above(50)`)
+	assert.True(ok)
+
+	summary := SummarizeMetric(metric, Mean, TimeWeightedMean, Integral, twp1, twp50, above)
+	assert.InDelta(66.667, summary[0], 0.001)
+	assert.InDelta(99.972, summary[1], 0.001)
+	assert.Equal(float64(359900), summary[2])
+	assert.Equal(float64(0), summary[3])
+	assert.Equal(float64(100), summary[4])
+	assert.Equal(float64(3599), summary[5])
+
+	// each bucket's last point holds until the end of the bucket
+	consolidated := metric.Consolidate(time.Hour, TimeWeightedMean)
+	points := consolidated.Points()
+	assert.Len(points, 2)
+	assert.InDelta(99.972, points[0].Value, 0.001)
+	assert.Equal(float64(100), points[1].Value)
+
+	consolidated = metric.Consolidate(time.Hour, Integral)
+	assert.Equal(float64(359900), consolidated.Points()[0].Value)
+	assert.Equal(float64(360000), consolidated.Points()[1].Value)
+
+	// a lone point has no duration to weigh it by
+	single := NewMetric(`mobius.test.time_weighted.single`)
+	single.Push(time.Date(2006, 1, 2, 10, 0, 0, 0, time.UTC), 42)
+	assert.Equal([]float64{42, 0}, SummarizeMetric(single, TimeWeightedMean, Integral))
+	assert.Equal([]float64{0}, SummarizeMetric(NewMetric(`empty`), TimeWeightedMean))
+
+	// time-weighted reducers also rank series
+	low := NewMetric(`mobius.test.time_weighted.low`)
+	low.Push(time.Date(2006, 1, 2, 10, 0, 0, 0, time.UTC), 90)
+	low.Push(time.Date(2006, 1, 2, 11, 0, 0, 0, time.UTC), 90)
+
+	ranked := RankMetrics([]*Metric{low, metric}, TimeWeightedMean)
+	assert.Equal(metric, ranked[0])
+	ranked = RankMetrics([]*Metric{low, metric}, Mean)
+	assert.Equal(low, ranked[0])
+}
+
+func TestMetricDownsample(t *testing.T) {
+	assert := require.New(t)
+
+	metric := NewMetric(`mobius.test.downsample`)
+	metric.SetTags(map[string]interface{}{`host`: `a`})
+	metric.Metadata[`color`] = `#ff0000`
+	start := time.Date(2006, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 1000; i++ {
+		value := float64(i % 7)
+
+		switch i {
+		case 500:
+			value = 1000
+		case 700:
+			value = -1000
+		}
+
+		metric.Push(start.Add(time.Duration(i)*time.Second), value)
+	}
+
+	// averaging flattens the peaks that downsampling keeps
+	assert.True(Reduce(Maximum, metric.Consolidate(20*time.Second, Mean).Points().Values()...) < 100)
+
+	for _, method := range []DownsampleMethod{LTTBDownsampling, MinMaxDownsampling} {
+		downsampled := metric.Downsample(50, method)
+		points := downsampled.Points()
+		values := points.Values()
+
+		assert.True(len(points) <= 50, string(method))
+		assert.True(len(points) >= 40, string(method))
+		assert.Equal(float64(1000), Reduce(Maximum, values...), string(method))
+		assert.Equal(float64(-1000), Reduce(Minimum, values...), string(method))
+		assert.True(sort.IsSorted(points), string(method))
+		assert.Equal(`a`, downsampled.GetTags()[`host`])
+		assert.Equal(`#ff0000`, downsampled.Metadata[`color`])
+	}
+
+	points := metric.Downsample(50, LTTBDownsampling).Points()
+	assert.Len(points, 50)
+	assert.True(points[0].Timestamp.Equal(start))
+	assert.True(points[49].Timestamp.Equal(start.Add(999 * time.Second)))
+
+	// short series are left alone
+	assert.Equal(metric, metric.Downsample(1000, LTTBDownsampling))
+	assert.Equal(metric, metric.Downsample(0, LTTBDownsampling))
+
+	// gaps survive downsampling
+	gappy := NewMetric(`mobius.test.downsample.gaps`)
+
+	for i := 0; i < 1000; i++ {
+		if i >= 400 && i < 600 {
+			gappy.Push(start.Add(time.Duration(i)*time.Second), math.NaN())
+		} else {
+			gappy.Push(start.Add(time.Duration(i)*time.Second), float64(i%7))
+		}
+	}
+
+	for _, method := range []DownsampleMethod{LTTBDownsampling, MinMaxDownsampling} {
+		gaps := 0
+
+		for _, point := range gappy.Downsample(50, method).Points() {
+			if math.IsNaN(point.Value) {
+				gaps++
+			}
+		}
+
+		assert.True(gaps > 0, string(method))
+	}
+
+	method, err := ParseDownsampleMethod(`MinMax`)
+	assert.NoError(err)
+	assert.Equal(MinMaxDownsampling, method)
+
+	_, err = ParseDownsampleMethod(`bogus`)
+	assert.Error(err)
+}
@@ -16,14 +16,11 @@ func (self CarbonParser) Parse(line string) (string, Point, error) {
 
 	if len(parts) >= 3 {
 		if epoch, err := strconv.ParseInt(parts[2], 10, 64); err == nil {
-			if value, err := strconv.ParseFloat(parts[1], 32); err == nil {
+			if point, err := parsePoint(time.Unix(epoch, 0), parts[1]); err == nil {
 				metricName := parts[0]
 				metricName = strings.TrimSpace(metricName)
 
-				return metricName, Point{
-					Timestamp: time.Unix(epoch, 0),
-					Value:     value,
-				}, nil
+				return metricName, point, nil
 			}
 		}
 	}
@@ -0,0 +1,132 @@
+package mobius
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type InfluxParser struct {
+	Parser
+}
+
+// Parses a line in the InfluxDB line protocol ("measurement,tag=value field=1,other=2i 1136239445000000000").
+// Lines consisting of a single field named "value" produce a single-valued point; all others produce
+// a multi-field point.
+func (self InfluxParser) Parse(line string) (string, Point, error) {
+	parts := splitEscaped(strings.TrimSpace(line), ' ')
+
+	if len(parts) >= 2 {
+		timestamp := time.Now()
+
+		if len(parts) >= 3 {
+			if epochNs, err := strconv.ParseInt(parts[2], 10, 64); err == nil {
+				timestamp = time.Unix(0, epochNs)
+			} else {
+				return ``, Point{}, fmt.Errorf("Invalid InfluxDB timestamp %q", parts[2])
+			}
+		}
+
+		series := splitEscaped(parts[0], ',')
+		metricName := unescapeInflux(series[0])
+		tags := make([]string, 0)
+
+		for _, tag := range series[1:] {
+			tags = append(tags, unescapeInflux(tag))
+		}
+
+		if len(tags) > 0 {
+			sort.Strings(tags)
+			metricName = metricName + NameTagsDelimiter + strings.Join(tags, InlineTagSeparator)
+		}
+
+		fields := make(map[string]float64)
+		pairs := splitEscaped(parts[1], ',')
+
+		for _, pair := range pairs {
+			kv := splitEscaped(pair, '=')
+
+			if len(kv) != 2 {
+				return ``, Point{}, fmt.Errorf("Invalid InfluxDB field %q", pair)
+			}
+
+			key := unescapeInflux(kv[0])
+			value := kv[1]
+
+			switch value {
+			case `t`, `T`, `true`, `True`, `TRUE`:
+				fields[key] = 1
+			case `f`, `F`, `false`, `False`, `FALSE`:
+				fields[key] = 0
+			default:
+				if strings.HasPrefix(value, `"`) {
+					// string fields have no numeric representation
+					continue
+				} else if strings.HasSuffix(value, `i`) && len(pairs) == 1 && key == `value` {
+					// a lone integer "value" field is preserved exactly
+					if v, err := strconv.ParseInt(strings.TrimSuffix(value, `i`), 10, 64); err == nil {
+						return metricName, IntegerPoint(timestamp, v), nil
+					}
+				}
+
+				if v, err := strconv.ParseFloat(strings.TrimSuffix(value, `i`), 64); err == nil {
+					fields[key] = v
+				} else {
+					return ``, Point{}, fmt.Errorf("Invalid InfluxDB field value %q", value)
+				}
+			}
+		}
+
+		if len(fields) == 0 {
+			return ``, Point{}, fmt.Errorf("No numeric fields in InfluxDB metric line %q", line)
+		} else if v, ok := fields[`value`]; ok && len(fields) == 1 {
+			return metricName, Point{
+				Timestamp: timestamp,
+				Value:     v,
+			}, nil
+		}
+
+		return metricName, FieldsPoint(timestamp, fields), nil
+	}
+
+	return ``, Point{}, fmt.Errorf("Invalid InfluxDB metric line %q", line)
+}
+
+// Splits a string on the given separator, ignoring separators escaped with a backslash or
+// appearing inside double quotes.
+func splitEscaped(in string, separator rune) []string {
+	parts := make([]string, 0)
+	current := make([]rune, 0)
+	escaped := false
+	quoted := false
+
+	for _, c := range in {
+		switch {
+		case escaped:
+			current = append(current, '\\', c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+			current = append(current, c)
+		case c == separator && !quoted:
+			parts = append(parts, string(current))
+			current = make([]rune, 0)
+		default:
+			current = append(current, c)
+		}
+	}
+
+	return append(parts, string(current))
+}
+
+func unescapeInflux(in string) string {
+	return strings.NewReplacer(`\ `, ` `, `\,`, `,`, `\=`, `=`).Replace(in)
+}
+
+func escapeInflux(in string) string {
+	return strings.NewReplacer(` `, `\ `, `,`, `\,`, `=`, `\=`).Replace(in)
+}
@@ -18,7 +18,7 @@ func (self KairosParser) Parse(line string) (string, Point, error) {
 	if len(parts) >= 4 {
 		if parts[0] == `put` {
 			if epochMs, err := strconv.ParseInt(parts[2], 10, 64); err == nil {
-				if value, err := strconv.ParseFloat(parts[3], 32); err == nil {
+				if point, err := parsePoint(time.Unix(0, epochMs*int64(time.Millisecond)), parts[3]); err == nil {
 					tags := parts[4:]
 					metricName := parts[1]
 
@@ -30,10 +30,7 @@ func (self KairosParser) Parse(line string) (string, Point, error) {
 
 					metricName = strings.TrimSpace(metricName)
 
-					return metricName, Point{
-						Timestamp: time.Unix(0, epochMs*int64(time.Millisecond)),
-						Value:     value,
-					}, nil
+					return metricName, point, nil
 				}
 			}
 		}
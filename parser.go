@@ -1,5 +1,10 @@
 package mobius
 
+import (
+	"strconv"
+	"time"
+)
+
 type Parser interface {
 	Parse(string) (string, Point, error)
 }
@@ -8,9 +13,26 @@ func GetParser(name string) (Parser, bool) {
 	switch name {
 	case `graphite`:
 		return CarbonParser{}, true
+	case `influxdb`:
+		return InfluxParser{}, true
 	case `kairosdb`:
 		return KairosParser{}, true
 	default:
 		return nil, false
 	}
 }
+
+// Parses a numeric value into a point.  Integer literals are preserved exactly as integers; all
+// other values are parsed at full 64-bit floating point precision.
+func parsePoint(timestamp time.Time, value string) (Point, error) {
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return IntegerPoint(timestamp, i), nil
+	} else if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return Point{
+			Timestamp: timestamp,
+			Value:     f,
+		}, nil
+	} else {
+		return Point{}, err
+	}
+}
@@ -0,0 +1,58 @@
+package mobius
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseInfluxDB(t *testing.T) {
+	assert := require.New(t)
+	parser, ok := GetParser(`influxdb`)
+	assert.True(ok)
+
+	name, point, err := parser.Parse(`app.latency,host=web\ 1,env=prod count=42i,sum=1.5,min=0.25,max=0.75,note="hi" 1136239445000000000`)
+	assert.NoError(err)
+	assert.Equal(`app.latency:env=prod,host=web 1`, name)
+	assert.Equal(FieldsType, point.Type)
+	assert.Equal(time.Unix(0, 1136239445000000000), point.Timestamp)
+	assert.Equal(map[string]float64{
+		`count`: 42,
+		`sum`:   1.5,
+		`min`:   0.25,
+		`max`:   0.75,
+	}, point.Fields)
+
+	name, point, err = parser.Parse(`app.bytes value=9007199254740993i 1136239445000000000`)
+	assert.NoError(err)
+	assert.Equal(`app.bytes`, name)
+	assert.Equal(IntegerType, point.Type)
+	assert.Equal(int64(9007199254740993), point.Integer)
+
+	_, _, err = parser.Parse(`app.bytes`)
+	assert.Error(err)
+}
+
+func TestFormatInfluxDB(t *testing.T) {
+	assert := require.New(t)
+	formatter, ok := GetFormatter(`influxdb`)
+	assert.True(ok)
+
+	metric := NewMetric(`app.latency:host=web1`)
+	metric.PushFields(time.Unix(1136239445, 0), map[string]float64{
+		`max`:   0.75,
+		`count`: 42,
+	})
+
+	assert.Equal(
+		`app.latency,host=web1 count=42,max=0.75 1136239445000000000`,
+		formatter.Format(metric, metric.Points()[0]),
+	)
+
+	graphite, _ := GetFormatter(`graphite`)
+
+	assert.Equal(
+		"app.latency#count:host=web1 42 1136239445\napp.latency#max:host=web1 0.75 1136239445",
+		graphite.Format(metric, metric.Points()[0]),
+	)
+}
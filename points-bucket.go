@@ -0,0 +1,178 @@
+package mobius
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A calendar unit whose boundaries buckets may be aligned to.
+type CalendarUnit string
+
+const (
+	MinuteBuckets CalendarUnit = `minute`
+	HourBuckets   CalendarUnit = `hour`
+	DayBuckets    CalendarUnit = `day`
+	WeekBuckets   CalendarUnit = `week`
+	MonthBuckets  CalendarUnit = `month`
+)
+
+// Describes how points are divided into time buckets.  Buckets are either a fixed duration wide and
+// aligned to the Unix epoch, or span one calendar unit (e.g. a day, or an ISO week starting on Monday.)
+// Boundaries are computed in the given location (UTC if nil), so that e.g. hourly buckets in a zone
+// with a half-hour offset start on the local hour.  Fixed-width buckets may instead be aligned to a
+// given origin.
+type TimeBucketing struct {
+	Size     time.Duration
+	Unit     CalendarUnit
+	Location *time.Location
+	Origin   time.Time
+}
+
+// Parses a bucket width given as a duration (e.g. "5m" or "1d") or the name of a calendar unit
+// ("minute", "hour", "day", "week", or "month"), with boundaries computed in the named time zone.
+func ParseTimeBucketing(spec string, zone string) (TimeBucketing, error) {
+	bucketing := TimeBucketing{}
+
+	if location, err := time.LoadLocation(zone); err == nil {
+		bucketing.Location = location
+	} else {
+		return bucketing, fmt.Errorf("invalid time zone %q: %v", zone, err)
+	}
+
+	switch unit := CalendarUnit(strings.ToLower(spec)); unit {
+	case MinuteBuckets, HourBuckets, DayBuckets, WeekBuckets, MonthBuckets:
+		bucketing.Unit = unit
+		return bucketing, nil
+	}
+
+	if d, err := time.ParseDuration(spec); err == nil {
+		bucketing.Size = d
+	} else if d, err := parsePromDuration(spec); err == nil {
+		bucketing.Size = d
+	} else {
+		return bucketing, fmt.Errorf("invalid bucket size %q, expected a duration or a calendar unit", spec)
+	}
+
+	if bucketing.Size <= 0 {
+		return bucketing, fmt.Errorf("bucket size must be positive")
+	}
+
+	return bucketing, nil
+}
+
+// Returns the nominal width of each bucket.  Months are taken to be 30 days long.
+func (self TimeBucketing) Duration() time.Duration {
+	switch self.Unit {
+	case MinuteBuckets:
+		return time.Minute
+	case HourBuckets:
+		return time.Hour
+	case DayBuckets:
+		return 24 * time.Hour
+	case WeekBuckets:
+		return 7 * 24 * time.Hour
+	case MonthBuckets:
+		return 30 * 24 * time.Hour
+	default:
+		return self.Size
+	}
+}
+
+// Returns the start of the bucket containing the given time.  If no location is set, the start is
+// returned in the location of the given time.
+func (self TimeBucketing) Start(t time.Time) time.Time {
+	if self.Location == nil {
+		self.Location = time.UTC
+		return self.Start(t).In(t.Location())
+	}
+
+	location := self.Location
+	t = t.In(location)
+
+	switch self.Unit {
+	case MinuteBuckets:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, location)
+	case HourBuckets:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, location)
+	case DayBuckets:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+	case WeekBuckets:
+		// ISO weeks start on Monday
+		return time.Date(t.Year(), t.Month(), t.Day()-(int(t.Weekday())+6)%7, 0, 0, 0, 0, location)
+	case MonthBuckets:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, location)
+	}
+
+	if self.Size <= 0 {
+		return t
+	}
+
+	var elapsed int64
+
+	if self.Origin.IsZero() {
+		// align to the epoch as observed in the bucketing location
+		_, offset := t.Zone()
+		elapsed = t.UnixNano() + int64(offset)*int64(time.Second)
+	} else {
+		elapsed = int64(t.Sub(self.Origin))
+	}
+
+	remainder := elapsed % int64(self.Size)
+
+	if remainder < 0 {
+		remainder += int64(self.Size)
+	}
+
+	return t.Add(-time.Duration(remainder))
+}
+
+// Returns the start of the bucket following the one starting at the given time.
+func (self TimeBucketing) Next(start time.Time) time.Time {
+	switch self.Unit {
+	case MinuteBuckets:
+		return start.Add(time.Minute)
+	case HourBuckets:
+		return start.Add(time.Hour)
+	case DayBuckets:
+		return start.AddDate(0, 0, 1)
+	case WeekBuckets:
+		return start.AddDate(0, 0, 7)
+	case MonthBuckets:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.Add(self.Size)
+	}
+}
+
+// Divides the given points into buckets according to the given bucketing, returning the non-empty
+// buckets in time order.  The points within each bucket are sorted.
+func (self TimeBucketing) Buckets(points PointSet) []PointSet {
+	pointsets := make([]PointSet, 0)
+	sorted := make(PointSet, len(points))
+	copy(sorted, points)
+	sort.Stable(sorted)
+
+	var current PointSet
+	var start time.Time
+
+	for _, point := range sorted {
+		if s := self.Start(point.Timestamp); current == nil || !s.Equal(start) {
+			if len(current) > 0 {
+				pointsets = append(pointsets, current)
+			}
+
+			current = make(PointSet, 0)
+			start = s
+		}
+
+		current = append(current, point)
+	}
+
+	if len(current) > 0 {
+		pointsets = append(pointsets, current)
+	}
+
+	return pointsets
+}
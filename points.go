@@ -1,18 +1,224 @@
 package mobius
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
 	"sort"
 	"time"
 )
 
+// Describes how the values of a series are represented and stored.
+type ValueType int
+
+const (
+	FloatType ValueType = iota
+	IntegerType
+	FieldsType
+	SketchType
+	UniqueType
+)
+
+func (self ValueType) String() string {
+	switch self {
+	case IntegerType:
+		return `integer`
+	case FieldsType:
+		return `fields`
+	case SketchType:
+		return `sketch`
+	case UniqueType:
+		return `unique`
+	default:
+		return `float`
+	}
+}
+
+func ParseValueType(name string) (ValueType, error) {
+	switch name {
+	case `float`, ``:
+		return FloatType, nil
+	case `integer`:
+		return IntegerType, nil
+	case `fields`:
+		return FieldsType, nil
+	case `sketch`:
+		return SketchType, nil
+	case `unique`:
+		return UniqueType, nil
+	default:
+		return FloatType, fmt.Errorf("Unknown value type %q", name)
+	}
+}
+
+// The character separating a metric name from a field name in selectors (e.g.: "app.latency#max")
+var FieldDelimiter = `#`
+
 type Point struct {
-	Timestamp time.Time `json:"time"`
-	Value     float64   `json:"value"`
+	Timestamp time.Time          `json:"time"`
+	Value     float64            `json:"value"`
+	Integer   int64              `json:"-"`
+	Fields    map[string]float64 `json:"fields,omitempty"`
+	Sketch    *Sketch            `json:"-"`
+	Unique    *HyperLogLog       `json:"-"`
+	Type      ValueType          `json:"-"`
+}
+
+// Creates a new point holding an exact integer value.
+func IntegerPoint(timestamp time.Time, value int64) Point {
+	return Point{
+		Timestamp: timestamp,
+		Value:     float64(value),
+		Integer:   value,
+		Type:      IntegerType,
+	}
+}
+
+// Creates a new point holding several named values observed at the same time.
+func FieldsPoint(timestamp time.Time, fields map[string]float64) Point {
+	return Point{
+		Timestamp: timestamp,
+		Fields:    fields,
+		Type:      FieldsType,
+	}
+}
+
+// Creates a new point holding a quantile sketch of many observations.  The point's value is the
+// median of the sketch.
+func SketchPoint(timestamp time.Time, sketch *Sketch) Point {
+	return Point{
+		Timestamp: timestamp,
+		Value:     sketch.Quantile(0.5),
+		Sketch:    sketch,
+		Type:      SketchType,
+	}
+}
+
+// Creates a new point holding a HyperLogLog set of distinct members.  The point's value is the
+// estimated number of distinct members.
+func UniquePoint(timestamp time.Time, set *HyperLogLog) Point {
+	return Point{
+		Timestamp: timestamp,
+		Value:     set.Estimate(),
+		Unique:    set,
+		Type:      UniqueType,
+	}
 }
 
 func (self Point) String() string {
-	return fmt.Sprintf("(%v, %f)", self.Timestamp, self.Value)
+	switch self.Type {
+	case IntegerType:
+		return fmt.Sprintf("(%v, %d)", self.Timestamp, self.Integer)
+	case FieldsType:
+		return fmt.Sprintf("(%v, %v)", self.Timestamp, self.Fields)
+	case SketchType:
+		return fmt.Sprintf("(%v, %f, n=%d)", self.Timestamp, self.Value, self.Sketch.Count())
+	default:
+		return fmt.Sprintf("(%v, %f)", self.Timestamp, self.Value)
+	}
+}
+
+// Returns the point's value as an integer.  Integer points return their exact value, whereas
+// floating point values are truncated.
+func (self Point) Int64() int64 {
+	switch self.Type {
+	case IntegerType:
+		return self.Integer
+	default:
+		return int64(self.Value)
+	}
+}
+
+func (self Point) isZero() bool {
+	switch self.Type {
+	case FieldsType:
+		for _, v := range self.Fields {
+			if v != 0 {
+				return false
+			}
+		}
+
+		return true
+	case SketchType:
+		return (self.Sketch == nil || self.Sketch.Count() == 0)
+	default:
+		return (self.Value == 0)
+	}
+}
+
+// Returns a copy of this point converted to the given value type.  An error is returned if the
+// value cannot be represented exactly in the target type.
+func (self Point) As(valueType ValueType) (Point, error) {
+	if self.Type == valueType {
+		return self, nil
+	} else if self.Type == FieldsType || valueType == FieldsType || valueType == UniqueType {
+		return self, fmt.Errorf("Cannot convert %v point to %v", self.Type, valueType)
+	}
+
+	switch valueType {
+	case IntegerType:
+		if self.Value != math.Trunc(self.Value) || math.IsInf(self.Value, 0) || math.IsNaN(self.Value) {
+			return self, fmt.Errorf("Cannot represent %v as an integer", self.Value)
+		}
+
+		return IntegerPoint(self.Timestamp, int64(self.Value)), nil
+	case SketchType:
+		sketch := NewSketch()
+		sketch.Add(self.Value)
+
+		return SketchPoint(self.Timestamp, sketch), nil
+	default:
+		return Point{
+			Timestamp: self.Timestamp,
+			Value:     self.Value,
+		}, nil
+	}
+}
+
+func (self Point) MarshalJSON() ([]byte, error) {
+	var value interface{}
+
+	switch self.Type {
+	case IntegerType:
+		value = self.Integer
+	case FieldsType:
+		return json.Marshal(struct {
+			Timestamp time.Time          `json:"time"`
+			Fields    map[string]float64 `json:"fields"`
+		}{
+			Timestamp: self.Timestamp,
+			Fields:    self.Fields,
+		})
+	case SketchType:
+		return json.Marshal(struct {
+			Timestamp time.Time   `json:"time"`
+			Value     interface{} `json:"value"`
+			Count     uint64      `json:"count"`
+		}{
+			Timestamp: self.Timestamp,
+			Value:     jsonFloat(self.Value),
+			Count:     self.Sketch.Count(),
+		})
+	default:
+		value = jsonFloat(self.Value)
+	}
+
+	return json.Marshal(struct {
+		Timestamp time.Time   `json:"time"`
+		Value     interface{} `json:"value"`
+	}{
+		Timestamp: self.Timestamp,
+		Value:     value,
+	})
+}
+
+// JSON cannot represent NaN or infinite values, so they are encoded as null.
+func jsonFloat(value float64) interface{} {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+
+	return value
 }
 
 type PointSet []Point
@@ -53,6 +259,124 @@ func (self PointSet) Values() []float64 {
 	return output
 }
 
+// Returns the individual observations represented by the points in the set.  This is the same as
+// Values() except for sketch points, which contribute the observations reconstructed from their
+// sketches.
+func (self PointSet) Observations() []float64 {
+	output := make([]float64, 0, len(self))
+
+	for _, point := range self {
+		if point.Type == SketchType && point.Sketch != nil {
+			output = append(output, point.Sketch.Values()...)
+		} else {
+			output = append(output, point.Value)
+		}
+	}
+
+	return output
+}
+
+// Returns the distinct observations represented by the points in the set along with how many times
+// each occurs, without expanding sketches into every observation they summarize.
+func (self PointSet) weightedObservations() []sketchBucket {
+	output := make([]sketchBucket, 0, len(self))
+
+	for _, point := range self {
+		if point.Type == SketchType && point.Sketch != nil {
+			output = append(output, point.Sketch.clampedBuckets()...)
+		} else {
+			output = append(output, sketchBucket{point.Value, 1})
+		}
+	}
+
+	return output
+}
+
+// Merges the sketches of all sketch points in the set into a single sketch.
+func (self PointSet) MergedSketch() *Sketch {
+	merged := NewSketch()
+
+	for _, point := range self {
+		if point.Sketch != nil {
+			merged.Merge(point.Sketch)
+		}
+	}
+
+	return merged
+}
+
+// Merges the HyperLogLogs of all distinct-count points in the set into a single set.
+func (self PointSet) MergedUnique() *HyperLogLog {
+	merged := NewHyperLogLog()
+
+	for _, point := range self {
+		if point.Unique != nil {
+			merged.Merge(point.Unique)
+		}
+	}
+
+	return merged
+}
+
+// Returns the exact integer values of all points in the set.
+func (self PointSet) Integers() []int64 {
+	output := make([]int64, len(self))
+
+	for i, point := range self {
+		output[i] = point.Int64()
+	}
+
+	return output
+}
+
+// Returns the names of all fields present in any point of the set, sorted.
+func (self PointSet) FieldNames() []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for _, point := range self {
+		for name := range point.Fields {
+			if !seen[name] {
+				names = append(names, name)
+				seen[name] = true
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Returns the points in the set that contain the named field, with that field as their value.
+func (self PointSet) FieldPoints(name string) PointSet {
+	output := make(PointSet, 0, len(self))
+
+	for _, point := range self {
+		if v, ok := point.Fields[name]; ok {
+			output = append(output, Point{
+				Timestamp: point.Timestamp,
+				Value:     v,
+			})
+		}
+	}
+
+	return output
+}
+
+// Returns the values of the named field from all points in the set that contain it.
+func (self PointSet) FieldValues(name string) []float64 {
+	output := make([]float64, 0, len(self))
+
+	for _, point := range self {
+		if v, ok := point.Fields[name]; ok {
+			output = append(output, v)
+		}
+	}
+
+	return output
+}
+
 func (self PointSet) Len() int {
 	return len(self)
 }
@@ -73,36 +397,39 @@ func (self PointSet) Swap(i, j int) {
 	}
 }
 
+// Divides the given points into buckets of the given duration, aligned to the Unix epoch.  The
+// buckets are returned in time order.
 func MakeTimeBuckets(points PointSet, duration time.Duration) []PointSet {
-	pointsets := make([]PointSet, 0)
-
-	if l := len(points); l > 0 {
-		currentBucket := make(PointSet, 0)
-		endOfBucket := points[l-1].Timestamp.Add(-1 * duration)
+	return TimeBucketing{
+		Size: duration,
+	}.Buckets(points)
+}
 
-		for i := (l - 1); i >= 0; i-- {
-			currentBucket = append(PointSet{points[i]}, currentBucket...)
+// Combines two points of a mergeable value type (sketches and distinct-count sets) into a new point
+// holding the union of both.  The given points are not modified.
+func mergePoints(a Point, b Point) (Point, error) {
+	switch a.Type {
+	case SketchType:
+		merged := a.Sketch.Clone()
 
-			if i > 0 {
-				if t := points[i-1].Timestamp; t.Before(endOfBucket) || t.Equal(endOfBucket) {
-					if len(currentBucket) > 0 {
-						sort.Sort(currentBucket)
-						pointsets = append([]PointSet{currentBucket}, pointsets...)
-					}
+		if err := merged.Merge(b.Sketch); err != nil {
+			return a, err
+		}
 
-					currentBucket = nil
+		return SketchPoint(a.Timestamp, merged), nil
+	case UniqueType:
+		merged := a.Unique.Clone()
 
-					endOfBucket = t.Add(-1 * duration)
-				}
-			}
+		if err := merged.Merge(b.Unique); err != nil {
+			return a, err
 		}
 
-		if len(currentBucket) > 0 {
-			sort.Sort(currentBucket)
-			pointsets = append([]PointSet{currentBucket}, pointsets...)
-			currentBucket = nil
-		}
+		return UniquePoint(a.Timestamp, merged), nil
+	default:
+		return a, fmt.Errorf("Cannot merge %v points", a.Type)
 	}
+}
 
-	return pointsets
+func isMergeableType(valueType ValueType) bool {
+	return (valueType == SketchType || valueType == UniqueType)
 }
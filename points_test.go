@@ -1,6 +1,7 @@
 package mobius
 
 import (
+	"encoding/json"
 	"github.com/stretchr/testify/require"
 	"math/rand"
 	"testing"
@@ -23,7 +24,7 @@ func TestPointBucketing(t *testing.T) {
 	assert.Equal(4, len(output))
 
 	bucket := output[0]
-	assert.Equal(10, len(bucket))
+	assert.Equal(30, len(bucket))
 	assert.True(bucket[0].Timestamp.Before(bucket[len(bucket)-1].Timestamp))
 
 	bucket = output[1]
@@ -35,6 +36,89 @@ func TestPointBucketing(t *testing.T) {
 	assert.True(bucket[0].Timestamp.Before(bucket[len(bucket)-1].Timestamp))
 
 	bucket = output[3]
-	assert.Equal(30, len(bucket))
+	assert.Equal(10, len(bucket))
 	assert.True(bucket[0].Timestamp.Before(bucket[len(bucket)-1].Timestamp))
 }
+
+func TestPointValueTypes(t *testing.T) {
+	assert := require.New(t)
+	tm := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	point, err := parsePoint(tm, `9007199254740993`)
+	assert.NoError(err)
+	assert.Equal(IntegerType, point.Type)
+	assert.Equal(int64(9007199254740993), point.Int64())
+	assert.Equal(`9007199254740993`, formatValue(point))
+
+	data, err := json.Marshal(point)
+	assert.NoError(err)
+	assert.Equal(`{"time":"2006-01-02T15:04:05Z","value":9007199254740993}`, string(data))
+
+	point, err = parsePoint(tm, `0.30000000000000004`)
+	assert.NoError(err)
+	assert.Equal(FloatType, point.Type)
+	assert.Equal(0.30000000000000004, point.Value)
+
+	_, err = point.As(IntegerType)
+	assert.Error(err)
+
+	point, err = IntegerPoint(tm, 42).As(FloatType)
+	assert.NoError(err)
+	assert.Equal(FloatType, point.Type)
+	assert.Equal(float64(42), point.Value)
+}
+
+func TestTimeBucketing(t *testing.T) {
+	assert := require.New(t)
+	india := time.FixedZone(`IST`, 5*3600+1800)
+	tm := time.Date(2006, 1, 5, 15, 4, 5, 0, time.UTC) // a Thursday
+
+	for _, tc := range []struct {
+		Bucketing TimeBucketing
+		Start     time.Time
+	}{
+		{TimeBucketing{Size: 5 * time.Minute}, time.Date(2006, 1, 5, 15, 0, 0, 0, time.UTC)},
+		{TimeBucketing{Size: time.Hour, Location: india}, time.Date(2006, 1, 5, 14, 30, 0, 0, time.UTC)},
+		{TimeBucketing{Size: time.Hour, Origin: time.Date(2006, 1, 5, 14, 50, 0, 0, time.UTC)}, time.Date(2006, 1, 5, 14, 50, 0, 0, time.UTC)},
+		{TimeBucketing{Unit: MinuteBuckets}, time.Date(2006, 1, 5, 15, 4, 0, 0, time.UTC)},
+		{TimeBucketing{Unit: HourBuckets, Location: india}, time.Date(2006, 1, 5, 14, 30, 0, 0, time.UTC)},
+		{TimeBucketing{Unit: DayBuckets}, time.Date(2006, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{TimeBucketing{Unit: DayBuckets, Location: india}, time.Date(2006, 1, 4, 18, 30, 0, 0, time.UTC)},
+		{TimeBucketing{Unit: WeekBuckets}, time.Date(2006, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{TimeBucketing{Unit: MonthBuckets}, time.Date(2006, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		assert.True(tc.Start.Equal(tc.Bucketing.Start(tm)), "%+v: %v", tc.Bucketing, tc.Bucketing.Start(tm))
+	}
+
+	// the same points are bucketed identically no matter when the newest one arrived
+	metric := NewMetric(`mobius.test.calendarbucket`)
+
+	for i := 0; i < 48; i++ {
+		metric.Push(time.Date(2006, 1, 31, i, 30, 0, 0, time.UTC), 1)
+	}
+
+	bucketing, err := ParseTimeBucketing(`day`, `UTC`)
+	assert.NoError(err)
+
+	consolidated := metric.ConsolidateBuckets(bucketing, Sum)
+	assert.Len(consolidated.Points(), 2)
+	assert.Equal([]float64{24, 24}, consolidated.Points().Values())
+	assert.True(time.Date(2006, 2, 1, 0, 0, 0, 0, time.UTC).Equal(consolidated.Points()[1].Timestamp))
+
+	metric.Push(time.Date(2006, 2, 2, 0, 0, 1, 0, time.UTC), 1)
+	assert.Equal([]float64{24, 24, 1}, metric.ConsolidateBuckets(bucketing, Sum).Points().Values())
+
+	bucketing, err = ParseTimeBucketing(`month`, ``)
+	assert.NoError(err)
+	assert.Equal([]float64{24, 25}, metric.ConsolidateBuckets(bucketing, Sum).Points().Values())
+
+	bucketing, err = ParseTimeBucketing(`1d`, `UTC`)
+	assert.NoError(err)
+	assert.Equal(24*time.Hour, bucketing.Duration())
+
+	_, err = ParseTimeBucketing(`fortnight`, `UTC`)
+	assert.Error(err)
+
+	_, err = ParseTimeBucketing(`1h`, `Not/A_Zone`)
+	assert.Error(err)
+}
@@ -0,0 +1,136 @@
+package mobius
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/husobee/vestigo"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Registers Prometheus-compatible query endpoints (/api/v1/query and /api/v1/query_range) that
+// evaluate PromQL queries against the dataset.
+func registerPromRoutes(router *vestigo.Router, dataset *Dataset) {
+	instant := func(w http.ResponseWriter, req *http.Request) {
+		at, err := parsePromTime(req.FormValue(`time`), time.Now())
+
+		if err != nil {
+			respondProm(w, nil, fmt.Errorf("invalid parameter 'time': %v", err))
+			return
+		}
+
+		if query, err := ParsePromQL(req.FormValue(`query`)); err == nil {
+			respondProm(w, func() (*PromResult, error) {
+				return query.Instant(dataset, at)
+			})
+		} else {
+			respondProm(w, nil, err)
+		}
+	}
+
+	rangeQuery := func(w http.ResponseWriter, req *http.Request) {
+		start, err := parsePromTime(req.FormValue(`start`), time.Time{})
+
+		if err != nil || start.IsZero() {
+			respondProm(w, nil, fmt.Errorf("invalid parameter 'start': %v", err))
+			return
+		}
+
+		end, err := parsePromTime(req.FormValue(`end`), time.Time{})
+
+		if err != nil || end.IsZero() {
+			respondProm(w, nil, fmt.Errorf("invalid parameter 'end': %v", err))
+			return
+		}
+
+		step, err := parsePromStep(req.FormValue(`step`))
+
+		if err != nil {
+			respondProm(w, nil, fmt.Errorf("invalid parameter 'step': %v", err))
+			return
+		}
+
+		if query, err := ParsePromQL(req.FormValue(`query`)); err == nil {
+			respondProm(w, func() (*PromResult, error) {
+				return query.Range(dataset, start, end, step)
+			})
+		} else {
+			respondProm(w, nil, err)
+		}
+	}
+
+	router.Get(`/api/v1/query`, instant)
+	router.Post(`/api/v1/query`, instant)
+	router.Get(`/api/v1/query_range`, rangeQuery)
+	router.Post(`/api/v1/query_range`, rangeQuery)
+}
+
+// Writes a response in the Prometheus API envelope.  Errors given directly are reported as bad
+// request data; errors returned from evaluation are reported as execution errors.
+func respondProm(w http.ResponseWriter, evaluate func() (*PromResult, error), errs ...error) {
+	var result *PromResult
+	var err error
+	errorType := `bad_data`
+	code := http.StatusBadRequest
+
+	if len(errs) > 0 {
+		err = errs[0]
+	} else if result, err = evaluate(); err != nil {
+		errorType = `execution`
+		code = http.StatusUnprocessableEntity
+	}
+
+	var body interface{}
+
+	if err != nil {
+		body = map[string]interface{}{
+			`status`:    `error`,
+			`errorType`: errorType,
+			`error`:     err.Error(),
+		}
+	} else {
+		code = http.StatusOK
+		body = map[string]interface{}{
+			`status`: `success`,
+			`data`:   result,
+		}
+	}
+
+	w.Header().Set(`Content-Type`, `application/json`)
+
+	if output, err := json.Marshal(body); err == nil {
+		w.WriteHeader(code)
+		w.Write(output)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Parses a Prometheus API timestamp, given either as (fractional) Unix seconds or in RFC3339.
+func parsePromTime(value string, fallback time.Time) (time.Time, error) {
+	if value == `` {
+		return fallback, nil
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, frac := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(frac*1e9)), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// Parses a Prometheus API step, given either as (fractional) seconds or as a duration.
+func parsePromStep(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds <= 0 {
+			return 0, fmt.Errorf("step must be positive")
+		}
+
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	return parsePromDuration(value)
+}
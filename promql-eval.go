@@ -0,0 +1,908 @@
+package mobius
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How far back an instant vector selector looks for the most recent point of each series.
+var PromLookbackDelta = 5 * time.Minute
+
+// The maximum number of steps a single range query may evaluate.
+var PromMaxSteps = 11000
+
+// The labels identifying a Prometheus series: the series tags plus the metric name in "__name__".
+type PromLabels map[string]string
+
+func (self PromLabels) key(ignoreName bool) string {
+	keys := make([]string, 0, len(self))
+
+	for k := range self {
+		if !(ignoreName && k == `__name__`) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+
+	for i, k := range keys {
+		parts[i] = k + "\xff" + self[k]
+	}
+
+	return strings.Join(parts, "\xfe")
+}
+
+func (self PromLabels) without(names ...string) PromLabels {
+	labels := make(PromLabels)
+
+	for k, v := range self {
+		labels[k] = v
+	}
+
+	for _, name := range names {
+		delete(labels, name)
+	}
+
+	return labels
+}
+
+type PromSample struct {
+	Labels PromLabels
+	Point  Point
+}
+
+type PromSeries struct {
+	Labels PromLabels
+	Points PointSet
+}
+
+// The result of evaluating a PromQL query, serialized as the "data" of a Prometheus API response.
+type PromResult struct {
+	Type   string
+	Time   time.Time
+	Scalar float64
+	Vector []PromSample
+	Matrix []PromSeries
+}
+
+func (self *PromResult) MarshalJSON() ([]byte, error) {
+	var result interface{}
+
+	switch self.Type {
+	case `scalar`:
+		result = promValue(self.Time, self.Scalar)
+	case `vector`:
+		samples := make([]map[string]interface{}, len(self.Vector))
+
+		for i, sample := range self.Vector {
+			samples[i] = map[string]interface{}{
+				`metric`: sample.Labels,
+				`value`:  promValue(sample.Point.Timestamp, sample.Point.Value),
+			}
+		}
+
+		result = samples
+	default:
+		series := make([]map[string]interface{}, len(self.Matrix))
+
+		for i, s := range self.Matrix {
+			values := make([][]interface{}, len(s.Points))
+
+			for j, point := range s.Points {
+				values[j] = promValue(point.Timestamp, point.Value)
+			}
+
+			series[i] = map[string]interface{}{
+				`metric`: s.Labels,
+				`values`: values,
+			}
+		}
+
+		result = series
+	}
+
+	return json.Marshal(map[string]interface{}{
+		`resultType`: self.Type,
+		`result`:     result,
+	})
+}
+
+func promValue(timestamp time.Time, value float64) []interface{} {
+	var text string
+
+	switch {
+	case math.IsInf(value, 1):
+		text = `+Inf`
+	case math.IsInf(value, -1):
+		text = `-Inf`
+	case math.IsNaN(value):
+		text = `NaN`
+	default:
+		text = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+
+	return []interface{}{float64(timestamp.UnixNano()) / 1e9, text}
+}
+
+// Evaluates the query at a single point in time.
+func (self *PromQuery) Instant(dataset *Dataset, at time.Time) (*PromResult, error) {
+	evaluator := self.evaluator(dataset, at, at)
+
+	if value, err := evaluator.eval(self.root, at); err == nil {
+		switch v := value.(type) {
+		case float64:
+			return &PromResult{Type: `scalar`, Time: at, Scalar: v}, nil
+		case []PromSample:
+			return &PromResult{Type: `vector`, Time: at, Vector: v}, nil
+		case []PromSeries:
+			return &PromResult{Type: `matrix`, Time: at, Matrix: v}, nil
+		default:
+			return nil, self.errorf(self.root.Position, "query must produce a scalar or vector")
+		}
+	} else {
+		return nil, err
+	}
+}
+
+// Evaluates the query at every step between start and end, returning a matrix.
+func (self *PromQuery) Range(dataset *Dataset, start time.Time, end time.Time, step time.Duration) (*PromResult, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	} else if end.Before(start) {
+		return nil, fmt.Errorf("end time must not be before start time")
+	} else if steps := int64(end.Sub(start)/step) + 1; steps > int64(PromMaxSteps) {
+		return nil, fmt.Errorf("query would evaluate %d steps, the maximum is %d", steps, PromMaxSteps)
+	} else if t := self.valueType(self.root); t != `vector` && t != `scalar` {
+		return nil, self.errorf(self.root.Position, "range queries must produce a scalar or vector, not a %s", t)
+	}
+
+	evaluator := self.evaluator(dataset, start, end)
+	series := make(map[string]*PromSeries)
+	keys := make([]string, 0)
+
+	appendPoint := func(labels PromLabels, point Point) {
+		key := labels.key(false)
+
+		if _, ok := series[key]; !ok {
+			series[key] = &PromSeries{
+				Labels: labels,
+			}
+
+			keys = append(keys, key)
+		}
+
+		series[key].Points = append(series[key].Points, point)
+	}
+
+	for t := start; !t.After(end); t = t.Add(step) {
+		if value, err := evaluator.eval(self.root, t); err == nil {
+			switch v := value.(type) {
+			case float64:
+				appendPoint(PromLabels{}, Point{Timestamp: t, Value: v})
+			case []PromSample:
+				for _, sample := range v {
+					appendPoint(sample.Labels, Point{Timestamp: t, Value: sample.Point.Value})
+				}
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	sort.Strings(keys)
+	result := &PromResult{
+		Type:   `matrix`,
+		Matrix: make([]PromSeries, len(keys)),
+	}
+
+	for i, key := range keys {
+		result.Matrix[i] = *series[key]
+	}
+
+	return result, nil
+}
+
+func (self *PromQuery) evaluator(dataset *Dataset, start time.Time, end time.Time) *promEvaluator {
+	return &promEvaluator{
+		query:   self,
+		dataset: dataset,
+		start:   start,
+		end:     end,
+		cache:   make(map[*promNode][]PromSeries),
+	}
+}
+
+type promEvaluator struct {
+	query   *PromQuery
+	dataset *Dataset
+	start   time.Time
+	end     time.Time
+	cache   map[*promNode][]PromSeries
+}
+
+// Evaluates a node at the given time, returning a float64 (scalar), []PromSample (instant vector),
+// or []PromSeries (range vector.)
+func (self *promEvaluator) eval(node *promNode, at time.Time) (interface{}, error) {
+	switch node.Type {
+	case promNumberNode:
+		return node.Number, nil
+	case promStringNode:
+		return node.Name, nil
+	case promSelectorNode:
+		return self.evalSelector(node, at)
+	case promCallNode:
+		fn := promFunctions[node.Name]
+		args := make([]interface{}, len(node.Args))
+
+		for i, arg := range node.Args {
+			if value, err := self.eval(arg, at); err == nil {
+				args[i] = value
+			} else {
+				return nil, err
+			}
+		}
+
+		if value, err := fn.fn(at, args); err == nil {
+			return value, nil
+		} else {
+			return nil, self.query.errorf(node.Position, "%s: %v", node.Name, err)
+		}
+	case promAggregateNode:
+		return self.evalAggregate(node, at)
+	case promUnaryNode:
+		if value, err := self.eval(node.Args[0], at); err == nil {
+			return promApply(value, func(v float64) float64 {
+				return -v
+			}), nil
+		} else {
+			return nil, err
+		}
+	default:
+		return self.evalBinary(node, at)
+	}
+}
+
+func (self *promEvaluator) evalSelector(node *promNode, at time.Time) (interface{}, error) {
+	all, err := self.load(node)
+
+	if err != nil {
+		return nil, self.query.errorf(node.Position, "%v", err)
+	}
+
+	at = at.Add(-node.Offset)
+
+	if node.IsRange {
+		matrix := make([]PromSeries, 0)
+
+		for _, series := range all {
+			if points := promWindow(series.Points, at.Add(-node.Range), at); len(points) > 0 {
+				matrix = append(matrix, PromSeries{
+					Labels: series.Labels,
+					Points: points,
+				})
+			}
+		}
+
+		return matrix, nil
+	}
+
+	vector := make([]PromSample, 0)
+
+	for _, series := range all {
+		if points := promWindow(series.Points, at.Add(-PromLookbackDelta), at); len(points) > 0 {
+			point := points[len(points)-1]
+			point.Timestamp = at.Add(node.Offset)
+
+			vector = append(vector, PromSample{
+				Labels: series.Labels,
+				Point:  point,
+			})
+		}
+	}
+
+	return vector, nil
+}
+
+// Returns the points in the half-open interval (from, to] of a sorted PointSet.
+func promWindow(points PointSet, from time.Time, to time.Time) PointSet {
+	first := sort.Search(len(points), func(i int) bool {
+		return points[i].Timestamp.After(from)
+	})
+
+	last := sort.Search(len(points), func(i int) bool {
+		return points[i].Timestamp.After(to)
+	})
+
+	if first >= last {
+		return nil
+	}
+
+	return points[first:last]
+}
+
+// Retrieves (once per query) all points of the series matching a selector that any step of the
+// query may need.
+func (self *promEvaluator) load(node *promNode) ([]PromSeries, error) {
+	if series, ok := self.cache[node]; ok {
+		return series, nil
+	}
+
+	lookback := PromLookbackDelta
+
+	if node.IsRange {
+		lookback = node.Range
+	}
+
+	start := self.start.Add(-node.Offset - lookback)
+	end := self.end.Add(-node.Offset)
+	output := make([]PromSeries, 0)
+
+	names, err := self.dataset.GetNames(`**`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		candidate := NewMetric(name)
+		labels := promMetricLabels(candidate)
+
+		// the series may be a multi-field series whose fields are selected as "<name>_<field>"
+		isFieldPrefix := (node.Name != `` && strings.HasPrefix(node.Name, labels[`__name__`]+`_`))
+
+		if !isFieldPrefix && !promMatches(node, labels) {
+			continue
+		}
+
+		metrics, err := self.dataset.Range(start, end, name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, metric := range metrics {
+			// range patterns are prefix matches, so only take the series being loaded
+			if metric.GetUniqueName() != name {
+				continue
+			}
+
+			for _, m := range metric.SplitFields() {
+				if labels := promMetricLabels(m); promMatches(node, labels) {
+					output = append(output, PromSeries{
+						Labels: labels,
+						Points: m.Points(),
+					})
+				}
+			}
+		}
+	}
+
+	self.cache[node] = output
+	return output, nil
+}
+
+func promMetricLabels(metric *Metric) PromLabels {
+	labels := PromLabels{
+		`__name__`: PromMetricName(metric.GetName()),
+	}
+
+	for k, v := range metric.GetTags() {
+		labels[k] = fmt.Sprintf("%v", v)
+	}
+
+	return labels
+}
+
+func promMatches(node *promNode, labels PromLabels) bool {
+	if node.Name != `` && labels[`__name__`] != node.Name {
+		return false
+	}
+
+	for _, matcher := range node.Matchers {
+		if !matcher.matches(labels[matcher.Label]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+var promAggregateReducers = map[string]ReducerFunc{
+	`sum`:    Sum,
+	`avg`:    Mean,
+	`min`:    Minimum,
+	`max`:    Maximum,
+	`count`:  Count,
+	`stddev`: StandardDeviationPopulation,
+	`stdvar`: PopulationVariance,
+}
+
+func (self *promEvaluator) evalAggregate(node *promNode, at time.Time) (interface{}, error) {
+	var reducer Reducer
+
+	if node.Name == `quantile` {
+		if q, err := self.eval(node.Args[0], at); err == nil {
+			if qv, ok := q.(float64); ok {
+				reducer = newQuantileReducer(qv)
+			} else {
+				return nil, self.query.errorf(node.Args[0].Position, "quantile expects a scalar parameter")
+			}
+		} else {
+			return nil, err
+		}
+	} else {
+		reducer = promAggregateReducers[node.Name]
+	}
+
+	value, err := self.eval(node.Args[len(node.Args)-1], at)
+
+	if err != nil {
+		return nil, err
+	}
+
+	vector, _ := value.([]PromSample)
+	groups := make(map[string][]PromSample)
+	groupLabels := make(map[string]PromLabels)
+	keys := make([]string, 0)
+
+	for _, sample := range vector {
+		var labels PromLabels
+
+		if node.Without {
+			labels = sample.Labels.without(append(node.Labels, `__name__`)...)
+		} else {
+			labels = make(PromLabels)
+
+			for _, name := range node.Labels {
+				if v, ok := sample.Labels[name]; ok {
+					labels[name] = v
+				}
+			}
+		}
+
+		key := labels.key(false)
+
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+			groupLabels[key] = labels
+		}
+
+		groups[key] = append(groups[key], sample)
+	}
+
+	sort.Strings(keys)
+	output := make([]PromSample, 0, len(keys))
+
+	for _, key := range keys {
+		points := make(PointSet, 0)
+
+		for _, sample := range groups[key] {
+			points = append(points, sample.Point)
+		}
+
+		output = append(output, PromSample{
+			Labels: groupLabels[key],
+			Point:  promReducePoints(points, reducer, node.Name == `sum`, at),
+		})
+	}
+
+	return output, nil
+}
+
+// Reduces a set of points to a single point at the given time.  If merge is set and the points are
+// all sketches or distinct-count sets, they are merged instead so that quantiles and distinct counts
+// remain available.  Otherwise, quantiles of sketches are answered from their merged sketch.
+func promReducePoints(points PointSet, reducer Reducer, merge bool, at time.Time) Point {
+	if merge && len(points) > 0 && isMergeableType(points[0].Type) {
+		merged := points[0]
+		merged.Timestamp = at
+
+		for _, point := range points[1:] {
+			if m, err := mergePoints(merged, point); err == nil {
+				merged = m
+			}
+		}
+
+		return merged
+	}
+
+	return Point{
+		Timestamp: at,
+		Value:     newObservations(points).reduce(reducer, at, at),
+	}
+}
+
+func (self *promEvaluator) evalBinary(node *promNode, at time.Time) (interface{}, error) {
+	lhs, err := self.eval(node.Args[0], at)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rhs, err := self.eval(node.Args[1], at)
+
+	if err != nil {
+		return nil, err
+	}
+
+	isComparison := (promBinaryPrecedence[node.Operator] == 1)
+
+	switch l := lhs.(type) {
+	case float64:
+		switch r := rhs.(type) {
+		case float64:
+			if v, keep := promOperate(node.Operator, l, r); keep || !isComparison {
+				return v, nil
+			} else {
+				return 0.0, nil
+			}
+		case []PromSample:
+			output := make([]PromSample, 0, len(r))
+
+			for _, sample := range r {
+				if v, keep := promOperate(node.Operator, l, sample.Point.Value); keep {
+					if isComparison {
+						v = sample.Point.Value
+					}
+
+					output = append(output, promSample(sample, v, !isComparison))
+				}
+			}
+
+			return output, nil
+		}
+	case []PromSample:
+		switch r := rhs.(type) {
+		case float64:
+			output := make([]PromSample, 0, len(l))
+
+			for _, sample := range l {
+				if v, keep := promOperate(node.Operator, sample.Point.Value, r); keep {
+					if isComparison {
+						v = sample.Point.Value
+					}
+
+					output = append(output, promSample(sample, v, !isComparison))
+				}
+			}
+
+			return output, nil
+		case []PromSample:
+			return self.evalVectorMatch(node, l, r, isComparison)
+		}
+	}
+
+	return nil, self.query.errorf(node.Position, "invalid operands for %q", node.Operator)
+}
+
+// Applies a binary operator to two vectors whose samples are matched one-to-one on their labels
+// (excluding the metric name), or on the labels given with on(...)/ignoring(...).
+func (self *promEvaluator) evalVectorMatch(node *promNode, lhs []PromSample, rhs []PromSample, isComparison bool) (interface{}, error) {
+	matchKey := func(labels PromLabels) string {
+		if node.Matching && !node.Ignoring {
+			subset := make(PromLabels)
+
+			for _, name := range node.Labels {
+				if v, ok := labels[name]; ok {
+					subset[name] = v
+				}
+			}
+
+			return subset.key(true)
+		}
+
+		return labels.without(node.Labels...).key(true)
+	}
+
+	right := make(map[string]PromSample)
+
+	for _, sample := range rhs {
+		key := matchKey(sample.Labels)
+
+		if _, ok := right[key]; ok {
+			return nil, self.query.errorf(node.Position, "many-to-many matching not allowed: duplicate series on the right-hand side of %q", node.Operator)
+		}
+
+		right[key] = sample
+	}
+
+	output := make([]PromSample, 0)
+	seen := make(map[string]bool)
+
+	for _, sample := range lhs {
+		key := matchKey(sample.Labels)
+
+		if other, ok := right[key]; ok {
+			if seen[key] {
+				return nil, self.query.errorf(node.Position, "many-to-many matching not allowed: duplicate series on the left-hand side of %q", node.Operator)
+			}
+
+			seen[key] = true
+
+			if v, keep := promOperate(node.Operator, sample.Point.Value, other.Point.Value); keep {
+				if isComparison {
+					v = sample.Point.Value
+				}
+
+				result := promSample(sample, v, !isComparison)
+
+				if node.Matching && !node.Ignoring {
+					labels := make(PromLabels)
+
+					for _, name := range node.Labels {
+						if v, ok := sample.Labels[name]; ok {
+							labels[name] = v
+						}
+					}
+
+					result.Labels = labels
+				}
+
+				output = append(output, result)
+			}
+		}
+	}
+
+	return output, nil
+}
+
+// Returns a copy of the sample with a new value, optionally dropping the metric name.
+func promSample(sample PromSample, value float64, dropName bool) PromSample {
+	labels := sample.Labels
+
+	if dropName {
+		labels = labels.without(`__name__`)
+	}
+
+	return PromSample{
+		Labels: labels,
+		Point: Point{
+			Timestamp: sample.Point.Timestamp,
+			Value:     value,
+		},
+	}
+}
+
+// Applies an operator, returning the result and (for comparisons) whether the comparison held.
+func promOperate(operator string, l float64, r float64) (float64, bool) {
+	switch operator {
+	case `+`:
+		return l + r, true
+	case `-`:
+		return l - r, true
+	case `*`:
+		return l * r, true
+	case `/`:
+		return l / r, true
+	case `%`:
+		return math.Mod(l, r), true
+	case `^`:
+		return math.Pow(l, r), true
+	}
+
+	var result bool
+
+	switch operator {
+	case `==`:
+		result = (l == r)
+	case `!=`:
+		result = (l != r)
+	case `<`:
+		result = (l < r)
+	case `<=`:
+		result = (l <= r)
+	case `>`:
+		result = (l > r)
+	case `>=`:
+		result = (l >= r)
+	}
+
+	if result {
+		return 1, true
+	} else {
+		return 0, false
+	}
+}
+
+// Applies a function to a scalar or to every sample of a vector (dropping the metric name.)
+func promApply(value interface{}, fn func(float64) float64) interface{} {
+	switch v := value.(type) {
+	case float64:
+		return fn(v)
+	case []PromSample:
+		output := make([]PromSample, len(v))
+
+		for i, sample := range v {
+			output[i] = promSample(sample, fn(sample.Point.Value), true)
+		}
+
+		return output
+	}
+
+	return value
+}
+
+type promFunction struct {
+	args    []string
+	returns string
+	fn      func(at time.Time, args []interface{}) (interface{}, error)
+}
+
+var promFunctions = map[string]promFunction{
+	`rate`: promRangeFunction(func(points PointSet) (float64, bool) {
+		if len(points) < 2 {
+			return 0, false
+		}
+
+		seconds := points[len(points)-1].Timestamp.Sub(points[0].Timestamp).Seconds()
+		return promIncrease(points) / seconds, true
+	}),
+	`irate`: promRangeFunction(func(points PointSet) (float64, bool) {
+		if len(points) < 2 {
+			return 0, false
+		}
+
+		last := points[len(points)-2:]
+		return promIncrease(last) / last[1].Timestamp.Sub(last[0].Timestamp).Seconds(), true
+	}),
+	`increase`: promRangeFunction(func(points PointSet) (float64, bool) {
+		if len(points) < 2 {
+			return 0, false
+		}
+
+		return promIncrease(points), true
+	}),
+	`delta`: promRangeFunction(func(points PointSet) (float64, bool) {
+		if len(points) < 2 {
+			return 0, false
+		}
+
+		return points[len(points)-1].Value - points[0].Value, true
+	}),
+	`avg_over_time`:    promOverTime(Mean),
+	`min_over_time`:    promOverTime(Minimum),
+	`max_over_time`:    promOverTime(Maximum),
+	`count_over_time`:  promOverTime(Count),
+	`stddev_over_time`: promOverTime(StandardDeviationPopulation),
+	`stdvar_over_time`: promOverTime(PopulationVariance),
+	`last_over_time`: promRangeFunction(func(points PointSet) (float64, bool) {
+		return points[len(points)-1].Value, true
+	}),
+	`sum_over_time`: {
+		args:    []string{`matrix`},
+		returns: `vector`,
+		fn: func(at time.Time, args []interface{}) (interface{}, error) {
+			output := make([]PromSample, 0)
+
+			for _, series := range args[0].([]PromSeries) {
+				output = append(output, PromSample{
+					Labels: series.Labels.without(`__name__`),
+					Point:  promReducePoints(series.Points, Sum, true, at),
+				})
+			}
+
+			return output, nil
+		},
+	},
+	`quantile_over_time`: {
+		args:    []string{`scalar`, `matrix`},
+		returns: `vector`,
+		fn: func(at time.Time, args []interface{}) (interface{}, error) {
+			return promOverTime(newQuantileReducer(args[0].(float64))).fn(at, args[1:])
+		},
+	},
+	`histogram_quantile`: {
+		args:    []string{`scalar`, `vector`},
+		returns: `vector`,
+		fn: func(at time.Time, args []interface{}) (interface{}, error) {
+			q := args[0].(float64)
+			output := make([]PromSample, 0)
+
+			for _, sample := range args[1].([]PromSample) {
+				if sample.Point.Sketch != nil {
+					output = append(output, promSample(sample, sample.Point.Sketch.Quantile(q), true))
+				}
+			}
+
+			return output, nil
+		},
+	},
+	`abs`:   promMathFunction(math.Abs),
+	`ceil`:  promMathFunction(math.Ceil),
+	`floor`: promMathFunction(math.Floor),
+	`sqrt`:  promMathFunction(math.Sqrt),
+	`exp`:   promMathFunction(math.Exp),
+	`ln`:    promMathFunction(math.Log),
+	`log2`:  promMathFunction(math.Log2),
+	`log10`: promMathFunction(math.Log10),
+	`time`: {
+		returns: `scalar`,
+		fn: func(at time.Time, args []interface{}) (interface{}, error) {
+			return float64(at.UnixNano()) / 1e9, nil
+		},
+	},
+	`scalar`: {
+		args:    []string{`vector`},
+		returns: `scalar`,
+		fn: func(at time.Time, args []interface{}) (interface{}, error) {
+			if vector := args[0].([]PromSample); len(vector) == 1 {
+				return vector[0].Point.Value, nil
+			}
+
+			return math.NaN(), nil
+		},
+	},
+	`vector`: {
+		args:    []string{`scalar`},
+		returns: `vector`,
+		fn: func(at time.Time, args []interface{}) (interface{}, error) {
+			return []PromSample{{
+				Labels: PromLabels{},
+				Point:  Point{Timestamp: at, Value: args[0].(float64)},
+			}}, nil
+		},
+	},
+}
+
+// Wraps a function of the points in each series of a range vector.  Series for which the function
+// returns false are omitted from the result.
+func promRangeFunction(fn func(points PointSet) (float64, bool)) promFunction {
+	return promFunction{
+		args:    []string{`matrix`},
+		returns: `vector`,
+		fn: func(at time.Time, args []interface{}) (interface{}, error) {
+			output := make([]PromSample, 0)
+
+			for _, series := range args[0].([]PromSeries) {
+				if v, ok := fn(series.Points); ok {
+					output = append(output, PromSample{
+						Labels: series.Labels.without(`__name__`),
+						Point:  Point{Timestamp: at, Value: v},
+					})
+				}
+			}
+
+			return output, nil
+		},
+	}
+}
+
+// Wraps a reducer applied to all observations in each series of a range vector.  Quantiles of
+// sketches are answered from their merged sketch rather than by expanding every observation.
+func promOverTime(reducer Reducer) promFunction {
+	return promRangeFunction(func(points PointSet) (float64, bool) {
+		return newObservations(points).reduce(reducer, points[0].Timestamp, points[len(points)-1].Timestamp), true
+	})
+}
+
+func promMathFunction(fn func(float64) float64) promFunction {
+	return promFunction{
+		args:    []string{`vector`},
+		returns: `vector`,
+		fn: func(at time.Time, args []interface{}) (interface{}, error) {
+			return promApply(args[0], fn), nil
+		},
+	}
+}
+
+// Returns the increase of a counter over the given points, compensating for counter resets.
+func promIncrease(points PointSet) float64 {
+	var increase float64
+
+	for i := 1; i < len(points); i++ {
+		if delta := points[i].Value - points[i-1].Value; delta >= 0 {
+			increase += delta
+		} else {
+			// the counter was reset, so the current value is all that accrued since the reset
+			increase += points[i].Value
+		}
+	}
+
+	return increase
+}
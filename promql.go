@@ -0,0 +1,801 @@
+package mobius
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The PromQL front-end maps Prometheus-style metric names onto mobius series names by replacing
+// each character that is not valid in a Prometheus metric name (such as ".") with "_", so that
+// the series "app.requests:host=a" is selected by `app_requests{host="a"}`.
+//
+// The supported subset of PromQL includes instant and range vector selectors with label matchers
+// and offsets, arithmetic and comparison operators (with on/ignoring), the sum, avg, min, max,
+// count, stddev, stdvar, and quantile aggregations (with by/without), and the functions listed in
+// promFunctions.  Quantiles of sketch series are available through histogram_quantile.
+
+type promNodeType int
+
+const (
+	promNumberNode promNodeType = iota
+	promStringNode
+	promSelectorNode
+	promCallNode
+	promAggregateNode
+	promBinaryNode
+	promUnaryNode
+)
+
+type promMatcher struct {
+	Label    string
+	Operator string
+	Value    string
+	regex    *regexp.Regexp
+}
+
+func (self promMatcher) matches(value string) bool {
+	switch self.Operator {
+	case `!=`:
+		return value != self.Value
+	case `=~`:
+		return self.regex.MatchString(value)
+	case `!~`:
+		return !self.regex.MatchString(value)
+	default:
+		return value == self.Value
+	}
+}
+
+type promNode struct {
+	Type     promNodeType
+	Position int
+	Name     string
+	Number   float64
+	Matchers []promMatcher
+	Range    time.Duration
+	Offset   time.Duration
+	Args     []*promNode
+
+	// aggregation and vector matching modifiers
+	Labels   []string
+	Without  bool
+	Ignoring bool
+	Matching bool
+	Operator string
+	IsRange  bool
+}
+
+// A parsed PromQL query (see ParsePromQL.)
+type PromQuery struct {
+	Source string
+	root   *promNode
+}
+
+var promBinaryPrecedence = map[string]int{
+	`==`: 1, `!=`: 1, `<`: 1, `<=`: 1, `>`: 1, `>=`: 1,
+	`+`: 2, `-`: 2,
+	`*`: 3, `/`: 3, `%`: 3,
+	`^`: 4,
+}
+
+var promAggregations = map[string]bool{
+	`sum`: true, `avg`: true, `min`: true, `max`: true, `count`: true,
+	`stddev`: true, `stdvar`: true, `quantile`: true,
+}
+
+// Parses a PromQL query, returning an ExpressionError identifying the position of any syntax
+// error.
+func ParsePromQL(source string) (*PromQuery, error) {
+	parser := &promParser{
+		source: source,
+	}
+
+	if err := parser.tokenize(); err != nil {
+		return nil, err
+	}
+
+	if root, err := parser.parseExpr(0); err == nil {
+		if tok := parser.peek(); tok.kind != `eof` {
+			return nil, parser.errorf(tok.pos, "unexpected %q", tok.text)
+		}
+
+		query := &PromQuery{
+			Source: source,
+			root:   root,
+		}
+
+		if err := query.check(root); err != nil {
+			return nil, err
+		}
+
+		return query, nil
+	} else {
+		return nil, err
+	}
+}
+
+// Verifies function names and argument types.
+func (self *PromQuery) check(node *promNode) error {
+	switch node.Type {
+	case promCallNode:
+		fn, ok := promFunctions[node.Name]
+
+		if !ok {
+			return self.errorf(node.Position, "unknown function %q", node.Name)
+		} else if len(node.Args) != len(fn.args) {
+			return self.errorf(node.Position, "%s expects %d arguments, got %d", node.Name, len(fn.args), len(node.Args))
+		}
+
+		for i, arg := range node.Args {
+			if err := self.check(arg); err != nil {
+				return err
+			}
+
+			switch want, got := fn.args[i], self.valueType(arg); {
+			case want == got:
+			case want == `scalar` && arg.Type == promNumberNode:
+			default:
+				return self.errorf(arg.Position, "argument %d of %s must be a %s, not a %s", i+1, node.Name, want, got)
+			}
+		}
+	case promAggregateNode:
+		for _, arg := range node.Args {
+			if err := self.check(arg); err != nil {
+				return err
+			}
+		}
+
+		if expr := node.Args[len(node.Args)-1]; self.valueType(expr) != `vector` {
+			return self.errorf(expr.Position, "%s expects an instant vector, not a %s", node.Name, self.valueType(expr))
+		}
+	case promBinaryNode, promUnaryNode:
+		for _, arg := range node.Args {
+			if err := self.check(arg); err != nil {
+				return err
+			} else if t := self.valueType(arg); t != `vector` && t != `scalar` {
+				return self.errorf(arg.Position, "operator %q cannot be applied to a %s", node.Operator, t)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (self *PromQuery) valueType(node *promNode) string {
+	switch node.Type {
+	case promNumberNode:
+		return `scalar`
+	case promStringNode:
+		return `string`
+	case promSelectorNode:
+		if node.IsRange {
+			return `matrix`
+		} else {
+			return `vector`
+		}
+	case promCallNode:
+		if fn, ok := promFunctions[node.Name]; ok {
+			return fn.returns
+		}
+	case promBinaryNode:
+		for _, arg := range node.Args {
+			if self.valueType(arg) == `vector` {
+				return `vector`
+			}
+		}
+
+		return `scalar`
+	case promUnaryNode:
+		return self.valueType(node.Args[0])
+	}
+
+	return `vector`
+}
+
+func (self *PromQuery) errorf(position int, format string, args ...interface{}) error {
+	return ExpressionError{
+		Expression: self.Source,
+		Position:   position,
+		Message:    fmt.Sprintf(format, args...),
+	}
+}
+
+type promToken struct {
+	kind string
+	text string
+	pos  int
+}
+
+type promParser struct {
+	source string
+	tokens []promToken
+	index  int
+}
+
+func (self *promParser) tokenize() error {
+	src := self.source
+	i := 0
+
+	for i < len(src) {
+		c := src[i]
+		start := i
+
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+			continue
+		case c == '"' || c == '\'' || c == '`':
+			i++
+			text := make([]byte, 0)
+
+			for i < len(src) && src[i] != c {
+				if src[i] == '\\' && c != '`' && i+1 < len(src) {
+					i++
+				}
+
+				text = append(text, src[i])
+				i++
+			}
+
+			if i >= len(src) {
+				return self.errorf(start, "unterminated string")
+			}
+
+			i++
+			self.tokens = append(self.tokens, promToken{`string`, string(text), start})
+			continue
+		case (c >= '0' && c <= '9') || (c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9'):
+			for i < len(src) && (isPromNameChar(src[i]) || src[i] == '.') {
+				i++
+			}
+
+			text := src[start:i]
+
+			if _, err := strconv.ParseFloat(text, 64); err == nil {
+				self.tokens = append(self.tokens, promToken{`number`, text, start})
+			} else if _, err := parsePromDuration(text); err == nil {
+				self.tokens = append(self.tokens, promToken{`duration`, text, start})
+			} else {
+				return self.errorf(start, "invalid number or duration %q", text)
+			}
+
+			continue
+		case isPromNameChar(c) || c == ':':
+			for i < len(src) && (isPromNameChar(src[i]) || src[i] == ':') {
+				i++
+			}
+
+			self.tokens = append(self.tokens, promToken{`ident`, src[start:i], start})
+			continue
+		}
+
+		// operators and punctuation, longest match first
+		matched := false
+
+		for _, op := range []string{`==`, `!=`, `<=`, `>=`, `=~`, `!~`, `+`, `-`, `*`, `/`, `%`, `^`, `<`, `>`, `=`, `(`, `)`, `{`, `}`, `[`, `]`, `,`} {
+			if strings.HasPrefix(src[i:], op) {
+				self.tokens = append(self.tokens, promToken{`op`, op, start})
+				i += len(op)
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return self.errorf(start, "unexpected character %q", string(c))
+		}
+	}
+
+	self.tokens = append(self.tokens, promToken{`eof`, ``, len(src)})
+	return nil
+}
+
+func (self *promParser) peek() promToken {
+	return self.tokens[self.index]
+}
+
+func (self *promParser) next() promToken {
+	tok := self.tokens[self.index]
+
+	if tok.kind != `eof` {
+		self.index++
+	}
+
+	return tok
+}
+
+func (self *promParser) isOp(text string) bool {
+	tok := self.peek()
+	return tok.kind == `op` && tok.text == text
+}
+
+func (self *promParser) expect(text string) (promToken, error) {
+	if tok := self.next(); tok.kind == `op` && tok.text == text {
+		return tok, nil
+	} else if tok.kind == `eof` {
+		return tok, self.errorf(tok.pos, "expected %q, got end of query", text)
+	} else {
+		return tok, self.errorf(tok.pos, "expected %q, got %q", text, tok.text)
+	}
+}
+
+// Parses binary expressions using precedence climbing.
+func (self *promParser) parseExpr(minPrecedence int) (*promNode, error) {
+	lhs, err := self.parseUnary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := self.peek()
+		precedence, ok := promBinaryPrecedence[tok.text]
+
+		if tok.kind != `op` || !ok || precedence < minPrecedence {
+			return lhs, nil
+		}
+
+		self.next()
+
+		node := &promNode{
+			Type:     promBinaryNode,
+			Position: tok.pos,
+			Operator: tok.text,
+		}
+
+		if err := self.parseMatching(node); err != nil {
+			return nil, err
+		}
+
+		// exponentiation is right-associative, all other operators are left-associative
+		nextPrecedence := precedence + 1
+
+		if tok.text == `^` {
+			nextPrecedence = precedence
+		}
+
+		if rhs, err := self.parseExpr(nextPrecedence); err == nil {
+			node.Args = []*promNode{lhs, rhs}
+			lhs = node
+		} else {
+			return nil, err
+		}
+	}
+}
+
+// Parses the optional on(...) or ignoring(...) vector matching modifiers of a binary operator.
+func (self *promParser) parseMatching(node *promNode) error {
+	if tok := self.peek(); tok.kind == `ident` && (tok.text == `on` || tok.text == `ignoring`) {
+		self.next()
+		node.Matching = true
+		node.Ignoring = (tok.text == `ignoring`)
+
+		if labels, err := self.parseLabelList(); err == nil {
+			node.Labels = labels
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (self *promParser) parseUnary() (*promNode, error) {
+	if tok := self.peek(); tok.kind == `op` && (tok.text == `-` || tok.text == `+`) {
+		self.next()
+
+		if expr, err := self.parseUnary(); err == nil {
+			if tok.text == `+` {
+				return expr, nil
+			} else if expr.Type == promNumberNode {
+				expr.Number = -expr.Number
+				expr.Position = tok.pos
+				return expr, nil
+			}
+
+			return &promNode{
+				Type:     promUnaryNode,
+				Position: tok.pos,
+				Operator: `-`,
+				Args:     []*promNode{expr},
+			}, nil
+		} else {
+			return nil, err
+		}
+	}
+
+	return self.parsePostfix()
+}
+
+// Parses a primary expression followed by optional range and offset modifiers.
+func (self *promParser) parsePostfix() (*promNode, error) {
+	node, err := self.parsePrimary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if self.isOp(`[`) {
+		open := self.next()
+
+		if node.Type != promSelectorNode || node.IsRange {
+			return nil, self.errorf(open.pos, "ranges can only be applied to vector selectors")
+		}
+
+		if d, err := self.parseDuration(); err == nil {
+			node.Range = d
+			node.IsRange = true
+		} else {
+			return nil, err
+		}
+
+		if _, err := self.expect(`]`); err != nil {
+			return nil, err
+		}
+	}
+
+	if tok := self.peek(); tok.kind == `ident` && tok.text == `offset` {
+		self.next()
+
+		if node.Type != promSelectorNode {
+			return nil, self.errorf(tok.pos, "offset can only be applied to selectors")
+		}
+
+		if d, err := self.parseDuration(); err == nil {
+			node.Offset = d
+		} else {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+func (self *promParser) parseDuration() (time.Duration, error) {
+	tok := self.next()
+
+	if tok.kind == `duration` || tok.kind == `number` {
+		if d, err := parsePromDuration(tok.text); err == nil {
+			return d, nil
+		}
+	}
+
+	return 0, self.errorf(tok.pos, "expected a duration, got %q", tok.text)
+}
+
+func (self *promParser) parsePrimary() (*promNode, error) {
+	tok := self.next()
+
+	switch tok.kind {
+	case `number`:
+		v, _ := strconv.ParseFloat(tok.text, 64)
+
+		return &promNode{
+			Type:     promNumberNode,
+			Position: tok.pos,
+			Number:   v,
+		}, nil
+	case `string`:
+		return &promNode{
+			Type:     promStringNode,
+			Position: tok.pos,
+			Name:     tok.text,
+		}, nil
+	case `op`:
+		switch tok.text {
+		case `(`:
+			if expr, err := self.parseExpr(0); err == nil {
+				if _, err := self.expect(`)`); err != nil {
+					return nil, err
+				}
+
+				return expr, nil
+			} else {
+				return nil, err
+			}
+		case `{`:
+			self.index--
+			return self.parseSelector(tok.pos, ``)
+		}
+	case `ident`:
+		switch {
+		case strings.ToLower(tok.text) == `inf` || strings.ToLower(tok.text) == `nan`:
+			v, _ := strconv.ParseFloat(tok.text, 64)
+
+			return &promNode{
+				Type:     promNumberNode,
+				Position: tok.pos,
+				Number:   v,
+			}, nil
+		case promAggregations[tok.text] && (self.isOp(`(`) || self.peekIdent(`by`) || self.peekIdent(`without`)):
+			return self.parseAggregate(tok)
+		case self.isOp(`(`):
+			return self.parseCall(tok)
+		default:
+			return self.parseSelector(tok.pos, tok.text)
+		}
+	case `eof`:
+		return nil, self.errorf(tok.pos, "unexpected end of query")
+	}
+
+	return nil, self.errorf(tok.pos, "unexpected %q", tok.text)
+}
+
+func (self *promParser) peekIdent(text string) bool {
+	tok := self.peek()
+	return tok.kind == `ident` && tok.text == text
+}
+
+func (self *promParser) parseCall(name promToken) (*promNode, error) {
+	node := &promNode{
+		Type:     promCallNode,
+		Position: name.pos,
+		Name:     name.text,
+	}
+
+	if args, err := self.parseArgs(); err == nil {
+		node.Args = args
+		return node, nil
+	} else {
+		return nil, err
+	}
+}
+
+func (self *promParser) parseArgs() ([]*promNode, error) {
+	args := make([]*promNode, 0)
+
+	if _, err := self.expect(`(`); err != nil {
+		return nil, err
+	}
+
+	if self.isOp(`)`) {
+		self.next()
+		return args, nil
+	}
+
+	for {
+		if arg, err := self.parseExpr(0); err == nil {
+			args = append(args, arg)
+		} else {
+			return nil, err
+		}
+
+		if self.isOp(`,`) {
+			self.next()
+		} else if _, err := self.expect(`)`); err == nil {
+			return args, nil
+		} else {
+			return nil, err
+		}
+	}
+}
+
+// Parses "op [by|without (labels)] (expr)" or "op (expr) [by|without (labels)]".
+func (self *promParser) parseAggregate(name promToken) (*promNode, error) {
+	node := &promNode{
+		Type:     promAggregateNode,
+		Position: name.pos,
+		Name:     name.text,
+	}
+
+	parseGrouping := func() error {
+		if tok := self.peek(); tok.kind == `ident` && (tok.text == `by` || tok.text == `without`) {
+			self.next()
+			node.Without = (tok.text == `without`)
+
+			if labels, err := self.parseLabelList(); err == nil {
+				node.Labels = labels
+			} else {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := parseGrouping(); err != nil {
+		return nil, err
+	}
+
+	if args, err := self.parseArgs(); err == nil {
+		node.Args = args
+	} else {
+		return nil, err
+	}
+
+	if node.Labels == nil {
+		if err := parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+
+	expected := 1
+
+	if node.Name == `quantile` {
+		expected = 2
+	}
+
+	if len(node.Args) != expected {
+		return nil, self.errorf(name.pos, "%s expects %d arguments, got %d", name.text, expected, len(node.Args))
+	}
+
+	return node, nil
+}
+
+func (self *promParser) parseLabelList() ([]string, error) {
+	labels := make([]string, 0)
+
+	if _, err := self.expect(`(`); err != nil {
+		return nil, err
+	}
+
+	for !self.isOp(`)`) {
+		if tok := self.next(); tok.kind == `ident` {
+			labels = append(labels, tok.text)
+		} else {
+			return nil, self.errorf(tok.pos, "expected a label name, got %q", tok.text)
+		}
+
+		if self.isOp(`,`) {
+			self.next()
+		} else if !self.isOp(`)`) {
+			tok := self.peek()
+			return nil, self.errorf(tok.pos, "expected ',' or ')', got %q", tok.text)
+		}
+	}
+
+	self.next()
+	return labels, nil
+}
+
+func (self *promParser) parseSelector(position int, name string) (*promNode, error) {
+	node := &promNode{
+		Type:     promSelectorNode,
+		Position: position,
+		Name:     name,
+	}
+
+	if self.isOp(`{`) {
+		self.next()
+
+		for !self.isOp(`}`) {
+			label := self.next()
+
+			if label.kind != `ident` {
+				return nil, self.errorf(label.pos, "expected a label name, got %q", label.text)
+			}
+
+			op := self.next()
+
+			switch op.text {
+			case `=`, `!=`, `=~`, `!~`:
+			default:
+				return nil, self.errorf(op.pos, "expected a label matching operator, got %q", op.text)
+			}
+
+			value := self.next()
+
+			if value.kind != `string` {
+				return nil, self.errorf(value.pos, "expected a quoted label value, got %q", value.text)
+			}
+
+			matcher := promMatcher{
+				Label:    label.text,
+				Operator: op.text,
+				Value:    value.text,
+			}
+
+			if op.text == `=~` || op.text == `!~` {
+				if rx, err := regexp.Compile(`^(?:` + value.text + `)$`); err == nil {
+					matcher.regex = rx
+				} else {
+					return nil, self.errorf(value.pos, "invalid regular expression: %v", err)
+				}
+			}
+
+			if label.text == `__name__` && op.text == `=` {
+				node.Name = value.text
+			} else {
+				node.Matchers = append(node.Matchers, matcher)
+			}
+
+			if self.isOp(`,`) {
+				self.next()
+			} else if !self.isOp(`}`) {
+				tok := self.peek()
+				return nil, self.errorf(tok.pos, "expected ',' or '}', got %q", tok.text)
+			}
+		}
+
+		self.next()
+	}
+
+	if node.Name == `` && len(node.Matchers) == 0 {
+		return nil, self.errorf(position, "vector selector must contain at least one matcher")
+	}
+
+	return node, nil
+}
+
+func (self *promParser) errorf(position int, format string, args ...interface{}) error {
+	return ExpressionError{
+		Expression: self.source,
+		Position:   position,
+		Message:    fmt.Sprintf(format, args...),
+	}
+}
+
+func isPromNameChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// Converts a mobius series name into the equivalent Prometheus metric name.
+func PromMetricName(name string) string {
+	out := []byte(name)
+
+	for i, c := range out {
+		if !isPromNameChar(c) && c != ':' {
+			out[i] = '_'
+		}
+	}
+
+	if len(out) > 0 && out[0] >= '0' && out[0] <= '9' {
+		return `_` + string(out)
+	}
+
+	return string(out)
+}
+
+// Parses a Prometheus duration such as "5m", "1h30m", "2d", or "1w".
+func parsePromDuration(text string) (time.Duration, error) {
+	var total time.Duration
+	units := map[string]time.Duration{
+		`ms`: time.Millisecond,
+		`s`:  time.Second,
+		`m`:  time.Minute,
+		`h`:  time.Hour,
+		`d`:  24 * time.Hour,
+		`w`:  7 * 24 * time.Hour,
+		`y`:  365 * 24 * time.Hour,
+	}
+
+	rest := text
+
+	if rest == `` {
+		return 0, fmt.Errorf("empty duration")
+	}
+
+	for rest != `` {
+		i := 0
+
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+
+		j := i
+
+		for j < len(rest) && (rest[j] < '0' || rest[j] > '9') {
+			j++
+		}
+
+		if i == 0 || j == i {
+			return 0, fmt.Errorf("invalid duration %q", text)
+		}
+
+		n, _ := strconv.ParseInt(rest[:i], 10, 64)
+
+		if unit, ok := units[rest[i:j]]; ok {
+			total += time.Duration(n) * unit
+		} else {
+			return 0, fmt.Errorf("invalid duration unit %q in %q", rest[i:j], text)
+		}
+
+		rest = rest[j:]
+	}
+
+	return total, nil
+}
@@ -0,0 +1,246 @@
+package mobius
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPromQLParse(t *testing.T) {
+	assert := require.New(t)
+
+	for _, query := range []string{
+		`app_requests`,
+		`app_requests{host="a",env=~"prod|dev"}[5m] offset 1h`,
+		`sum by (host) (rate(app_requests[5m]))`,
+		`sum(rate(app_requests[5m])) without (env)`,
+		`histogram_quantile(0.99, sum(app_latency))`,
+		`-app_requests * 2 ^ 3 ^ 2 + on(host) app_errors`,
+		`quantile(0.9, app_requests) > 10`,
+		`{__name__="app_requests"}`,
+	} {
+		_, err := ParsePromQL(query)
+		assert.NoError(err, query)
+	}
+
+	for query, position := range map[string]int{
+		`app_requests{host="a"`:          21,
+		`app_requests{host=a}`:           18,
+		`rate(app_requests)`:             5,
+		`nope(app_requests[5m])`:         0,
+		`sum by (host (app_requests)`:    13,
+		`app_requests[5q]`:               13,
+		`app_requests + app_errors[5m]`:  15,
+		`avg_over_time(app_requests[5m]`: 30,
+		`{}`:                             0,
+	} {
+		_, err := ParsePromQL(query)
+		assert.Error(err, query)
+		assert.Equal(position, err.(ExpressionError).Position, fmt.Sprintf("%s: %v", query, err))
+	}
+}
+
+func TestPromQLEvaluate(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	// counter resets are recorded as zeroes
+	database.StoreZeroes = true
+
+	epoch := time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC)
+
+	// counters that increase by 60/minute on host a and 120/minute on host b, with a reset on b
+	for host, perMinute := range map[string]float64{`a`: 60, `b`: 120} {
+		metric := NewMetric(`app.requests:env=prod,host=` + host)
+		value := 0.0
+
+		for i := 0; i <= 10; i++ {
+			if host == `b` && i == 5 {
+				value = 0
+			}
+
+			metric.Push(epoch.Add(time.Duration(i)*time.Minute), value)
+			value += perMinute
+		}
+
+		assert.NoError(database.Write(metric))
+
+		latency := NewMetric(`app.latency:host=` + host)
+
+		for i := 1; i <= 100; i++ {
+			sketch := NewSketch()
+			sketch.Add(float64(i))
+			latency.PushSketch(epoch.Add(10*time.Minute), sketch)
+		}
+
+		assert.NoError(database.Write(latency))
+	}
+
+	at := epoch.Add(10 * time.Minute)
+
+	instant := func(query string) *PromResult {
+		q, err := ParsePromQL(query)
+		assert.NoError(err, query)
+
+		result, err := q.Instant(database, at)
+		assert.NoError(err, query)
+		return result
+	}
+
+	values := func(result *PromResult) map[string]float64 {
+		out := make(map[string]float64)
+
+		for _, sample := range result.Vector {
+			out[sample.Labels[`host`]] = sample.Point.Value
+		}
+
+		return out
+	}
+
+	result := instant(`app_requests`)
+	assert.Equal(`vector`, result.Type)
+	assert.Equal(map[string]float64{`a`: 600, `b`: 600}, values(result))
+	assert.Equal(`app_requests`, result.Vector[0].Labels[`__name__`])
+
+	assert.Equal(map[string]float64{`a`: 1, `b`: 2}, values(instant(`rate(app_requests[5m])`)))
+	assert.Equal(map[string]float64{`a`: 600, `b`: 1080}, values(instant(`increase(app_requests[11m])`)))
+	assert.Equal(map[string]float64{`a`: 480}, values(instant(`avg_over_time(app_requests{host="a"}[5m])`)))
+	assert.Equal(map[string]float64{`a`: 300}, values(instant(`app_requests{host!="b"} offset 5m`)))
+
+	result = instant(`sum(rate(app_requests[5m])) by (env)`)
+	assert.Len(result.Vector, 1)
+	assert.Equal(PromLabels{`env`: `prod`}, result.Vector[0].Labels)
+	assert.Equal(float64(3), result.Vector[0].Point.Value)
+
+	// binary operators
+	assert.Equal(map[string]float64{`a`: 60, `b`: 120}, values(instant(`rate(app_requests[5m]) * 60`)))
+	assert.Equal(map[string]float64{`a`: 600, `b`: 540}, values(instant(`increase(app_requests[11m]) / rate(app_requests[5m])`)))
+	assert.Equal(map[string]float64{`b`: 2}, values(instant(`rate(app_requests[5m]) > 1.5`)))
+
+	// one-to-one matching on a subset of labels keeps only those labels
+	result = instant(`rate(app_requests{host="b"}[5m]) + on(env) (rate(app_requests{host="a"}[5m]) - 1)`)
+	assert.Len(result.Vector, 1)
+	assert.Equal(PromLabels{`env`: `prod`}, result.Vector[0].Labels)
+	assert.Equal(float64(2), result.Vector[0].Point.Value)
+
+	result = instant(`2 * 3 ^ 2`)
+	assert.Equal(`scalar`, result.Type)
+	assert.Equal(float64(18), result.Scalar)
+
+	// quantiles come from the sketches, merged across series by sum()
+	latency := values(instant(`histogram_quantile(0.5, app_latency)`))
+	assert.InDelta(50, latency[`a`], 1)
+	assert.InDelta(50, latency[`b`], 1)
+
+	result = instant(`histogram_quantile(0.99, sum(app_latency))`)
+	assert.Len(result.Vector, 1)
+	assert.InDelta(99, result.Vector[0].Point.Value, 1)
+
+	latency = values(instant(`quantile_over_time(0.9, app_latency[5m])`))
+	assert.InDelta(90, latency[`a`], 1)
+
+	result = instant(`quantile(0.9, app_latency)`)
+	assert.Len(result.Vector, 1)
+	assert.InDelta(90, result.Vector[0].Point.Value, 1)
+
+	// range queries
+	q, err := ParsePromQL(`sum(rate(app_requests[2m]))`)
+	assert.NoError(err)
+
+	result, err = q.Range(database, epoch.Add(6*time.Minute), at, time.Minute)
+	assert.NoError(err)
+	assert.Equal(`matrix`, result.Type)
+	assert.Len(result.Matrix, 1)
+	assert.Equal([]float64{3, 3, 3, 3, 3}, result.Matrix[0].Points.Values())
+
+	_, err = q.Range(database, epoch, at, time.Millisecond)
+	assert.Error(err)
+}
+
+func TestPromQLServer(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	epoch := time.Date(2006, 1, 2, 15, 0, 0, 0, time.UTC)
+	metric := NewMetric(`app.requests:host=a`)
+
+	for i := 0; i <= 10; i++ {
+		metric.Push(epoch.Add(time.Duration(i)*time.Minute), float64(i))
+	}
+
+	assert.NoError(database.Write(metric))
+	server := NewServer(database)
+
+	query := func(path string, values url.Values) (int, map[string]interface{}) {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(`GET`, path+`?`+values.Encode(), nil))
+
+		var body map[string]interface{}
+		jsonbody(recorder.Body, &body)
+		return recorder.Code, body
+	}
+
+	code, body := query(`/api/v1/query`, url.Values{
+		`query`: {`app_requests{host="a"}`},
+		`time`:  {fmt.Sprintf("%d", epoch.Add(5*time.Minute).Unix())},
+	})
+
+	assert.Equal(200, code)
+	assert.Equal(map[string]interface{}{
+		`status`: `success`,
+		`data`: map[string]interface{}{
+			`resultType`: `vector`,
+			`result`: []interface{}{
+				map[string]interface{}{
+					`metric`: map[string]interface{}{`__name__`: `app_requests`, `host`: `a`},
+					`value`:  []interface{}{float64(epoch.Add(5 * time.Minute).Unix()), `5`},
+				},
+			},
+		},
+	}, body)
+
+	code, body = query(`/api/v1/query_range`, url.Values{
+		`query`: {`app_requests * 2`},
+		`start`: {epoch.Add(8 * time.Minute).Format(time.RFC3339)},
+		`end`:   {epoch.Add(10 * time.Minute).Format(time.RFC3339)},
+		`step`:  {`60`},
+	})
+
+	assert.Equal(200, code)
+	data := body[`data`].(map[string]interface{})
+	assert.Equal(`matrix`, data[`resultType`])
+
+	series := data[`result`].([]interface{})[0].(map[string]interface{})
+	assert.Equal(map[string]interface{}{`host`: `a`}, series[`metric`])
+	assert.Len(series[`values`], 3)
+	assert.Equal(`20`, series[`values`].([]interface{})[2].([]interface{})[1])
+
+	code, body = query(`/api/v1/query`, url.Values{
+		`query`: {`rate(app_requests)`},
+	})
+
+	assert.Equal(400, code)
+	assert.Equal(`error`, body[`status`])
+	assert.Equal(`bad_data`, body[`errorType`])
+}
@@ -0,0 +1,211 @@
+package mobius
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Anything that can reduce a set of points to a single number: either a ReducerFunc, which only sees
+// the values of the points, or a TimeReducerFunc, which also sees when each value was recorded.
+type Reducer interface {
+	ReducePoints(points PointSet, start time.Time, end time.Time) float64
+}
+
+// Reduces the values of the given points, ignoring their timestamps.
+func (self ReducerFunc) ReducePoints(points PointSet, start time.Time, end time.Time) float64 {
+	return Reduce(self, points.Values()...)
+}
+
+// A reducer that accounts for the timing of the points it reduces, for series whose points are
+// irregularly spaced.  Each point's value is taken to hold from its timestamp until the next point's
+// (or, for the last point, until the end of the given period.)  Points are given in time order.
+type TimeReducerFunc func(points PointSet, start time.Time, end time.Time) float64
+
+func (self TimeReducerFunc) ReducePoints(points PointSet, start time.Time, end time.Time) float64 {
+	if len(points) == 0 {
+		return 0
+	}
+
+	return self(points, start, end)
+}
+
+// Creates a time-weighted reducer from the parameters given in a reducer name, e.g. the threshold in
+// "duration-above(90)".
+type TimeReducerFactory func(params ...float64) (TimeReducerFunc, error)
+
+// The mean of the values, each weighted by how long it held.  A gauge that sat at 100 for an hour
+// then dropped to 0 for a second averages just under 100, rather than 50.
+var TimeWeightedMean = TimeReducerFunc(func(points PointSet, start time.Time, end time.Time) float64 {
+	weights, total := timeWeights(points, end)
+
+	if total == 0 {
+		return Reduce(Mean, points.Values()...)
+	}
+
+	var sum float64
+
+	for i, point := range points {
+		sum += point.Value * weights[i]
+	}
+
+	return sum / total
+})
+
+// The area under the series in value-seconds, treating it as a step function.
+var Integral = TimeReducerFunc(func(points PointSet, start time.Time, end time.Time) float64 {
+	weights, _ := timeWeights(points, end)
+
+	var sum float64
+
+	for i, point := range points {
+		sum += point.Value * weights[i]
+	}
+
+	return sum
+})
+
+var timeReducerNameMap = map[string]TimeReducerFunc{
+	`integral`:           Integral,
+	`time-weighted-mean`: TimeWeightedMean,
+}
+
+var timeReducerFactoryMap = map[string]TimeReducerFactory{
+	`duration-above`:           durationAboveFactory,
+	`time-weighted-percentile`: timeWeightedPercentileFactory,
+}
+
+// Adds a time-weighted reducer to the registry of reducers available by name, replacing any existing
+// time-weighted reducer with the same name.
+func RegisterTimeReducer(name string, reducer TimeReducerFunc, aliases ...string) {
+	timeReducerNameMap[name] = reducer
+
+	for _, alias := range aliases {
+		reducerAliasMap[alias] = name
+	}
+}
+
+// Adds a parameterized time-weighted reducer to the registry (see RegisterReducerFactory.)
+func RegisterTimeReducerFactory(name string, factory TimeReducerFactory, aliases ...string) {
+	timeReducerFactoryMap[name] = factory
+
+	for _, alias := range aliases {
+		reducerAliasMap[alias] = name
+	}
+}
+
+// Returns the time-weighted reducer with the given name or alias, e.g. "time-weighted-mean" or
+// "time-weighted-percentile(99)".
+func GetTimeReducer(name string) (TimeReducerFunc, bool) {
+	if reducer, ok := timeReducerNameMap[GetReducerName(name)]; ok {
+		return reducer, true
+	} else if base, params, ok := parseReducerName(name); ok {
+		if factory, ok := timeReducerFactoryMap[base]; ok {
+			if reducer, err := factory(params...); err == nil {
+				return reducer, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Returns the reducer with the given name or alias, which may be either time-weighted or not.  This
+// is how reducers should be looked up wherever a Reducer (rather than a ReducerFunc) is accepted, such
+// as when consolidating or summarizing a series.
+func LookupReducer(name string) (Reducer, bool) {
+	if reducer, ok := GetTimeReducer(name); ok {
+		return reducer, true
+	} else if reducer, ok := GetReducer(name); ok {
+		return withQuantile(name, reducer), true
+	}
+
+	return nil, false
+}
+
+// The value below which the series spent the given percentage of its time.
+func timeWeightedPercentileFactory(params ...float64) (TimeReducerFunc, error) {
+	if len(params) != 1 {
+		return nil, fmt.Errorf("time-weighted-percentile takes one parameter")
+	} else if params[0] <= 0 || params[0] > 100 {
+		return nil, fmt.Errorf("percentile must be greater than 0 and at most 100")
+	}
+
+	percentile := params[0]
+
+	return func(points PointSet, start time.Time, end time.Time) float64 {
+		weights, total := timeWeights(points, end)
+
+		if total == 0 {
+			return Reduce(percentileFn(percentile), points.Values()...)
+		}
+
+		order := make([]int, len(points))
+
+		for i := range order {
+			order[i] = i
+		}
+
+		sort.SliceStable(order, func(i, j int) bool {
+			return points[order[i]].Value < points[order[j]].Value
+		})
+
+		target := total * percentile / 100
+		var elapsed float64
+
+		for _, i := range order {
+			if elapsed += weights[i]; elapsed >= target && weights[i] > 0 {
+				return points[i].Value
+			}
+		}
+
+		return points[order[len(order)-1]].Value
+	}, nil
+}
+
+// The number of seconds the series spent above the given threshold.
+func durationAboveFactory(params ...float64) (TimeReducerFunc, error) {
+	if len(params) != 1 {
+		return nil, fmt.Errorf("duration-above takes one parameter")
+	} else if math.IsNaN(params[0]) {
+		return nil, fmt.Errorf("duration-above threshold must be a number")
+	}
+
+	threshold := params[0]
+
+	return func(points PointSet, start time.Time, end time.Time) float64 {
+		weights, _ := timeWeights(points, end)
+
+		var seconds float64
+
+		for i, point := range points {
+			if point.Value > threshold {
+				seconds += weights[i]
+			}
+		}
+
+		return seconds
+	}, nil
+}
+
+// Returns the number of seconds each point's value held for, and their total.
+func timeWeights(points PointSet, end time.Time) ([]float64, float64) {
+	weights := make([]float64, len(points))
+	var total float64
+
+	for i, point := range points {
+		until := end
+
+		if i+1 < len(points) {
+			until = points[i+1].Timestamp
+		}
+
+		if until.After(point.Timestamp) {
+			weights[i] = until.Sub(point.Timestamp).Seconds()
+			total += weights[i]
+		}
+	}
+
+	return weights, total
+}
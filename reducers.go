@@ -1,13 +1,24 @@
 package mobius
 
 import (
+	"fmt"
 	"github.com/montanaflynn/stats"
 	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type statsUnary func(stats.Float64Data) (float64, error)
 type ReducerFunc func(values ...float64) float64
 
+// An exact counterpart to a ReducerFunc for reducers whose output is always an integer when all of
+// their inputs are.
+type IntegerReducerFunc func(values ...int64) int64
+
 // wraps a unary function from the stats package in our ReducerFunc
 func statsFn(fn statsUnary) ReducerFunc {
 	return func(values ...float64) float64 {
@@ -19,6 +30,7 @@ func statsFn(fn statsUnary) ReducerFunc {
 	}
 }
 
+// Returns a reducer yielding the given percentile (in the range (0, 100]) of its values.
 func percentileFn(percentile float64) ReducerFunc {
 	return func(values ...float64) float64 {
 		if result, err := stats.Percentile(stats.Float64Data(values), percentile); err == nil {
@@ -29,7 +41,7 @@ func percentileFn(percentile float64) ReducerFunc {
 	}
 }
 
-var First = func(values ...float64) float64 {
+var First ReducerFunc = func(values ...float64) float64 {
 	if len(values) == 0 {
 		return 0
 	} else {
@@ -37,7 +49,7 @@ var First = func(values ...float64) float64 {
 	}
 }
 
-var Last = func(values ...float64) float64 {
+var Last ReducerFunc = func(values ...float64) float64 {
 	if len(values) == 0 {
 		return 0
 	} else {
@@ -45,35 +57,74 @@ var Last = func(values ...float64) float64 {
 	}
 }
 
-var Count = func(values ...float64) float64 {
+var Count ReducerFunc = func(values ...float64) float64 {
 	return float64(len(values))
 }
 
+var Maximum ReducerFunc = func(values ...float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	max := values[0]
+
+	for _, v := range values[1:] {
+		if v > max {
+			max = v
+		}
+	}
+
+	return max
+}
+
+var Minimum ReducerFunc = func(values ...float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	min := values[0]
+
+	for _, v := range values[1:] {
+		if v < min {
+			min = v
+		}
+	}
+
+	return min
+}
+
+var Sum ReducerFunc = func(values ...float64) float64 {
+	var sum float64
+
+	for _, v := range values {
+		sum += v
+	}
+
+	return sum
+}
+
 var GeometricMean = statsFn(stats.GeometricMean)
 var HarmonicMean = statsFn(stats.HarmonicMean)
 var InterQuartileRange = statsFn(stats.InterQuartileRange)
-var Maximum = statsFn(stats.Max)
 var Mean = statsFn(stats.Mean)
 var Median = statsFn(stats.Median)
 var MedianAbsoluteDeviation = statsFn(stats.MedianAbsoluteDeviation)
 var MedianAbsoluteDeviationPopulation = statsFn(stats.MedianAbsoluteDeviationPopulation)
 var Midhinge = statsFn(stats.Midhinge)
-var Minimum = statsFn(stats.Min)
-var Percent25 = percentileFn(0.25)
-var Percent50 = percentileFn(0.50)
-var Percent75 = percentileFn(0.75)
-var Percent85 = percentileFn(0.85)
-var Percent90 = percentileFn(0.90)
-var Percent95 = percentileFn(0.95)
-var Percent98 = percentileFn(0.98)
-var Percent99 = percentileFn(0.99)
-var Percent9999 = percentileFn(0.9999)
+var Percent25 = percentileFn(25)
+var Percent50 = percentileFn(50)
+var Percent75 = percentileFn(75)
+var Percent85 = percentileFn(85)
+var Percent90 = percentileFn(90)
+var Percent95 = percentileFn(95)
+var Percent98 = percentileFn(98)
+var Percent99 = percentileFn(99)
+var Percent9999 = percentileFn(99.99)
 var PopulationVariance = statsFn(stats.PopulationVariance)
 var SampleVariance = statsFn(stats.SampleVariance)
 var StandardDeviation = statsFn(stats.StandardDeviation)
 var StandardDeviationPopulation = statsFn(stats.StandardDeviationPopulation)
 var StandardDeviationSample = statsFn(stats.StandardDeviationSample)
-var Sum = statsFn(stats.Sum)
 var Trimean = statsFn(stats.Trimean)
 var Variance = statsFn(stats.Variance)
 
@@ -86,6 +137,79 @@ func Reduce(reducer ReducerFunc, values ...float64) float64 {
 	}
 }
 
+var integerReducers = []struct {
+	reducer ReducerFunc
+	integer IntegerReducerFunc
+}{
+	{First, func(values ...int64) int64 {
+		return values[0]
+	}},
+	{Last, func(values ...int64) int64 {
+		return values[len(values)-1]
+	}},
+	{Count, func(values ...int64) int64 {
+		return int64(len(values))
+	}},
+	{Maximum, func(values ...int64) int64 {
+		max := values[0]
+
+		for _, v := range values[1:] {
+			if v > max {
+				max = v
+			}
+		}
+
+		return max
+	}},
+	{Minimum, func(values ...int64) int64 {
+		min := values[0]
+
+		for _, v := range values[1:] {
+			if v < min {
+				min = v
+			}
+		}
+
+		return min
+	}},
+	{Sum, func(values ...int64) int64 {
+		var sum int64
+
+		for _, v := range values {
+			sum += v
+		}
+
+		return sum
+	}},
+}
+
+// Returns the exact integer implementation of the given reducer, if one exists.  Reducers such as
+// Sum, Minimum, and Maximum always yield an integer when given integers, and so can preserve the
+// full precision of integer-valued series.
+func GetIntegerReducer(reducer ReducerFunc) (IntegerReducerFunc, bool) {
+	if reducer != nil {
+		ptr := reflect.ValueOf(reducer).Pointer()
+
+		for _, pair := range integerReducers {
+			if reflect.ValueOf(pair.reducer).Pointer() == ptr {
+				return pair.integer, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Applies the given integer reducer to the values, returning zero if no values are given.
+func ReduceInteger(reducer IntegerReducerFunc, values ...int64) int64 {
+	switch len(values) {
+	case 0:
+		return 0
+	default:
+		return reducer(values...)
+	}
+}
+
 var reducerNameMap = map[string]ReducerFunc{
 	`count`:                                Count,
 	`first`:                                First,
@@ -114,9 +238,9 @@ var reducerNameMap = map[string]ReducerFunc{
 	`standard-deviation`:                   StandardDeviation,
 	`standard-deviation-population`:        StandardDeviationPopulation,
 	`standard-deviation-sample`:            StandardDeviationSample,
-	`sum`:      Sum,
-	`trimean`:  Trimean,
-	`variance`: Variance,
+	`sum`:                                  Sum,
+	`trimean`:                              Trimean,
+	`variance`:                             Variance,
 }
 
 var reducerAliasMap = map[string]string{
@@ -128,8 +252,12 @@ var reducerAliasMap = map[string]string{
 	`average`:   `mean`,
 	`mad`:       `median-absolute-deviation`,
 	`madp`:      `median-absolute-deviation-population`,
+	`pct`:       `percentile`,
 	`pvar`:      `population-variance`,
 	`svar`:      `sample-variance`,
+	`tmean`:     `trimmed-mean`,
+	`twa`:       `time-weighted-mean`,
+	`twp`:       `time-weighted-percentile`,
 	`stddev`:    `standard-deviation`,
 	`stddevp`:   `standard-deviation-population`,
 	`stddevs`:   `standard-deviation-sample`,
@@ -144,22 +272,283 @@ var reducerAliasMap = map[string]string{
 	`var`:       `variance`,
 }
 
+// The quantiles (0-1) yielded by reducers, which sketch-valued series answer directly from their
+// merged sketches rather than by reconstructing every observation the sketches summarize.
+var reducerQuantiles = map[string]float64{
+	`median`:      0.5,
+	`percent25`:   0.25,
+	`percent50`:   0.5,
+	`percent75`:   0.75,
+	`percent85`:   0.85,
+	`percent90`:   0.9,
+	`percent95`:   0.95,
+	`percent98`:   0.98,
+	`percent99`:   0.99,
+	`percent9999`: 0.9999,
+}
+
+// A reducer yielding a quantile of its values.
+type quantileReducer struct {
+	fn       ReducerFunc
+	quantile float64
+}
+
+// Returns a reducer yielding the given quantile (0-1) of its values.
+func newQuantileReducer(quantile float64) quantileReducer {
+	return quantileReducer{percentileFn(quantile * 100), quantile}
+}
+
+func (self quantileReducer) ReducePoints(points PointSet, start time.Time, end time.Time) float64 {
+	return self.fn.ReducePoints(points, start, end)
+}
+
+// Wraps the named reducer so that it can be answered from sketches if it yields a quantile.
+func withQuantile(name string, reducer ReducerFunc) Reducer {
+	if quantile, ok := reducerQuantiles[GetReducerName(name)]; ok {
+		return quantileReducer{reducer, quantile}
+	} else if base, params, ok := parseReducerName(name); ok && base == `percentile` && len(params) == 1 {
+		return quantileReducer{reducer, params[0] / 100}
+	}
+
+	return reducer
+}
+
+var reducerFactoryMap = map[string]ReducerFactory{
+	`percentile`:   percentileFactory,
+	`topn-mean`:    topNMeanFactory,
+	`trimmed-mean`: trimmedMeanFactory,
+}
+
+var rxReducerPercentile = regexp.MustCompile(`^p(\d+(?:\.\d+)?)$`)
+var rxReducerParameters = regexp.MustCompile(`^([\w\-]+)\((.*)\)$`)
+
+// Creates a reducer from the parameters given in a reducer name, e.g. the 99.9 in "percentile(99.9)".
+type ReducerFactory func(params ...float64) (ReducerFunc, error)
+
+// Describes a registered reducer.
+type ReducerInfo struct {
+	Name          string   `json:"name"`
+	Aliases       []string `json:"aliases,omitempty"`
+	Parameterized bool     `json:"parameterized,omitempty"`
+	TimeWeighted  bool     `json:"time_weighted,omitempty"`
+}
+
+// Adds a reducer to the registry of reducers available by name, replacing any existing reducer with
+// the same name.
+func RegisterReducer(name string, reducer ReducerFunc, aliases ...string) {
+	reducerNameMap[name] = reducer
+
+	for _, alias := range aliases {
+		reducerAliasMap[alias] = name
+	}
+}
+
+// Adds a parameterized reducer to the registry, which is used when a reducer is named like a function
+// call (e.g. "trimmed-mean(10)".)  Any existing parameterized reducer with the same name is replaced.
+func RegisterReducerFactory(name string, factory ReducerFactory, aliases ...string) {
+	reducerFactoryMap[name] = factory
+
+	for _, alias := range aliases {
+		reducerAliasMap[alias] = name
+	}
+}
+
+// Returns all registered reducers, sorted by name.
+func Reducers() []ReducerInfo {
+	aliases := make(map[string][]string)
+
+	for alias, name := range reducerAliasMap {
+		aliases[name] = append(aliases[name], alias)
+	}
+
+	reducers := make([]ReducerInfo, 0, len(reducerNameMap)+len(reducerFactoryMap)+len(timeReducerNameMap)+len(timeReducerFactoryMap))
+
+	for name := range reducerNameMap {
+		reducers = append(reducers, ReducerInfo{
+			Name: name,
+		})
+	}
+
+	for name := range reducerFactoryMap {
+		reducers = append(reducers, ReducerInfo{
+			Name:          name,
+			Parameterized: true,
+		})
+	}
+
+	for name := range timeReducerNameMap {
+		reducers = append(reducers, ReducerInfo{
+			Name:         name,
+			TimeWeighted: true,
+		})
+	}
+
+	for name := range timeReducerFactoryMap {
+		reducers = append(reducers, ReducerInfo{
+			Name:          name,
+			Parameterized: true,
+			TimeWeighted:  true,
+		})
+	}
+
+	for i, reducer := range reducers {
+		sort.Strings(aliases[reducer.Name])
+		reducers[i].Aliases = aliases[reducer.Name]
+	}
+
+	sort.Slice(reducers, func(i, j int) bool {
+		return reducers[i].Name < reducers[j].Name
+	})
+
+	return reducers
+}
+
+// Returns the reducer with the given name or alias.  Parameterized reducers are given as e.g.
+// "percentile(99.9)", "trimmed-mean(10)", or "topn-mean(5)", and percentiles may be abbreviated as
+// e.g. "p97.5".
 func GetReducer(name string) (ReducerFunc, bool) {
 	if reducer, ok := reducerNameMap[GetReducerName(name)]; ok {
 		return reducer, true
+	} else if base, params, ok := parseReducerName(name); ok {
+		if factory, ok := reducerFactoryMap[base]; ok {
+			if reducer, err := factory(params...); err == nil {
+				return reducer, true
+			}
+		}
 	}
 
 	return nil, false
 }
 
+// Returns the canonical name of the given reducer name or alias, or an empty string if there is no
+// such reducer.  Parameterized reducers are named like "percentile(97.5)".
 func GetReducerName(aliasOrName string) string {
-	if _, ok := reducerNameMap[aliasOrName]; ok {
-		return aliasOrName
-	} else if alias, ok := reducerAliasMap[aliasOrName]; ok {
-		if _, ok := reducerNameMap[alias]; ok {
-			return alias
+	name := aliasOrName
+
+	if alias, ok := reducerAliasMap[aliasOrName]; ok {
+		name = alias
+	}
+
+	if _, ok := reducerNameMap[name]; ok {
+		return name
+	} else if _, ok := timeReducerNameMap[name]; ok {
+		return name
+	}
+
+	if base, params, ok := parseReducerName(aliasOrName); ok {
+		var err error
+
+		if factory, ok := reducerFactoryMap[base]; ok {
+			_, err = factory(params...)
+		} else if factory, ok := timeReducerFactoryMap[base]; ok {
+			_, err = factory(params...)
+		} else {
+			return ``
+		}
+
+		if err == nil {
+			args := make([]string, len(params))
+
+			for i, param := range params {
+				args[i] = strconv.FormatFloat(param, 'f', -1, 64)
+			}
+
+			return base + `(` + strings.Join(args, `,`) + `)`
 		}
 	}
 
 	return ``
 }
+
+// Splits a parameterized reducer name into the canonical name of the reducer and its parameters.
+func splitReducerName(name string) (string, string) {
+	if match := rxReducerPercentile.FindStringSubmatch(name); match != nil {
+		return `percentile`, match[1]
+	} else if match := rxReducerParameters.FindStringSubmatch(name); match != nil {
+		if alias, ok := reducerAliasMap[match[1]]; ok {
+			return alias, match[2]
+		}
+
+		return match[1], match[2]
+	}
+
+	return ``, ``
+}
+
+// Like splitReducerName, but also parses the parameters.
+func parseReducerName(name string) (string, []float64, bool) {
+	base, args := splitReducerName(strings.TrimSpace(name))
+
+	if base == `` {
+		return ``, nil, false
+	}
+
+	params := make([]float64, 0)
+
+	for _, arg := range strings.Split(args, `,`) {
+		if arg = strings.TrimSpace(arg); arg == `` {
+			continue
+		} else if v, err := strconv.ParseFloat(arg, 64); err == nil {
+			params = append(params, v)
+		} else {
+			return ``, nil, false
+		}
+	}
+
+	return base, params, true
+}
+
+func percentileFactory(params ...float64) (ReducerFunc, error) {
+	if len(params) != 1 {
+		return nil, fmt.Errorf("percentile takes one parameter")
+	} else if params[0] <= 0 || params[0] > 100 {
+		return nil, fmt.Errorf("percentile must be greater than 0 and at most 100")
+	}
+
+	return percentileFn(params[0]), nil
+}
+
+// The mean of the values remaining after discarding the given percentage of the smallest and
+// largest values.
+func trimmedMeanFactory(params ...float64) (ReducerFunc, error) {
+	if len(params) != 1 {
+		return nil, fmt.Errorf("trimmed-mean takes one parameter")
+	} else if params[0] < 0 || params[0] >= 50 {
+		return nil, fmt.Errorf("trimmed-mean percentage must be at least 0 and less than 50")
+	}
+
+	percent := params[0]
+
+	return func(values ...float64) float64 {
+		sorted := make([]float64, len(values))
+		copy(sorted, values)
+		sort.Float64s(sorted)
+
+		trim := int(float64(len(sorted)) * percent / 100)
+
+		return Mean(sorted[trim : len(sorted)-trim]...)
+	}, nil
+}
+
+// The mean of the n largest values.
+func topNMeanFactory(params ...float64) (ReducerFunc, error) {
+	if len(params) != 1 {
+		return nil, fmt.Errorf("topn-mean takes one parameter")
+	} else if n := params[0]; n < 1 || n != math.Trunc(n) {
+		return nil, fmt.Errorf("topn-mean count must be a positive integer")
+	}
+
+	n := int(params[0])
+
+	return func(values ...float64) float64 {
+		sorted := make([]float64, len(values))
+		copy(sorted, values)
+		sort.Sort(sort.Reverse(sort.Float64Slice(sorted)))
+
+		if n < len(sorted) {
+			sorted = sorted[:n]
+		}
+
+		return Mean(sorted...)
+	}, nil
+}
@@ -85,3 +85,134 @@ func TestReduceVariance(t *testing.T) {
 	assert.Equal(float64(0), Reduce(Variance, 1))
 	assert.Equal(float64(4), Reduce(Variance, 2, 4, 4, 4, 5, 5, 7, 9))
 }
+
+func TestReducePercentScale(t *testing.T) {
+	assert := require.New(t)
+	values := make([]float64, 1000)
+
+	for i := range values {
+		values[i] = float64(i + 1)
+	}
+
+	// percentiles are given as percentages, not fractions
+	assert.Equal(float64(9.5), Reduce(percentileFn(0.95), values...))
+	assert.Equal(float64(950), Reduce(Percent95, values...))
+
+	assert.Equal(float64(250), Reduce(Percent25, values...))
+	assert.Equal(float64(500), Reduce(Percent50, values...))
+	assert.Equal(float64(990), Reduce(Percent99, values...))
+	assert.Equal(float64(999.5), Reduce(Percent9999, values...))
+}
+
+func TestReduceParameterized(t *testing.T) {
+	assert := require.New(t)
+	values := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 100}
+
+	assert.Equal(`percentile(97.5)`, GetReducerName(`p97.5`))
+	assert.Equal(`percentile(99.9)`, GetReducerName(`percentile(99.9)`))
+	assert.Equal(`percentile(50)`, GetReducerName(`pct(50)`))
+	assert.Equal(`trimmed-mean(10)`, GetReducerName(`trimmed-mean( 10 )`))
+	assert.Equal(``, GetReducerName(`percentile(101)`))
+	assert.Equal(``, GetReducerName(`trimmed-mean(50)`))
+	assert.Equal(``, GetReducerName(`topn-mean(1.5)`))
+	assert.Equal(``, GetReducerName(`bogus(1)`))
+
+	reducer, ok := GetReducer(`p50`)
+	assert.True(ok)
+	assert.Equal(Reduce(Percent50, values...), Reduce(reducer, values...))
+
+	reducer, ok = GetReducer(`trimmed-mean(10)`)
+	assert.True(ok)
+	assert.Equal(float64(5.5), Reduce(reducer, values...))
+
+	reducer, ok = GetReducer(`topn-mean(2)`)
+	assert.True(ok)
+	assert.Equal(float64(54.5), Reduce(reducer, values...))
+
+	_, ok = GetReducer(`percentile(abc)`)
+	assert.False(ok)
+
+	_, ok = GetReducer(`percentile`)
+	assert.False(ok)
+}
+
+func TestReduceRegister(t *testing.T) {
+	assert := require.New(t)
+
+	RegisterReducer(`test-range`, func(values ...float64) float64 {
+		return Maximum(values...) - Minimum(values...)
+	}, `test-spread`)
+
+	RegisterReducerFactory(`test-scaled-sum`, func(params ...float64) (ReducerFunc, error) {
+		return func(values ...float64) float64 {
+			return Sum(values...) * params[0]
+		}, nil
+	})
+
+	defer func() {
+		delete(reducerNameMap, `test-range`)
+		delete(reducerAliasMap, `test-spread`)
+		delete(reducerFactoryMap, `test-scaled-sum`)
+	}()
+
+	reducer, ok := GetReducer(`test-spread`)
+	assert.True(ok)
+	assert.Equal(float64(4), Reduce(reducer, 1, 5, 3))
+
+	reducer, ok = GetReducer(`test-scaled-sum(2)`)
+	assert.True(ok)
+	assert.Equal(float64(18), Reduce(reducer, 1, 5, 3))
+
+	var found int
+
+	for _, info := range Reducers() {
+		switch info.Name {
+		case `test-range`:
+			assert.Equal([]string{`test-spread`}, info.Aliases)
+			assert.False(info.Parameterized)
+			found++
+		case `percentile`:
+			assert.Equal([]string{`pct`}, info.Aliases)
+			assert.True(info.Parameterized)
+			found++
+		case `test-scaled-sum`:
+			found++
+		}
+	}
+
+	assert.Equal(3, found)
+}
+
+func TestReduceTimeWeightedNames(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal(`time-weighted-mean`, GetReducerName(`twa`))
+	assert.Equal(`integral`, GetReducerName(`integral`))
+	assert.Equal(`time-weighted-percentile(99)`, GetReducerName(`twp(99)`))
+	assert.Equal(`duration-above(-5)`, GetReducerName(`duration-above(-5)`))
+	assert.Equal(``, GetReducerName(`time-weighted-percentile(0)`))
+
+	_, ok := GetReducer(`twa`)
+	assert.False(ok)
+
+	_, ok = GetTimeReducer(`sum`)
+	assert.False(ok)
+
+	reducer, ok := LookupReducer(`twa`)
+	assert.True(ok)
+	assert.IsType(TimeReducerFunc(nil), reducer)
+
+	reducer, ok = LookupReducer(`sum`)
+	assert.True(ok)
+	assert.IsType(ReducerFunc(nil), reducer)
+
+	// quantiles can be answered from sketches
+	for name, quantile := range map[string]float64{`p97.5`: 0.975, `percent99`: 0.99, `median`: 0.5} {
+		reducer, ok = LookupReducer(name)
+		assert.True(ok)
+		assert.Equal(quantile, reducer.(quantileReducer).quantile, name)
+	}
+
+	_, ok = LookupReducer(`bogus`)
+	assert.False(ok)
+}
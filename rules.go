@@ -0,0 +1,453 @@
+package mobius
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// A RecordingRule precomputes an aggregate over the series matching a selector and stores the
+// result as a new series.  Each evaluation reads the points in the intervals it covers, groups them
+// with MergeMetrics, consolidates each group into one point per interval (aligned to the epoch, as
+// ConsolidateMetric does), and writes those points (timestamped at the start of each interval) to
+// the series named by the rule.
+type RecordingRule struct {
+	// The name of the series the results are written to.  When grouping by a tag, each output series
+	// is additionally tagged with the value of that tag.
+	Name string `json:"name"`
+
+	// The pattern selecting the input series (as accepted by Range.)
+	Selector string `json:"selector"`
+
+	// The name of the reducer used to consolidate each interval (defaults to DefaultMetricReducerFunc.)
+	Reducer string `json:"reducer,omitempty"`
+
+	// The width of the intervals the input series are consolidated into (e.g. "1m".)
+	Interval string `json:"interval"`
+
+	// The tag to group the input series by; if empty, all input series are aggregated together.
+	GroupBy string `json:"group_by,omitempty"`
+
+	// How often the rule is evaluated on a schedule (e.g. "1m".)  If empty, the rule only runs on
+	// write (if OnWrite is set) or when triggered manually.
+	Every string `json:"every,omitempty"`
+
+	// How far back each scheduled evaluation looks for complete intervals (defaults to Interval.)
+	// Intervals are recomputed on every run that covers them, so a longer lookback tolerates points
+	// that arrive late.
+	Lookback string `json:"lookback,omitempty"`
+
+	// Whether to re-evaluate the intervals covered by each write to a matching input series.  Series
+	// written by recording rules (this one or any other) never trigger rules.
+	OnWrite bool `json:"on_write,omitempty"`
+
+	reducer  Reducer
+	interval time.Duration
+	every    time.Duration
+	lookback time.Duration
+}
+
+// Loads a set of recording rules from a JSON file containing either an array of rules or an object
+// with the rules under the "rules" key.
+func LoadRules(filename string) ([]*RecordingRule, error) {
+	if data, err := ioutil.ReadFile(filename); err == nil {
+		return ParseRules(data)
+	} else {
+		return nil, err
+	}
+}
+
+// Parses and validates a set of recording rules from JSON (see LoadRules.)
+func ParseRules(data []byte) ([]*RecordingRule, error) {
+	var rules []*RecordingRule
+	var config struct {
+		Rules []*RecordingRule `json:"rules"`
+	}
+
+	if err := json.Unmarshal(data, &rules); err != nil {
+		if err := json.Unmarshal(data, &config); err == nil {
+			rules = config.Rules
+		} else {
+			return nil, err
+		}
+	}
+
+	names := make(map[string]bool)
+
+	for i, rule := range rules {
+		if err := rule.init(); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		} else if names[rule.Name] {
+			return nil, fmt.Errorf("rule %d: duplicate rule %q", i, rule.Name)
+		}
+
+		names[rule.Name] = true
+	}
+
+	return rules, nil
+}
+
+func (self *RecordingRule) init() error {
+	if self.Name == `` {
+		return fmt.Errorf("a name is required")
+	} else if self.Selector == `` {
+		return fmt.Errorf("a selector is required")
+	}
+
+	switch self.GroupBy {
+	case `name`, `unique`:
+		return fmt.Errorf("rules can only group by a tag")
+	}
+
+	if _, err := parseNamePattern(self.Selector); err != nil {
+		return err
+	}
+
+	if self.Reducer == `` {
+		self.Reducer = DefaultMetricReducerFunc
+	}
+
+	if reducer, ok := LookupReducer(self.Reducer); ok {
+		self.reducer = reducer
+	} else {
+		return fmt.Errorf("unknown reducer %q", self.Reducer)
+	}
+
+	if d, err := time.ParseDuration(self.Interval); err == nil && d > 0 {
+		self.interval = d
+	} else {
+		return fmt.Errorf("invalid interval %q", self.Interval)
+	}
+
+	if self.Every != `` {
+		if d, err := time.ParseDuration(self.Every); err == nil && d > 0 {
+			self.every = d
+		} else {
+			return fmt.Errorf("invalid schedule %q", self.Every)
+		}
+	}
+
+	if self.Lookback == `` {
+		self.lookback = self.interval
+	} else if d, err := time.ParseDuration(self.Lookback); err == nil && d > 0 {
+		self.lookback = d
+	} else {
+		return fmt.Errorf("invalid lookback %q", self.Lookback)
+	}
+
+	return nil
+}
+
+// Computes the output series for all intervals that overlap the given time range.  Intervals are
+// aligned to the epoch, as when consolidating.
+func (self *RecordingRule) Evaluate(dataset *Dataset, start time.Time, end time.Time) ([]*Metric, error) {
+	outputs := make(map[string]*Metric)
+	names := make([]string, 0)
+	bucketing := self.bucketing()
+	first := bucketing.Start(start)
+	last := bucketing.Next(bucketing.Start(end.Add(-1)))
+
+	if !last.After(first) {
+		return nil, nil
+	}
+
+	metrics, err := dataset.Range(first, last.Add(-1), self.Selector)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range MergeMetrics(self.inputs(metrics), self.GroupBy) {
+		output := NewMetric(self.Name)
+
+		if self.GroupBy != `` {
+			if value := group.GetTag(self.GroupBy); value != nil {
+				output.SetTag(self.GroupBy, value)
+			}
+		}
+
+		if existing, ok := outputs[output.GetUniqueName()]; ok {
+			output = existing
+		} else {
+			outputs[output.GetUniqueName()] = output
+			names = append(names, output.GetUniqueName())
+		}
+
+		for _, point := range ConsolidateMetricBuckets(group, bucketing, self.reducer).Points() {
+			// record the reduced value of sketches rather than the sketch itself
+			if point.Type == SketchType {
+				point, _ = point.As(FloatType)
+			}
+
+			output.PushPoint(point)
+		}
+	}
+
+	results := make([]*Metric, 0, len(names))
+
+	for _, name := range names {
+		if !outputs[name].IsEmpty() {
+			results = append(results, outputs[name])
+		}
+	}
+
+	return results, nil
+}
+
+// The intervals the rule consolidates its input series into.
+func (self *RecordingRule) bucketing() TimeBucketing {
+	return TimeBucketing{
+		Size: self.interval,
+	}
+}
+
+// Excludes the rule's own output series, which its selector may also match.
+func (self *RecordingRule) inputs(metrics []*Metric) []*Metric {
+	inputs := make([]*Metric, 0, len(metrics))
+
+	for _, metric := range metrics {
+		if metric.GetName() != self.Name {
+			inputs = append(inputs, metric)
+		}
+	}
+
+	return inputs
+}
+
+// Evaluates the rule over the given time range and writes the results to the dataset.  The results
+// are delivered to subscribers as usual, except that they never trigger on-write rules.
+func (self *RecordingRule) Run(dataset *Dataset, start time.Time, end time.Time) error {
+	if metrics, err := self.Evaluate(dataset, start, end); err == nil {
+		for _, metric := range metrics {
+			if err := dataset.writeDerived(metric); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	} else {
+		return err
+	}
+}
+
+// Evaluates the complete intervals within the rule's lookback window that precede the given time.
+func (self *RecordingRule) RunAt(dataset *Dataset, now time.Time) error {
+	end := self.bucketing().Start(now)
+
+	return self.Run(dataset, end.Add(-self.lookback), end)
+}
+
+// A RuleEngine evaluates a set of recording rules against a dataset on their schedules and as
+// matching series are written to.  Since only one process may have a dataset open for writing, the
+// engine must run in the process that writes to it (e.g. alongside the server receiving its data);
+// on-write rules see only the writes made through that process's Dataset.
+type RuleEngine struct {
+	Rules         []*RecordingRule
+	dataset       *Dataset
+	stop          chan bool
+	subscriptions []*Subscription
+	wg            sync.WaitGroup
+}
+
+func NewRuleEngine(dataset *Dataset, rules []*RecordingRule) *RuleEngine {
+	return &RuleEngine{
+		Rules:   rules,
+		dataset: dataset,
+	}
+}
+
+// Returns the rule with the given name.
+func (self *RuleEngine) Get(name string) (*RecordingRule, bool) {
+	for _, rule := range self.Rules {
+		if rule.Name == name {
+			return rule, true
+		}
+	}
+
+	return nil, false
+}
+
+// Immediately evaluates the named rule (or all rules if no names are given) using each rule's
+// lookback window.
+func (self *RuleEngine) Trigger(names ...string) error {
+	rules := self.Rules
+
+	if len(names) > 0 {
+		rules = nil
+
+		for _, name := range names {
+			if rule, ok := self.Get(name); ok {
+				rules = append(rules, rule)
+			} else {
+				return fmt.Errorf("no such rule %q", name)
+			}
+		}
+	}
+
+	now := time.Now()
+
+	for _, rule := range rules {
+		if err := rule.RunAt(self.dataset, now); err != nil {
+			return fmt.Errorf("rule %q failed: %v", rule.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Starts evaluating scheduled and on-write rules in the background until Stop is called.
+func (self *RuleEngine) Start() error {
+	if self.stop != nil {
+		return fmt.Errorf("rule engine is already running")
+	} else if self.dataset.readonly {
+		return ErrReadOnly
+	}
+
+	self.stop = make(chan bool)
+
+	for _, rule := range self.Rules {
+		if rule.every > 0 {
+			self.wg.Add(1)
+			go self.schedule(rule)
+		}
+
+		if rule.OnWrite {
+			// rules don't receive rule output, so nothing they write can block on their subscriptions
+			if subscription, err := self.dataset.subscribe(rule.Selector, true, false); err == nil {
+				pending := newPendingRange()
+
+				self.subscriptions = append(self.subscriptions, subscription)
+				self.wg.Add(2)
+				go self.watch(subscription, pending)
+				go self.runPending(rule, pending)
+			} else {
+				self.Stop()
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Stops all background rule evaluation.
+func (self *RuleEngine) Stop() {
+	if self.stop != nil {
+		close(self.stop)
+
+		for _, subscription := range self.subscriptions {
+			subscription.Unsubscribe()
+		}
+
+		self.wg.Wait()
+		self.stop = nil
+		self.subscriptions = nil
+	}
+}
+
+func (self *RuleEngine) schedule(rule *RecordingRule) {
+	defer self.wg.Done()
+
+	ticker := time.NewTicker(rule.every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.stop:
+			return
+		case now := <-ticker.C:
+			if err := rule.RunAt(self.dataset, now); err != nil {
+				log.Warningf("Recording rule %q failed: %v", rule.Name, err)
+			}
+		}
+	}
+}
+
+// Gathers the time range covered by each write to a rule's input series.  The rule is run
+// separately (see runPending), so that receiving writes never waits on the rule.
+func (self *RuleEngine) watch(subscription *Subscription, pending *pendingRange) {
+	defer self.wg.Done()
+	defer pending.close()
+
+	for metric := range subscription.C {
+		for _, point := range metric.Points() {
+			pending.add(point.Timestamp)
+		}
+	}
+}
+
+// Re-evaluates the intervals covered by the writes gathered since the rule last ran.
+func (self *RuleEngine) runPending(rule *RecordingRule, pending *pendingRange) {
+	defer self.wg.Done()
+
+	for {
+		if start, end, ok := pending.take(); ok {
+			if err := rule.Run(self.dataset, start, end); err != nil {
+				log.Warningf("Recording rule %q failed: %v", rule.Name, err)
+			}
+		} else {
+			return
+		}
+	}
+}
+
+// The span of the points written to a rule's input series that the rule has yet to cover.
+type pendingRange struct {
+	lock   sync.Mutex
+	start  time.Time
+	end    time.Time
+	wake   chan bool
+	closed chan bool
+}
+
+func newPendingRange() *pendingRange {
+	return &pendingRange{
+		wake:   make(chan bool, 1),
+		closed: make(chan bool),
+	}
+}
+
+// Extends the range to cover the given time.
+func (self *pendingRange) add(t time.Time) {
+	self.lock.Lock()
+
+	if self.end.IsZero() || t.Before(self.start) {
+		self.start = t
+	}
+
+	if t.Add(1).After(self.end) {
+		self.end = t.Add(1)
+	}
+
+	self.lock.Unlock()
+
+	select {
+	case self.wake <- true:
+	default:
+	}
+}
+
+// Waits for a non-empty range and returns it, resetting the range; returns false once closed.
+func (self *pendingRange) take() (time.Time, time.Time, bool) {
+	for {
+		select {
+		case <-self.closed:
+			return time.Time{}, time.Time{}, false
+		case <-self.wake:
+			self.lock.Lock()
+			start, end := self.start, self.end
+			self.start, self.end = time.Time{}, time.Time{}
+			self.lock.Unlock()
+
+			if !end.IsZero() {
+				return start, end, true
+			}
+		}
+	}
+}
+
+func (self *pendingRange) close() {
+	close(self.closed)
+}
@@ -0,0 +1,260 @@
+package mobius
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecordingRulesParse(t *testing.T) {
+	assert := require.New(t)
+
+	rules, err := ParseRules([]byte(`{
+		"rules": [{
+			"name":     "rollup.requests.total",
+			"selector": "app.requests.*",
+			"interval": "1m",
+			"every":    "1m"
+		}]
+	}`))
+
+	assert.NoError(err)
+	assert.Len(rules, 1)
+	assert.Equal(`sum`, rules[0].Reducer)
+	assert.Equal(time.Minute, rules[0].lookback)
+
+	for _, invalid := range []string{
+		`[{"selector": "app.*", "interval": "1m"}]`,
+		`[{"name": "total", "selector": "app.*", "interval": "nope"}]`,
+		`[{"name": "total", "selector": "app.*", "interval": "1m", "reducer": "nope"}]`,
+		`[{"name": "total", "selector": "app.*", "interval": "1m", "group_by": "name"}]`,
+	} {
+		_, err := ParseRules([]byte(invalid))
+		assert.Error(err, invalid)
+	}
+}
+
+func TestRecordingRulesEvaluate(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, time.UTC)
+
+	for _, name := range []string{
+		`app.requests.get:host=a,region=east`,
+		`app.requests.get:host=b,region=west`,
+		`app.requests.put:host=a,region=east`,
+	} {
+		metric := NewMetric(name)
+
+		for i := 0; i < 12; i++ {
+			metric.Push(epoch.Add(time.Duration(i)*10*time.Second), 1)
+		}
+
+		assert.NoError(database.Write(metric))
+	}
+
+	rules, err := ParseRules([]byte(`[{
+		"name":     "rollup.requests.total",
+		"selector": "app.requests.*",
+		"interval": "1m"
+	}, {
+		"name":     "rollup.requests.by_region",
+		"selector": "app.requests.*",
+		"interval": "1m",
+		"group_by": "region"
+	}]`))
+
+	assert.NoError(err)
+
+	engine := NewRuleEngine(database, rules)
+	total, _ := engine.Get(`rollup.requests.total`)
+	assert.NoError(total.Run(database, epoch, epoch.Add(2*time.Minute)))
+
+	metrics, err := database.Range(epoch, epoch.Add(time.Hour), `rollup.requests.total`)
+	assert.NoError(err)
+	assert.Len(metrics, 1)
+	assert.Equal([]float64{18, 18}, metrics[0].Points().Values())
+	assert.True(metrics[0].Points()[0].Timestamp.Equal(epoch))
+	assert.True(metrics[0].Points()[1].Timestamp.Equal(epoch.Add(time.Minute)))
+
+	// re-running an interval overwrites its previous result
+	assert.NoError(total.RunAt(database, epoch.Add(90*time.Second)))
+
+	metrics, err = database.Range(epoch, epoch.Add(time.Hour), `rollup.requests.total`)
+	assert.NoError(err)
+	assert.Len(metrics[0].Points(), 2)
+
+	byRegion, _ := engine.Get(`rollup.requests.by_region`)
+	results, err := byRegion.Evaluate(database, epoch, epoch.Add(time.Minute))
+	assert.NoError(err)
+	assert.Len(results, 2)
+	assert.Equal(`rollup.requests.by_region:region=east`, results[0].GetUniqueName())
+	assert.Equal([]float64{12}, results[0].Points().Values())
+	assert.Equal(`rollup.requests.by_region:region=west`, results[1].GetUniqueName())
+	assert.Equal([]float64{6}, results[1].Points().Values())
+
+	// intervals are aligned to the epoch, and every interval covered is emitted
+	slow := NewMetric(`app.slow:host=a`)
+
+	for i := 0; i < 12; i++ {
+		slow.Push(epoch.Add(6*time.Minute+time.Duration(i)*10*time.Second), 1)
+	}
+
+	assert.NoError(database.Write(slow))
+
+	rules, err = ParseRules([]byte(`[{
+		"name":     "rollup.slow",
+		"selector": "app.slow",
+		"interval": "7m"
+	}]`))
+
+	assert.NoError(err)
+
+	results, err = rules[0].Evaluate(database, epoch.Add(6*time.Minute), epoch.Add(8*time.Minute))
+	assert.NoError(err)
+	assert.Len(results, 1)
+	assert.Equal([]float64{6, 6}, results[0].Points().Values())
+	assert.True(results[0].Points()[0].Timestamp.Equal(epoch))
+	assert.True(results[0].Points()[1].Timestamp.Equal(epoch.Add(7 * time.Minute)))
+
+	assert.Error(engine.Trigger(`rollup.requests.nope`))
+}
+
+func TestRecordingRulesOnWrite(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	rules, err := ParseRules([]byte(`[{
+		"name":     "app.latency.max",
+		"selector": "app.latency",
+		"reducer":  "max",
+		"interval": "1m",
+		"on_write": true
+	}]`))
+
+	assert.NoError(err)
+
+	engine := NewRuleEngine(database, rules)
+	assert.NoError(engine.Start())
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, time.UTC)
+
+	for i, value := range []float64{5, 9, 3} {
+		metric := NewMetric(`app.latency:host=a`)
+		metric.Push(epoch.Add(time.Duration(i)*time.Second), value)
+		assert.NoError(database.Write(metric))
+	}
+
+	var metrics []*Metric
+
+	for i := 0; i < 100; i++ {
+		metrics, err = database.Range(epoch, epoch.Add(time.Hour), `app.latency.max`)
+		assert.NoError(err)
+
+		if len(metrics) == 1 && metrics[0].Points()[0].Value == 9 {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	engine.Stop()
+
+	assert.Len(metrics, 1)
+	assert.Equal([]float64{9}, metrics[0].Points().Values())
+	assert.True(metrics[0].Points()[0].Timestamp.Equal(epoch))
+
+	// rules can only run continuously in the process writing to the dataset
+	reader, err := OpenDatasetReadOnly(tempPath)
+	assert.NoError(err)
+	defer reader.Close()
+
+	assert.Equal(ErrReadOnly, NewRuleEngine(reader, rules).Start())
+
+	// rules whose outputs feed one another don't trigger each other, even with tiny buffers
+	bufferSize := SubscriptionBufferSize
+	SubscriptionBufferSize = 1
+	defer func() {
+		SubscriptionBufferSize = bufferSize
+	}()
+
+	rules, err = ParseRules([]byte(`[
+		{"name": "app.ping.total", "selector": "app.p", "interval": "1m", "on_write": true},
+		{"name": "app.pong.total", "selector": "app.p", "interval": "1m", "on_write": true}
+	]`))
+
+	assert.NoError(err)
+
+	engine = NewRuleEngine(database, rules)
+	assert.NoError(engine.Start())
+
+	written := make(chan bool)
+
+	go func() {
+		for i := 0; i < 50; i++ {
+			metric := NewMetric(`app.ping`)
+			metric.Push(epoch.Add(time.Duration(i)*time.Second), 1)
+			database.Write(metric)
+		}
+
+		close(written)
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		assert.Fail(`writes should not wait on recording rules`)
+	}
+
+	// once the writes have been covered, the outputs settle rather than re-triggering forever
+	outputs := func() []float64 {
+		metrics, err := database.Range(epoch, epoch.Add(time.Hour), `app.p*.total`)
+		assert.NoError(err)
+
+		values := make([]float64, 0)
+
+		for _, metric := range metrics {
+			values = append(values, metric.Points().Values()...)
+		}
+
+		return values
+	}
+
+	var settled []float64
+
+	for i := 0; i < 100; i++ {
+		time.Sleep(20 * time.Millisecond)
+
+		if current := outputs(); len(current) == 2 && reflect.DeepEqual(current, settled) {
+			break
+		} else {
+			settled = current
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(settled, 2)
+	assert.Equal(settled, outputs())
+
+	engine.Stop()
+}
@@ -12,6 +12,8 @@ import (
 )
 
 var DefaultMetricReducerFunc = `sum`
+var DefaultSmoothingWindow = `5`
+var DefaultSmoothingAlpha = 0.3
 
 type Server struct {
 	router  *vestigo.Router
@@ -25,6 +27,14 @@ type metricSummary struct {
 	Statistics map[string]float64     `json:"statistics"`
 }
 
+type anomalySummary struct {
+	Name       string                 `json:"name"`
+	Tags       map[string]interface{} `json:"tags,omitempty"`
+	UniqueName string                 `json:"unique_name"`
+	Severity   interface{}            `json:"severity"`
+	Anomalies  PointSet               `json:"anomalies"`
+}
+
 func NewServer(dataset *Dataset) *Server {
 	router := vestigo.NewRouter()
 
@@ -52,61 +62,108 @@ func NewServer(dataset *Dataset) *Server {
 		nameset := strings.Split(vestigo.Param(req, `_name`), `;`)
 		palette := getPalette(req)
 
-		var start, end time.Time
 		var aggregateInterval time.Duration
+		var bucketing TimeBucketing
 
 		groupByField := httputil.Q(req, `group`, `name`)
+		start, end, err := getTimeRange(req)
+
+		if err != nil {
+			respond(w, err, http.StatusBadRequest)
+			return
+		}
 
-		if from := httputil.Q(req, `from`, `-1h`); from != `` {
-			switch from {
+		if v := httputil.Q(req, `interval`, `1s`); v != `none` {
+			switch v {
 			case `max`:
-				start = time.Time{}.Add(1)
+				aggregateInterval = time.Duration(math.MaxInt64)
+				bucketing = TimeBucketing{
+					Size:   aggregateInterval,
+					Origin: start,
+				}
+
 			default:
-				if v, err := ParseTimeString(from); err == nil {
-					start = v
+				// buckets are aligned to the epoch or to calendar units in the given time zone
+				if b, err := ParseTimeBucketing(v, httputil.Q(req, `tz`, `UTC`)); err == nil {
+					bucketing = b
+					aggregateInterval = b.Duration()
 				} else {
 					respond(w, err, http.StatusBadRequest)
 					return
 				}
 			}
+
 		}
 
-		if v, err := ParseTimeString(httputil.Q(req, `to`)); err == nil {
-			end = v
-		} else {
+		fill, err := ParseFillPolicy(httputil.Q(req, `fill`))
+
+		if err != nil {
 			respond(w, err, http.StatusBadRequest)
 			return
 		}
 
-		if v := httputil.Q(req, `interval`, `1s`); v != `none` {
-			switch v {
-			case `max`:
-				aggregateInterval = time.Duration(math.MaxInt64)
+		transforms, err := ParseTransforms(httputil.Q(req, `transform`))
 
-			default:
-				if d, err := time.ParseDuration(v); err == nil {
-					aggregateInterval = d
+		if err != nil {
+			respond(w, err, http.StatusBadRequest)
+			return
+		}
+
+		var selector SeriesSelector
+
+		if spec := httputil.Q(req, `select`); spec != `` {
+			if selector, err = ParseSeriesSelector(spec); err != nil {
+				respond(w, err, http.StatusBadRequest)
+				return
+			}
+		}
+
+		if metrics, err := dataset.RangeShifted(start, end, nameset...); err == nil {
+			// apply transforms to each series individually (so that e.g. counter resets are detected
+			// per series), then regroup the metrics according to the given field
+			metrics = TransformMetrics(metrics, transforms...)
+
+			// if an aggregate function is given, the grouped series are combined point-by-point rather
+			// than merged
+			if agg := httputil.Q(req, `agg`); agg != `` {
+				if reducer, ok := LookupReducer(agg); ok {
+					step := aggregateInterval
+
+					if step == time.Duration(math.MaxInt64) {
+						step = 0
+					}
+
+					metrics = AggregateShiftedMetrics(metrics, groupByField, step, reducer)
 				} else {
-					respond(w, err, http.StatusBadRequest)
+					respond(w, fmt.Errorf("Unknown aggregate function '%s'", agg), http.StatusBadRequest)
 					return
 				}
+			} else {
+				metrics = MergeShiftedMetrics(metrics, groupByField)
 			}
 
-		}
+			// narrow down the series, optionally summing the remainder into an "other" series
+			if selector != nil {
+				selected, rest := selector(metrics)
+
+				if httputil.QBool(req, `other`) {
+					if other := OtherSeries(rest); other != nil {
+						selected = append(selected, other)
+					}
+				}
 
-		if metrics, err := dataset.Range(start, end, nameset...); err == nil {
-			// regroup the metrics according to the given field
-			metrics = MergeMetrics(metrics, groupByField)
-			format := httputil.Q(req, `format`)
+				metrics = selected
+			}
 
 			switch action {
 			case `query`:
-				// if we're consolidating metrics into time buckets, do so now
-				if aggregateInterval > 0 {
+				// if we're consolidating metrics into time buckets, do so now (heatmaps bucket the
+				// points themselves)
+				if aggregateInterval > 0 && httputil.Q(req, `type`) != string(HeatmapGraph) {
 					gfn := httputil.Q(req, `fn`, DefaultMetricReducerFunc)
-					if reducer, ok := GetReducer(gfn); ok {
+					if reducer, ok := LookupReducer(gfn); ok {
 						for i, metric := range metrics {
-							metrics[i] = metric.Consolidate(aggregateInterval, reducer)
+							metrics[i] = metric.ConsolidateBuckets(bucketing, reducer).FillBuckets(bucketing, fill, start, end)
 
 							if palette != nil {
 								metrics[i].Metadata[`color`] = palette.Get(i)
@@ -118,35 +175,36 @@ func NewServer(dataset *Dataset) *Server {
 					}
 				}
 
-				switch format {
-				case `png`, `svg`:
-					graph := NewGraph(metrics)
+				// compare series to their time-shifted baselines
+				if comparison := httputil.Q(req, `compare`); comparison != `` {
+					step := ExpressionResolution
 
-					graph.Options.Title = httputil.Q(req, `title`)
-					graph.Options.Width = int(httputil.QInt(req, `width`))
-					graph.Options.Height = int(httputil.QInt(req, `height`))
-					graph.Options.DPI = httputil.QFloat(req, `dpi`, 72)
+					if aggregateInterval > 0 {
+						step = aggregateInterval
+					}
 
-					switch format {
-					case `png`:
-						w.Header().Set(`Content-Type`, `image/png`)
-					case `svg`:
-						w.Header().Set(`Content-Type`, `image/svg+xml`)
+					if compared, err := CompareToBaselines(metrics, BaselineComparison(comparison), step); err == nil {
+						metrics = compared
+					} else {
+						respond(w, err, http.StatusBadRequest)
+						return
 					}
+				}
 
-					if err := graph.Render(w, RenderFormat(format)); err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
+				for _, metric := range metrics {
+					if IsShifted(metric) {
+						metric.Metadata[`baseline`] = true
 					}
-				default:
-					respond(w, metrics)
 				}
 
+				respondMetrics(w, req, metrics)
+
 			case `summary`:
 				gfn := strings.Split(httputil.Q(req, `fn`, DefaultMetricReducerFunc), `,`)
-				reducers := make([]ReducerFunc, len(gfn))
+				reducers := make([]Reducer, len(gfn))
 
 				for i, name := range gfn {
-					if r, ok := GetReducer(name); ok {
+					if r, ok := LookupReducer(name); ok {
 						reducers[i] = r
 					} else {
 						respond(w, fmt.Errorf("Unknown grouping function '%s'", name), http.StatusBadRequest)
@@ -172,6 +230,131 @@ func NewServer(dataset *Dataset) *Server {
 				}
 
 				respond(w, summary)
+
+			case `correlate`:
+				var step time.Duration
+
+				if v := httputil.Q(req, `step`); v != `` {
+					if d, err := time.ParseDuration(v); err == nil {
+						step = d
+					} else {
+						respond(w, err, http.StatusBadRequest)
+						return
+					}
+				}
+
+				if err := CheckAlignmentStep(metrics, step); err != nil {
+					respond(w, err, http.StatusBadRequest)
+					return
+				}
+
+				method, err := ParseInterpolationMethod(httputil.Q(req, `interpolation`))
+
+				if err != nil {
+					respond(w, err, http.StatusBadRequest)
+					return
+				}
+
+				names := make([]string, len(metrics))
+				matrix := make([][]*float64, len(metrics))
+
+				for i, metric := range metrics {
+					names[i] = metric.GetUniqueName()
+				}
+
+				// correlations that could not be computed are rendered as nulls
+				for i, row := range CorrelateMetrics(metrics, step, method) {
+					matrix[i] = make([]*float64, len(row))
+
+					for j := range row {
+						if !math.IsNaN(row[j]) {
+							matrix[i][j] = &row[j]
+						}
+					}
+				}
+
+				respond(w, map[string]interface{}{
+					`series`: names,
+					`matrix`: matrix,
+				})
+
+			case `histogram`:
+				options := HistogramOptions{
+					Scale:   HistogramScale(httputil.Q(req, `scale`, string(LinearHistogram))),
+					Buckets: int(httputil.QInt(req, `buckets`, int64(DefaultHistogramBuckets))),
+					Min:     getBound(req, `min`),
+					Max:     getBound(req, `max`),
+				}
+
+				if v := httputil.Q(req, `bounds`); v != `` {
+					if options.Boundaries, err = ParseHistogramBoundaries(v); err != nil {
+						respond(w, err, http.StatusBadRequest)
+						return
+					}
+				}
+
+				if histograms, err := HistogramMetrics(metrics, options); err == nil {
+					respondHistograms(w, req, histograms)
+				} else {
+					respond(w, err, http.StatusBadRequest)
+				}
+
+			case `anomalies`:
+				options := AnomalyOptions{
+					Threshold: httputil.QFloat(req, `threshold`, DefaultAnomalyThreshold),
+				}
+
+				if options.Detector, err = ParseAnomalyDetector(httputil.Q(req, `detector`)); err != nil {
+					respond(w, err, http.StatusBadRequest)
+					return
+				}
+
+				if v := httputil.Q(req, `window`); v != `` {
+					if options.Window, err = ParseWindow(v); err != nil {
+						respond(w, err, http.StatusBadRequest)
+						return
+					}
+				}
+
+				// score the consolidated series so that points are evenly spaced
+				if aggregateInterval > 0 {
+					gfn := httputil.Q(req, `fn`, DefaultMetricReducerFunc)
+
+					if reducer, ok := LookupReducer(gfn); ok {
+						for i, metric := range metrics {
+							metrics[i] = metric.ConsolidateBuckets(bucketing, reducer)
+						}
+					} else {
+						respond(w, fmt.Errorf("Unknown grouping function '%s'", gfn), http.StatusBadRequest)
+						return
+					}
+				}
+
+				ranked, err := RankAnomalies(metrics, options)
+
+				if err != nil {
+					respond(w, err, http.StatusBadRequest)
+					return
+				}
+
+				if limit := int(httputil.QInt(req, `limit`)); limit > 0 && limit < len(ranked) {
+					ranked = ranked[:limit]
+				}
+
+				summary := make([]anomalySummary, len(ranked))
+
+				for i, anomalies := range ranked {
+					summary[i] = anomalySummary{
+						Name:       anomalies.Metric.GetName(),
+						Tags:       anomalies.Metric.GetTags(),
+						UniqueName: anomalies.Metric.GetUniqueName(),
+						Severity:   jsonFloat(anomalies.Severity()),
+						Anomalies:  anomalies.Points(),
+					}
+				}
+
+				respond(w, summary)
+
 			default:
 				respond(w, `Not Found`, http.StatusNotFound)
 			}
@@ -180,6 +363,37 @@ func NewServer(dataset *Dataset) *Server {
 		}
 	})
 
+	router.Get(`/reducers`, func(w http.ResponseWriter, req *http.Request) {
+		respond(w, Reducers())
+	})
+
+	router.Get(`/query`, func(w http.ResponseWriter, req *http.Request) {
+		start, end, err := getTimeRange(req)
+
+		if err != nil {
+			respond(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if expression, err := ParseExpression(httputil.Q(req, `expr`)); err == nil {
+			if metrics, err := expression.Evaluate(dataset, start, end); err == nil {
+				if palette := getPalette(req); palette != nil {
+					for i, metric := range metrics {
+						metric.Metadata[`color`] = palette.Get(i)
+					}
+				}
+
+				respondMetrics(w, req, metrics)
+			} else {
+				respond(w, err, http.StatusBadRequest)
+			}
+		} else {
+			respond(w, err, http.StatusBadRequest)
+		}
+	})
+
+	registerPromRoutes(router, dataset)
+
 	return &Server{
 		router:  router,
 		dataset: dataset,
@@ -190,10 +404,249 @@ func (self *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	self.router.ServeHTTP(w, req)
 }
 
+// Renders the given metrics as a graph or as JSON, according to the "format" query parameter.
+//
+// If the "smooth" parameter names a reducer (applied over the trailing "window" of each point) or
+// is "ewma" (with a weight of "alpha"), each series is smoothed first.  If "raw" is also true, the
+// unsmoothed series are included as well, marked with the "raw" metadata key; graphs draw them
+// faintly behind their smoothed counterparts.
+//
+// Graphs downsample each series to at most "maxDataPoints" points (default: the graph's width) using
+// the "downsample" method (lttb or minmax); JSON is only downsampled if "maxDataPoints" is given.
+func respondMetrics(w http.ResponseWriter, req *http.Request, metrics []*Metric) {
+	var raw []*Metric
+
+	if httputil.Q(req, `type`) == string(HeatmapGraph) {
+		respondHeatmap(w, req, metrics)
+		return
+	}
+
+	if smooth := httputil.Q(req, `smooth`); smooth != `` {
+		var smoother TransformFunc
+
+		if smooth == `ewma` {
+			alpha := httputil.QFloat(req, `alpha`, DefaultSmoothingAlpha)
+
+			if alpha <= 0 || alpha > 1 {
+				respond(w, fmt.Errorf("alpha must be between 0 and 1"), http.StatusBadRequest)
+				return
+			}
+
+			smoother = func(metric *Metric) *Metric {
+				return metric.EWMA(alpha)
+			}
+		} else if reducer, ok := LookupReducer(smooth); ok {
+			if window, err := ParseWindow(httputil.Q(req, `window`, DefaultSmoothingWindow)); err == nil {
+				smoother = func(metric *Metric) *Metric {
+					return metric.Moving(window, reducer)
+				}
+			} else {
+				respond(w, err, http.StatusBadRequest)
+				return
+			}
+		} else {
+			respond(w, fmt.Errorf("Unknown smoothing function '%s'", smooth), http.StatusBadRequest)
+			return
+		}
+
+		raw = expandFields(metrics)
+		metrics = make([]*Metric, len(raw))
+
+		for i, metric := range raw {
+			metrics[i] = smoother(metric)
+
+			for k, v := range metric.Metadata {
+				metrics[i].Metadata[k] = v
+			}
+
+			metric.Metadata[`raw`] = true
+		}
+
+		if !httputil.QBool(req, `raw`) {
+			raw = nil
+		}
+	}
+
+	downsample, err := ParseDownsampleMethod(httputil.Q(req, `downsample`))
+
+	if err != nil {
+		respond(w, err, http.StatusBadRequest)
+		return
+	}
+
+	maxDataPoints := int(httputil.QInt(req, `maxDataPoints`))
+
+	switch format := httputil.Q(req, `format`); format {
+	case `png`, `svg`:
+		graph := NewGraph(metrics)
+		graph.Raw = raw
+
+		graph.Options.Title = httputil.Q(req, `title`)
+		graph.Options.Width = int(httputil.QInt(req, `width`))
+		graph.Options.Height = int(httputil.QInt(req, `height`))
+		graph.Options.DPI = httputil.QFloat(req, `dpi`, 72)
+		graph.Options.MaxDataPoints = maxDataPoints
+		graph.Options.Downsample = downsample
+
+		switch format {
+		case `png`:
+			w.Header().Set(`Content-Type`, `image/png`)
+		case `svg`:
+			w.Header().Set(`Content-Type`, `image/svg+xml`)
+		}
+
+		if err := graph.Render(w, RenderFormat(format)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		// graphs downsample to their width on their own, but JSON is only downsampled on request
+		if maxDataPoints > 0 {
+			metrics = DownsampleMetrics(metrics, maxDataPoints, downsample)
+			raw = DownsampleMetrics(raw, maxDataPoints, downsample)
+		}
+
+		respond(w, append(metrics, raw...))
+	}
+}
+
+// Responds with the distribution of the given metrics over time as JSON, or as a heatmap graph if a
+// graph format is requested.  The width of each time bucket is given by the "interval" parameter, or
+// divides the time spanned by the metrics into DefaultHeatmapColumns buckets.
+func respondHeatmap(w http.ResponseWriter, req *http.Request, metrics []*Metric) {
+	interval, err := time.ParseDuration(httputil.Q(req, `interval`))
+
+	if err != nil || interval <= 0 {
+		var first, last time.Time
+
+		for _, metric := range metrics {
+			for _, point := range metric.Points() {
+				if first.IsZero() || point.Timestamp.Before(first) {
+					first = point.Timestamp
+				}
+
+				if point.Timestamp.After(last) {
+					last = point.Timestamp
+				}
+			}
+		}
+
+		if interval = last.Sub(first) / time.Duration(DefaultHeatmapColumns); interval <= 0 {
+			interval = time.Second
+		}
+	}
+
+	heatmap, err := MakeHeatmap(metrics, interval, HistogramOptions{
+		Scale:   HistogramScale(httputil.Q(req, `scale`, string(LinearHistogram))),
+		Buckets: int(httputil.QInt(req, `buckets`, int64(DefaultHistogramBuckets))),
+		Min:     getBound(req, `min`),
+		Max:     getBound(req, `max`),
+	})
+
+	if err != nil {
+		respond(w, err, http.StatusBadRequest)
+		return
+	}
+
+	switch format := httputil.Q(req, `format`); format {
+	case `png`, `svg`:
+		graph := NewHeatmapGraph(heatmap)
+		graph.Palette = getPalette(req)
+
+		graph.Options.Title = httputil.Q(req, `title`)
+		graph.Options.Width = int(httputil.QInt(req, `width`))
+		graph.Options.Height = int(httputil.QInt(req, `height`))
+		graph.Options.DPI = httputil.QFloat(req, `dpi`, 72)
+
+		switch format {
+		case `png`:
+			w.Header().Set(`Content-Type`, `image/png`)
+		case `svg`:
+			w.Header().Set(`Content-Type`, `image/svg+xml`)
+		}
+
+		if err := graph.Render(w, RenderFormat(format)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		respond(w, heatmap)
+	}
+}
+
+// Responds with the given histograms as JSON, or as a bar graph if a graph format is requested.
+func respondHistograms(w http.ResponseWriter, req *http.Request, histograms []*Histogram) {
+	switch format := httputil.Q(req, `format`); format {
+	case `png`, `svg`:
+		graph := NewHistogramGraph(histograms)
+
+		graph.Options.Title = httputil.Q(req, `title`)
+		graph.Options.Width = int(httputil.QInt(req, `width`))
+		graph.Options.Height = int(httputil.QInt(req, `height`))
+		graph.Options.DPI = httputil.QFloat(req, `dpi`, 72)
+
+		switch format {
+		case `png`:
+			w.Header().Set(`Content-Type`, `image/png`)
+		case `svg`:
+			w.Header().Set(`Content-Type`, `image/svg+xml`)
+		}
+
+		if err := graph.Render(w, RenderFormat(format)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		respond(w, histograms)
+	}
+}
+
+// Parses the "from" and "to" query parameters.
+func getTimeRange(req *http.Request) (time.Time, time.Time, error) {
+	var start, end time.Time
+
+	if from := httputil.Q(req, `from`, `-1h`); from != `` {
+		switch from {
+		case `max`:
+			start = time.Time{}.Add(1)
+		default:
+			if v, err := ParseTimeString(from); err == nil {
+				start = v
+			} else {
+				return start, end, err
+			}
+		}
+	}
+
+	if v, err := ParseTimeString(httputil.Q(req, `to`)); err == nil {
+		end = v
+	} else {
+		return start, end, err
+	}
+
+	return start, end, nil
+}
+
+// Returns the numeric value of the given query string parameter, or NaN if it was not given so that
+// the bound is taken from the data.
+func getBound(req *http.Request, key string) float64 {
+	if httputil.Q(req, key) == `` {
+		return math.NaN()
+	}
+
+	return httputil.QFloat(req, key)
+}
+
 func respond(w http.ResponseWriter, data interface{}, code ...int) {
 	w.Header().Set(`Content-Type`, `application/json`)
 
-	if err, ok := data.(error); ok {
+	if err, ok := data.(ExpressionError); ok {
+		data = map[string]interface{}{
+			`error`:    err.Error(),
+			`position`: err.Position,
+		}
+
+		if len(code) == 0 || code[0] < 400 {
+			code = []int{http.StatusBadRequest}
+		}
+	} else if err, ok := data.(error); ok {
 		data = map[string]interface{}{
 			`error`: err.Error(),
 		}
@@ -225,6 +678,8 @@ func getPalette(req *http.Request) Palette {
 			return PaletteClassic9
 		case `munin`:
 			return PaletteMunin
+		case `heat`:
+			return PaletteHeat
 		default:
 			return Palette(strings.Split(v, `,`))
 		}
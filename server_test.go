@@ -6,7 +6,9 @@ import (
 	"github.com/stretchr/testify/require"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
 	"time"
@@ -65,3 +67,718 @@ func TestServer(t *testing.T) {
 
 	assert.Equal(out, jsonbody(response.Body, body))
 }
+
+func TestServerCorrelate(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+	up := NewMetric(`mobius.test.correlate.up`)
+	down := NewMetric(`mobius.test.correlate.down`)
+
+	for i := 1; i <= 10; i++ {
+		up.Push(epoch.Add(time.Duration(i)*time.Second), float64(i))
+		down.Push(epoch.Add(time.Duration(i)*time.Second+500*time.Millisecond), float64(-i))
+	}
+
+	assert.NoError(database.Write(up))
+	assert.NoError(database.Write(down))
+
+	server := NewServer(database)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, `/metrics/correlate/mobius.test.correlate.*?from=2006-01-02T15:00:00-07:00&to=2006-01-02T16:00:00-07:00&interpolation=linear`, nil))
+	assert.Equal(200, recorder.Code)
+
+	var body map[string]interface{}
+	jsonbody(recorder.Body, &body)
+
+	assert.Equal([]interface{}{`mobius.test.correlate.down`, `mobius.test.correlate.up`}, body[`series`])
+
+	matrix := body[`matrix`].([]interface{})
+	assert.Len(matrix, 2)
+	assert.InDelta(1, matrix[0].([]interface{})[0], 1e-9)
+	assert.InDelta(-1, matrix[0].([]interface{})[1], 1e-9)
+	assert.InDelta(-1, matrix[1].([]interface{})[0], 1e-9)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, `/metrics/correlate/mobius.test.correlate.*?interpolation=cubic`, nil))
+	assert.Equal(400, recorder.Code)
+
+	// steps too fine for the span of the series are refused
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, `/metrics/correlate/mobius.test.correlate.*?from=2006-01-02T15:00:00-07:00&to=2006-01-02T16:00:00-07:00&step=1ns`, nil))
+	assert.Equal(400, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, `/metrics/correlate/mobius.test.correlate.*?from=2006-01-02T15:00:00-07:00&to=2006-01-02T16:00:00-07:00&step=1m`, nil))
+	assert.Equal(200, recorder.Code)
+}
+
+func TestServerTransform(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+
+	// two counters that are grouped together after their rates are taken
+	for host, values := range map[string][]float64{
+		`a`: {10, 20, 5, 15},
+		`b`: {100, 110, 120, 130},
+	} {
+		metric := NewMetric(`mobius.test.transform.requests:host=` + host)
+
+		for i, v := range values {
+			metric.Push(epoch.Add(time.Duration(i)*time.Second), v)
+		}
+
+		assert.NoError(database.Write(metric))
+	}
+
+	server := NewServer(database)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, `/metrics/summary/mobius.test.transform.requests?from=2006-01-02T15:00:00-07:00&to=2006-01-02T16:00:00-07:00&transform=per-second&fn=sum`, nil))
+	assert.Equal(200, recorder.Code)
+
+	var body []map[string]interface{}
+	jsonbody(recorder.Body, &body)
+	assert.Len(body, 1)
+	assert.Equal(map[string]interface{}{`sum`: float64(55)}, body[0][`statistics`])
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, `/metrics/query/mobius.test.transform.requests?transform=bogus`, nil))
+	assert.Equal(400, recorder.Code)
+}
+
+func TestServerSmoothing(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+	metric := NewMetric(`mobius.test.smoothing`)
+
+	for i, v := range []float64{2, 4, 6, 8} {
+		metric.Push(epoch.Add(time.Duration(i)*time.Second), v)
+	}
+
+	assert.NoError(database.Write(metric))
+
+	server := NewServer(database)
+	query := `/metrics/query/mobius.test.smoothing?from=2006-01-02T15:00:00-07:00&to=2006-01-02T16:00:00-07:00&interval=none`
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&smooth=mean&window=2&raw=true`, nil))
+	assert.Equal(200, recorder.Code)
+
+	var body []map[string]interface{}
+	jsonbody(recorder.Body, &body)
+	assert.Len(body, 2)
+	assert.Nil(body[0][`metadata`])
+	assert.Equal(float64(3), body[0][`points`].([]interface{})[1].(map[string]interface{})[`value`])
+	assert.Equal(map[string]interface{}{`raw`: true}, body[1][`metadata`])
+	assert.Equal(float64(4), body[1][`points`].([]interface{})[1].(map[string]interface{})[`value`])
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&smooth=ewma&alpha=0.5&raw=true&format=svg`, nil))
+	assert.Equal(200, recorder.Code)
+	assert.Equal(`image/svg+xml`, recorder.Header().Get(`Content-Type`))
+
+	for _, params := range []string{`&smooth=bogus`, `&smooth=mean&window=0`, `&smooth=ewma&alpha=2`} {
+		recorder = httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+params, nil))
+		assert.Equal(400, recorder.Code, params)
+	}
+}
+
+func TestServerTimeShift(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	epoch := time.Date(2006, 1, 9, 15, 4, 0, 0, mst)
+
+	for host, factor := range map[string]float64{`a`: 2, `b`: 4} {
+		metric := NewMetric(`mobius.test.shift.requests:host=` + host)
+
+		for i := 0; i < 3; i++ {
+			metric.Push(epoch.Add(time.Duration(i)*time.Minute-7*24*time.Hour), 10)
+			metric.Push(epoch.Add(time.Duration(i)*time.Minute), 10*factor)
+		}
+
+		assert.NoError(database.Write(metric))
+	}
+
+	metrics, err := database.RangeShifted(epoch, epoch.Add(time.Hour), `mobius.test.shift.requests`, `mobius.test.shift.requests [-7d]`)
+	assert.NoError(err)
+	assert.Len(metrics, 4)
+	assert.Equal(`mobius.test.shift.requests`, metrics[0].GetName())
+	assert.Equal(`mobius.test.shift.requests [-7d]`, metrics[2].GetName())
+	assert.True(IsShifted(metrics[2]))
+	assert.True(metrics[2].Points()[0].Timestamp.Equal(epoch))
+
+	// current and shifted series are merged separately
+	merged := MergeShiftedMetrics(metrics, `host`)
+	assert.Len(merged, 4)
+
+	compared, err := CompareToBaselines(MergeShiftedMetrics(metrics, `unique`), PercentChange, time.Second)
+	assert.NoError(err)
+	assert.Len(compared, 4)
+	assert.Equal(`mobius.test.shift.requests [-7d percent]`, compared[2].GetName())
+	assert.Equal([]float64{100, 100, 100}, compared[2].Points().Values())
+	assert.Equal([]float64{300, 300, 300}, compared[3].Points().Values())
+
+	server := NewServer(database)
+	query := `/metrics/query/mobius.test.shift.requests;mobius.test.shift.requests%20[-7d]?from=2006-01-09T15:00:00-07:00&to=2006-01-09T16:00:00-07:00&interval=1m&fn=sum`
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&compare=ratio`, nil))
+	assert.Equal(200, recorder.Code)
+
+	var body []map[string]interface{}
+	jsonbody(recorder.Body, &body)
+	assert.Len(body, 2)
+	assert.Equal(`mobius.test.shift.requests [-7d ratio]`, body[1][`name`])
+	assert.Equal(float64(3), body[1][`points`].([]interface{})[0].(map[string]interface{})[`value`])
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query, nil))
+	assert.Equal(200, recorder.Code)
+
+	body = nil
+	jsonbody(recorder.Body, &body)
+	assert.Len(body, 2)
+	assert.Equal(map[string]interface{}{`baseline`: true}, body[1][`metadata`])
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&compare=bogus`, nil))
+	assert.Equal(400, recorder.Code)
+}
+
+func TestServerSelect(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+
+	for i := 1; i <= 5; i++ {
+		metric := NewMetric(fmt.Sprintf("mobius.test.select.cpu:host=h%d", i))
+		metric.Push(epoch, float64(i*10))
+		metric.Push(epoch.Add(time.Second), float64(i*10))
+		assert.NoError(database.Write(metric))
+	}
+
+	server := NewServer(database)
+	query := `/metrics/query/mobius.test.select.cpu?from=2006-01-02T15:00:00-07:00&to=2006-01-02T16:00:00-07:00&group=unique&interval=none`
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&select=topk(2,max)&other=true`, nil))
+	assert.Equal(200, recorder.Code)
+
+	var body []map[string]interface{}
+	jsonbody(recorder.Body, &body)
+	assert.Len(body, 3)
+	assert.Equal(map[string]interface{}{`host`: `h5`}, body[0][`tags`])
+	assert.Equal(map[string]interface{}{`host`: `h4`}, body[1][`tags`])
+	assert.Equal(`other`, body[2][`name`])
+	assert.Equal(float64(60), body[2][`points`].([]interface{})[0].(map[string]interface{})[`value`])
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&select=topk(x)`, nil))
+	assert.Equal(400, recorder.Code)
+}
+
+func TestServerAggregate(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	epoch := time.Date(2006, 1, 2, 15, 4, 0, 0, mst)
+
+	for i := 0; i < 10; i++ {
+		metric := NewMetric(fmt.Sprintf("mobius.test.aggregate.cpu:host=h%d,region=us", i))
+
+		for j := 0; j < 3; j++ {
+			metric.Push(epoch.Add(time.Duration(j)*time.Second+time.Duration(i)*time.Millisecond), 1)
+		}
+
+		assert.NoError(database.Write(metric))
+	}
+
+	server := NewServer(database)
+	query := `/metrics/query/mobius.test.aggregate.cpu?from=2006-01-02T15:00:00-07:00&to=2006-01-02T16:00:00-07:00&group=region&interval=none`
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&agg=sum`, nil))
+	assert.Equal(200, recorder.Code)
+
+	var body []map[string]interface{}
+	jsonbody(recorder.Body, &body)
+	assert.Len(body, 1)
+	assert.Equal(map[string]interface{}{`region`: `us`}, body[0][`tags`])
+
+	points := body[0][`points`].([]interface{})
+	assert.Len(points, 3)
+	assert.Equal(float64(10), points[0].(map[string]interface{})[`value`])
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&agg=bogus`, nil))
+	assert.Equal(400, recorder.Code)
+}
+
+func TestServerCalendarBuckets(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	metric := NewMetric(`mobius.test.calendar.requests`)
+
+	for i := 0; i < 6; i++ {
+		metric.Push(time.Date(2006, 1, 2, 10, i*20, 0, 0, time.UTC), 1)
+	}
+
+	assert.NoError(database.Write(metric))
+
+	server := NewServer(database)
+	query := `/metrics/query/mobius.test.calendar.requests?from=2006-01-02T00:00:00Z&to=2006-01-03T00:00:00Z&fn=sum`
+
+	for _, tc := range []struct {
+		Params string
+		Times  []string
+		Values []float64
+	}{
+		{`&interval=hour`, []string{`2006-01-02T10:00:00Z`, `2006-01-02T11:00:00Z`}, []float64{3, 3}},
+		{`&interval=1h&tz=Asia/Kolkata`, []string{`2006-01-02T09:30:00Z`, `2006-01-02T10:30:00Z`, `2006-01-02T11:30:00Z`}, []float64{2, 3, 1}},
+		{`&interval=max`, []string{`2006-01-02T00:00:00Z`}, []float64{6}},
+	} {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+tc.Params, nil))
+		assert.Equal(200, recorder.Code, tc.Params)
+
+		var body []map[string]interface{}
+		jsonbody(recorder.Body, &body)
+		assert.Len(body, 1)
+
+		points := body[0][`points`].([]interface{})
+		assert.Len(points, len(tc.Times), tc.Params)
+
+		for i, point := range points {
+			p := point.(map[string]interface{})
+			tm, err := time.Parse(time.RFC3339, p[`time`].(string))
+			assert.NoError(err)
+
+			expected, _ := time.Parse(time.RFC3339, tc.Times[i])
+			assert.True(expected.Equal(tm), "%s: %v", tc.Params, tm)
+			assert.Equal(tc.Values[i], p[`value`])
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&interval=hour&tz=Nowhere/Special`, nil))
+	assert.Equal(400, recorder.Code)
+}
+
+func TestServerFill(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	metric := NewMetric(`mobius.test.fill.requests`)
+	metric.Push(time.Date(2006, 1, 2, 10, 0, 0, 0, time.UTC), 1)
+	metric.Push(time.Date(2006, 1, 2, 10, 3, 0, 0, time.UTC), 4)
+	assert.NoError(database.Write(metric))
+
+	server := NewServer(database)
+	query := `/metrics/query/mobius.test.fill.requests?from=2006-01-02T10:00:00Z&to=2006-01-02T10:04:00Z&interval=1m&fn=sum`
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&fill=null`, nil))
+	assert.Equal(200, recorder.Code)
+
+	var body []map[string]interface{}
+	jsonbody(recorder.Body, &body)
+	assert.Len(body, 1)
+
+	values := make([]interface{}, 0)
+
+	for _, point := range body[0][`points`].([]interface{}) {
+		values = append(values, point.(map[string]interface{})[`value`])
+	}
+
+	assert.Equal([]interface{}{float64(1), nil, nil, float64(4), nil}, values)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&fill=linear`, nil))
+	assert.Equal(200, recorder.Code)
+
+	body = nil
+	jsonbody(recorder.Body, &body)
+	assert.Len(body[0][`points`], 5)
+	assert.Equal(float64(2), body[0][`points`].([]interface{})[1].(map[string]interface{})[`value`])
+
+	// gaps break the line rather than failing to render
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&fill=null&format=svg`, nil))
+	assert.Equal(200, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&fill=sideways`, nil))
+	assert.Equal(400, recorder.Code)
+}
+
+func TestServerForecast(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	metric := NewMetric(`mobius.test.forecast.disk`)
+
+	for i := 0; i < 24; i++ {
+		metric.Push(time.Date(2006, 1, 2, i, 0, 0, 0, time.UTC), float64(10+i%6))
+	}
+
+	assert.NoError(database.Write(metric))
+
+	server := NewServer(database)
+	query := `/query?from=2006-01-02T00:00:00Z&to=2006-01-03T00:00:00Z&expr=` + url.QueryEscape(`holtWintersForecast(mobius.test.forecast.disk, "6h", 12)`)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query, nil))
+	assert.Equal(200, recorder.Code)
+
+	var body []map[string]interface{}
+	jsonbody(recorder.Body, &body)
+	assert.Len(body, 3)
+	assert.Equal(map[string]interface{}{`forecast`: true}, body[0][`metadata`])
+	assert.Equal(map[string]interface{}{`band`: `upper`}, body[1][`metadata`])
+	assert.Len(body[0][`points`], 13)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&format=svg`, nil))
+	assert.Equal(200, recorder.Code)
+	assert.Equal(`image/svg+xml`, recorder.Header().Get(`Content-Type`))
+}
+
+func TestServerAnomalies(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	for host, spike := range map[string]float64{`a`: 50, `b`: 500, `c`: 0} {
+		metric := NewMetric(`mobius.test.anomalies.latency:host=` + host)
+
+		for i := 0; i < 30; i++ {
+			value := float64(1 + i%3)
+
+			if i == 20 && spike > 0 {
+				value = spike
+			}
+
+			metric.Push(time.Date(2006, 1, 2, 10, i, 0, 0, time.UTC), value)
+		}
+
+		assert.NoError(database.Write(metric))
+	}
+
+	server := NewServer(database)
+	query := `/metrics/anomalies/mobius.test.anomalies.latency:*?from=2006-01-02T10:00:00Z&to=2006-01-02T11:00:00Z&group=host&interval=1m`
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&detector=zscore&window=10`, nil))
+	assert.Equal(200, recorder.Code)
+
+	var body []map[string]interface{}
+	jsonbody(recorder.Body, &body)
+	assert.Len(body, 2)
+	assert.Equal(map[string]interface{}{`host`: `b`}, body[0][`tags`])
+	assert.Equal(map[string]interface{}{`host`: `a`}, body[1][`tags`])
+	assert.True(body[0][`severity`].(float64) > body[1][`severity`].(float64))
+
+	anomalies := body[0][`anomalies`].([]interface{})
+	assert.Len(anomalies, 1)
+	assert.Equal(float64(500), anomalies[0].(map[string]interface{})[`value`])
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&limit=1`, nil))
+	assert.Equal(200, recorder.Code)
+
+	body = nil
+	jsonbody(recorder.Body, &body)
+	assert.Len(body, 1)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&detector=tealeaves`, nil))
+	assert.Equal(400, recorder.Code)
+}
+
+func TestServerHistogram(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	metric := NewMetric(`mobius.test.histogram.latency`)
+
+	for i := 1; i <= 40; i++ {
+		metric.Push(time.Date(2006, 1, 2, 10, 0, i, 0, time.UTC), float64(i))
+	}
+
+	assert.NoError(database.Write(metric))
+
+	server := NewServer(database)
+	query := `/metrics/histogram/mobius.test.histogram.latency?from=2006-01-02T10:00:00Z&to=2006-01-02T11:00:00Z`
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&bounds=0,10,20,40`, nil))
+	assert.Equal(200, recorder.Code)
+
+	var body []map[string]interface{}
+	jsonbody(recorder.Body, &body)
+	assert.Len(body, 1)
+
+	counts := make([]float64, 0)
+
+	for _, bucket := range body[0][`buckets`].([]interface{}) {
+		counts = append(counts, bucket.(map[string]interface{})[`count`].(float64))
+	}
+
+	assert.Equal([]float64{9, 10, 21}, counts)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&buckets=4&format=png`, nil))
+	assert.Equal(200, recorder.Code)
+	assert.Equal(`image/png`, recorder.Header().Get(`Content-Type`))
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&scale=cubic`, nil))
+	assert.Equal(400, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&buckets=1000000000`, nil))
+	assert.Equal(400, recorder.Code)
+
+	// a bound that isn't given is taken from the data
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&min=0&buckets=4`, nil))
+	assert.Equal(200, recorder.Code)
+
+	body = nil
+	jsonbody(recorder.Body, &body)
+	buckets := body[0][`buckets`].([]interface{})
+	assert.Equal(float64(0), buckets[0].(map[string]interface{})[`lower`])
+	assert.Equal(float64(40), buckets[3].(map[string]interface{})[`upper`])
+	assert.Equal(float64(9), buckets[0].(map[string]interface{})[`count`])
+}
+
+func TestServerHeatmap(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	metric := NewMetric(`mobius.test.heatmap.latency`)
+
+	for i := 0; i < 180; i++ {
+		metric.Push(time.Date(2006, 1, 2, 10, 0, i, 0, time.UTC), float64(1+i%4))
+	}
+
+	assert.NoError(database.Write(metric))
+
+	server := NewServer(database)
+	query := `/metrics/query/mobius.test.heatmap.latency?from=2006-01-02T10:00:00Z&to=2006-01-02T11:00:00Z&interval=1m&type=heatmap&buckets=4`
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query, nil))
+	assert.Equal(200, recorder.Code)
+
+	var body map[string]interface{}
+	jsonbody(recorder.Body, &body)
+	assert.Len(body[`times`], 3)
+	assert.Len(body[`boundaries`], 5)
+	assert.Equal([]interface{}{float64(15), float64(15), float64(15), float64(15)}, body[`counts`].([]interface{})[0])
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&format=png&palette=heat`, nil))
+	assert.Equal(200, recorder.Code)
+	assert.Equal(`image/png`, recorder.Header().Get(`Content-Type`))
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&scale=cubic`, nil))
+	assert.Equal(400, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, `/metrics/query/mobius.test.heatmap.latency?from=2006-01-02T10:00:00Z&to=2006-01-02T11:00:00Z&interval=1m&type=heatmap&buckets=1000000000`, nil))
+	assert.Equal(400, recorder.Code)
+}
+
+func TestServerReducers(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	metric := NewMetric(`mobius.test.reducers.latency`)
+
+	for i := 1; i <= 10; i++ {
+		metric.Push(time.Date(2006, 1, 2, 10, 0, i, 0, time.UTC), float64(i))
+	}
+
+	assert.NoError(database.Write(metric))
+
+	server := NewServer(database)
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, `/reducers`, nil))
+	assert.Equal(200, recorder.Code)
+
+	var reducers []map[string]interface{}
+	jsonbody(recorder.Body, &reducers)
+	assert.Contains(reducers, map[string]interface{}{`name`: `trimmed-mean`, `aliases`: []interface{}{`tmean`}, `parameterized`: true})
+	assert.Contains(reducers, map[string]interface{}{`name`: `sum`})
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, `/metrics/summary/mobius.test.reducers.latency?from=2006-01-02T10:00:00Z&to=2006-01-02T11:00:00Z&fn=topn-mean(2),p50`, nil))
+	assert.Equal(200, recorder.Code)
+
+	var summary []map[string]interface{}
+	jsonbody(recorder.Body, &summary)
+	assert.Len(summary, 1)
+	assert.Equal(map[string]interface{}{
+		`topn_mean(2)`:   float64(9.5),
+		`percentile(50)`: float64(5),
+	}, summary[0][`statistics`])
+}
+
+func TestServerDownsample(t *testing.T) {
+	assert := require.New(t)
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	metric := NewMetric(`mobius.test.downsample.cpu`)
+	start := time.Date(2006, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 600; i++ {
+		value := float64(i%5 + 1)
+
+		if i == 321 {
+			value = 99
+		}
+
+		metric.Push(start.Add(time.Duration(i)*time.Second), value)
+	}
+
+	assert.NoError(database.Write(metric))
+
+	server := NewServer(database)
+	query := `/metrics/query/mobius.test.downsample.cpu?from=2006-01-02T10:00:00Z&to=2006-01-02T11:00:00Z`
+
+	for _, method := range []string{`lttb`, `minmax`} {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&maxDataPoints=30&downsample=`+method, nil))
+		assert.Equal(200, recorder.Code)
+
+		var body []map[string]interface{}
+		jsonbody(recorder.Body, &body)
+		assert.Len(body, 1)
+
+		points := body[0][`points`].([]interface{})
+		assert.True(len(points) <= 30, method)
+
+		max := 0.0
+
+		for _, point := range points {
+			max = math.Max(max, point.(map[string]interface{})[`value`].(float64))
+		}
+
+		assert.Equal(float64(99), max, method)
+	}
+
+	// JSON is left alone unless asked
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query, nil))
+	assert.Equal(200, recorder.Code)
+
+	var body []map[string]interface{}
+	jsonbody(recorder.Body, &body)
+	assert.Len(body[0][`points`], 600)
+
+	// graphs are downsampled to their width
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&format=svg&width=200`, nil))
+	assert.Equal(200, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest(`GET`, query+`&downsample=bogus`, nil))
+	assert.Equal(400, recorder.Code)
+}
@@ -0,0 +1,339 @@
+package mobius
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// The relative accuracy of quantiles estimated by new sketches.  A value of 0.01 means that any
+// quantile returned by a sketch is within 1% of the true value.
+var DefaultSketchAccuracy = 0.01
+
+// Values whose magnitude is below this threshold are counted as zero by sketches.
+var sketchMinIndexable = 1e-9
+
+const sketchEncodingVersion = 1
+
+// A Sketch is a mergeable summary of a distribution of values that can answer quantile queries
+// with a bounded relative error (a DDSketch.)  Sketches covering different time intervals or series
+// can be merged without loss of accuracy, which makes it possible to compute percentiles over
+// rolled-up data.
+type Sketch struct {
+	accuracy float64
+	gamma    float64
+	logGamma float64
+	positive map[int32]uint64
+	negative map[int32]uint64
+	zero     uint64
+	count    uint64
+	sum      float64
+	min      float64
+	max      float64
+}
+
+func NewSketch() *Sketch {
+	return NewSketchWithAccuracy(DefaultSketchAccuracy)
+}
+
+func NewSketchWithAccuracy(accuracy float64) *Sketch {
+	gamma := (1 + accuracy) / (1 - accuracy)
+
+	return &Sketch{
+		accuracy: accuracy,
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		positive: make(map[int32]uint64),
+		negative: make(map[int32]uint64),
+		min:      math.Inf(1),
+		max:      math.Inf(-1),
+	}
+}
+
+// Adds an observation to the sketch.
+func (self *Sketch) Add(value float64) {
+	self.AddN(value, 1)
+}
+
+// Adds the same observation to the sketch several times.
+func (self *Sketch) AddN(value float64, n uint64) {
+	if n == 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+
+	switch {
+	case value > sketchMinIndexable:
+		self.positive[self.index(value)] += n
+	case value < -sketchMinIndexable:
+		self.negative[self.index(-value)] += n
+	default:
+		self.zero += n
+	}
+
+	self.count += n
+	self.sum += value * float64(n)
+	self.min = math.Min(self.min, value)
+	self.max = math.Max(self.max, value)
+}
+
+// Merges the observations from another sketch into this one.  Both sketches must have been created
+// with the same relative accuracy.
+func (self *Sketch) Merge(other *Sketch) error {
+	if other == nil || other.count == 0 {
+		return nil
+	}
+
+	if self.accuracy != other.accuracy {
+		return fmt.Errorf("Cannot merge sketches with different accuracies (%v, %v)", self.accuracy, other.accuracy)
+	}
+
+	for k, n := range other.positive {
+		self.positive[k] += n
+	}
+
+	for k, n := range other.negative {
+		self.negative[k] += n
+	}
+
+	self.zero += other.zero
+	self.count += other.count
+	self.sum += other.sum
+	self.min = math.Min(self.min, other.min)
+	self.max = math.Max(self.max, other.max)
+
+	return nil
+}
+
+// Returns a deep copy of this sketch.
+func (self *Sketch) Clone() *Sketch {
+	clone := NewSketchWithAccuracy(self.accuracy)
+	clone.Merge(self)
+	return clone
+}
+
+func (self *Sketch) Count() uint64 {
+	return self.count
+}
+
+func (self *Sketch) Sum() float64 {
+	return self.sum
+}
+
+func (self *Sketch) Min() float64 {
+	if self.count == 0 {
+		return math.NaN()
+	}
+
+	return self.min
+}
+
+func (self *Sketch) Max() float64 {
+	if self.count == 0 {
+		return math.NaN()
+	}
+
+	return self.max
+}
+
+func (self *Sketch) Mean() float64 {
+	if self.count == 0 {
+		return math.NaN()
+	}
+
+	return self.sum / float64(self.count)
+}
+
+// Returns the estimated value at the given quantile (0 <= q <= 1.)
+func (self *Sketch) Quantile(q float64) float64 {
+	if self.count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	} else if q == 0 {
+		return self.min
+	} else if q == 1 {
+		return self.max
+	}
+
+	rank := uint64(q * float64(self.count-1))
+	var seen uint64
+
+	for _, bucket := range self.buckets() {
+		seen += bucket.count
+
+		if seen > rank {
+			return math.Max(self.min, math.Min(self.max, bucket.value))
+		}
+	}
+
+	return self.max
+}
+
+// Returns a reconstruction of the observations in this sketch: the representative value of each
+// bucket, repeated as many times as observations fell into it, in ascending order.  Reducers applied
+// to these values produce estimates within the accuracy of the sketch.
+func (self *Sketch) Values() []float64 {
+	values := make([]float64, 0, self.count)
+
+	for _, bucket := range self.clampedBuckets() {
+		for i := uint64(0); i < bucket.count; i++ {
+			values = append(values, bucket.value)
+		}
+	}
+
+	return values
+}
+
+type sketchBucket struct {
+	value float64
+	count uint64
+}
+
+// Returns all non-empty buckets in ascending order of value.
+func (self *Sketch) buckets() []sketchBucket {
+	buckets := make([]sketchBucket, 0, len(self.negative)+len(self.positive)+1)
+
+	for _, k := range sortedSketchKeys(self.negative, true) {
+		buckets = append(buckets, sketchBucket{-self.value(k), self.negative[k]})
+	}
+
+	if self.zero > 0 {
+		buckets = append(buckets, sketchBucket{0, self.zero})
+	}
+
+	for _, k := range sortedSketchKeys(self.positive, false) {
+		buckets = append(buckets, sketchBucket{self.value(k), self.positive[k]})
+	}
+
+	return buckets
+}
+
+// Returns all non-empty buckets in ascending order, with their values limited to the range of the
+// observations.
+func (self *Sketch) clampedBuckets() []sketchBucket {
+	buckets := self.buckets()
+
+	for i := range buckets {
+		buckets[i].value = math.Max(self.min, math.Min(self.max, buckets[i].value))
+	}
+
+	return buckets
+}
+
+func (self *Sketch) index(value float64) int32 {
+	return int32(math.Ceil(math.Log(value) / self.logGamma))
+}
+
+func (self *Sketch) value(index int32) float64 {
+	return 2 * math.Pow(self.gamma, float64(index)) / (1 + self.gamma)
+}
+
+func (self *Sketch) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+
+	for _, v := range []interface{}{
+		uint8(sketchEncodingVersion),
+		self.accuracy,
+		self.zero,
+		self.count,
+		self.sum,
+		self.min,
+		self.max,
+	} {
+		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, store := range []map[int32]uint64{self.positive, self.negative} {
+		if err := binary.Write(buf, binary.BigEndian, uint32(len(store))); err != nil {
+			return nil, err
+		}
+
+		for _, k := range sortedSketchKeys(store, false) {
+			if err := binary.Write(buf, binary.BigEndian, k); err != nil {
+				return nil, err
+			}
+
+			if err := binary.Write(buf, binary.BigEndian, store[k]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (self *Sketch) UnmarshalBinary(data []byte) error {
+	var version uint8
+	var accuracy float64
+
+	buf := bytes.NewReader(data)
+
+	if err := binary.Read(buf, binary.BigEndian, &version); err != nil {
+		return err
+	} else if version != sketchEncodingVersion {
+		return fmt.Errorf("Unsupported sketch encoding version %d", version)
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &accuracy); err != nil {
+		return err
+	}
+
+	*self = *NewSketchWithAccuracy(accuracy)
+
+	for _, v := range []interface{}{
+		&self.zero,
+		&self.count,
+		&self.sum,
+		&self.min,
+		&self.max,
+	} {
+		if err := binary.Read(buf, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+
+	for _, store := range []map[int32]uint64{self.positive, self.negative} {
+		var length uint32
+
+		if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
+			return err
+		}
+
+		for i := uint32(0); i < length; i++ {
+			var k int32
+			var n uint64
+
+			if err := binary.Read(buf, binary.BigEndian, &k); err != nil {
+				return err
+			}
+
+			if err := binary.Read(buf, binary.BigEndian, &n); err != nil {
+				return err
+			}
+
+			store[k] = n
+		}
+	}
+
+	return nil
+}
+
+func sortedSketchKeys(store map[int32]uint64, descending bool) []int32 {
+	keys := make([]int32, 0, len(store))
+
+	for k := range store {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if descending {
+			return keys[i] > keys[j]
+		} else {
+			return keys[i] < keys[j]
+		}
+	})
+
+	return keys
+}
@@ -0,0 +1,171 @@
+package mobius
+
+import (
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSketchQuantiles(t *testing.T) {
+	assert := require.New(t)
+	sketch := NewSketch()
+
+	for i := 1; i <= 1000; i++ {
+		sketch.Add(float64(i))
+	}
+
+	assert.Equal(uint64(1000), sketch.Count())
+	assert.Equal(float64(500500), sketch.Sum())
+	assert.Equal(float64(1), sketch.Min())
+	assert.Equal(float64(1000), sketch.Max())
+
+	for _, q := range []float64{0.25, 0.5, 0.9, 0.99} {
+		assert.InDelta(q*1000, sketch.Quantile(q), q*1000*DefaultSketchAccuracy+1)
+	}
+
+	assert.True(math.IsNaN(NewSketch().Quantile(0.5)))
+}
+
+func TestSketchMergeAndEncoding(t *testing.T) {
+	assert := require.New(t)
+	a := NewSketch()
+	b := NewSketch()
+
+	for i := 1; i <= 500; i++ {
+		a.Add(float64(i))
+		b.Add(float64(-i))
+	}
+
+	b.Add(0)
+
+	assert.NoError(a.Merge(b))
+	assert.Equal(uint64(1001), a.Count())
+	assert.Equal(float64(-500), a.Min())
+	assert.InDelta(0, a.Quantile(0.5), 1)
+
+	data, err := a.MarshalBinary()
+	assert.NoError(err)
+
+	decoded := NewSketch()
+	assert.NoError(decoded.UnmarshalBinary(data))
+	assert.Equal(a.Count(), decoded.Count())
+	assert.Equal(a.Quantile(0.99), decoded.Quantile(0.99))
+	assert.Equal(a.Values(), decoded.Values())
+
+	other := NewSketchWithAccuracy(0.05)
+	other.Add(1)
+	assert.Error(a.Merge(other))
+}
+
+func TestSketchMetricRollup(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+
+	database, err := OpenDataset(tempPath)
+	assert.NoError(err)
+	defer database.Close()
+
+	// write one observation at a time into per-10s sketches for two hosts
+	for host, offset := range map[string]float64{`a`: 0, `b`: 1000} {
+		for i := 0; i < 60; i++ {
+			for j := 1; j <= 10; j++ {
+				sketch := NewSketch()
+				sketch.Add(offset + float64(i*10+j))
+
+				metric := NewMetric(`mobius.test.timer:host=` + host)
+				metric.PushSketch(time.Date(2006, 1, 2, 15, 4, 0, 0, mst).Add(time.Duration(i/10)*10*time.Second), sketch)
+				assert.NoError(database.Write(metric))
+			}
+		}
+	}
+
+	metrics, err := database.Range(time.Time{}, time.Now(), `mobius.test.timer`)
+	assert.NoError(err)
+	assert.Len(metrics, 2)
+	assert.Equal(SketchType, metrics[0].Type)
+	assert.Len(metrics[0].Points(), 6)
+	assert.Equal(uint64(100), metrics[0].Points()[0].Sketch.Count())
+
+	// the p99 of the rolled-up series comes from the merged sketches, not from per-interval p99s
+	merged := MergeMetrics(metrics, `name`)
+	assert.Len(merged, 1)
+	assert.Len(merged[0].Points(), 6)
+
+	rollup := merged[0].Consolidate(time.Hour, Percent99)
+	assert.Len(rollup.Points(), 1)
+	assert.Equal(uint64(1200), rollup.Points()[0].Sketch.Count())
+	assert.InDelta(1594, rollup.Points()[0].Value, 1594*DefaultSketchAccuracy)
+
+	summary := SummarizeMetric(merged[0], Count, Percent50)
+	assert.Equal(float64(1200), summary[0])
+	assert.InDelta(600, summary[1], 600*DefaultSketchAccuracy)
+
+	// named quantiles are answered from the merged sketch itself
+	p99, ok := LookupReducer(`p99`)
+	assert.True(ok)
+	assert.Equal(merged[0].Points().MergedSketch().Quantile(0.99), SummarizeMetric(merged[0], p99)[0])
+
+	percentile, err := merged[0].Percentile(99)
+	assert.NoError(err)
+	assert.Equal(merged[0].Points().MergedSketch().Quantile(0.99), percentile)
+
+	aggregated := AggregateMetrics(metrics, ``, time.Hour, p99)
+	assert.Len(aggregated, 1)
+	assert.Equal(merged[0].Points().MergedSketch().Quantile(0.99), aggregated[0].Points()[0].Value)
+
+	histogram, err := merged[0].Histogram(HistogramOptions{})
+	assert.NoError(err)
+	assert.Equal(1200, histogram.Count())
+
+	// sketches whose median is zero still hold observations
+	zeroes := NewSketch()
+	zeroes.Add(0)
+	zeroes.Add(0)
+	zeroes.Add(5)
+
+	metric := NewMetric(`mobius.test.zeroes`)
+	metric.PushSketch(time.Date(2006, 1, 2, 15, 4, 0, 0, mst), zeroes)
+	assert.NoError(database.Write(metric))
+
+	metrics, err = database.Range(time.Time{}, time.Now(), `mobius.test.zeroes`)
+	assert.NoError(err)
+	assert.Len(metrics, 1)
+	assert.Len(metrics[0].Points(), 1)
+	assert.Equal(uint64(3), metrics[0].Points()[0].Sketch.Count())
+}
+
+func TestSketchElapsed(t *testing.T) {
+	assert := require.New(t)
+
+	tempPath, err := ioutil.TempDir(``, `mobius_test_`)
+	defer os.RemoveAll(tempPath)
+
+	assert.NoError(err)
+	assert.NoError(Initialize(tempPath, nil))
+	defer Cleanup()
+
+	// durations are gathered in memory until flushed
+	for i := 1; i <= 100; i++ {
+		Elapsed(`app.latency`, time.Duration(i)*time.Millisecond)
+	}
+
+	metrics, err := Database.Range(time.Time{}, time.Now().Add(TimerInterval), `app.latency`)
+	assert.NoError(err)
+	assert.Empty(metrics)
+
+	FlushTimers()
+
+	metrics, err = Database.Range(time.Time{}, time.Now().Add(TimerInterval), `app.latency`)
+	assert.NoError(err)
+	assert.Len(metrics, 1)
+	assert.Equal(SketchType, metrics[0].Type)
+	assert.Equal(uint64(100), metrics[0].Points().MergedSketch().Count())
+	assert.InDelta(99, SummarizeMetric(metrics[0], Percent99)[0], 99*DefaultSketchAccuracy)
+}
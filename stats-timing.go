@@ -1,9 +1,27 @@
 package mobius
 
 import (
+	"sync"
 	"time"
 )
 
+// The width of the time intervals that timer observations are aggregated into.
+var TimerInterval = 10 * time.Second
+
+// The sketches being filled by Elapsed, by series, which have not yet been written.
+var pendingTimers = make(map[string]*pendingSketch)
+var pendingTimersLock sync.Mutex
+
+type pendingSketch struct {
+	metric *Metric
+	start  time.Time
+	sketch *Sketch
+}
+
+func (self *pendingSketch) write() {
+	Database.Write(self.metric.PushSketch(self.start, self.sketch))
+}
+
 type Timing struct {
 	Name      string
 	StartedAt time.Time
@@ -20,13 +38,55 @@ func NewTiming(times ...time.Time) *Timing {
 }
 
 func (self *Timing) Send(name string, tags ...map[string]interface{}) {
-	Elapsed(name, time.Since(self.StartedAt))
+	Elapsed(name, time.Since(self.StartedAt), tags...)
 }
 
+// Records a duration (in milliseconds) into the quantile sketch covering the current TimerInterval.
+// Percentiles of timers are computed from the merged sketches, so they remain accurate regardless of
+// how the series is later consolidated.
+//
+// Durations are gathered in memory and written when the interval ends, when FlushTimers is called,
+// or at most one TimerInterval later, rather than each being written as it is recorded.
 func Elapsed(name string, duration time.Duration, tags ...map[string]interface{}) {
-	m := metric(name, tags)
+	if Database != nil {
+		m := metric(name, tags)
+		key := m.GetUniqueName()
+		start := time.Now().Truncate(TimerInterval)
+
+		pendingTimersLock.Lock()
+		defer pendingTimersLock.Unlock()
+
+		pending, ok := pendingTimers[key]
+
+		if ok && !pending.start.Equal(start) {
+			pending.write()
+			ok = false
+		}
+
+		if !ok {
+			pending = &pendingSketch{
+				metric: m,
+				start:  start,
+				sketch: NewSketch(),
+			}
+
+			pendingTimers[key] = pending
+		}
+
+		pending.sketch.Add(float64(duration) / float64(time.Millisecond))
+	}
+}
+
+// Writes the durations recorded by Elapsed that have not yet been written.
+func FlushTimers() {
+	pendingTimersLock.Lock()
+	defer pendingTimersLock.Unlock()
 
 	if Database != nil {
-		Database.Write(m.Push(time.Now(), float64(duration)/float64(time.Millisecond)))
+		for _, pending := range pendingTimers {
+			pending.write()
+		}
 	}
+
+	pendingTimers = make(map[string]*pendingSketch)
 }
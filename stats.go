@@ -3,6 +3,7 @@ package mobius
 import (
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/ghetzel/go-stockutil/maputil"
@@ -13,6 +14,24 @@ var Database *Dataset
 var StatsPrefix string
 var basetags = make(map[string]interface{})
 
+// The width of the time intervals that distinct-count members are aggregated into.
+var UniqueInterval = 10 * time.Second
+
+// The distinct-count sets being filled by AddUnique, by series, which have not yet been written.
+var pendingUnique = make(map[string]*pendingSet)
+var pendingUniqueLock sync.Mutex
+var flusherDone chan bool
+
+type pendingSet struct {
+	metric *Metric
+	start  time.Time
+	set    *HyperLogLog
+}
+
+func (self *pendingSet) write() {
+	Database.Write(self.metric.PushUnique(self.start, self.set))
+}
+
 func Initialize(statsdir string, tags map[string]interface{}) error {
 	if len(tags) > 0 {
 		basetags = tags
@@ -28,6 +47,10 @@ func Initialize(statsdir string, tags map[string]interface{}) error {
 
 		if dataset, err := OpenDataset(expandedStatsDir); err == nil {
 			Database = dataset
+			flusherDone = make(chan bool)
+
+			go flushPeriodically(UniqueInterval, FlushUnique, flusherDone)
+			go flushPeriodically(TimerInterval, FlushTimers, flusherDone)
 		} else {
 			return err
 		}
@@ -51,6 +74,14 @@ func IsEnabled() bool {
 }
 
 func Cleanup() {
+	if flusherDone != nil {
+		close(flusherDone)
+		flusherDone = nil
+	}
+
+	FlushUnique()
+	FlushTimers()
+
 	if Database != nil {
 		Database.Close()
 		Database = nil
@@ -62,10 +93,9 @@ func Increment(name string, tags ...map[string]interface{}) {
 }
 
 func IncrementN(name string, count int, tags ...map[string]interface{}) {
-
 	if Database != nil {
 		m := metric(name, tags)
-		Database.Write(m.Push(time.Now(), float64(count)))
+		Database.Write(m.PushInt(time.Now(), int64(count)))
 	}
 }
 
@@ -84,6 +114,71 @@ func Set(name string, value float64, tags ...map[string]interface{}) {
 	}
 }
 
+// Records a member into the distinct-count set covering the current UniqueInterval.  Querying the
+// series with an interval or group merges the sets, yielding the number of distinct members across
+// the combined buckets and series.
+//
+// Members are gathered in memory and written when the interval ends, when FlushUnique is called, or
+// at most one UniqueInterval later, rather than each being written as it is added.
+func AddUnique(name string, member string, tags ...map[string]interface{}) {
+	if Database != nil {
+		m := metric(name, tags)
+		key := m.GetUniqueName()
+		start := time.Now().Truncate(UniqueInterval)
+
+		pendingUniqueLock.Lock()
+		defer pendingUniqueLock.Unlock()
+
+		pending, ok := pendingUnique[key]
+
+		if ok && !pending.start.Equal(start) {
+			pending.write()
+			ok = false
+		}
+
+		if !ok {
+			pending = &pendingSet{
+				metric: m,
+				start:  start,
+				set:    NewHyperLogLog(),
+			}
+
+			pendingUnique[key] = pending
+		}
+
+		pending.set.Add(member)
+	}
+}
+
+// Writes the members recorded by AddUnique that have not yet been written.
+func FlushUnique() {
+	pendingUniqueLock.Lock()
+	defer pendingUniqueLock.Unlock()
+
+	if Database != nil {
+		for _, pending := range pendingUnique {
+			pending.write()
+		}
+	}
+
+	pendingUnique = make(map[string]*pendingSet)
+}
+
+// Calls the given flush function every interval until done is closed.
+func flushPeriodically(interval time.Duration, flush func(), done chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
 func metric(name string, tags []map[string]interface{}) *Metric {
 	outTags := basetags
 